@@ -0,0 +1,118 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//请求id与访问日志：server为每个请求确定一个请求id，优先取请求首帧元数据中的MetaRequestId，没有时生成；
+//请求处理完成(handler返回完整的响应或错误)之后，以AccessLogEntry调用ServerConfig.AccessLog。
+//0号系统channel上的请求及双向流不记录
+package iip
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+//一个已处理请求的访问日志
+type AccessLogEntry struct {
+	RequestId  string        `json:"request_id"`
+	Path       string        `json:"path"`
+	RemoteAddr string        `json:"remote_addr"`
+	ChannelId  uint32        `json:"channel_id"`
+	StartTime  time.Time     `json:"start_time"` //收到请求首帧的时间
+	Duration   time.Duration `json:"duration"`   //从收到请求首帧到响应入队
+	BytesIn    int           `json:"bytes_in"`   //请求数据字节数，含全部分片
+	BytesOut   int           `json:"bytes_out"`  //响应数据字节数，错误响应为0
+	Code       int           `json:"code"`       //0表示成功，否则为错误响应的错误码
+	Error      string        `json:"error,omitempty"`
+}
+
+//访问日志的处理函数，在处理请求的goroutine中同步调用，不应阻塞
+type AccessLogger func(entry *AccessLogEntry)
+
+//一个请求的状态，请求完成之前只由channel的处理goroutine访问
+type requestState struct {
+	id      string
+	path    string
+	start   time.Time
+	bytesIn int
+	seq     string //流水线请求的序号，见pipeline.go
+}
+
+var (
+	requestIdPrefix string
+	requestIdSeq    uint64
+)
+
+func init() {
+	var bts [6]byte
+	rand.Read(bts[:])
+	requestIdPrefix = hex.EncodeToString(bts[:]) + "-"
+}
+
+//生成请求id：进程随机前缀+序号
+func newRequestId() string {
+	return requestIdPrefix + strconv.FormatUint(atomic.AddUint64(&requestIdSeq, 1), 10)
+}
+
+//channel上正在处理的请求的id，供handler记录日志或者通过WithRequestMeta(ctx, MetaRequestId, id)传递给下游。
+//开启worker且不要求channel内有序时同一channel上的请求可能并发处理，此时返回最近开始的请求的id
+func (m *Channel) RequestId() string {
+	ret, _ := m.requestId.Load().(string)
+	return ret
+}
+
+//请求首帧到达时开始记录
+func (m *Channel) beginRequest(pkt *Packet) {
+	id := pkt.Meta[MetaRequestId]
+	if id == "" {
+		id = newRequestId()
+	}
+	m.request = &requestState{id: id, path: pkt.Path, start: time.Now(), seq: pkt.Meta[MetaRequestSeq]}
+	m.requestId.Store(id)
+	m.requestMeta.Store(pkt.Meta)
+}
+
+//channel上正在处理的请求首帧携带的元数据，返回值不应被修改；与RequestId相同，请求并发处理时为最近开始的请求的元数据
+func (m *Channel) RequestMeta() map[string]string {
+	ret, _ := m.requestMeta.Load().(map[string]string)
+	return ret
+}
+
+//请求处理完成，bytesOut为响应数据的字节数。同时记录path的耗时及慢请求，见pathstats.go
+func (m *Channel) endRequest(server *Server, req *requestState, path string, bytesOut int, err error) {
+	if req == nil {
+		return
+	}
+	config := server.getConfig()
+	duration := time.Since(req.start)
+	server.handler.observeLatency(path, duration)
+	if config.SlowRequestThreshold > 0 && duration >= config.SlowRequestThreshold {
+		log.Warnf("slow request %s, request id: %s, remote addr: %s, channel id: %d, duration: %s, bytes in: %d", path, req.id, m.conn.key, m.Id, duration, req.bytesIn)
+	}
+	logger := config.AccessLog
+	if logger == nil {
+		return
+	}
+	entry := &AccessLogEntry{
+		RequestId:  req.id,
+		Path:       path,
+		RemoteAddr: m.conn.key,
+		ChannelId:  m.Id,
+		StartTime:  req.start,
+		Duration:   duration,
+		BytesIn:    req.bytesIn,
+		BytesOut:   bytesOut,
+	}
+	if err != nil {
+		entry.BytesOut = 0
+		entry.Code = -1
+		if e, ok := err.(*Error); ok {
+			entry.Code = e.Code
+		}
+		entry.Error = err.Error()
+	}
+	logger(entry)
+}
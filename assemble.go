@@ -0,0 +1,62 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//请求合并：开启ServerConfig.AssembleRequests后，server在channel的处理循环中合并多帧请求(C0/C2...C3)，
+//中间件及handler只以完整的请求调用一次(dataCompleted为true)，不必处理ErrPacketContinue。
+//合并后的大小受MaxRequestSize限制，为0时取握手协商的max packet size，超过时以ErrRequestTooLarge重置channel(见limits.go)。
+//开关在请求首帧到达时确定，对之后开始的请求生效
+package iip
+
+//合并模式下请求大小的上限，0表示不限制
+func requestSizeLimit(config *ServerConfig, conn *Connection) int64 {
+	if config.AssembleRequests {
+		//合并的请求在一个[]byte中，不能超过MaxBufferedSize，见sizes.go
+		if config.MaxRequestSize == 0 {
+			return int64(conn.maxPacketSize)
+		}
+		if int64(config.MaxRequestSize) > MaxBufferedSize {
+			return MaxBufferedSize
+		}
+	}
+	return int64(config.MaxRequestSize)
+}
+
+//合并请求的一帧，只由serveReceived调用：首帧及中间帧被暂存，返回nil；末帧返回携带完整数据的请求首帧，
+//其状态为末帧的状态。单帧请求原样返回
+func (m *Channel) assemble(pkt *Packet) *Packet {
+	if pkt.Status == StatusC0 || pkt.Status == StatusC1 {
+		//上一个请求被重置或者被拒绝时残留的数据
+		if m.assembling != nil {
+			m.assembling.Release()
+			m.assembling, m.assembled = nil, nil
+		}
+		if pkt.Status == StatusC1 {
+			return pkt
+		}
+		//首帧的path、元数据随完整的请求交给handler，数据另行拷贝，首帧的缓冲区可以立即回收
+		m.assembled = append([]byte(nil), pkt.Data...)
+		if pkt.buf != nil {
+			putBuffer(pkt.buf)
+			pkt.buf = nil
+		}
+		pkt.Data = nil
+		m.assembling = pkt
+		return nil
+	}
+	if m.assembling == nil {
+		//没有首帧的后续帧(如首帧被限流)，原样交给handler
+		return pkt
+	}
+	m.assembled = append(m.assembled, pkt.Data...)
+	if !isClientStatusCompleted(pkt.Status) {
+		pkt.Release()
+		return nil
+	}
+	ret := m.assembling
+	//合并的缓冲区交给handler后不再复用，handler可能直接以其作为响应
+	ret.Data, ret.Status = m.assembled, pkt.Status
+	m.assembling, m.assembled = nil, nil
+	pkt.Release()
+	return ret
+}
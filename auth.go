@@ -0,0 +1,171 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//连接认证：client在握手请求中携带凭证，server配置了Authenticator时，在握手中完成认证，
+//认证通过之前连接上除握手外的任何帧都会导致连接被关闭，认证失败时响应握手后关闭连接。
+//认证得到的身份保存在连接上下文中(CtxIdentity)，可通过Channel.Identity()获取
+package iip
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//认证得到的身份
+type Identity struct {
+	Name       string
+	Tenant     string            //不为空且server未设置TenantResolver时，连接绑定到该租户
+	Attributes map[string]string //认证器附加的其他信息
+}
+
+//连接认证器，返回错误时拒绝连接
+type Authenticator interface {
+	Authenticate(conn *Connection, credentials map[string]string) (*Identity, error)
+}
+
+//client端生成握手凭证，每次建立连接时调用
+type CredentialsFunc func() (map[string]string, error)
+
+//连接认证得到的身份，未认证时返回nil
+func (m *Connection) Identity() *Identity {
+	if v, ok := m.GetCtxData(CtxIdentity).(*Identity); ok {
+		return v
+	}
+	return nil
+}
+
+//channel所在连接认证得到的身份，未认证时返回nil
+func (m *Channel) Identity() *Identity {
+	return m.conn.Identity()
+}
+
+//基于静态token的认证，凭证为{"token": token}
+type TokenAuthenticator struct {
+	tokens map[string]*Identity
+}
+
+//tokens: token -> 身份
+func NewTokenAuthenticator(tokens map[string]*Identity) *TokenAuthenticator {
+	return &TokenAuthenticator{tokens: tokens}
+}
+
+func (m *TokenAuthenticator) Authenticate(conn *Connection, credentials map[string]string) (*Identity, error) {
+	if id, ok := m.tokens[credentials["token"]]; ok && credentials["token"] != "" {
+		return id, nil
+	}
+	return nil, fmt.Errorf("invalid token")
+}
+
+func TokenCredentials(token string) CredentialsFunc {
+	return func() (map[string]string, error) {
+		return map[string]string{"token": token}, nil
+	}
+}
+
+//基于共享密钥的HMAC-SHA256认证，凭证为key_id、timestamp(unix秒)、nonce及signature，
+//signature = hex(HMAC-SHA256(secret, key_id + "\n" + timestamp + "\n" + nonce))。
+//时间偏差超过MaxSkew或者nonce在有效期内重复使用的凭证被拒绝，身份的Name为key_id
+type HMACAuthenticator struct {
+	MaxSkew time.Duration //允许的时间偏差，默认5分钟
+	keys    map[string][]byte
+	nonces  map[string]time.Time
+	lock    sync.Mutex
+}
+
+//keys: key id -> secret
+func NewHMACAuthenticator(keys map[string][]byte) *HMACAuthenticator {
+	return &HMACAuthenticator{MaxSkew: time.Minute * 5, keys: keys, nonces: make(map[string]time.Time)}
+}
+
+func hmacSignature(secret []byte, keyId, timestamp, nonce string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(keyId + "\n" + timestamp + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *HMACAuthenticator) Authenticate(conn *Connection, credentials map[string]string) (*Identity, error) {
+	keyId, timestamp, nonce := credentials["key_id"], credentials["timestamp"], credentials["nonce"]
+	secret, ok := m.keys[keyId]
+	if !ok || nonce == "" {
+		return nil, fmt.Errorf("invalid credentials")
+	}
+	if !hmac.Equal([]byte(credentials["signature"]), []byte(hmacSignature(secret, keyId, timestamp, nonce))) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp")
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(ts, 0)); d > m.MaxSkew || d < -m.MaxSkew {
+		return nil, fmt.Errorf("timestamp out of range")
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for k, v := range m.nonces {
+		if now.Sub(v) > m.MaxSkew*2 {
+			delete(m.nonces, k)
+		}
+	}
+	if _, ok := m.nonces[keyId+"/"+nonce]; ok {
+		return nil, fmt.Errorf("nonce reused")
+	}
+	m.nonces[keyId+"/"+nonce] = now
+	return &Identity{Name: keyId}, nil
+}
+
+func HMACCredentials(keyId string, secret []byte) CredentialsFunc {
+	return func() (map[string]string, error) {
+		var bts [16]byte
+		if _, err := rand.Read(bts[:]); err != nil {
+			return nil, err
+		}
+		timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), hex.EncodeToString(bts[:])
+		return map[string]string{
+			"key_id":    keyId,
+			"timestamp": timestamp,
+			"nonce":     nonce,
+			"signature": hmacSignature(secret, keyId, timestamp, nonce),
+		}, nil
+	}
+}
+
+//server端在握手中认证连接并绑定租户：先按client证书(见tls.go)，再按Authenticator，都未配置且没有client证书时直接通过
+func (m *Server) authenticate(conn *Connection, credentials map[string]string) error {
+	if m == nil {
+		return nil
+	}
+	config := m.getConfig()
+	identity, err := m.certIdentity(conn, config)
+	if err != nil {
+		return err
+	}
+	if config.Authenticator != nil {
+		if identity, err = config.Authenticator.Authenticate(conn, credentials); err != nil {
+			return err
+		}
+		if identity == nil {
+			return fmt.Errorf("no identity")
+		}
+	}
+	if identity != nil {
+		conn.SetCtxData(CtxIdentity, identity)
+	}
+	if !config.authRequired() {
+		//未要求认证的连接已在创建时绑定租户
+		return nil
+	}
+	if err := m.bindTenant(conn); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&conn.authenticated, 1)
+	return nil
+}
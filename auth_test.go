@@ -0,0 +1,109 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"testing"
+	"time"
+)
+
+//要求认证的server，/test/whoami返回连接认证得到的身份
+func newAuthTestServer(t *testing.T, authenticator Authenticator) (*Server, string) {
+	t.Helper()
+	server, addr := newTestServer(t, ServerConfig{Authenticator: authenticator})
+	err := server.RegisterHandler("/test/whoami", NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		name := ""
+		if id := c.Identity(); id != nil {
+			name = id.Name
+		}
+		tenant := ""
+		if v := c.conn.tenant(); v != nil {
+			tenant = v.Name()
+		}
+		_, err := w.Write([]byte(name + "@" + tenant))
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, addr
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	_, addr := newAuthTestServer(t, NewTokenAuthenticator(map[string]*Identity{"secret": {Name: "alice"}}))
+	client := newTestClient(t, addr, ClientConfig{Credentials: TokenCredentials("secret")})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret, err := channel.DoRequest("/test/whoami", []byte("x"), time.Second*5); err != nil || string(ret) != "alice@" {
+		t.Fatalf("whoami: %q, %v", ret, err)
+	}
+}
+
+//凭证错误或者没有凭证的连接不能新建channel
+func TestAuthenticationRejected(t *testing.T) {
+	server, addr := newAuthTestServer(t, NewTokenAuthenticator(map[string]*Identity{"secret": {Name: "alice"}}))
+	for _, credentials := range []CredentialsFunc{TokenCredentials("wrong"), nil} {
+		client := newTestClient(t, addr, ClientConfig{Credentials: credentials})
+		if channel, err := client.NewChannel(); err == nil {
+			ret, err := channel.DoRequest("/test/whoami", []byte("x"), time.Second*5)
+			t.Fatalf("unauthenticated request: %q, %v", ret, err)
+		}
+	}
+	waitFor(t, "rejected connections closed", func() bool { return len(server.ConnectionsSnapshot()) == 0 })
+}
+
+//HMAC凭证每次连接重新生成，重复使用的nonce被拒绝
+func TestHMACAuthentication(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	authenticator := NewHMACAuthenticator(map[string][]byte{"k1": secret})
+	_, addr := newAuthTestServer(t, authenticator)
+	for i := 0; i < 2; i++ {
+		client := newTestClient(t, addr, ClientConfig{Credentials: HMACCredentials("k1", secret)})
+		channel, err := client.NewChannel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ret, err := channel.DoRequest("/test/whoami", []byte("x"), time.Second*5); err != nil || string(ret) != "k1@" {
+			t.Fatalf("whoami: %q, %v", ret, err)
+		}
+	}
+	credentials, _ := HMACCredentials("k1", secret)()
+	if _, err := authenticator.Authenticate(nil, credentials); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticator.Authenticate(nil, credentials); err == nil {
+		t.Fatal("reused nonce accepted")
+	}
+	if _, err := authenticator.Authenticate(nil, map[string]string{"key_id": "k1", "timestamp": credentials["timestamp"], "nonce": "n", "signature": credentials["signature"]}); err == nil {
+		t.Fatal("wrong signature accepted")
+	}
+}
+
+//身份携带租户时，连接在认证之后绑定到该租户
+func TestAuthenticationBindsTenant(t *testing.T) {
+	server, addr := newAuthTestServer(t, NewTokenAuthenticator(map[string]*Identity{"secret": {Name: "bob", Tenant: "t1"}}))
+	tenant, err := server.AddTenant(TenantConfig{Name: "t1", MaxConnections: 1, ShareServerHandlers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, addr, ClientConfig{Credentials: TokenCredentials("secret")})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret, err := channel.DoRequest("/test/whoami", []byte("x"), time.Second*5); err != nil || string(ret) != "bob@t1" {
+		t.Fatalf("whoami: %q, %v", ret, err)
+	}
+	waitTenantStats(t, tenant, 1, 1)
+	//超过租户的连接数上限，认证通过但绑定失败
+	other := newTestClient(t, addr, ClientConfig{Credentials: TokenCredentials("secret")})
+	if _, err := other.NewChannel(); err == nil {
+		t.Fatal("connection over tenant limit accepted")
+	}
+	client.Close()
+	waitTenantStats(t, tenant, 0, 0)
+}
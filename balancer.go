@@ -0,0 +1,136 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//负载均衡：client新建channel时，由Balancer在Resolver提供的服务端地址中选择一个，
+//再使用该地址上有空闲channel配额的连接，没有时新建连接。内置轮转、最少等待请求、按path一致性哈希三种策略
+package iip
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//服务端地址的当前状态
+type EndpointState struct {
+	Addr        string
+	Connections int
+	Channels    int //不含0号系统channel
+	Pending     int //正在等待响应的channel数
+}
+
+//新建channel时的选择依据
+type PickInfo struct {
+	Path string //channel将要请求的path，见Client.NewChannelFor，未知时为空
+}
+
+//在服务端地址中为新建的channel选择一个，endpoints不为空
+type Balancer interface {
+	Pick(endpoints []EndpointState, info PickInfo) (string, error)
+}
+
+type roundRobinBalancer struct {
+	next uint32
+}
+
+//轮转，默认的策略
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{}
+}
+
+func (m *roundRobinBalancer) Pick(endpoints []EndpointState, info PickInfo) (string, error) {
+	n := atomic.AddUint32(&m.next, 1)
+	return endpoints[int(n%uint32(len(endpoints)))].Addr, nil
+}
+
+type leastPendingBalancer struct {
+	next uint32
+}
+
+//选择等待响应的请求最少的地址，相同时选择channel较少的，再相同时轮转
+func NewLeastPendingBalancer() Balancer {
+	return &leastPendingBalancer{}
+}
+
+func (m *leastPendingBalancer) Pick(endpoints []EndpointState, info PickInfo) (string, error) {
+	start := int(atomic.AddUint32(&m.next, 1) % uint32(len(endpoints)))
+	best := endpoints[start]
+	for i := 1; i < len(endpoints); i++ {
+		v := endpoints[(start+i)%len(endpoints)]
+		if v.Pending < best.Pending || (v.Pending == best.Pending && v.Channels < best.Channels) {
+			best = v
+		}
+	}
+	return best.Addr, nil
+}
+
+type hashRing struct {
+	key    string //地址列表，用于判断环是否需要重建
+	hashes []uint32
+	addrs  map[uint32]string
+}
+
+type consistentHashBalancer struct {
+	replicas int
+	fallback Balancer
+	ring     *hashRing
+	lock     sync.Mutex
+}
+
+//按path一致性哈希，相同path的channel落在同一地址上，地址增减时只有少量path改变映射。
+//replicas为每个地址的虚拟节点数，默认100；path未知时轮转
+func NewConsistentHashBalancer(replicas int) Balancer {
+	if replicas <= 0 {
+		replicas = 100
+	}
+	return &consistentHashBalancer{replicas: replicas, fallback: NewRoundRobinBalancer()}
+}
+
+func (m *consistentHashBalancer) Pick(endpoints []EndpointState, info PickInfo) (string, error) {
+	if info.Path == "" {
+		return m.fallback.Pick(endpoints, info)
+	}
+	ring := m.getRing(endpoints)
+	if len(ring.hashes) == 0 {
+		return "", fmt.Errorf("no endpoint")
+	}
+	h := crc32.ChecksumIEEE([]byte(info.Path))
+	i := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= h })
+	if i == len(ring.hashes) {
+		i = 0
+	}
+	return ring.addrs[ring.hashes[i]], nil
+}
+
+func (m *consistentHashBalancer) getRing(endpoints []EndpointState) *hashRing {
+	addrs := make([]string, 0, len(endpoints))
+	for _, v := range endpoints {
+		addrs = append(addrs, v.Addr)
+	}
+	sort.Strings(addrs)
+	key := strings.Join(addrs, ",")
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.ring != nil && m.ring.key == key {
+		return m.ring
+	}
+	ring := &hashRing{key: key, addrs: make(map[uint32]string, len(addrs)*m.replicas)}
+	for _, addr := range addrs {
+		for i := 0; i < m.replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "#" + addr))
+			if _, ok := ring.addrs[h]; ok {
+				continue
+			}
+			ring.addrs[h] = addr
+			ring.hashes = append(ring.hashes, h)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	m.ring = ring
+	return ring
+}
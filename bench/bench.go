@@ -0,0 +1,265 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//bench是iip的性能基准：小请求RPC、1MB消息的流式传输、单连接1000个channel的扇出、连接风暴(反复建连、请求、断开)，
+//各基准对进程内在回环地址上监听的server执行，结果可以在版本之间比较以发现性能回退。
+//基准函数的签名与testing的Benchmark函数相同，bench_test.go中的包装使其可以由go test运行，如：
+//	go test -run x -bench . ./bench
+//命令行工具cmd/iipbench以testing.Benchmark运行全部基准(-suite)，或者作为压测工具对指定的server施加负载并报告延迟分位数，见Load
+package bench
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//基准server注册的路径
+const (
+	EchoPath   = "/bench/echo"   //原样返回请求数据
+	StreamPath = "/bench/stream" //接收流中的全部消息，对端半关闭后返回
+)
+
+//基准server的配置，连接、channel及队列足以容纳扇出和连接风暴
+var ServerConfig = iip.ServerConfig{
+	MaxConnections:        100000,
+	MaxChannelsPerConn:    2000,
+	ChannelPacketQueueLen: 1000,
+	TcpWriteQueueLen:      1000,
+	RecycleRequests:       true,
+}
+
+//基准client的配置
+var ClientConfig = iip.ClientConfig{
+	MaxConnections:        1,
+	MaxChannelsPerConn:    2000,
+	ChannelPacketQueueLen: 1000,
+	TcpWriteQueueLen:      1000,
+	TcpConnectTimeout:     time.Second * 3,
+}
+
+//一个基准
+type Benchmark struct {
+	Name string
+	F    func(b *testing.B)
+}
+
+var Benchmarks = []Benchmark{
+	{"SmallRPC", SmallRPC},
+	{"Stream1MB", Stream1MB},
+	{"FanOut1000", FanOut1000},
+	{"ReconnectStorm", ReconnectStorm},
+}
+
+//在lsn上启动基准server，注册EchoPath及StreamPath
+func Serve(lsn net.Listener) (*iip.Server, error) {
+	server, err := iip.NewServer(ServerConfig, lsn.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	if err := server.RegisterHandler(EchoPath, &echoHandler{}); err != nil {
+		return nil, err
+	}
+	if err := server.RegisterStreamHandler(StreamPath, drainStream); err != nil {
+		return nil, err
+	}
+	server.Serve(lsn)
+	return server, nil
+}
+
+const ctxEchoRequest = "/ctx/bench/echo_request"
+
+type echoHandler struct {
+}
+
+func (m *echoHandler) Handle(c *iip.Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	buf, _ := c.GetCtxData(ctxEchoRequest).([]byte)
+	//data的缓冲区在handler返回后被回收，须拷贝
+	buf = append(buf, data...)
+	if !dataCompleted {
+		c.SetCtxData(ctxEchoRequest, buf)
+		return nil, iip.ErrPacketContinue
+	}
+	c.RemoveCtxData(ctxEchoRequest)
+	if buf == nil {
+		//nil表示没有响应
+		buf = []byte{}
+	}
+	return buf, nil
+}
+
+func drainStream(s *iip.Stream) error {
+	for {
+		if _, err := s.Recv(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+//进程内的基准server及其地址
+type env struct {
+	server *iip.Server
+	addr   string
+}
+
+func startEnv(b *testing.B) *env {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	server, err := Serve(lsn)
+	if err != nil {
+		lsn.Close()
+		b.Fatal(err)
+	}
+	return &env{server: server, addr: lsn.Addr().String()}
+}
+
+func (m *env) stop() {
+	m.server.Stop(fmt.Errorf("benchmark finished"))
+}
+
+func (m *env) client(b *testing.B) *iip.Client {
+	client, err := iip.NewClient(ClientConfig, m.addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return client
+}
+
+//64字节请求的往返，以GOMAXPROCS个并发的channel共享一个连接
+func SmallRPC(b *testing.B) {
+	e := startEnv(b)
+	defer e.stop()
+	client := e.client(b)
+	defer client.Close()
+	payload := make([]byte, 64)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		c, err := client.NewChannel()
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer c.Close(nil)
+		for pb.Next() {
+			if _, err := c.DoRequest(EchoPath, payload, time.Second*5); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+//在一个流上连续发送1MB的消息
+func Stream1MB(b *testing.B) {
+	e := startEnv(b)
+	defer e.stop()
+	client := e.client(b)
+	defer client.Close()
+	s, err := client.NewStream(StreamPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	payload := make([]byte, 1<<20)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.Send(payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+	//server读完全部消息之后半关闭，计时包含消息的接收
+	if err := s.CloseSend(); err != nil {
+		b.Fatal(err)
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		b.Fatalf("stream not closed by server, %v", err)
+	}
+	b.StopTimer()
+	s.Close(nil)
+}
+
+//单连接上的1000个channel同时各发出一个请求，每次迭代等待全部响应
+func FanOut1000(b *testing.B) {
+	const fanOut = 1000
+	e := startEnv(b)
+	defer e.stop()
+	client := e.client(b)
+	defer client.Close()
+	channels := make([]*iip.ClientChannel, fanOut)
+	for i := range channels {
+		c, err := client.NewChannel()
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer c.Close(nil)
+		channels[i] = c
+	}
+	payload := make([]byte, 64)
+	b.SetBytes(int64(len(payload) * fanOut))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		errs := make(chan error, fanOut)
+		for _, c := range channels {
+			wg.Add(1)
+			go func(c *iip.ClientChannel) {
+				defer wg.Done()
+				if _, err := c.DoRequest(EchoPath, payload, time.Second*10); err != nil {
+					errs <- err
+				}
+			}(c)
+		}
+		wg.Wait()
+		select {
+		case err := <-errs:
+			b.Fatal(err)
+		default:
+		}
+	}
+}
+
+//每次迭代新建client、完成握手及一个请求后关闭，GOMAXPROCS个并发
+func ReconnectStorm(b *testing.B) {
+	e := startEnv(b)
+	defer e.stop()
+	payload := make([]byte, 64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := connectOnce(e.addr, payload); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func connectOnce(addr string, payload []byte) error {
+	client, err := iip.NewClient(ClientConfig, addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	c, err := client.NewChannel()
+	if err != nil {
+		return err
+	}
+	_, err = c.DoRequest(EchoPath, payload, time.Second*5)
+	return err
+}
@@ -0,0 +1,16 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package bench_test
+
+import (
+	"testing"
+
+	"github.com/truexf/iip/bench"
+)
+
+func BenchmarkSmallRPC(b *testing.B)       { bench.SmallRPC(b) }
+func BenchmarkStream1MB(b *testing.B)      { bench.Stream1MB(b) }
+func BenchmarkFanOut1000(b *testing.B)     { bench.FanOut1000(b) }
+func BenchmarkReconnectStorm(b *testing.B) { bench.ReconnectStorm(b) }
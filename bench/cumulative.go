@@ -0,0 +1,122 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package bench
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//接收流中的全部消息并计数的路径，用于累计流量的测量
+const SinkPath = "/bench/sink"
+
+//累计流量：在一个双向流上连续发送Total字节，累计超过2GB时覆盖32位平台(386、arm)上int溢出的边界，
+//核对两端的字节计数及server的连接、channel统计，见iip的sizes.go
+type CumulativeConfig struct {
+	Total       int64 //累计发送的字节数，默认3GB
+	MessageSize int   //每条消息的字节数，默认1MB
+}
+
+//累计流量的结果，各计数均为int64，在32位平台上与64位平台相同
+type CumulativeResult struct {
+	Sent             int64         `json:"sent"`               //client发送的消息数据字节数
+	Received         int64         `json:"received"`           //server的流处理收到的消息数据字节数
+	Messages         int64         `json:"messages"`           //server收到的消息数
+	ClientWriteBytes int64         `json:"client_write_bytes"` //client端channel统计的写出字节数
+	ServerReadBytes  int64         `json:"server_read_bytes"`  //server端channel统计的读入字节数
+	ConnReadBytes    int64         `json:"conn_read_bytes"`    //server端连接统计的读入字节数，含帧头
+	Elapsed          time.Duration `json:"elapsed"`
+}
+
+func (m *CumulativeResult) String() string {
+	return fmt.Sprintf("sent %d, received %d in %d messages, client channel write %d, server channel read %d, server conn read %d, elapsed %s, %s/s",
+		m.Sent, m.Received, m.Messages, m.ClientWriteBytes, m.ServerReadBytes, m.ConnReadBytes,
+		m.Elapsed.Round(time.Millisecond), byteSize(float64(m.Sent)/m.Elapsed.Seconds()))
+}
+
+//在进程内的server上发送累计Total字节的流，任何一个计数与发送的字节数不符时返回错误
+func Cumulative(config CumulativeConfig) (*CumulativeResult, error) {
+	if config.Total <= 0 {
+		config.Total = 3 << 30
+	}
+	if config.MessageSize <= 0 {
+		config.MessageSize = 1 << 20
+	}
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server, err := iip.NewServer(ServerConfig, lsn.Addr().String())
+	if err != nil {
+		lsn.Close()
+		return nil, err
+	}
+	defer server.Stop(fmt.Errorf("cumulative finished"))
+	ret := &CumulativeResult{}
+	//流处理返回之后server半关闭发送方向，client的Recv返回io.EOF，此时以下计数已确定
+	server.RegisterStreamHandler(SinkPath, func(s *iip.Stream) error {
+		for {
+			msg, err := s.Recv()
+			if err != nil {
+				ret.ServerReadBytes = s.Channel().Stats().ReadBytes
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			ret.Received += int64(len(msg))
+			ret.Messages++
+		}
+	})
+	server.Serve(lsn)
+
+	client, err := iip.NewClient(ClientConfig, lsn.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	s, err := client.NewStream(SinkPath)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close(nil)
+	payload := make([]byte, config.MessageSize)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	start := time.Now()
+	for ret.Sent < config.Total {
+		msg := payload
+		if remain := config.Total - ret.Sent; remain < int64(len(msg)) {
+			msg = msg[:remain]
+		}
+		if err := s.Send(msg); err != nil {
+			return nil, err
+		}
+		ret.Sent += int64(len(msg))
+	}
+	if err := s.CloseSend(); err != nil {
+		return nil, err
+	}
+	if _, err := s.Recv(); err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("unexpected message from %s", SinkPath)
+		}
+		return nil, err
+	}
+	ret.Elapsed = time.Since(start)
+	ret.ClientWriteBytes = s.Channel().Stats().WriteBytes
+	for _, v := range server.ConnectionsSnapshot() {
+		ret.ConnReadBytes += v.ReadBytes
+	}
+	if ret.Received != ret.Sent || ret.ServerReadBytes < ret.Sent || ret.ClientWriteBytes < ret.Sent || ret.ConnReadBytes < ret.Sent {
+		return ret, fmt.Errorf("byte counts mismatch, %s", ret.String())
+	}
+	return ret, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package bench
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//处理每一帧都耗时的路径，用于公平性的测量
+const SlowPath = "/bench/slow"
+
+//公平性测量：同一连接上，heavy channel发出一个多帧请求，server处理其每一帧耗时FrameDelay，
+//light channel同时连续发出小请求。未开启公平分派时heavy channel的接收队列很快被填满，读循环阻塞，
+//light channel的请求排在heavy channel未处理的帧之后；开启之后heavy channel的帧暂存在分派器中，light channel不受影响
+type FairnessConfig struct {
+	MaxConsecutiveFrames int           //server的公平分派，0表示不开启，见iip.ServerConfig
+	Frames               int           //heavy请求的帧数，默认256
+	FrameSize            int           //heavy请求每帧的字节数，默认1KB
+	FrameDelay           time.Duration //server处理heavy请求每一帧的耗时，默认1ms
+	QueueLen             uint32        //server的channel接收队列长度，默认8
+}
+
+//公平性测量的结果，延迟为heavy请求进行期间light channel的请求延迟
+type FairnessResult struct {
+	Dispatch      bool          `json:"dispatch"`
+	HeavyElapsed  time.Duration `json:"heavy_elapsed"`
+	LightRequests int           `json:"light_requests"`
+	LightP50      time.Duration `json:"light_p50"`
+	LightP99      time.Duration `json:"light_p99"`
+	LightMax      time.Duration `json:"light_max"`
+	MaxRun        int           `json:"max_run"` //server读循环连续收到同一channel的最长帧数
+	Yields        int64         `json:"yields"`  //分派器轮到下一个channel时heavy channel仍有待投递帧的次数
+}
+
+func (m *FairnessResult) String() string {
+	return fmt.Sprintf("dispatch %v, heavy %s, light requests %d, p50 %s, p99 %s, max %s, max run %d, yields %d",
+		m.Dispatch, m.HeavyElapsed.Round(time.Millisecond), m.LightRequests, m.LightP50, m.LightP99, m.LightMax, m.MaxRun, m.Yields)
+}
+
+type slowHandler struct {
+	delay time.Duration
+}
+
+func (m *slowHandler) Handle(c *iip.Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	time.Sleep(m.delay)
+	if !dataCompleted {
+		return nil, iip.ErrPacketContinue
+	}
+	return []byte("done"), nil
+}
+
+//在进程内的server上测量同一连接上channel之间的公平性
+func Fairness(config FairnessConfig) (*FairnessResult, error) {
+	if config.Frames <= 0 {
+		config.Frames = 256
+	}
+	if config.FrameSize <= 0 {
+		config.FrameSize = 1024
+	}
+	if config.FrameDelay <= 0 {
+		config.FrameDelay = time.Millisecond
+	}
+	if config.QueueLen == 0 {
+		config.QueueLen = 8
+	}
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	serverConfig := ServerConfig
+	serverConfig.ChannelPacketQueueLen = config.QueueLen
+	serverConfig.MaxConsecutiveFrames = config.MaxConsecutiveFrames
+	server, err := iip.NewServer(serverConfig, lsn.Addr().String())
+	if err != nil {
+		lsn.Close()
+		return nil, err
+	}
+	defer server.Stop(fmt.Errorf("fairness finished"))
+	server.RegisterHandler(EchoPath, &echoHandler{})
+	server.RegisterHandler(SlowPath, &slowHandler{delay: config.FrameDelay})
+	server.Serve(lsn)
+
+	clientConfig := ClientConfig
+	clientConfig.FrameSize = uint32(config.FrameSize)
+	client, err := iip.NewClient(clientConfig, lsn.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	heavy, err := client.NewChannel()
+	if err != nil {
+		return nil, err
+	}
+	defer heavy.Close(nil)
+	light, err := client.NewChannel()
+	if err != nil {
+		return nil, err
+	}
+	defer light.Close(nil)
+
+	ret := &FairnessResult{Dispatch: config.MaxConsecutiveFrames > 0}
+	var heavyErr error
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		start := time.Now()
+		timeout := config.FrameDelay*time.Duration(config.Frames) + time.Second*10
+		_, heavyErr = heavy.DoRequest(SlowPath, make([]byte, config.Frames*config.FrameSize), timeout)
+		ret.HeavyElapsed = time.Since(start)
+	}()
+	var latencies []time.Duration
+	payload := make([]byte, 64)
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+			continue
+		default:
+		}
+		begin := time.Now()
+		if _, err := light.DoRequest(EchoPath, payload, time.Second*10); err != nil {
+			wg.Wait()
+			return nil, err
+		}
+		latencies = append(latencies, time.Since(begin))
+	}
+	wg.Wait()
+	if heavyErr != nil {
+		return nil, heavyErr
+	}
+	for _, v := range server.ConnectionsSnapshot() {
+		if v.MaxConsecutiveFrames > ret.MaxRun {
+			ret.MaxRun = v.MaxConsecutiveFrames
+		}
+		ret.Yields += v.DispatchYields
+	}
+	ret.LightRequests = len(latencies)
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		ret.LightP50, ret.LightP99, ret.LightMax = percentile(latencies, 0.5), percentile(latencies, 0.99), latencies[len(latencies)-1]
+	}
+	return ret, nil
+}
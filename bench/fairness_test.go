@@ -0,0 +1,36 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package bench_test
+
+import (
+	"testing"
+
+	"github.com/truexf/iip/bench"
+)
+
+//开启公平分派之后，大请求进行期间小请求的延迟不随大请求的耗时增长
+func TestFairnessBoundsLightLatency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("fairness takes about a second")
+	}
+	//未开启时小请求排在大请求未处理的帧之后，先确认场景确实造成阻塞
+	blocked, err := bench.Fairness(bench.FairnessConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocked.LightMax < blocked.HeavyElapsed/4 {
+		t.Skipf("light requests not blocked without dispatch, scenario is not meaningful here: %s", blocked)
+	}
+	fair, err := bench.Fairness(bench.FairnessConfig{MaxConsecutiveFrames: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fair.LightRequests < 2 {
+		t.Fatalf("too few light requests during the heavy request: %s", fair)
+	}
+	if fair.LightMax >= fair.HeavyElapsed/4 {
+		t.Fatalf("light latency not bounded: %s, without dispatch: %s", fair, blocked)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package bench
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//压测的配置：Concurrency个channel在Duration内各自连续发出请求，请求数据为PayloadSize字节
+type LoadConfig struct {
+	Addr        string        //server地址
+	Path        string        //请求的path，server须返回响应，默认EchoPath
+	Concurrency int           //并发的channel数，默认1
+	Connections int           //channel分布的连接数，默认1
+	PayloadSize int           //请求数据的字节数
+	Duration    time.Duration //压测时长，默认10秒
+	Timeout     time.Duration //单个请求的超时，默认5秒
+}
+
+//压测的结果，延迟只统计成功的请求
+type LoadResult struct {
+	Requests   int64         `json:"requests"`
+	Errors     int64         `json:"errors"`
+	Elapsed    time.Duration `json:"elapsed"`
+	Throughput float64       `json:"throughput"` //每秒成功完成的请求数
+	BytesOut   int64         `json:"bytes_out"`  //请求数据的字节数
+	BytesIn    int64         `json:"bytes_in"`   //响应数据的字节数
+	Mean       time.Duration `json:"mean"`
+	P50        time.Duration `json:"p50"`
+	P90        time.Duration `json:"p90"`
+	P99        time.Duration `json:"p99"`
+	P999       time.Duration `json:"p999"`
+	Max        time.Duration `json:"max"`
+	FirstError string        `json:"first_error,omitempty"`
+}
+
+func (m *LoadResult) String() string {
+	return fmt.Sprintf("requests %d, errors %d, elapsed %s, %.0f req/s, in %s/s, out %s/s\nlatency mean %s, p50 %s, p90 %s, p99 %s, p99.9 %s, max %s",
+		m.Requests, m.Errors, m.Elapsed.Round(time.Millisecond), m.Throughput,
+		byteSize(float64(m.BytesIn)/m.Elapsed.Seconds()), byteSize(float64(m.BytesOut)/m.Elapsed.Seconds()),
+		m.Mean, m.P50, m.P90, m.P99, m.P999, m.Max)
+}
+
+func byteSize(n float64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2fGB", n/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2fMB", n/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2fKB", n/(1<<10))
+	}
+	return fmt.Sprintf("%.0fB", n)
+}
+
+//对config.Addr施加负载，全部channel建立之后开始计时，Duration之后等待进行中的请求完成并返回统计结果
+func Load(config LoadConfig) (*LoadResult, error) {
+	if config.Path == "" {
+		config.Path = EchoPath
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if config.Connections <= 0 {
+		config.Connections = 1
+	}
+	if config.Duration <= 0 {
+		config.Duration = time.Second * 10
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second * 5
+	}
+	clientConfig := ClientConfig
+	clientConfig.MaxConnections = config.Connections
+	clientConfig.MaxChannelsPerConn = (config.Concurrency + config.Connections - 1) / config.Connections
+	client, err := iip.NewClient(clientConfig, config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	channels := make([]*iip.ClientChannel, config.Concurrency)
+	for i := range channels {
+		if channels[i], err = client.NewChannel(); err != nil {
+			return nil, fmt.Errorf("create channel %d fail, %s", i, err.Error())
+		}
+	}
+	payload := make([]byte, config.PayloadSize)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	var (
+		errCount  int64
+		bytesIn   int64
+		firstErr  atomic.Value
+		wg        sync.WaitGroup
+		latencies = make([][]time.Duration, len(channels))
+	)
+	start := time.Now()
+	deadline := start.Add(config.Duration)
+	for i, c := range channels {
+		wg.Add(1)
+		go func(i int, c *iip.ClientChannel) {
+			defer wg.Done()
+			defer func() { c.Close(nil) }()
+			for time.Now().Before(deadline) {
+				begin := time.Now()
+				resp, err := c.DoRequest(config.Path, payload, config.Timeout)
+				if err != nil {
+					atomic.AddInt64(&errCount, 1)
+					firstErr.CompareAndSwap(nil, err.Error())
+					//channel出错后重建，重建失败时退出
+					c.Close(err)
+					if c, err = client.NewChannel(); err != nil {
+						return
+					}
+					continue
+				}
+				latencies[i] = append(latencies[i], time.Since(begin))
+				atomic.AddInt64(&bytesIn, int64(len(resp)))
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	ret := &LoadResult{Errors: errCount, Elapsed: time.Since(start), BytesIn: bytesIn}
+	if v, ok := firstErr.Load().(string); ok {
+		ret.FirstError = v
+	}
+	var all []time.Duration
+	for _, v := range latencies {
+		all = append(all, v...)
+	}
+	ret.Requests = int64(len(all))
+	ret.BytesOut = ret.Requests * int64(len(payload))
+	ret.Throughput = float64(ret.Requests) / ret.Elapsed.Seconds()
+	if len(all) == 0 {
+		return ret, nil
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	var sum time.Duration
+	for _, v := range all {
+		sum += v
+	}
+	ret.Mean = sum / time.Duration(len(all))
+	ret.P50, ret.P90, ret.P99, ret.P999 = percentile(all, 0.5), percentile(all, 0.9), percentile(all, 0.99), percentile(all, 0.999)
+	ret.Max = all[len(all)-1]
+	return ret, nil
+}
+
+//已排序的延迟的分位数
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"context"
+	"fmt"
+)
+
+//空闲ClientChannel池。一个channel同一时刻只承载一个请求，需要并发请求的场景(网关、代理)从池中取用channel
+type ChannelPool struct {
+	client *Client
+	idle   chan *ClientChannel
+	active chan struct{} //取出使用中的channel的配额，nil表示不限制
+}
+
+func NewChannelPool(client *Client, maxIdle int) *ChannelPool {
+	if maxIdle <= 0 {
+		maxIdle = 64
+	}
+	return &ChannelPool{client: client, idle: make(chan *ClientChannel, maxIdle)}
+}
+
+//创建限制同时使用的channel数的池：取出的channel达到maxActive时，Get等待其他channel归还。
+//取出的channel须以Put或Discard归还
+func NewLimitedChannelPool(client *Client, maxIdle, maxActive int) *ChannelPool {
+	ret := NewChannelPool(client, maxIdle)
+	if maxActive > 0 {
+		ret.active = make(chan struct{}, maxActive)
+	}
+	return ret
+}
+
+//取一个空闲的channel，没有时新建
+func (m *ChannelPool) Get() (*ClientChannel, error) {
+	return m.GetContext(context.Background())
+}
+
+//取一个空闲的channel，没有时新建；限制了同时使用的channel数时等待配额直至ctx结束
+func (m *ChannelPool) GetContext(ctx context.Context) (*ClientChannel, error) {
+	if m.active != nil {
+		select {
+		case m.active <- struct{}{}:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, ErrRequestTimeout
+			}
+			return nil, ctx.Err()
+		}
+	}
+	ret, err := m.get()
+	if err != nil {
+		m.release()
+	}
+	return ret, err
+}
+
+//归还channel，池满时关闭
+func (m *ChannelPool) Put(c *ClientChannel) {
+	m.release()
+	m.put(c)
+}
+
+//取一个空闲的channel，没有时新建，不占用配额。请求重试使用，见retry.go
+func (m *ChannelPool) get() (*ClientChannel, error) {
+	for {
+		select {
+		case c := <-m.idle:
+			if c.internalChannel.isClosed() {
+				continue
+			}
+			return c, nil
+		default:
+			return m.client.NewChannel()
+		}
+	}
+}
+
+//放回空闲的channel，池满时关闭
+func (m *ChannelPool) put(c *ClientChannel) {
+	select {
+	case m.idle <- c:
+	default:
+		c.Close(fmt.Errorf("idle channel pool is full"))
+	}
+}
+
+//关闭取出的channel并归还其配额，用于请求失败、不宜复用的channel
+func (m *ChannelPool) Discard(c *ClientChannel, err error) {
+	m.release()
+	c.Close(err)
+}
+
+func (m *ChannelPool) release() {
+	if m.active != nil {
+		<-m.active
+	}
+}
+
+//从池中取一个channel完成一次请求。请求失败的channel上可能还会到达迟到的响应，不再放回池中
+func (m *ChannelPool) DoRequestContext(ctx context.Context, path string, requestData []byte) ([]byte, error) {
+	c, err := m.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := c.DoRequestContext(ctx, path, requestData)
+	if err != nil {
+		m.Discard(c, err)
+		return nil, err
+	}
+	m.Put(c)
+	return ret, nil
+}
+
+//关闭池中全部空闲的channel
+func (m *ChannelPool) Close() {
+	for {
+		select {
+		case c := <-m.idle:
+			c.Close(fmt.Errorf("channel pool closed"))
+		default:
+			return
+		}
+	}
+}
+
+//以client内部的channel池完成一次请求，调用者不需要创建、管理channel。
+//同时进行的请求数不超过ClientConfig.MaxPoolChannels，超过时等待空闲的channel
+func (m *Client) Do(path string, requestData []byte) ([]byte, error) {
+	return m.DoContext(context.Background(), path, requestData)
+}
+
+//同Do，等待channel及响应直至ctx结束
+func (m *Client) DoContext(ctx context.Context, path string, requestData []byte) ([]byte, error) {
+	return m.pool.DoRequestContext(ctx, path, requestData)
+}
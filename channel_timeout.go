@@ -0,0 +1,77 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//channel的截止时间及空闲超时：到达截止时间，或者在空闲超时时间内没有收发任何帧的channel被关闭(并通知对端)，
+//其id被回收，避免对端打开channel后弃之不用造成泄漏
+package iip
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//设置channel的截止时间，到达后channel以ErrChannelDeadline关闭；零值表示取消截止时间
+func (m *Channel) SetDeadline(t time.Time) {
+	m.deadlineLock.Lock()
+	defer m.deadlineLock.Unlock()
+	if m.deadlineTimer != nil {
+		m.deadlineTimer.Stop()
+		m.deadlineTimer = nil
+	}
+	if t.IsZero() {
+		return
+	}
+	m.deadlineTimer = time.AfterFunc(time.Until(t), func() {
+		m.Close(ErrChannelDeadline)
+	})
+}
+
+func (m *Channel) stopDeadline() {
+	m.deadlineLock.Lock()
+	defer m.deadlineLock.Unlock()
+	if m.deadlineTimer != nil {
+		m.deadlineTimer.Stop()
+		m.deadlineTimer = nil
+	}
+}
+
+//最近一次收发帧的时间
+func (m *Channel) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&m.lastActive))
+}
+
+//设置连接上channel的空闲超时，在start之前调用，0表示不检查
+func (m *Connection) setChannelIdleTimeout(timeout time.Duration) {
+	m.channelIdleTimeout = timeout
+}
+
+//定期关闭空闲超时的channel，0号系统channel及正在处理请求/等待响应的channel除外
+func (m *Connection) channelIdleLoop(done chan int) {
+	interval := m.channelIdleTimeout / 4
+	if interval < time.Millisecond*100 {
+		interval = time.Millisecond * 100
+	} else if interval > time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			var idle []*Channel
+			m.ChannelsLock.RLock()
+			for id, c := range m.Channels {
+				if id != 0 && atomic.LoadInt32(&c.busy) == 0 && now.Sub(c.LastActive()) > m.channelIdleTimeout {
+					idle = append(idle, c)
+				}
+			}
+			m.ChannelsLock.RUnlock()
+			for _, c := range idle {
+				c.Close(ErrChannelIdle)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"math"
+)
+
+//本端命名空间中channel id的分配，由Connection.ChannelsLock保护。
+//与进程号的分配相同，游标每次前进2，跳过仍在使用的id，到达上限后回绕并使代数加1：
+//一个id只在游标转完整个命名空间之后才被复用，使对端迟到的旧帧几乎不可能被同id的新channel误收；
+//全部id都在使用时返回ErrChannelIdExhausted，不再返回与系统channel冲突的0
+type channelIdSpace struct {
+	cursor     uint32         //最近一次分配的id，0表示尚未分配
+	limit      uint32         //可分配的最大id，0表示math.MaxUint32
+	generation uint32         //游标回绕的次数
+	used       uint32         //已分配、尚未释放的id数
+	held       map[uint32]int //channel已删除，但写队列中仍有其帧或者等待对端的关闭确认，暂不能复用的id及其等待的条件数
+}
+
+//分配一个id，first为命名空间的第一个id(client为1，server为2)，inUse判断id是否被打开的channel占用
+func (m *channelIdSpace) alloc(first uint32, inUse func(id uint32) bool) (uint32, error) {
+	last := m.limit
+	if last == 0 {
+		last = math.MaxUint32
+	}
+	if last%2 != first%2 {
+		last--
+	}
+	if last < first || m.used >= (last-first)/2+1 {
+		return 0, ErrChannelIdExhausted
+	}
+	for {
+		if m.cursor == 0 {
+			m.cursor = first
+		} else if m.cursor >= last {
+			m.cursor = first
+			m.generation++
+		} else {
+			m.cursor += 2
+		}
+		if _, ok := m.held[m.cursor]; ok || inUse(m.cursor) {
+			continue
+		}
+		m.used++
+		return m.cursor, nil
+	}
+}
+
+//id在n个条件满足之前不被复用，每个条件满足时调用一次release
+func (m *channelIdSpace) hold(id uint32, n int) {
+	if m.held == nil {
+		m.held = make(map[uint32]int)
+	}
+	m.held[id] += n
+}
+
+//id等待的一个条件已满足，全部满足之后可被复用
+func (m *channelIdSpace) release(id uint32) {
+	if n := m.held[id]; n > 1 {
+		m.held[id] = n - 1
+		return
+	}
+	delete(m.held, id)
+	if m.used > 0 {
+		m.used--
+	}
+}
+
+//本端命名空间的第一个id：client发起的channel为奇数，server发起的推送channel为偶数
+func (m *Connection) firstChannelId() uint32 {
+	if m.Role == RoleClient {
+		return 1
+	}
+	return 2
+}
+
+//在本端命名空间中分配id并创建channel
+func (m *Connection) newOwnedChannel(queueLen uint32, push bool) (*Channel, error) {
+	ret := m.makeChannel(0, queueLen, push)
+	m.ChannelsLock.Lock()
+	defer m.ChannelsLock.Unlock()
+	if m.stopped {
+		return nil, m.errClosed()
+	}
+	generation := m.channelIds.generation
+	id, err := m.channelIds.alloc(m.firstChannelId(), func(id uint32) bool {
+		_, ok := m.Channels[id]
+		return ok
+	})
+	if err != nil {
+		log.Errorf("alloc channel id of %s fail, channels: %d, %s", m.key, len(m.Channels), err.Error())
+		return nil, err
+	}
+	if m.channelIds.generation != generation {
+		log.Warnf("channel id of %s wrapped around, generation: %d", m.key, m.channelIds.generation)
+	}
+	ret.Id, ret.generation = id, m.channelIds.generation
+	m.addChannel(ret)
+	return ret, nil
+}
+
+//为未携带channel_id的new_channel请求(旧版client)分配id并创建channel：旧版client在本地从1开始按顺序分配id，
+//不使用响应中的id，server须以相同的顺序分配才能与之一致。这样的id不属于任何一端的命名空间，channel关闭之后不经channelIds回收
+func (m *Connection) newLegacyChannel(queueLen uint32, tenant *Tenant) (*Channel, error) {
+	ret := m.makeChannel(0, queueLen, false)
+	ret.legacyId, ret.tenant = true, tenant
+	m.ChannelsLock.Lock()
+	defer m.ChannelsLock.Unlock()
+	if m.stopped {
+		return nil, m.errClosed()
+	}
+	for {
+		if m.legacyId == math.MaxUint32 {
+			return nil, ErrChannelIdExhausted
+		}
+		m.legacyId++
+		//跳过推送channel等占用的id
+		if _, ok := m.Channels[m.legacyId]; !ok {
+			break
+		}
+	}
+	ret.Id = m.legacyId
+	m.addChannel(ret)
+	return ret, nil
+}
+
+//释放本端命名空间中的id：写队列中仍有该id的帧时等其写出之后释放；awaitAck时还须等待对端的关闭确认，
+//见closeack.go。调用者持有ChannelsLock
+func (m *Connection) releaseChannelId(id uint32, awaitAck bool) {
+	n := 1
+	if awaitAck {
+		n = 2
+		m.awaitCloseAck(id)
+	}
+	m.channelIds.hold(id, n)
+	if m.writeSched.whenDrained(id, func() {
+		m.ChannelsLock.Lock()
+		m.channelIds.release(id)
+		m.ChannelsLock.Unlock()
+	}) {
+		m.channelIds.release(id)
+	}
+}
+
+//channel id的代数：id随游标回绕而被复用，同一id的不同代数是不同的channel
+func (m *Channel) Generation() uint32 {
+	return m.generation
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+//client命名空间限制为1..21，共11个id
+const testChannelIdLimit = 21
+
+func TestChannelIdSpaceChurn(t *testing.T) {
+	space := channelIdSpace{limit: testChannelIdLimit}
+	notUsed := func(uint32) bool { return false }
+	const n = 1000000
+	for i := 0; i < n; i++ {
+		id, err := space.alloc(1, notUsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == 0 || id%2 != 1 || id > testChannelIdLimit {
+			t.Fatalf("invalid id: %d", id)
+		}
+		if want := uint32(i%11*2 + 1); id != want {
+			t.Fatalf("id %d, want %d", id, want)
+		}
+		space.hold(id, 1)
+		space.release(id)
+	}
+	//第一轮之后每11次分配回绕一次
+	if space.generation != (n-1)/11 {
+		t.Fatalf("generation: %d", space.generation)
+	}
+	if space.used != 0 || len(space.held) != 0 {
+		t.Fatalf("ids not reclaimed, used: %d, held: %d", space.used, len(space.held))
+	}
+}
+
+func TestChannelIdSpaceExhausted(t *testing.T) {
+	space := channelIdSpace{limit: testChannelIdLimit}
+	notUsed := func(uint32) bool { return false }
+	var ids []uint32
+	for i := 0; i < 11; i++ {
+		id, err := space.alloc(1, notUsed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := space.alloc(1, notUsed); err != ErrChannelIdExhausted {
+		t.Fatalf("expected ErrChannelIdExhausted, got %v", err)
+	}
+	//等待两个条件的id在两个条件都满足之前不被复用
+	for _, id := range ids {
+		n := 1
+		if id == 1 {
+			n = 2
+		}
+		space.hold(id, n)
+		space.release(id)
+	}
+	for i := 0; i < 10; i++ {
+		if id, err := space.alloc(1, notUsed); err != nil || id == 1 {
+			t.Fatalf("alloc %d: %d, %v", i, id, err)
+		}
+	}
+	if _, err := space.alloc(1, notUsed); err != ErrChannelIdExhausted {
+		t.Fatalf("held id reused: %v", err)
+	}
+	space.release(1)
+	if id, err := space.alloc(1, notUsed); err != nil || id != 1 {
+		t.Fatalf("released id not reused: %d, %v", id, err)
+	}
+}
+
+//反复打开、关闭channel，id在限定的命名空间中循环复用，关闭的channel全部移出两端的channel map
+func TestChannelChurn(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{})
+	client := newTestClient(t, addr, ClientConfig{})
+	first, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := first.internalChannel.conn
+	conn.ChannelsLock.Lock()
+	conn.channelIds.limit = testChannelIdLimit
+	conn.ChannelsLock.Unlock()
+	first.Close(nil)
+
+	const n = 500
+	for i := 0; i < n; i++ {
+		channel, err := client.NewChannel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := channel.internalChannel.Id; id > testChannelIdLimit {
+			t.Fatalf("id %d out of the limited space", id)
+		}
+		data := []byte(fmt.Sprint(i))
+		if ret, err := channel.DoRequest(testEchoPath, data, time.Second*5); err != nil || string(ret) != string(data) {
+			t.Fatalf("request %d: %q, %v", i, ret, err)
+		}
+		channel.Close(nil)
+	}
+
+	server.connLock.Lock()
+	var serverConns []*Connection
+	for _, v := range server.connections {
+		serverConns = append(serverConns, v)
+	}
+	server.connLock.Unlock()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		conn.ChannelsLock.RLock()
+		channels, used, held, generation := len(conn.Channels), conn.channelIds.used, len(conn.channelIds.held), conn.channelIds.generation
+		conn.ChannelsLock.RUnlock()
+		serverChannels := 0
+		for _, v := range serverConns {
+			serverChannels += len(v.ChannelsStats())
+		}
+		//只剩0号系统channel
+		if channels == 1 && used == 0 && held == 0 && serverChannels == 0 {
+			if generation < n/11 {
+				t.Fatalf("ids did not wrap around, generation: %d", generation)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("channels not reclaimed, client channels: %d, used ids: %d, held ids: %d, server channels: %d", channels, used, held, serverChannels)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
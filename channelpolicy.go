@@ -0,0 +1,28 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//新建channel的准入策略：client请求新建channel(PathNewChannel)时，server在连接排空、MaxChannelsPerConn的检查之后、
+//租户的channel配额之前调用ServerConfig.OnNewChannelRequest，可以按连接的认证身份(Connection.Identity)、
+//对端地址或者自定义的配额拒绝新建channel。拒绝的错误随新建channel的响应返回，client的NewChannel返回同错误码的*Error
+package iip
+
+//新建channel的准入回调，返回错误时拒绝：*Error的错误码及消息原样返回给client，其他错误的错误码为-1。
+//在连接0号channel的处理goroutine中同步调用，不应阻塞
+type NewChannelPolicy func(conn *Connection) error
+
+//按OnNewChannelRequest检查是否允许新建channel，拒绝时返回新建channel的响应
+func (m *Server) admitNewChannel(conn *Connection) *ResponseNewChannel {
+	policy := m.getConfig().OnNewChannelRequest
+	if policy == nil {
+		return nil
+	}
+	err := policy(conn)
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*Error); ok {
+		return &ResponseNewChannel{Code: e.Code, Message: e.Message}
+	}
+	return &ResponseNewChannel{Code: -1, Message: err.Error()}
+}
@@ -0,0 +1,29 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//帧校验：握手时协商校验算法，之后每一帧在数据之后追加4字节校验和(覆盖帧头及数据)，
+//读循环校验失败时以明确的错误关闭连接，避免将损坏的数据交给handler
+package iip
+
+import (
+	"hash/crc32"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+//校验算法对应的crc32表，ChecksumNone及未知算法返回nil
+func checksumTable(alg byte) *crc32.Table {
+	switch alg {
+	case ChecksumCRC32:
+		return crc32.IEEETable
+	case ChecksumCRC32C:
+		return crc32cTable
+	default:
+		return nil
+	}
+}
+
+func isValidChecksum(alg byte) bool {
+	return alg == ChecksumNone || checksumTable(alg) != nil
+}
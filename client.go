@@ -6,45 +6,120 @@
 package iip
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ClientConfig struct {
-	MaxConnections        int           //单client最大连接数
-	MaxChannelsPerConn    int           //单connection最大channel数
-	ChannelPacketQueueLen uint32        //channel的packet接收队列长度
-	TcpWriteQueueLen      uint32        //connection的packet写队列长度
-	TcpConnectTimeout     time.Duration //服务器连接超时限制
-	TcpReadBufferSize     int           //内核socket读缓冲区大小
-	TcpWriteBufferSize    int           //内核socket写缓冲区大小
+	MaxConnections        int                //单client最大连接数
+	MaxChannelsPerConn    int                //单connection最大channel数
+	ChannelPacketQueueLen uint32             //channel的packet接收队列长度
+	TcpWriteQueueLen      uint32             //connection的packet写队列长度
+	TcpConnectTimeout     time.Duration      //服务器连接超时限制
+	TcpReadBufferSize     int                //内核socket读缓冲区大小，0表示使用系统默认值
+	TcpWriteBufferSize    int                //内核socket写缓冲区大小，0表示使用系统默认值
+	TcpKeepAlive          time.Duration      //TCP keepalive间隔，0表示15秒，负数表示关闭
+	TcpDelay              bool               //开启Nagle算法(关闭TCP_NODELAY)，小帧合并发送以提高吞吐，默认关闭即小帧立即发送
+	TcpLinger             time.Duration      //关闭连接时的SO_LINGER，0表示使用系统默认值(在后台发送剩余数据)，负数表示丢弃未发送的数据并发送RST
+	MaxPacketSize         uint32             //packet最大字节数，0表示使用默认值MaxPacketSize，握手时与server协商取较小值
+	MaxPathLen            uint32             //path最大字节数，0表示使用默认值MaxPathLen，握手时与server协商取较小值
+	FrameSize             uint32             //发送时每帧数据的最大字节数，大数据按此分帧，使各channel的帧交错写出，0表示与MaxPacketSize相同，握手时与server协商取较小值
+	Checksum              byte               //帧校验算法，握手时提议给server
+	Codec                 Codec              //Call使用的编解码器，默认JSONCodec
+	Credentials           CredentialsFunc    //握手时提交给server认证的凭证
+	ChannelIdleTimeout    time.Duration      //channel空闲超时，超时的channel被关闭并回收，0表示不检查
+	ChannelCloseLinger    time.Duration      //channel关闭后的逗留期，期间该channel的帧被静默丢弃，也是等待对端关闭确认的上限，0为5秒，负数表示不逗留，见closeack.go
+	FrameReadTimeout      time.Duration      //读取一帧的时限，从收到帧的首字节开始计时，超时未读完整帧时关闭连接，0表示不限制，见readtimeout.go
+	Retry                 *RetryPolicy       //幂等path的请求重试策略，nil表示不重试
+	ResolveInterval       time.Duration      //服务端地址中主机名的重新解析间隔，默认30秒
+	Resolver              Resolver           //服务端地址解析器，nil表示由NewClient的serverAddr解析，见resolver.go
+	Balancer              Balancer           //新建channel时选择服务端地址的策略，nil表示轮转，见balancer.go
+	HealthCheck           *HealthCheckConfig //连接的健康检查，nil表示不检查，见health.go
+	TLSConfig             *tls.Config        //非nil时连接使用TLS，设置Certificates即为双向认证，未设置ServerName时取自serverAddr，见tls.go
+	PSK                   []byte             //预共享密钥，配置后连接以PSKCipher加密，server须配置相同的PSK，见psk.go
+	PSKCipher             PSKCipher          //PSK加密的算法，nil为AES-256-GCM，须与server相同
+	MaxPoolChannels       int                //Do使用的channel数上限，即同时进行的请求数，超过时等待，默认64，见channel_pool.go
+	SequenceCheck         bool               //握手时协商帧序号，双方校验每个channel上帧的顺序，见sequence.go
+	PipelineDepth         int                //channel上可同时进行的请求数，大于1时开启请求流水线，见pipeline.go
+	PathRules             *PathRules         //发送时path的校验规则，nil表示只拒绝含有\0的path，见pathrules.go
 }
 
 type Client struct {
+	//以原子操作访问的64位字段放在最前，保证在32位平台上按8字节对齐，见sizes.go
+	seqErrors            int64 //帧序号校验失败而关闭的连接数
+	unknownChannelFrames int64 //收到的不存在的channel的帧数，见reset.go
+	oneWay               oneWayCounters
+
 	DefaultErrorHolder
 	DefaultContext
 	config      ClientConfig
 	serverAddr  string
+	endpoints   *endpointSet
+	balancer    Balancer
+	closeNotify chan int
+	closed      int32
 	connections []*Connection
 	connLock    sync.Mutex
 	handler     *clientHandler
+	pushHandler *clientHandler //处理server推送channel上的数据
+	pool        *ChannelPool   //Do使用的channel池
+	taps        tapList        //全部连接上的tap，见tap.go
+
+	interceptors     []ClientInterceptor
+	interceptorsLock sync.RWMutex
 }
 
+//完成一次请求/响应的函数，ctx控制超时，并携带请求元数据(WithRequestMeta)
+type RequestInvoker func(ctx context.Context, c *ClientChannel, path string, requestData []byte) ([]byte, error)
+
+//客户端拦截器，可以观察或改写每一个DoRequest/DoRequestContext发出的请求及收到的响应（path, data, 耗时, error），
+//通过调用invoker继续执行请求，可用于重试、链路追踪、统计等
+type ClientInterceptor func(ctx context.Context, c *ClientChannel, path string, requestData []byte, invoker RequestInvoker) ([]byte, error)
+
 type ClientChannel struct {
 	internalChannel *Channel
 	client          *Client
 }
 
-//创建一个新的client
-func NewClient(config ClientConfig, serverAddr string) (*Client, error) {
+//创建一个新的client，serverAddr可以是逗号分隔的多个地址，主机名解析出的全部地址都会被使用，见endpoints.go。
+//config.Resolver不为nil时忽略serverAddr，opts按顺序修改config，见options.go
+func NewClient(config ClientConfig, serverAddr string, opts ...ClientOption) (*Client, error) {
+	for _, opt := range opts {
+		opt.applyClient(&config)
+	}
 	ret := &Client{
 		config:      config,
 		serverAddr:  serverAddr,
+		endpoints:   newEndpointSet(),
+		balancer:    config.Balancer,
+		closeNotify: make(chan int),
 		connections: make([]*Connection, 0),
 		handler:     &clientHandler{pathHandlerManager: &PathHandlerManager{}},
+		pushHandler: &clientHandler{pathHandlerManager: &PathHandlerManager{}},
+	}
+	poolChannels := config.MaxPoolChannels
+	if poolChannels <= 0 {
+		poolChannels = 64
+	}
+	ret.pool = NewLimitedChannelPool(ret, poolChannels, poolChannels)
+	if config.Retry != nil {
+		ret.interceptors = append(ret.interceptors, newRetryInterceptor(*config.Retry))
+	}
+	if ret.balancer == nil {
+		ret.balancer = NewRoundRobinBalancer()
+	}
+	if err := ret.startResolver(); err != nil {
+		return nil, err
+	}
+	if config.HealthCheck != nil {
+		go ret.healthLoop(*config.HealthCheck)
 	}
 	return ret, nil
 }
@@ -53,45 +128,116 @@ func NewClient(config ClientConfig, serverAddr string) (*Client, error) {
 //每个connection会默认建立一个ID为0的信道，用于基础通讯功能，创建一个新的channel就是通过这个0号channel实现的：
 //创建channel的流程由client发起，服务器返回新创建的channel id，后续的业务通讯（request/response）应该在新创建的channel上进行
 func (m *Client) NewChannel() (*ClientChannel, error) {
-	conn, err := m.getFreeConnection()
+	return m.NewChannelFor("")
+}
+
+//创建一个新的channel，path为channel将要请求的path，供Balancer选择服务端地址，如按path一致性哈希
+func (m *Client) NewChannelFor(path string) (*ClientChannel, error) {
+	//连接正在被server排空时被标记为排空状态，改用其他未排空的连接，都已排空时新建的连接也被拒绝则不再重试
+	m.connLock.Lock()
+	attempts := len(m.connections) + 1
+	m.connLock.Unlock()
+	for i := 1; ; i++ {
+		ret, err := m.newChannel(PickInfo{Path: path})
+		if err == nil || !errors.Is(err, ErrConnDraining) || i >= attempts {
+			return ret, err
+		}
+	}
+}
+
+func (m *Client) newChannel(info PickInfo) (*ClientChannel, error) {
+	conn, err := m.getFreeConnection(info)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &ClientChannel{internalChannel: conn.Channels[0], client: m}
-	bts, err := c.DoRequest(PathNewChannel, []byte("{}"), time.Second)
+	//client在本端命名空间(奇数)中分配id，server按该id创建对应的channel
+	newChannel, err := conn.newOwnedChannel(m.config.ChannelPacketQueueLen, false)
 	if err != nil {
 		return nil, err
 	}
+	req, _ := json.Marshal(&RequestNewChannel{ChannelId: newChannel.Id})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	bts, err := m.sysRequest(ctx, conn, PathNewChannel, req)
+	cancel()
+	if err != nil {
+		abandonChannel(newChannel, err)
+		return nil, err
+	}
 	var resp ResponseNewChannel
 	if err := json.Unmarshal(bts, &resp); err != nil {
+		abandonChannel(newChannel, err)
 		return nil, err
 	}
-	if resp.ChannelId > 0 && resp.Code == 0 {
-		c := &ClientChannel{internalChannel: conn.newChannel(false, m.config.ChannelPacketQueueLen), client: m}
-		c.client.SetCtxData(CtxClient, m)
-		return c, nil
+	if resp.ChannelId == newChannel.Id && resp.Code == 0 {
+		return &ClientChannel{internalChannel: newChannel, client: m}, nil
 	} else {
-		return nil, fmt.Errorf(resp.Message)
+		conn.discardChannel(newChannel)
+		if resp.Code == ErrConnDraining.(*Error).Code {
+			atomic.StoreInt32(&conn.draining, 1)
+			conn.closeIfDrained()
+			return nil, ErrConnDraining
+		}
+		if resp.Code == ErrTooManyChannels.(*Error).Code {
+			return nil, ErrTooManyChannels
+		}
+		return nil, &Error{Code: resp.Code, Message: resp.Message, remote: true}
 	}
 }
 
-func (m *Client) newConnection() (*Connection, error) {
-	conn, err := net.DialTimeout("tcp4", m.serverAddr, m.config.TcpConnectTimeout)
+//新建channel的请求没有明确的结果(超时、连接出错或者响应无法解析)，server可能已经创建了该channel：
+//关闭本端的channel并通知server删除，协商了FeatureCloseAck时id在server确认之后才被复用
+func abandonChannel(c *Channel, err error) {
+	c.close(fmt.Errorf("new channel fail, %s", err.Error()), true)
+}
+
+func (m *Client) newConnection(addr string) (*Connection, error) {
+	if atomic.LoadInt32(&m.closed) == 1 {
+		return nil, fmt.Errorf("client closed")
+	}
+	conn, err := dialTransport(addr, m.config.TcpConnectTimeout)
 	if err != nil {
 		return nil, err
 	}
-	tcpConn := conn.(*net.TCPConn)
-	ret, err := NewConnection(tcpConn, RoleClient, int(m.config.TcpWriteQueueLen))
+	keepAlive := m.config.TcpKeepAlive
+	if keepAlive == 0 {
+		keepAlive = time.Second * 15
+	}
+	setTcpOptions(conn, tcpOptions{
+		keepAlive:   keepAlive,
+		delay:       m.config.TcpDelay,
+		readBuffer:  m.config.TcpReadBufferSize,
+		writeBuffer: m.config.TcpWriteBufferSize,
+		linger:      m.config.TcpLinger,
+	})
+	if conn, err = m.tlsClient(conn, addr); err != nil {
+		return nil, err
+	}
+	return m.addConnection(conn, addr)
+}
+
+//为已建立的网络连接创建client端的connection，启动并完成握手后加入client的连接列表。
+//endpoint为连接对应的服务端地址，内存连接为空
+func (m *Client) addConnection(netConn net.Conn, endpoint string) (*Connection, error) {
+	ret, err := createConnection(netConn, RoleClient, int(m.config.TcpWriteQueueLen))
 	if err != nil {
+		netConn.Close()
 		return nil, err
 	}
+	ret.client = m
 	ret.SetCtxData(CtxClient, m)
+	ret.ownerTaps = &m.taps
+	ret.endpoint = endpoint
+	ret.setLimits(m.config.MaxPacketSize, m.config.MaxPathLen)
+	ret.setChannelIdleTimeout(m.config.ChannelIdleTimeout)
+	ret.setCloseLinger(m.config.ChannelCloseLinger)
+	ret.setFrameReadTimeout(m.config.FrameReadTimeout)
+	ret.start()
 
-	tcpConn.SetKeepAlive(true)
-	tcpConn.SetKeepAlivePeriod(time.Second * 15)
-	tcpConn.SetReadBuffer(m.config.TcpReadBufferSize)
-	tcpConn.SetWriteBuffer(m.config.TcpWriteBufferSize)
+	if err := m.handshake(ret); err != nil {
+		ret.Close(err)
+		return nil, err
+	}
 
 	m.connLock.Lock()
 	m.connections = append(m.connections, ret)
@@ -113,72 +259,189 @@ func (m *Client) removeConnection(conn *Connection) {
 		}
 	}
 }
-func (m *Client) getFreeConnection() (*Connection, error) {
-	var conn *Connection = nil
+
+//内存连接等非tcp连接优先，否则由Balancer选择服务端地址，使用该地址上有空闲channel配额的连接，没有时新建连接
+func (m *Client) getFreeConnection(info PickInfo) (*Connection, error) {
+	if conn := m.freeConnection(func(conn *Connection) bool { return conn.endpoint == "" }); conn != nil {
+		return conn, nil
+	}
+	states, err := m.endpointStates()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := m.balancer.Pick(states, info)
+	if err != nil {
+		return nil, err
+	}
+	if conn := m.freeConnection(func(conn *Connection) bool { return conn.endpoint == addr }); conn != nil {
+		return conn, nil
+	}
+	return m.newConnection(addr)
+}
+
+func (m *Client) freeConnection(match func(conn *Connection) bool) *Connection {
 	m.connLock.Lock()
+	defer m.connLock.Unlock()
 	for _, v := range m.connections {
-		v.ChannelsLock.Lock()
-		if len(v.Channels) < m.config.MaxChannelsPerConn {
-			conn = v
-			v.ChannelsLock.Unlock()
-			break
+		if v.Draining() || !v.Healthy() || !match(v) {
+			continue
+		}
+		v.ChannelsLock.RLock()
+		free := len(v.Channels) < m.config.MaxChannelsPerConn
+		v.ChannelsLock.RUnlock()
+		if free {
+			return v
 		}
-		v.ChannelsLock.Unlock()
 	}
-	m.connLock.Unlock()
-	var err error
-	if conn == nil {
-		conn, err = m.newConnection()
+	return nil
+}
+
+//添加拦截器，先添加的拦截器位于外层
+func (m *Client) AddInterceptor(interceptor ClientInterceptor) {
+	if interceptor == nil {
+		return
 	}
-	return conn, err
+	m.interceptorsLock.Lock()
+	defer m.interceptorsLock.Unlock()
+	m.interceptors = append(m.interceptors, interceptor)
 }
 
 //用于"消息式"请求/响应（系统自动将多个部分的响应数据合成为一个完整的响应，并通过这个阻塞的函数返回）
 func (m *ClientChannel) DoRequest(path string, requestData []byte, timeout time.Duration) ([]byte, error) {
-	if m.internalChannel != nil && m.internalChannel.err != nil {
-		return nil, fmt.Errorf("this channel is invalid, [%s]", m.internalChannel.err.Error())
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
+	return m.DoRequestContext(ctx, path, requestData)
+}
 
+//同DoRequest，等待响应直至ctx结束，ctx中的请求元数据随请求首帧发出
+func (m *ClientChannel) DoRequestContext(ctx context.Context, path string, requestData []byte) ([]byte, error) {
+	m.client.interceptorsLock.RLock()
+	interceptors := m.client.interceptors
+	m.client.interceptorsLock.RUnlock()
+	if len(interceptors) == 0 {
+		return m.doRequestContext(ctx, path, requestData)
+	}
+	invoker := func(ctx context.Context, c *ClientChannel, path string, requestData []byte) ([]byte, error) {
+		return c.doRequestContext(ctx, path, requestData)
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		next, interceptor := invoker, interceptors[i]
+		invoker = func(ctx context.Context, c *ClientChannel, path string, requestData []byte) ([]byte, error) {
+			return interceptor(ctx, c, path, requestData, next)
+		}
+	}
+	return invoker(ctx, m, path, requestData)
+}
+
+func (m *ClientChannel) doRequest(path string, requestData []byte, timeout time.Duration) ([]byte, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return m.doRequestContext(ctx, path, requestData)
+}
+
+//请求/响应，等待响应直至ctx结束，ctx超时返回ErrRequestTimeout
+func (m *ClientChannel) doRequestContext(ctx context.Context, path string, requestData []byte) ([]byte, error) {
+	if m.internalChannel != nil {
+		if err := m.internalChannel.errClosed(); err != nil {
+			return nil, err
+		}
+	}
+
+	//先登记再发送，见pending.go
+	pending := &pendingRequest{ch: make(chan pendingResult, 1)}
+	pending.deadline, _ = ctx.Deadline()
 	pkt := &Packet{
 		Type:      PacketTypeRequest,
 		Path:      path,
 		ChannelId: m.internalChannel.Id,
 		Data:      requestData,
+		Meta:      RequestMetaFromContext(ctx),
 		channel:   m.internalChannel,
 	}
-	if err := m.internalChannel.SendPacket(pkt); err != nil {
+	//对端读取缓慢、写队列满时，发送的等待也受ctx的截止时间限制
+	if err := m.internalChannel.sendRequest(pending, pkt, sendTimeout(pending.deadline)); err != nil {
+		pending.complete(nil, err)
 		return nil, err
 	}
 
-	respChan := make(chan *Packet)
-	m.internalChannel.SetCtxData(CtxResponseChan, respChan)
-	defer func() {
-		m.internalChannel.RemoveCtxData(CtxResponseChan)
-		close(respChan)
-	}()
-
-	if timeout > 0 {
-		select {
-		case <-time.After(timeout):
-			return nil, ErrRequestTimeout
-		case resp := <-respChan:
-			if resp != nil {
-				return resp.Data, nil
-			}
-		}
-	} else {
-		resp := <-respChan
-		if resp != nil {
-			return resp.Data, nil
+	//超时由pending表的timer完成，ctx被取消时取消请求。channel在等待期间关闭时，关闭之前已到达的响应(如认证失败的响应)优先
+	var ret pendingResult
+	select {
+	case ret = <-pending.ch:
+	case <-ctx.Done():
+		err := ctx.Err()
+		if err == context.DeadlineExceeded {
+			err = ErrRequestTimeout
 		}
+		//与响应同时到达时以先完成者为准，结果总是交付到ch
+		pending.complete(nil, err)
+		m.internalChannel.refreshBusy()
+		ret = <-pending.ch
+	}
+	if ret.err != nil {
+		return nil, ret.err
 	}
-	return nil, ErrUnknown
+	return m.response(ctx, ret.resp)
+}
+
+//请求在写队列满时等待的时间：截止时间之前，没有截止时间时一直等待(-1)
+func sendTimeout(deadline time.Time) time.Duration {
+	if deadline.IsZero() {
+		return -1
+	}
+	if ret := time.Until(deadline); ret > 0 {
+		return ret
+	}
+	return 0
+}
+
+func (m *ClientChannel) response(ctx context.Context, resp *Packet) ([]byte, error) {
+	if resp == nil {
+		return nil, ErrUnknown
+	}
+	if resp.Status == StatusS11 || resp.Status == StatusR12 {
+		return nil, decodeErrorFrame(resp.Data)
+	}
+	if trailer := trailerFromContext(ctx); trailer != nil {
+		*trailer = resp.Trailer
+	}
+	return resp.Data, nil
+}
+
+//探测服务器能力：协议版本、特性位、已注册的path数量及各项限制，用于路由流量前的兼容性检查
+func (m *Client) Probe(ctx context.Context) (*ResponseProbe, error) {
+	conn, err := m.getFreeConnection(PickInfo{})
+	if err != nil {
+		return nil, err
+	}
+	bts, err := m.sysRequest(ctx, conn, PathProbe, []byte("{}"))
+	if err != nil {
+		return nil, err
+	}
+	var resp ResponseProbe
+	if err := json.Unmarshal(bts, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Code != 0 {
+		return nil, fmt.Errorf(resp.Message)
+	}
+	return &resp, nil
 }
 
 //用于于流式请求/响应（用户自己注册处理Handler，每接收到一部分响应数据，系统会调用Handler一次，这个调用是异步的，发送函数立即返回）
 func (m *ClientChannel) DoStreamRequest(path string, requestData []byte) error {
-	if m.internalChannel != nil && m.internalChannel.err != nil {
-		return fmt.Errorf("this channel is invalid, [%s]", m.internalChannel.err.Error())
+	if m.internalChannel != nil {
+		if err := m.internalChannel.errClosed(); err != nil {
+			return err
+		}
 	}
 
 	pkt := &Packet{
@@ -202,6 +465,11 @@ func (m *ClientChannel) Close(err error) {
 	}
 }
 
+//半关闭channel：请求数据已经发送完毕，仍继续接收server的响应，见Channel.CloseSend
+func (m *ClientChannel) CloseSend() error {
+	return m.internalChannel.CloseSend()
+}
+
 //注册Path-Handler
 //iip协议中包含一个path字段，该字段一般用来代表具体的服务器接口和资源
 //client和server通过注册对path的处理函数，以实现基于iip框架的开发
@@ -213,3 +481,18 @@ func (m *Client) RegisterHandler(path string, handler PathHandler) error {
 func (m *Client) UnRegisterHandler(path string) {
 	m.handler.pathHandlerManager.unRegisterHandler(path)
 }
+
+//注册server推送数据的Path-Handler，server通过推送channel发来的数据交由其处理，handler的返回值被忽略
+func (m *Client) RegisterPushHandler(path string, handler PathHandler) error {
+	return m.pushHandler.pathHandlerManager.registerHandler(path, handler)
+}
+
+//取消注册推送数据的Path-Handler
+func (m *Client) UnRegisterPushHandler(path string) {
+	m.pushHandler.pathHandlerManager.unRegisterHandler(path)
+}
+
+//设置channel的截止时间，到达后channel被关闭；零值表示取消截止时间
+func (m *ClientChannel) SetDeadline(t time.Time) {
+	m.internalChannel.SetDeadline(t)
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//channel的关闭确认：一端关闭channel(PathDeleteChannel)或者重置channel(StatusR12)时，对端可能已经发出了该channel的帧。
+//协商FeatureCloseAck之后，收到关闭通知或重置帧的一端回复PathDeleteChannelAck，发起关闭的一端在收到确认
+//(或者逗留期结束)之后才复用本端分配的id，保证对端迟到的帧不会被同id的新channel误收。
+//channel关闭之后的逗留期(ChannelCloseLinger)内，收到的该channel的帧被静默丢弃。
+//新建channel的请求超时之后，发起的一端关闭该channel并发出关闭通知，通知可能先于新建请求被处理：
+//逗留期内对端删除过的id不再按其新建请求创建channel，避免遗留没有对端的channel
+package iip
+
+import (
+	"time"
+)
+
+//channel关闭的默认逗留期
+const DefaultChannelCloseLinger = 5 * time.Second
+
+//设置channel关闭的逗留期，0为DefaultChannelCloseLinger，负数表示不逗留，也不等待关闭确认
+func (m *Connection) setCloseLinger(linger time.Duration) {
+	if linger == 0 {
+		linger = DefaultChannelCloseLinger
+	}
+	if linger < 0 {
+		linger = 0
+	}
+	m.closeLinger = linger
+}
+
+//记录关闭的channel，逗留期内收到的该channel的帧被静默丢弃。调用者持有ChannelsLock
+func (m *Connection) lingerClosed(id uint32) {
+	if m.closeLinger <= 0 {
+		return
+	}
+	if m.closedChannels == nil {
+		m.closedChannels = make(map[uint32]int64)
+	}
+	now := time.Now().UnixNano()
+	m.closedChannels[id] = now
+	//每记录一定数量之后清理逗留期已过的记录
+	m.closedCount++
+	if m.closedCount%1024 == 0 {
+		for k, v := range m.closedChannels {
+			if now-v > int64(m.closeLinger) {
+				delete(m.closedChannels, k)
+			}
+		}
+	}
+}
+
+//channel是否在逗留期内关闭
+func (m *Connection) recentlyClosed(id uint32) bool {
+	m.ChannelsLock.RLock()
+	defer m.ChannelsLock.RUnlock()
+	t, ok := m.closedChannels[id]
+	return ok && time.Now().UnixNano()-t <= int64(m.closeLinger)
+}
+
+//等待对端对id的关闭确认，逗留期结束时视为已确认。调用者持有ChannelsLock
+func (m *Connection) awaitCloseAck(id uint32) {
+	if m.closing == nil {
+		m.closing = make(map[uint32]*time.Timer)
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(m.closeLinger, func() {
+		m.closeAcked(id, timer)
+	})
+	m.closing[id] = timer
+}
+
+//是否须等待对端的关闭确认：本端发起关闭、已协商FeatureCloseAck且有逗留期
+func (m *Connection) closeAckRequired() bool {
+	return m.closeLinger > 0 && m.HasFeature(FeatureCloseAck)
+}
+
+//收到对端的关闭确认，或者等待超时(timer不为nil)
+func (m *Connection) closeAcked(id uint32, timer *time.Timer) {
+	m.ChannelsLock.Lock()
+	defer m.ChannelsLock.Unlock()
+	t, ok := m.closing[id]
+	if !ok || (timer != nil && t != timer) {
+		return
+	}
+	if timer == nil {
+		t.Stop()
+	} else {
+		log.Warnf("close ack of channel %d of %s timeout", id, m.key)
+	}
+	delete(m.closing, id)
+	m.channelIds.release(id)
+}
+
+//回复对端的关闭通知或重置帧。在读循环中调用，写队列满时不等待，对端在逗留期结束后复用id
+func (m *Connection) sendCloseAck(id uint32) {
+	if !m.HasFeature(FeatureCloseAck) {
+		return
+	}
+	pkt := acquirePacket()
+	pkt.Type, pkt.Status, pkt.Path, pkt.ChannelId, pkt.Data = PacketTypeRequest, StatusC1, PathDeleteChannelAck, id, []byte("{}")
+	if m.Role == RoleServer {
+		pkt.Type, pkt.Status = PacketTypeResponse, StatusS5
+	}
+	if err := m.enqueuePacket(pkt, 0, nil); err != nil {
+		pkt.Release()
+		log.Warnf("send close ack of channel %d of %s fail, %s", id, m.key, err.Error())
+	}
+}
+
+//对端删除了本端尚未创建的channel：其新建请求可能仍在0号channel的队列中，逗留期内不再按该id创建channel
+func (m *Connection) cancelChannel(id uint32) {
+	if m.closeLinger <= 0 {
+		return
+	}
+	m.ChannelsLock.Lock()
+	defer m.ChannelsLock.Unlock()
+	if m.cancelled == nil {
+		m.cancelled = make(map[uint32]int64)
+	}
+	now := time.Now().UnixNano()
+	for k, v := range m.cancelled {
+		if now-v > int64(m.closeLinger) {
+			delete(m.cancelled, k)
+		}
+	}
+	m.cancelled[id] = now
+}
+
+//id是否在创建之前被对端删除，是时清除该记录。调用者持有ChannelsLock
+func (m *Connection) cancelledBeforeCreated(id uint32) bool {
+	t, ok := m.cancelled[id]
+	if !ok {
+		return false
+	}
+	delete(m.cancelled, id)
+	return time.Now().UnixNano()-t <= int64(m.closeLinger)
+}
+
+//读循环中收到的帧所属的channel在本端已不存在：双方同时关闭时对端的关闭通知或重置帧同时是对本端的确认，
+//并且对端同样在等待确认；逗留期内已关闭的channel的帧被静默丢弃，其他帧见Connection.unknownChannel
+func (m *Connection) discardFrame(pkt *Packet) {
+	defer pkt.Release()
+	id := pkt.ChannelId
+	if id != 0 && (pkt.Path == PathDeleteChannel || pkt.Status == StatusR12) {
+		if !m.ownsChannelId(id) {
+			m.cancelChannel(id)
+		}
+		m.sendCloseAck(id)
+		m.closeAcked(id, nil)
+		return
+	}
+	if m.recentlyClosed(id) {
+		return
+	}
+	m.unknownChannel(pkt)
+}
@@ -0,0 +1,76 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//新建channel的请求超时，client的关闭通知先于新建请求被server处理：server不应再创建该channel。
+//以-race运行，新建请求阻塞在server的0号channel，关闭通知由读循环处理
+func TestDeleteBeforeNewChannel(t *testing.T) {
+	release := make(chan struct{})
+	var blocked int32
+	var config ServerConfig
+	config.OnNewChannelRequest = func(conn *Connection) error {
+		if atomic.CompareAndSwapInt32(&blocked, 0, 1) {
+			<-release
+		}
+		return nil
+	}
+	server, addr := newTestServer(t, config)
+	var releaseOnce sync.Once
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	defer unblock()
+	client := newTestClient(t, addr, ClientConfig{})
+	if _, err := client.NewChannel(); err == nil {
+		t.Fatal("new channel should time out")
+	}
+	server.connLock.Lock()
+	var conn *Connection
+	for _, v := range server.connections {
+		conn = v
+	}
+	server.connLock.Unlock()
+
+	//等待读循环处理关闭通知，之后放行阻塞的新建请求
+	waitFor(t, "delete_channel handled", func() bool {
+		conn.ChannelsLock.RLock()
+		defer conn.ChannelsLock.RUnlock()
+		return len(conn.cancelled) == 1
+	})
+	unblock()
+	//新建请求被拒绝时清除删除的记录，被接受时创建了没有对端的channel
+	waitFor(t, "new_channel handled", func() bool {
+		conn.ChannelsLock.RLock()
+		defer conn.ChannelsLock.RUnlock()
+		return len(conn.cancelled) == 0 || len(conn.Channels) > 1
+	})
+	if n := len(conn.ChannelsStats()); n != 0 {
+		t.Fatalf("%d channels left on server after the cancelled new_channel", n)
+	}
+
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret, err := channel.DoRequest(testEchoPath, []byte("ok"), time.Second*5); err != nil || string(ret) != "ok" {
+		t.Fatalf("request on the next channel: %q, %v", ret, err)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//关闭连接的原因：握手协商FeatureCloseReason之后，关闭连接的帧Status8之后为4字节的长度及原因(ResponseHandleFail的json，
+//不超过MaxCloseReasonLen字节，长度为0表示没有原因)，不携带元数据、帧序号及校验和，以PSK加密时也不加密。
+//本端以*Error关闭连接时(如ErrConnectionIdle、ErrConnectionMaxAge、违反协议的ErrProtocol、server停止时的ErrShutdown)，
+//在关闭网络连接之前写出携带该错误的关闭帧，最多等待closeFrameTimeout；读写失败或者对端发来的关闭不再回送。
+//对端以该错误码、消息关闭连接及其上的channel，如errors.Is(err, ErrShutdown)，不再只是笼统的"closed by peer command"。
+//未协商时Status8仍只有1个字节
+package iip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+//写出关闭帧的最长等待，包括等待写循环写完正在写出的帧
+const closeFrameTimeout = time.Millisecond * 500
+
+//随关闭帧发给对端的原因：本端产生的*Error，其他错误不发送
+func closeReasonOf(err error) *Error {
+	var e *Error
+	if !errors.As(err, &e) || e.remote {
+		return nil
+	}
+	return e
+}
+
+//编码关闭帧，reason为nil时长度为0
+func appendCloseFrame(dst []byte, reason *Error) []byte {
+	var data []byte
+	if reason != nil {
+		data = ErrorResponse(reason).Data()
+		if len(data) > int(MaxCloseReasonLen) {
+			data = ErrorResponse(&Error{Code: reason.Code, Message: "message too large"}).Data()
+		}
+	}
+	var bt [4]byte
+	binary.BigEndian.PutUint32(bt[:], uint32(len(data)))
+	dst = append(dst, Status8)
+	dst = append(dst, bt[:]...)
+	return append(dst, data...)
+}
+
+//读取关闭帧的原因，pkt.Data为原因的json
+func (m *FrameReader) readCloseReason(pkt *Packet) error {
+	if _, err := io.ReadFull(m.reader, m.btsHeader[:]); err != nil {
+		return readFrameError(err)
+	}
+	n := binary.BigEndian.Uint32(m.btsHeader[:])
+	if n > MaxCloseReasonLen {
+		return protocolError("close reason len %d > %d", n, MaxCloseReasonLen)
+	}
+	if n > 0 {
+		pkt.Data = make([]byte, n)
+		if _, err := io.ReadFull(m.reader, pkt.Data); err != nil {
+			return readFrameError(err)
+		}
+	}
+	m.frameLen += 4 + int(n)
+	return nil
+}
+
+//对端以关闭帧关闭连接时本端的错误，携带原因时为对端的错误码及消息
+func peerCloseError(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("connection closed by peer command")
+	}
+	e := decodeErrorFrame(data)
+	e.Message = "connection closed by peer, " + e.Message
+	return e
+}
+
+//在关闭网络连接之前写出携带reason的关闭帧，写循环正在写出的帧写完之后写出。
+//未协商FeatureCloseReason、reason不是本端产生的*Error或者写出已经失败时不发送，只发送一次
+func (m *Connection) sendCloseFrame(reason error) {
+	e := closeReasonOf(reason)
+	if e == nil || !m.writeFrameFormat().closeReason() {
+		return
+	}
+	//写截止时间同样限制写循环正在进行的写出，对端不读取时不会一直等待
+	m.tcpConn.SetWriteDeadline(time.Now().Add(closeFrameTimeout))
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	if m.writeBroken {
+		return
+	}
+	m.writeBroken = true
+	if _, err := m.tcpConn.Write(appendCloseFrame(nil, e)); err != nil {
+		log.Warnf("close frame of %s not sent, %s", m.key, err.Error())
+	}
+}
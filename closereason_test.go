@@ -0,0 +1,84 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+//建立一个channel，返回server端的连接及client端的channel
+func newCloseReasonTest(t *testing.T) (*Server, *Connection, *ClientChannel) {
+	t.Helper()
+	server, addr := newTestServer(t, ServerConfig{})
+	client := newTestClient(t, addr, ClientConfig{})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := serverConnections(server)
+	if len(conns) != 1 {
+		t.Fatalf("%d server connections", len(conns))
+	}
+	return server, conns[0], channel
+}
+
+//server停止时client的连接及channel以ErrShutdown关闭
+func TestCloseReasonShutdown(t *testing.T) {
+	server, _, channel := newCloseReasonTest(t)
+	conn := channel.internalChannel.conn
+	server.Stop(fmt.Errorf("test stop"))
+	waitFor(t, "client connection closed", conn.isClosed)
+	if err := conn.errClosed(); !errors.Is(err, ErrShutdown) || !errors.Is(err, ErrClosed) {
+		t.Fatalf("connection closed with %v", err)
+	}
+	if _, err := channel.DoRequest(testEchoPath, []byte("x"), time.Second); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("request after shutdown: %v", err)
+	}
+}
+
+//server以*Error关闭连接时client得到同一错误码，其他错误不发送关闭帧
+func TestCloseReasonCodes(t *testing.T) {
+	for _, c := range []struct {
+		reason error
+		want   error
+	}{
+		{ErrConnectionMaxAge, ErrConnectionMaxAge},
+		{ErrConnectionIdle, ErrConnectionIdle},
+		{fmt.Errorf("plain error"), nil},
+	} {
+		_, serverConn, channel := newCloseReasonTest(t)
+		conn := channel.internalChannel.conn
+		serverConn.Close(c.reason)
+		waitFor(t, "client connection closed", conn.isClosed)
+		err := conn.errClosed()
+		if c.want != nil && !errors.Is(err, c.want) {
+			t.Fatalf("closed with %v, expected %v", err, c.want)
+		}
+		//不发送关闭帧，client只看到连接断开
+		if c.want == nil && (!errors.Is(err, io.EOF) || strings.Contains(err.Error(), "plain error")) {
+			t.Fatalf("closed with %v, expected eof without reason", err)
+		}
+	}
+}
+
+//过长的原因只保留错误码
+func TestCloseFrameReasonTooLarge(t *testing.T) {
+	frame := appendCloseFrame(nil, &Error{Code: ErrProtocol.(*Error).Code, Message: strings.Repeat("x", int(MaxCloseReasonLen))})
+	if len(frame) > 5+int(MaxCloseReasonLen) {
+		t.Fatalf("close frame of %d bytes", len(frame))
+	}
+	err := peerCloseError(frame[5:])
+	if !errors.Is(err, ErrProtocol) || !strings.Contains(err.Error(), "message too large") {
+		t.Fatalf("decoded %v", err)
+	}
+	if frame := appendCloseFrame(nil, nil); len(frame) != 5 {
+		t.Fatalf("empty close frame of %d bytes", len(frame))
+	}
+}
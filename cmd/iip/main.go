@@ -0,0 +1,264 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//iip是iip协议的命令行client，类似于curl，用于手工测试及脚本调用iip服务。
+//用法：
+//	iip [flags] addr path
+//	iip 127.0.0.1:9090 /echo -d hello                   发送请求，响应数据原样写到stdout
+//	iip 127.0.0.1:9090 /echo -f body.json               请求数据取自文件，-f -表示取自stdin
+//	iip 127.0.0.1:9090 /event -d x -oneway              发送单向消息
+//	iip 127.0.0.1:9090 /chat -stream                    打开双向流：stdin的每一行作为一条消息发送，收到的每条消息输出为一行，
+//	                                                    stdin结束时半关闭发送方向，对端关闭流之后退出
+//	iip 127.0.0.1:9090 /echo -H traceparent=00-... -d x 携带元数据(可重复)
+//请求失败时错误输出到stderr，退出码为1；server返回的错误输出错误码及消息
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//可重复的-H k=v
+type metaFlag map[string]string
+
+func (m metaFlag) String() string {
+	var ret []string
+	for k, v := range m {
+		ret = append(ret, k+"="+v)
+	}
+	return strings.Join(ret, ",")
+}
+
+func (m metaFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("invalid metadata %q, must be key=value", s)
+	}
+	m[k] = v
+	return nil
+}
+
+var (
+	data       = flag.String("d", "", "request data")
+	file       = flag.String("f", "", "read request data from this file, - for stdin")
+	timeout    = flag.Duration("timeout", 10*time.Second, "timeout of connecting and of the request, 0 for no timeout")
+	oneway     = flag.Bool("oneway", false, "send a one-way message, no response is expected")
+	stream     = flag.Bool("stream", false, "open a bidirectional stream, send stdin line by line and print received messages")
+	useTLS     = flag.Bool("tls", false, "connect with tls")
+	insecure   = flag.Bool("insecure", false, "skip verification of the server certificate")
+	caFile     = flag.String("cacert", "", "pem file of the ca to verify the server certificate")
+	serverName = flag.String("servername", "", "server name to verify, taken from addr if empty")
+	psk        = flag.String("psk", "", "pre-shared key in hex")
+	checksum   = flag.Int("checksum", 0, "frame checksum to propose: 0 none, 1 crc32, 2 crc32c")
+	verbose    = flag.Bool("v", false, "print the log output of iip to stderr")
+	meta       = metaFlag{}
+)
+
+func main() {
+	flag.Var(meta, "H", "request metadata key=value, repeatable")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] addr path\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	//flag在第一个非flag参数处停止解析，允许flag出现在addr path之后
+	flag.Parse()
+	args := flag.Args()
+	var positional []string
+	for len(args) > 0 {
+		positional = append(positional, args[0])
+		flag.CommandLine.Parse(args[1:])
+		args = flag.Args()
+	}
+	if len(positional) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	addr, path := positional[0], positional[1]
+	iip.SetLogger(stderrLogger{verbose: *verbose})
+	client, err := newClient(addr)
+	if err != nil {
+		fatal(err)
+	}
+	defer client.Close()
+	if *stream {
+		err = runStream(client, path)
+	} else {
+		err = request(client, path)
+	}
+	if err != nil {
+		client.Close()
+		fatal(err)
+	}
+}
+
+func newClient(addr string) (*iip.Client, error) {
+	config := iip.ClientConfig{
+		MaxConnections:        1,
+		MaxChannelsPerConn:    10,
+		ChannelPacketQueueLen: 100,
+		TcpWriteQueueLen:      100,
+		TcpConnectTimeout:     *timeout,
+		Checksum:              byte(*checksum),
+	}
+	if *useTLS {
+		config.TLSConfig = &tls.Config{InsecureSkipVerify: *insecure, ServerName: *serverName}
+		if *caFile != "" {
+			pem, err := os.ReadFile(*caFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", *caFile)
+			}
+			config.TLSConfig.RootCAs = pool
+		}
+	}
+	if *psk != "" {
+		key, err := hex.DecodeString(*psk)
+		if err != nil {
+			return nil, fmt.Errorf("invalid psk, %s", err.Error())
+		}
+		config.PSK = key
+	}
+	return iip.NewClient(config, addr)
+}
+
+//请求数据：-f指定的文件或stdin，否则为-d
+func requestData() ([]byte, error) {
+	switch *file {
+	case "":
+		return []byte(*data), nil
+	case "-":
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(*file)
+}
+
+func request(client *iip.Client, path string) error {
+	body, err := requestData()
+	if err != nil {
+		return err
+	}
+	c, err := client.NewChannelFor(path)
+	if err != nil {
+		return err
+	}
+	defer c.Close(nil)
+	if *oneway {
+		return c.Send(path, body)
+	}
+	ctx := context.Background()
+	for k, v := range meta {
+		ctx = iip.WithRequestMeta(ctx, k, v)
+	}
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	resp, err := c.DoRequestContext(ctx, path, body)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(resp)
+	return err
+}
+
+//双向流：-d或-f给出的数据作为首条消息，之后stdin的每一行为一条消息
+func runStream(client *iip.Client, path string) error {
+	s, err := client.NewStream(path)
+	if err != nil {
+		return err
+	}
+	defer s.Close(nil)
+	if *data != "" || *file != "" {
+		body, err := requestData()
+		if err != nil {
+			return err
+		}
+		if err := s.Send(body); err != nil {
+			return err
+		}
+	}
+	go func() {
+		if *file != "-" {
+			scanner := bufio.NewScanner(os.Stdin)
+			scanner.Buffer(make([]byte, 64*1024), int(iip.MaxPacketSize))
+			for scanner.Scan() {
+				if err := s.Send(scanner.Bytes()); err != nil {
+					return
+				}
+			}
+		}
+		s.CloseSend()
+	}()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for {
+		msg, err := s.Recv()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		out.Write(msg)
+		out.WriteByte('\n')
+		out.Flush()
+	}
+}
+
+func fatal(err error) {
+	var iipErr *iip.Error
+	if errors.As(err, &iipErr) {
+		fmt.Fprintf(os.Stderr, "error %d: %s\n", iipErr.Code, iipErr.Message)
+	} else {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	os.Exit(1)
+}
+
+//iip的日志写到stderr，不干扰stdout上的响应；未指定-v时丢弃(连接、channel的关闭等常规日志)
+type stderrLogger struct {
+	verbose bool
+}
+
+func (m stderrLogger) Log(s string) {
+	if m.verbose {
+		fmt.Fprintln(os.Stderr, strings.TrimSuffix(s, "\n"))
+	}
+}
+
+func (m stderrLogger) Logf(format string, args ...interface{}) {
+	m.Log(fmt.Sprintf(format, args...))
+}
+
+func (m stderrLogger) Warn(s string) {
+	m.Log(s)
+}
+
+func (m stderrLogger) Warnf(format string, args ...interface{}) {
+	m.Log(fmt.Sprintf(format, args...))
+}
+
+func (m stderrLogger) Error(s string) {
+	m.Log(s)
+}
+
+func (m stderrLogger) Errorf(format string, args ...interface{}) {
+	m.Log(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//iipbench运行iip的性能基准，或者作为压测工具对server施加负载，报告吞吐量及延迟分位数。
+//用法：
+//	iipbench -suite [-run SmallRPC]                    以testing.Benchmark运行bench包的全部基准
+//	iipbench -addr 127.0.0.1:9090 -c 64 -size 256 -d 30s   对指定的server压测，server须在-path返回响应
+//	iipbench -c 64 -size 256 -d 10s                    对进程内的基准server压测
+//	iipbench -serve 127.0.0.1:9090                     启动基准server(注册/bench/echo及/bench/stream)，供其他机器上的iipbench压测
+//	iipbench -fairness 16                              分别在不开启及开启公平分派(每轮最多16帧)时测量同一连接上channel之间的公平性，见bench.Fairness
+//	iipbench -cumulative 3GB                           在一个流上累计发送3GB，核对两端的字节计数及统计(用于32位平台)，见bench.Cumulative
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/truexf/iip"
+	"github.com/truexf/iip/bench"
+)
+
+var (
+	suite       = flag.Bool("suite", false, "run the benchmark suite of package bench")
+	run         = flag.String("run", "", "only run benchmarks whose name matches this regexp")
+	serve       = flag.String("serve", "", "serve the benchmark server at this address and wait")
+	addr        = flag.String("addr", "", "address of the server to load, load an in-process benchmark server if empty")
+	path        = flag.String("path", bench.EchoPath, "request path")
+	concurrency = flag.Int("c", 16, "concurrent channels")
+	connections = flag.Int("conns", 1, "connections the channels are spread over")
+	size        = flag.Int("size", 64, "request data size in bytes")
+	duration    = flag.Duration("d", 10*time.Second, "load duration")
+	timeout     = flag.Duration("timeout", 5*time.Second, "timeout of each request")
+	jsonOut     = flag.Bool("json", false, "print the load result as json")
+	verbose     = flag.Bool("v", false, "keep the log output of iip")
+	fairness    = flag.Int("fairness", 0, "measure the fairness between channels without and with fair dispatch of this many consecutive frames")
+	cumulative  = flag.String("cumulative", "", "stream this many bytes (e.g. 3GB) over one channel and check the byte counters")
+)
+
+func main() {
+	flag.Parse()
+	if !*verbose {
+		iip.SetLogger(discardLogger{})
+	}
+	if *suite {
+		runSuite()
+		return
+	}
+	if *fairness > 0 {
+		for _, n := range []int{0, *fairness} {
+			result, err := bench.Fairness(bench.FairnessConfig{MaxConsecutiveFrames: n})
+			if err != nil {
+				fatal(err)
+			}
+			fmt.Println(result.String())
+		}
+		return
+	}
+	if *cumulative != "" {
+		total, err := parseSize(*cumulative)
+		if err != nil {
+			fatal(err)
+		}
+		result, err := bench.Cumulative(bench.CumulativeConfig{Total: total})
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(result.String())
+		return
+	}
+	if *serve != "" {
+		lsn, err := net.Listen("tcp", *serve)
+		if err != nil {
+			fatal(err)
+		}
+		if _, err := bench.Serve(lsn); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("benchmark server listening at %s, paths: %s %s\n", lsn.Addr().String(), bench.EchoPath, bench.StreamPath)
+		select {}
+	}
+	target := *addr
+	if target == "" {
+		lsn, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fatal(err)
+		}
+		server, err := bench.Serve(lsn)
+		if err != nil {
+			fatal(err)
+		}
+		defer server.Stop(fmt.Errorf("load finished"))
+		target = lsn.Addr().String()
+	}
+	result, err := bench.Load(bench.LoadConfig{
+		Addr:        target,
+		Path:        *path,
+		Concurrency: *concurrency,
+		Connections: *connections,
+		PayloadSize: *size,
+		Duration:    *duration,
+		Timeout:     *timeout,
+	})
+	if err != nil {
+		fatal(err)
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+		return
+	}
+	fmt.Println(result.String())
+	if result.FirstError != "" {
+		fmt.Printf("first error: %s\n", result.FirstError)
+	}
+}
+
+//以go test -bench的格式输出各基准的结果
+func runSuite() {
+	var re *regexp.Regexp
+	if *run != "" {
+		var err error
+		if re, err = regexp.Compile(*run); err != nil {
+			fatal(err)
+		}
+	}
+	for _, v := range bench.Benchmarks {
+		if re != nil && !re.MatchString(v.Name) {
+			continue
+		}
+		r := testing.Benchmark(v.F)
+		if r.N == 0 {
+			fmt.Printf("Benchmark%s\tFAIL\n", v.Name)
+			continue
+		}
+		fmt.Printf("Benchmark%s\t%s\t%s\n", v.Name, r.String(), r.MemString())
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
+
+//丢弃iip的日志，压测中大量的连接、channel关闭日志影响结果的输出
+type discardLogger struct {
+}
+
+func (m discardLogger) Log(s string)                              {}
+func (m discardLogger) Logf(format string, args ...interface{})   {}
+func (m discardLogger) Warn(s string)                             {}
+func (m discardLogger) Warnf(format string, args ...interface{})  {}
+func (m discardLogger) Error(s string)                            {}
+func (m discardLogger) Errorf(format string, args ...interface{}) {}
+
+//字节数，可以带有KB、MB、GB后缀
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		n      int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+	for _, v := range units {
+		if strings.HasSuffix(strings.ToUpper(s), v.suffix) {
+			n, err := strconv.ParseInt(strings.TrimSpace(s[:len(s)-len(v.suffix)]), 10, 64)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid size %q", s)
+			}
+			return n * v.n, nil
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//iipconform对iip server(任何语言的实现)执行一致性测试，或者输出帧编码的测试向量。
+//用法：
+//	iipconform -addr 127.0.0.1:9090          测试指定的server，被测server须在/conformance/echo注册echo handler
+//	iipconform -serve 127.0.0.1:9090         启动Go的参考server，供其他语言实现的client测试
+//	iipconform                               对进程内的参考server执行用例并检查测试向量及帧状态转换，验证本工具自身
+//	iipconform -vectors > vectors.json       输出测试向量
+//有用例失败时退出码为1
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/truexf/iip/conformance"
+)
+
+var (
+	addr    = flag.String("addr", "", "address of the server under test, run against an in-process reference server if empty")
+	serve   = flag.String("serve", "", "serve the reference server at this address and wait")
+	vectors = flag.Bool("vectors", false, "print the frame test vectors as json and exit")
+	run     = flag.String("run", "", "only run cases whose name matches this regexp")
+	timeout = flag.Duration("timeout", 3*time.Second, "timeout of each read and of waiting for the server to close the connection")
+	verbose = flag.Bool("v", false, "print the description of each case")
+	jsonOut = flag.Bool("json", false, "print results as json")
+)
+
+var exitCode int
+
+func main() {
+	//以defer退出，确保进程内的参考server先被停止
+	defer func() { os.Exit(exitCode) }()
+	flag.Parse()
+	if *vectors {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(conformance.Vectors); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if *serve != "" {
+		lsn, err := net.Listen("tcp", *serve)
+		if err != nil {
+			fatal(err)
+		}
+		if _, err := conformance.ServeReference(lsn); err != nil {
+			fatal(err)
+		}
+		fmt.Printf("reference server listening at %s, echo path: %s\n", lsn.Addr().String(), conformance.EchoPath)
+		select {}
+	}
+	options := conformance.Options{Timeout: *timeout}
+	if *run != "" {
+		re, err := regexp.Compile(*run)
+		if err != nil {
+			fatal(err)
+		}
+		options.Filter = re.MatchString
+	}
+	target := *addr
+	checkVectors := target == ""
+	if target == "" {
+		lsn, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			fatal(err)
+		}
+		server, err := conformance.ServeReference(lsn)
+		if err != nil {
+			fatal(err)
+		}
+		defer server.Stop(fmt.Errorf("conformance finished"))
+		target = lsn.Addr().String()
+	}
+	results := conformance.Run(target, options)
+	var vectorResults, transitionResults []conformance.VectorResult
+	if checkVectors {
+		vectorResults = conformance.VerifyVectors()
+		transitionResults = conformance.VerifyTransitions()
+	}
+	if report(results, vectorResults, transitionResults) > 0 {
+		exitCode = 1
+	}
+}
+
+//输出结果，返回失败的个数
+func report(results []conformance.Result, vectorResults, transitionResults []conformance.VectorResult) int {
+	failed := 0
+	for _, v := range results {
+		if !v.Passed && !v.Skipped {
+			failed++
+		}
+	}
+	for _, v := range append(vectorResults, transitionResults...) {
+		if !v.Passed {
+			failed++
+		}
+	}
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]interface{}{"cases": results, "vectors": vectorResults, "transitions": transitionResults, "failed": failed})
+		return failed
+	}
+	descriptions := make(map[string]string)
+	for _, c := range conformance.Cases {
+		descriptions[c.Name] = c.Description
+	}
+	passed, skipped := 0, 0
+	for _, v := range results {
+		state := "PASS"
+		switch {
+		case v.Passed:
+			passed++
+		case v.Skipped:
+			state = "SKIP"
+			skipped++
+		default:
+			state = "FAIL"
+		}
+		fmt.Printf("%-4s %-22s %8s", state, v.Name, v.Duration.Round(time.Millisecond))
+		if v.Error != "" {
+			fmt.Printf("  %s", v.Error)
+		}
+		fmt.Println()
+		if *verbose {
+			fmt.Printf("     %s\n", descriptions[v.Name])
+		}
+	}
+	fmt.Printf("cases: %d passed, %d skipped, %d failed\n", passed, skipped, len(results)-passed-skipped)
+	if len(vectorResults) > 0 {
+		vectorFailed := 0
+		for _, v := range vectorResults {
+			if !v.Passed {
+				vectorFailed++
+				fmt.Printf("FAIL vector %s  %s\n", v.Name, v.Error)
+			}
+		}
+		fmt.Printf("vectors: %d passed, %d failed\n", len(vectorResults)-vectorFailed, vectorFailed)
+	}
+	if len(transitionResults) > 0 {
+		transitionFailed := 0
+		for _, v := range transitionResults {
+			if !v.Passed {
+				transitionFailed++
+				fmt.Printf("FAIL transition %s  %s\n", v.Name, v.Error)
+			}
+		}
+		fmt.Printf("transitions: %d passed, %d failed\n", len(transitionResults)-transitionFailed, transitionFailed)
+	}
+	return failed
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
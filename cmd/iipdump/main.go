@@ -0,0 +1,230 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//iipdump以可读的文本输出iip的帧，用于排查与其他语言实现之间的互通问题，帧的解析与iip的读循环使用同一份代码。
+//用法：
+//	iipdump -r capture.pcap [-port 9090]   解码pcap文件(tcpdump -w)中的iip连接，按时间顺序输出两个方向的帧
+//	iipdump < stream.bin                   解码stdin中一个方向的字节流
+//数据流以握手开始时，按握手协商的结果(校验算法、元数据、帧序号)解析之后的帧；没有握手的数据流(如抓包开始于连接建立之后)
+//按-checksum、-meta、-seq、-close-reason指定的格式解析。以PSK加密的连接在握手之后无法解码
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//帧格式，对应握手协商的结果
+type frameFormat struct {
+	checksum    byte
+	meta        bool
+	seq         bool
+	closeReason bool
+}
+
+func (m frameFormat) apply(fr *iip.FrameReader) error {
+	fr.SetSequence(m.seq)
+	fr.SetCloseReason(m.closeReason)
+	return fr.SetFormat(m.checksum, m.meta)
+}
+
+//解码的一帧(或者错误)
+type line struct {
+	time time.Time
+	text string
+}
+
+var (
+	pcapFile      = flag.String("r", "", "pcap file to decode, read a raw byte stream from stdin if empty")
+	port          = flag.Int("port", 0, "only decode connections with this tcp port, 0 means all")
+	checksum      = flag.Int("checksum", 0, "frame checksum of streams without handshake: 0 none, 1 crc32, 2 crc32c")
+	meta          = flag.Bool("meta", false, "frames of streams without handshake carry metadata")
+	seq           = flag.Bool("seq", false, "frames of streams without handshake carry sequence numbers")
+	closeReason   = flag.Bool("close-reason", false, "close frames of streams without handshake carry a reason")
+	hexBytes      = flag.Int("hex", 32, "bytes of data to preview in hex, 0 for none")
+	maxPacketSize = flag.Uint("max-packet-size", 0, "max data size of a frame, 0 means default")
+)
+
+func main() {
+	flag.Parse()
+	if *hexBytes == 0 {
+		*hexBytes = -1
+	}
+	dumper := &iip.FrameDumper{Writer: os.Stdout, HexBytes: *hexBytes}
+	defaultFormat := frameFormat{checksum: byte(*checksum), meta: *meta, seq: *seq, closeReason: *closeReason}
+	if err := defaultFormat.apply(iip.NewFrameReader(bytes.NewReader(nil))); err != nil {
+		fatal(err)
+	}
+	if *pcapFile == "" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fatal(err)
+		}
+		f := &flow{data: data}
+		for _, v := range decodeAlone(f, defaultFormat, dumper) {
+			fmt.Println(v.text)
+		}
+		return
+	}
+	file, err := os.Open(*pcapFile)
+	if err != nil {
+		fatal(err)
+	}
+	flows, err := readPcap(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	var lines []line
+	paired := make(map[*flow]bool)
+	for _, f := range flows {
+		if paired[f] || len(f.data) == 0 || !matchPort(f) {
+			continue
+		}
+		var reverse *flow
+		for _, v := range flows {
+			if v.src == f.dst && v.dst == f.src {
+				reverse = v
+				break
+			}
+		}
+		paired[f] = true
+		if reverse != nil {
+			paired[reverse] = true
+		}
+		lines = append(lines, decodeConnection(f, reverse, defaultFormat, dumper)...)
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].time.Before(lines[j].time) })
+	for _, v := range lines {
+		fmt.Printf("%s %s\n", v.time.Format("15:04:05.000000"), v.text)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
+
+func matchPort(f *flow) bool {
+	if *port == 0 {
+		return true
+	}
+	p := strconv.Itoa(*port)
+	for _, addr := range []string{f.src, f.dst} {
+		if _, v, err := net.SplitHostPort(addr); err == nil && v == p {
+			return true
+		}
+	}
+	return false
+}
+
+//以基本格式解析数据流的首帧，是握手请求或者响应时返回该帧
+func handshakeFrame(f *flow) *iip.Packet {
+	if f == nil || len(f.data) == 0 {
+		return nil
+	}
+	pkt, err := iip.ParseFrame(bytes.NewReader(f.data))
+	if err != nil {
+		return nil
+	}
+	if pkt.ChannelId != 0 || pkt.Path != iip.PathHandshake || (pkt.Status != iip.StatusC1 && pkt.Status != iip.StatusS5) {
+		pkt.Release()
+		return nil
+	}
+	return pkt
+}
+
+//握手响应中协商的帧格式，握手失败时为基本格式；sealed表示连接以PSK加密
+func negotiated(resp *iip.Packet) (format frameFormat, sealed bool) {
+	var hs iip.ResponseHandshake
+	if err := json.Unmarshal(resp.Data, &hs); err != nil || hs.Code != 0 {
+		return frameFormat{}, false
+	}
+	format = frameFormat{checksum: hs.Checksum, meta: hs.Features&iip.FeatureMetadata != 0, seq: hs.Features&iip.FeatureSequence != 0,
+		closeReason: hs.Features&iip.FeatureCloseReason != 0}
+	return format, len(hs.Nonce) > 0
+}
+
+//解码一个连接的两个方向，reverse可以为nil
+func decodeConnection(f, reverse *flow, defaultFormat frameFormat, dumper *iip.FrameDumper) []line {
+	var resp *iip.Packet
+	for _, v := range []*flow{f, reverse} {
+		if pkt := handshakeFrame(v); pkt != nil && pkt.Status == iip.StatusS5 {
+			resp = pkt
+		}
+	}
+	if resp == nil {
+		ret := decodeAlone(f, defaultFormat, dumper)
+		if reverse != nil {
+			ret = append(ret, decodeAlone(reverse, defaultFormat, dumper)...)
+		}
+		return ret
+	}
+	format, sealed := negotiated(resp)
+	resp.Release()
+	ret := decodeFlow(f, format, true, sealed, dumper)
+	if reverse != nil {
+		ret = append(ret, decodeFlow(reverse, format, true, sealed, dumper)...)
+	}
+	return ret
+}
+
+//解码没有对端数据的数据流：以握手响应开始时按其协商结果解析，否则按defaultFormat解析
+func decodeAlone(f *flow, defaultFormat frameFormat, dumper *iip.FrameDumper) []line {
+	pkt := handshakeFrame(f)
+	if pkt == nil {
+		return decodeFlow(f, defaultFormat, false, false, dumper)
+	}
+	defer pkt.Release()
+	if pkt.Status == iip.StatusS5 {
+		format, sealed := negotiated(pkt)
+		return decodeFlow(f, format, true, sealed, dumper)
+	}
+	return decodeFlow(f, defaultFormat, true, false, dumper)
+}
+
+//解码数据流，handshake为true时首帧(握手)按基本格式解析，之后按format解析
+func decodeFlow(f *flow, format frameFormat, handshake, sealed bool, dumper *iip.FrameDumper) []line {
+	var ret []line
+	prefix := ""
+	if f.src != "" {
+		prefix = f.src + " -> " + f.dst + " "
+	}
+	fr := iip.NewFrameReader(bytes.NewReader(f.data))
+	fr.SetLimits(uint32(*maxPacketSize), 0)
+	if !handshake {
+		format.apply(fr)
+	}
+	for offset, n := 0, 0; offset < len(f.data); n++ {
+		if sealed && n == 1 {
+			ret = append(ret, line{f.timeAt(offset), fmt.Sprintf("%sencrypted with psk, %d bytes not decoded", prefix, len(f.data)-offset)})
+			break
+		}
+		pkt, err := fr.ReadFrame()
+		if err != nil {
+			ret = append(ret, line{f.timeAt(offset), fmt.Sprintf("%sdecode fail at offset %d, %s", prefix, offset, err.Error())})
+			break
+		}
+		ret = append(ret, line{f.timeAt(offset), prefix + dumper.Format(pkt)})
+		pkt.Release()
+		offset += fr.FrameLen()
+		if handshake && n == 0 {
+			format.apply(fr)
+		}
+	}
+	if len(f.pending) > 0 {
+		ret = append(ret, line{f.timeAt(len(f.data)), fmt.Sprintf("%s%d segments after a gap in the capture not decoded", prefix, len(f.pending))})
+	}
+	return ret
+}
@@ -0,0 +1,237 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//pcap的链路层类型
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+)
+
+//一个方向的tcp数据流，按序号重组
+type flow struct {
+	src, dst string
+	first    time.Time
+	started  bool
+	next     uint32
+	data     []byte
+	marks    []mark             //数据流中各段的起始偏移及抓包时间
+	pending  map[uint32]segment //乱序到达、尚未能拼接的段
+}
+
+type mark struct {
+	offset int
+	time   time.Time
+}
+
+type segment struct {
+	data []byte
+	time time.Time
+}
+
+func (m *flow) add(seq uint32, syn bool, payload []byte, t time.Time) {
+	if syn {
+		m.next, m.started = seq+1, true
+		return
+	}
+	if !m.started {
+		m.next, m.started = seq, true
+	}
+	if len(payload) == 0 {
+		return
+	}
+	if int32(seq-m.next) > 0 {
+		if m.pending == nil {
+			m.pending = make(map[uint32]segment)
+		}
+		m.pending[seq] = segment{append([]byte(nil), payload...), t}
+		return
+	}
+	m.append(seq, payload, t)
+	for progress := true; progress; {
+		progress = false
+		for s, v := range m.pending {
+			if int32(s-m.next) <= 0 {
+				delete(m.pending, s)
+				m.append(s, v.data, v.time)
+				progress = true
+			}
+		}
+	}
+}
+
+//拼接起始序号不晚于next的段，重传的部分被丢弃
+func (m *flow) append(seq uint32, payload []byte, t time.Time) {
+	skip := int(m.next - seq)
+	if skip >= len(payload) {
+		return
+	}
+	m.marks = append(m.marks, mark{len(m.data), t})
+	m.data = append(m.data, payload[skip:]...)
+	m.next += uint32(len(payload) - skip)
+}
+
+//数据流中offset处的字节的抓包时间
+func (m *flow) timeAt(offset int) time.Time {
+	i := sort.Search(len(m.marks), func(i int) bool { return m.marks[i].offset > offset })
+	if i == 0 {
+		return m.first
+	}
+	return m.marks[i-1].time
+}
+
+//读取pcap文件中的tcp数据流，按首次出现的顺序返回
+func readPcap(r io.Reader) ([]*flow, error) {
+	br := bufio.NewReader(r)
+	var hdr [24]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, fmt.Errorf("read pcap header fail, %s", err.Error())
+	}
+	var order binary.ByteOrder
+	nano := false
+	switch binary.LittleEndian.Uint32(hdr[:4]) {
+	case 0xa1b2c3d4:
+		order = binary.LittleEndian
+	case 0xa1b23c4d:
+		order, nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nano = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, fmt.Errorf("pcapng is not supported, convert with: editcap -F pcap in.pcapng out.pcap")
+	default:
+		return nil, fmt.Errorf("invalid pcap magic")
+	}
+	linkType := order.Uint32(hdr[20:24])
+	flows := make(map[string]*flow)
+	var ret []*flow
+	var rec [16]byte
+	for {
+		if _, err := io.ReadFull(br, rec[:]); err != nil {
+			if err == io.EOF {
+				return ret, nil
+			}
+			return ret, fmt.Errorf("read pcap record fail, %s", err.Error())
+		}
+		sec, frac, inclLen := order.Uint32(rec[0:4]), order.Uint32(rec[4:8]), order.Uint32(rec[8:12])
+		if inclLen > 1<<24 {
+			return ret, fmt.Errorf("invalid pcap record length: %d", inclLen)
+		}
+		data := make([]byte, inclLen)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return ret, fmt.Errorf("read pcap record fail, %s", err.Error())
+		}
+		if !nano {
+			frac *= 1000
+		}
+		t := time.Unix(int64(sec), int64(frac))
+		ip, ok := linkPayload(linkType, data, order)
+		if !ok {
+			continue
+		}
+		src, dst, tcp, ok := ipPayload(ip)
+		if !ok || len(tcp) < 20 {
+			continue
+		}
+		dataOffset := int(tcp[12]>>4) * 4
+		if dataOffset < 20 || dataOffset > len(tcp) {
+			continue
+		}
+		srcAddr := net.JoinHostPort(src.String(), strconv.Itoa(int(binary.BigEndian.Uint16(tcp[0:2]))))
+		dstAddr := net.JoinHostPort(dst.String(), strconv.Itoa(int(binary.BigEndian.Uint16(tcp[2:4]))))
+		key := srcAddr + ">" + dstAddr
+		f := flows[key]
+		if f == nil {
+			f = &flow{src: srcAddr, dst: dstAddr, first: t}
+			flows[key] = f
+			ret = append(ret, f)
+		}
+		f.add(binary.BigEndian.Uint32(tcp[4:8]), tcp[13]&0x02 != 0, tcp[dataOffset:], t)
+	}
+}
+
+//链路层帧中的ip包
+func linkPayload(linkType uint32, data []byte, order binary.ByteOrder) ([]byte, bool) {
+	switch linkType {
+	case linkEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType, off := binary.BigEndian.Uint16(data[12:14]), 14
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= off+4 {
+			etherType, off = binary.BigEndian.Uint16(data[off+2:off+4]), off+4
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil, false
+		}
+		return data[off:], true
+	case linkNull:
+		if len(data) < 4 {
+			return nil, false
+		}
+		return data[4:], true
+	case linkRaw, linkIPv4, linkIPv6:
+		return data, true
+	case linkLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		return data[16:], true
+	case linkSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		return data[20:], true
+	}
+	return nil, false
+}
+
+//ip包中的源地址、目的地址及tcp段，不支持分片及ipv6扩展头
+func ipPayload(data []byte) (net.IP, net.IP, []byte, bool) {
+	if len(data) < 1 {
+		return nil, nil, nil, false
+	}
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 || data[9] != 6 {
+			return nil, nil, nil, false
+		}
+		ihl, total := int(data[0]&0x0f)*4, int(binary.BigEndian.Uint16(data[2:4]))
+		if total > len(data) || total == 0 {
+			total = len(data)
+		}
+		if ihl < 20 || ihl > total {
+			return nil, nil, nil, false
+		}
+		return net.IP(data[12:16]), net.IP(data[16:20]), data[ihl:total], true
+	case 6:
+		if len(data) < 40 || data[6] != 6 {
+			return nil, nil, nil, false
+		}
+		end := 40 + int(binary.BigEndian.Uint16(data[4:6]))
+		if end > len(data) {
+			end = len(data)
+		}
+		return net.IP(data[8:24]), net.IP(data[24:40]), data[40:end], true
+	}
+	return nil, nil, nil, false
+}
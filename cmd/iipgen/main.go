@@ -0,0 +1,204 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//iipgen根据Go接口定义生成iip的类型化client桩代码及server注册代码。
+//接口的每个方法须形如 Method(ctx context.Context, req *Req) (*Resp, error)，
+//对应的path为 /<service>/<method>（驼峰转为下划线小写，可用-prefix指定service部分）。
+//用法：在接口所在的文件中添加
+//	//go:generate iipgen -type Greeter
+//生成的代码写入<源文件名>_iip.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+type method struct {
+	Name     string
+	Path     string
+	Request  string
+	Response string
+}
+
+type service struct {
+	Package string
+	Source  string
+	Name    string
+	Imports []string
+	Methods []*method
+}
+
+var tpl = template.Must(template.New("iip").Parse(`// Code generated by iipgen from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"context"
+
+	"github.com/truexf/iip"
+{{- range .Imports}}
+	{{.}}
+{{- end}}
+)
+
+const (
+{{- range .Methods}}
+	{{$.Name}}{{.Name}}Path = "{{.Path}}"
+{{- end}}
+)
+
+//{{.Name}}的client桩
+type {{.Name}}Client struct {
+	channel *iip.ClientChannel
+}
+
+func New{{.Name}}Client(c *iip.ClientChannel) *{{.Name}}Client {
+	return &{{.Name}}Client{channel: c}
+}
+{{range .Methods}}
+func (m *{{$.Name}}Client) {{.Name}}(ctx context.Context, req *{{.Request}}) (*{{.Response}}, error) {
+	return iip.Call[{{.Request}}, {{.Response}}](ctx, m.channel, {{$.Name}}{{.Name}}Path, req)
+}
+{{end}}
+//在server上注册{{.Name}}的全部方法
+func Register{{.Name}}Server(server *iip.Server, impl {{.Name}}) error {
+{{- range .Methods}}
+	if err := iip.RegisterTyped(server, {{$.Name}}{{.Name}}Path, impl.{{.Name}}); err != nil {
+		return err
+	}
+{{- end}}
+	return nil
+}
+`))
+
+func main() {
+	typeName := flag.String("type", "", "service interface name")
+	prefix := flag.String("prefix", "", "path prefix, default /<snake_case(type)>")
+	source := flag.String("file", os.Getenv("GOFILE"), "source file containing the interface, default $GOFILE")
+	output := flag.String("o", "", "output file, default <file>_iip.go")
+	flag.Parse()
+	if *typeName == "" || *source == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output == "" {
+		*output = strings.TrimSuffix(*source, ".go") + "_iip.go"
+	}
+	if *prefix == "" {
+		*prefix = "/" + snakeCase(*typeName)
+	}
+	bts, err := generate(*source, *typeName, strings.TrimSuffix(*prefix, "/"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "iipgen: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*output, bts, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "iipgen: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func generate(source string, typeName string, prefix string) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, source, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	var iface *ast.InterfaceType
+	ast.Inspect(file, func(n ast.Node) bool {
+		if ts, ok := n.(*ast.TypeSpec); ok && ts.Name.Name == typeName {
+			iface, _ = ts.Type.(*ast.InterfaceType)
+			return false
+		}
+		return iface == nil
+	})
+	if iface == nil {
+		return nil, fmt.Errorf("interface %s not found in %s", typeName, source)
+	}
+	svc := &service{Package: file.Name.Name, Source: filepath.Base(source), Name: typeName}
+	usedPkgs := make(map[string]struct{})
+	for _, field := range iface.Methods.List {
+		ft, ok := field.Type.(*ast.FuncType)
+		if !ok || len(field.Names) != 1 {
+			return nil, fmt.Errorf("%s: embedded interfaces are not supported", fset.Position(field.Pos()))
+		}
+		name := field.Names[0].Name
+		if len(ft.Params.List) != 2 || ft.Results == nil || len(ft.Results.List) != 2 || len(ft.Params.List[1].Names) > 1 {
+			return nil, fmt.Errorf("%s: method %s must be func(context.Context, *Req) (*Resp, error)", fset.Position(field.Pos()), name)
+		}
+		req, err := pointerElem(ft.Params.List[1].Type, usedPkgs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: method %s request %s", fset.Position(field.Pos()), name, err.Error())
+		}
+		resp, err := pointerElem(ft.Results.List[0].Type, usedPkgs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: method %s response %s", fset.Position(field.Pos()), name, err.Error())
+		}
+		svc.Methods = append(svc.Methods, &method{Name: name, Path: prefix + "/" + snakeCase(name), Request: req, Response: resp})
+	}
+	for _, imp := range file.Imports {
+		pkgName := strings.Trim(imp.Path.Value, `"`)
+		pkgName = pkgName[strings.LastIndex(pkgName, "/")+1:]
+		if imp.Name != nil {
+			pkgName = imp.Name.Name
+		}
+		if _, ok := usedPkgs[pkgName]; ok {
+			if imp.Name != nil {
+				svc.Imports = append(svc.Imports, imp.Name.Name+" "+imp.Path.Value)
+			} else {
+				svc.Imports = append(svc.Imports, imp.Path.Value)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, svc); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+//*T或*pkg.T，返回T或pkg.T
+func pointerElem(expr ast.Expr, usedPkgs map[string]struct{}) (string, error) {
+	star, ok := expr.(*ast.StarExpr)
+	if !ok {
+		return "", fmt.Errorf("must be a pointer type")
+	}
+	switch t := star.X.(type) {
+	case *ast.Ident:
+		return t.Name, nil
+	case *ast.SelectorExpr:
+		if pkg, ok := t.X.(*ast.Ident); ok {
+			usedPkgs[pkg.Name] = struct{}{}
+			return pkg.Name + "." + t.Sel.Name, nil
+		}
+	}
+	return "", fmt.Errorf("must be a pointer to a named type")
+}
+
+//驼峰转为下划线小写，如SayHello转为say_hello
+func snakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//内置handler的路径
+const (
+	EchoPath  = "/echo"  //原样返回请求数据
+	DelayPath = "/delay" //请求数据为时长(如200ms)，等待该时长之后返回请求数据
+	FilePath  = "/file"  //请求数据为-root之下的相对路径，返回文件内容
+)
+
+//多帧请求合并之后交给fn处理
+type wholeRequest func(c *iip.Channel, data []byte) ([]byte, error)
+
+const ctxRequestData = "/ctx/iipserver/request_data"
+
+func (m wholeRequest) Handle(c *iip.Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	buf, _ := c.GetCtxData(ctxRequestData).([]byte)
+	//data的缓冲区在handler返回后被回收，须拷贝
+	buf = append(buf, data...)
+	if !dataCompleted {
+		c.SetCtxData(ctxRequestData, buf)
+		return nil, iip.ErrPacketContinue
+	}
+	c.RemoveCtxData(ctxRequestData)
+	ret, err := m(c, buf)
+	if err == nil && ret == nil {
+		//nil表示没有响应
+		ret = []byte{}
+	}
+	return ret, err
+}
+
+func echo(c *iip.Channel, data []byte) ([]byte, error) {
+	return data, nil
+}
+
+//等待时长以请求数据指定，不超过maxDelay；handler超时(-handler-timeout)时提前返回
+func delay(maxDelay time.Duration) wholeRequest {
+	return func(c *iip.Channel, data []byte) ([]byte, error) {
+		d, err := time.ParseDuration(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, &iip.Error{Code: 400, Message: fmt.Sprintf("invalid delay %q, %s", string(data), err.Error())}
+		}
+		if d > maxDelay {
+			return nil, &iip.Error{Code: 400, Message: fmt.Sprintf("delay %s exceeds max %s", d.String(), maxDelay.String())}
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.HandlerContext().Done():
+			return nil, c.HandlerContext().Err()
+		}
+		return data, nil
+	}
+}
+
+//返回root之下的文件，不允许访问root之外的路径；文件大小受server的max packet size限制
+func serveFile(root string, maxSize int64) wholeRequest {
+	return func(c *iip.Channel, data []byte) ([]byte, error) {
+		name := filepath.Join(root, filepath.FromSlash(path.Clean("/"+strings.TrimSpace(string(data)))))
+		info, err := os.Stat(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, &iip.Error{Code: 404, Message: fmt.Sprintf("file not found: %s", string(data))}
+			}
+			return nil, &iip.Error{Code: 500, Message: err.Error()}
+		}
+		if info.IsDir() {
+			return nil, &iip.Error{Code: 400, Message: fmt.Sprintf("%s is a directory", string(data))}
+		}
+		if info.Size() > maxSize {
+			return nil, &iip.Error{Code: 413, Message: fmt.Sprintf("file size %d exceeds max packet size %d", info.Size(), maxSize)}
+		}
+		ret, err := os.ReadFile(name)
+		if err != nil {
+			return nil, &iip.Error{Code: 500, Message: err.Error()}
+		}
+		return ret, nil
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//iipserver是内置echo、delay、文件handler的iip server，用作client的冒烟测试对端，也是以ServerOption组装server的示例。
+//用法：
+//	iipserver -addr :9090                                   /echo、/delay
+//	iipserver -addr :9090 -root ./www                       另外以/file提供./www之下的文件
+//	iipserver -tls-cert server.pem -tls-key server.key      TLS，指定-client-ca时要求client证书
+//	iipserver -metrics :6060                                在http://:6060/debug/iip/发布统计数据
+//	iipserver -max-conns 1000 -max-conns-per-ip 10 -accept-rate 100 -idle-timeout 5m
+//请求示例(见cmd/iip)：
+//	iip 127.0.0.1:9090 /echo -d hello
+//	iip 127.0.0.1:9090 /delay -d 200ms
+//	iip 127.0.0.1:9090 /file -d index.html
+//收到SIGINT、SIGTERM时排空连接(GOAWAY)，超过-drain之后退出
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/truexf/iip"
+	"github.com/truexf/iip/debug"
+)
+
+var (
+	addr           = flag.String("addr", ":9090", "listen address")
+	root           = flag.String("root", "", "serve files under this directory at "+FilePath+", disabled if empty")
+	maxDelay       = flag.Duration("max-delay", time.Minute, "max delay of "+DelayPath)
+	handlerTimeout = flag.Duration("handler-timeout", 0, "timeout of each handler call, 0 for no timeout")
+	tlsCert        = flag.String("tls-cert", "", "pem file of the server certificate, enables tls")
+	tlsKey         = flag.String("tls-key", "", "pem file of the server private key")
+	clientCA       = flag.String("client-ca", "", "pem file of the ca to verify client certificates, requires client certificates")
+	psk            = flag.String("psk", "", "pre-shared key in hex, encrypts connections with aes-256-gcm")
+	maxConns       = flag.Int("max-conns", 10000, "max concurrent connections, 0 for no limit")
+	maxChannels    = flag.Int("max-channels", 1000, "max channels per connection, 0 for no limit")
+	maxConnsPerIP  = flag.Int("max-conns-per-ip", 0, "max concurrent connections per remote ip, 0 for no limit")
+	acceptRate     = flag.Float64("accept-rate", 0, "max accepted connections per second, 0 for no limit")
+	idleTimeout    = flag.Duration("idle-timeout", 0, "close connections idle for this long, 0 for never")
+	maxPacketSize  = flag.Uint("max-packet-size", 0, "max packet size in bytes, 0 for the default 16MB")
+	workers        = flag.Int("workers", 0, "handle requests in a pool of this many workers, 0 for a goroutine per channel")
+	eventLoops     = flag.Int("event-loops", 0, "serve channels on this many shared goroutines instead of a goroutine per channel, 0 for off")
+	sysEndpoints   = flag.Bool("sys", false, "enable the /sys/stats and /sys/channels management paths")
+	metrics        = flag.String("metrics", "", "serve statistics over http at this address under /debug/iip/")
+	accessLog      = flag.Bool("access-log", false, "print an access log line (json) for each request")
+	drain          = flag.Duration("drain", 10*time.Second, "grace period of draining connections on SIGINT, SIGTERM")
+	quiet          = flag.Bool("q", false, "discard the log output of iip")
+)
+
+func main() {
+	flag.Parse()
+	opts, err := serverOptions()
+	if err != nil {
+		fatal(err)
+	}
+	if *quiet {
+		opts = append(opts, iip.WithLogger(discardLogger{}))
+	}
+	server, err := iip.NewServer(iip.ServerConfig{ChannelPacketQueueLen: 1000, TcpWriteQueueLen: 1000}, *addr, opts...)
+	if err != nil {
+		fatal(err)
+	}
+	if err := registerHandlers(server); err != nil {
+		fatal(err)
+	}
+	if *metrics != "" {
+		debug.AddServer("iipserver", server)
+		go func() {
+			if err := http.ListenAndServe(*metrics, nil); err != nil {
+				fatal(err)
+			}
+		}()
+	}
+	if err := server.StartListen(); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("iipserver listening at %s\n", *addr)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	fmt.Printf("draining connections, at most %s\n", drain.String())
+	server.Drain(*drain)
+}
+
+//将命令行参数转换为ServerOption
+func serverOptions() ([]iip.ServerOption, error) {
+	opts := []iip.ServerOption{
+		iip.WithMaxConnections(*maxConns),
+		iip.WithMaxChannelsPerConn(*maxChannels),
+		iip.WithMaxConnectionsPerIP(*maxConnsPerIP),
+		iip.WithIdleTimeout(*idleTimeout),
+	}
+	if *acceptRate > 0 {
+		opts = append(opts, iip.WithAcceptRate(*acceptRate, 0))
+	}
+	if *maxPacketSize > 0 {
+		opts = append(opts, iip.WithMaxPacketSize(uint32(*maxPacketSize)))
+	}
+	if *workers > 0 {
+		opts = append(opts, iip.WithWorkers(*workers, *workers*100))
+	}
+	if *eventLoops > 0 {
+		opts = append(opts, iip.WithEventLoops(*eventLoops))
+	}
+	if *sysEndpoints {
+		opts = append(opts, iip.WithSysEndpoints(nil))
+	}
+	if *accessLog {
+		enc := json.NewEncoder(os.Stdout)
+		opts = append(opts, iip.WithAccessLog(func(entry *iip.AccessLogEntry) { enc.Encode(entry) }))
+	}
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if *clientCA != "" {
+			pem, err := os.ReadFile(*clientCA)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in %s", *clientCA)
+			}
+			tlsConfig.ClientCAs, tlsConfig.ClientAuth = pool, tls.RequireAndVerifyClientCert
+		}
+		opts = append(opts, iip.WithTLS(tlsConfig))
+	}
+	if *psk != "" {
+		key, err := hex.DecodeString(*psk)
+		if err != nil {
+			return nil, fmt.Errorf("invalid psk, %s", err.Error())
+		}
+		opts = append(opts, iip.WithPSK(key))
+	}
+	return opts, nil
+}
+
+func registerHandlers(server *iip.Server) error {
+	handlers := map[string]iip.PathHandler{
+		EchoPath:  wholeRequest(echo),
+		DelayPath: delay(*maxDelay),
+	}
+	if *root != "" {
+		maxSize := int64(iip.MaxPacketSize)
+		if *maxPacketSize > 0 && int64(*maxPacketSize) < maxSize {
+			maxSize = int64(*maxPacketSize)
+		}
+		handlers[FilePath] = serveFile(*root, maxSize)
+	}
+	for path, handler := range handlers {
+		if *handlerTimeout > 0 {
+			handler = iip.NewTimeoutHandler(handler, *handlerTimeout)
+		}
+		if err := server.RegisterHandler(path, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
+
+type discardLogger struct {
+}
+
+func (m discardLogger) Log(s string)                              {}
+func (m discardLogger) Logf(format string, args ...interface{})   {}
+func (m discardLogger) Warn(s string)                             {}
+func (m discardLogger) Warnf(format string, args ...interface{})  {}
+func (m discardLogger) Error(s string)                            {}
+func (m discardLogger) Errorf(format string, args ...interface{}) {}
@@ -0,0 +1,155 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//类型化的请求/响应：通过Codec自动完成请求、响应与Packet.Data之间的编解码。
+//client使用Call发起请求，server使用RegisterTyped注册处理函数，双方须使用相同的Codec(ClientConfig.Codec/ServerConfig.Codec，默认JSONCodec)。
+//成功的响应以1字节typedResponseOK开头，其后为编码后的响应；失败的响应经错误帧返回，对端不支持错误帧时为ResponseHandleFail的json，
+//均由Call转换为*Error返回
+package iip
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+)
+
+//编解码器
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSONCodec   Codec = jsonCodec{}
+	BinaryCodec Codec = binaryCodec{} //用于实现了encoding.BinaryMarshaler/BinaryUnmarshaler的类型
+)
+
+const typedResponseOK byte = 0
+
+//分片到达的类型化请求在channel上下文中累积，直至数据完整
+const ctxTypedRequest = "/ctx/sys/typed_request"
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(encoding.BinaryMarshaler); ok {
+		return m.MarshalBinary()
+	}
+	return nil, fmt.Errorf("%T does not implement encoding.BinaryMarshaler", v)
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return m.UnmarshalBinary(data)
+	}
+	return fmt.Errorf("%T does not implement encoding.BinaryUnmarshaler", v)
+}
+
+func codecOrDefault(codec Codec) Codec {
+	if codec == nil {
+		return JSONCodec
+	}
+	return codec
+}
+
+type channelCtxKey struct{}
+
+//类型化处理函数的ctx中携带的channel
+func ChannelFromContext(ctx context.Context) *Channel {
+	c, _ := ctx.Value(channelCtxKey{}).(*Channel)
+	return c
+}
+
+//类型化的请求/响应，使用client配置的Codec编码请求并解码响应
+func Call[TReq any, TResp any](ctx context.Context, c *ClientChannel, path string, req *TReq) (*TResp, error) {
+	codec := codecOrDefault(c.client.config.Codec)
+	data, err := codec.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request fail, %s", err.Error())
+	}
+	bts, err := c.DoRequestContext(ctx, path, data)
+	if err != nil {
+		return nil, err
+	}
+	//错误通常经错误帧以*Error返回，对端不支持错误帧时为ResponseHandleFail的json
+	if len(bts) > 0 && bts[0] == typedResponseOK {
+		ret := new(TResp)
+		if err := codec.Unmarshal(bts[1:], ret); err != nil {
+			return nil, fmt.Errorf("unmarshal response fail, %s", err.Error())
+		}
+		return ret, nil
+	}
+	var fail ResponseHandleFail
+	if err := json.Unmarshal(bts, &fail); err != nil || fail.Code == 0 {
+		return nil, fmt.Errorf("invalid typed response")
+	}
+	return nil, &Error{Code: fail.Code, Message: fail.Message}
+}
+
+//将类型化的处理函数适配为PathHandler。fn返回*Error时，其Code、Message原样返回给Call的调用者
+func NewTypedHandler[TReq any, TResp any](codec Codec, fn func(ctx context.Context, req *TReq) (*TResp, error)) PathHandler {
+	return &typedHandler[TReq, TResp]{codec: codecOrDefault(codec), fn: fn}
+}
+
+//在server上注册类型化的处理函数，使用server配置的Codec
+func RegisterTyped[TReq any, TResp any](server *Server, path string, fn func(ctx context.Context, req *TReq) (*TResp, error)) error {
+	return server.RegisterHandler(path, NewTypedHandler(server.getConfig().Codec, fn))
+}
+
+type typedHandler[TReq any, TResp any] struct {
+	codec Codec
+	fn    func(ctx context.Context, req *TReq) (*TResp, error)
+}
+
+func (m *typedHandler[TReq, TResp]) Handle(c *Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	if buf, ok := c.GetCtxData(ctxTypedRequest).([]byte); ok || !dataCompleted {
+		if exceedsBuffered(len(buf), len(data)) {
+			//未配置MaxRequestSize时的兜底，见sizes.go
+			c.RemoveCtxData(ctxTypedRequest)
+			c.reject(path, ErrRequestTooLarge.(*Error))
+			return nil, ErrPacketContinue
+		}
+		//开启RecycleRequests时data的缓冲区在handler返回后被回收，须拷贝
+		buf = append(buf, data...)
+		if !dataCompleted {
+			c.SetCtxData(ctxTypedRequest, buf)
+			return nil, ErrPacketContinue
+		}
+		c.RemoveCtxData(ctxTypedRequest)
+		data = buf
+	}
+	req := new(TReq)
+	if err := m.codec.Unmarshal(data, req); err != nil {
+		return nil, &Error{Code: -1, Message: "invalid request, " + err.Error()}
+	}
+	resp, err := m.fn(c.HandlerContext(), req)
+	if err != nil {
+		return nil, err
+	}
+	bts, err := m.codec.Marshal(resp)
+	if err != nil {
+		return nil, fmt.Errorf("marshal response fail, %s", err.Error())
+	}
+	return append([]byte{typedResponseOK}, bts...), nil
+}
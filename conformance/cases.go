@@ -0,0 +1,615 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package conformance
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/truexf/iip"
+)
+
+//全部用例，依赖握手特性的用例在server不同意该特性时跳过。client新建的channel使用奇数id
+var Cases = []Case{
+	{"handshake", "handshake without features returns code 0 and limits not larger than requested", caseHandshake},
+	{"handshake-limits", "negotiated limits are the smaller of both sides", caseHandshakeLimits},
+	{"no-handshake", "a connection works without handshake, using the basic frame format", caseNoHandshake},
+	{"new-channel", "new channel with an odd id is accepted", caseNewChannel},
+	{"new-channel-legacy", "new channel without channel_id (old clients) gets an id allocated by the server in order from 1", caseNewChannelLegacy},
+	{"new-channel-invalid", "new channel with id 0 or an id in use is rejected with a non-zero code", caseNewChannelInvalid},
+	{"echo", "single frame request gets the echoed response", caseEcho},
+	{"echo-multi-frame", "request of several frames (C0, C2, C3) is merged before handling", caseEchoMultiFrame},
+	{"echo-large", "256KB request in 16KB frames", caseEchoLarge},
+	{"sequential-requests", "several requests one after another on one channel", caseSequentialRequests},
+	{"interleaved-channels", "frames of requests on different channels may interleave", caseInterleavedChannels},
+	{"delete-channel", "channel id can be reused after delete_channel", caseDeleteChannel},
+	{"close-ack", "with close ack negotiated, delete_channel is acknowledged on the channel", caseCloseAck},
+	{"delete-before-new-channel", "delete_channel arriving before new_channel of the same id cancels it, the next id still opens", caseDeleteBeforeNewChannel},
+	{"unknown-path", "request to a path without handler gets a response with a non-zero code", caseUnknownPath},
+	{"unknown-channel", "frame on a channel that is not open does not break the connection", caseUnknownChannel},
+	{"unknown-channel-reset", "with reset negotiated, frame on a channel that is not open gets a reset frame", caseUnknownChannelReset},
+	{"error-frame", "with error frames negotiated, request to an unknown path gets an S11 error frame", caseErrorFrame},
+	{"metadata", "with metadata negotiated, frames carry a metadata block", caseMetadata},
+	{"checksum-crc32", "with crc32 negotiated, frames carry a checksum", caseChecksum(iip.ChecksumCRC32)},
+	{"checksum-crc32c", "with crc32c negotiated, frames carry a checksum", caseChecksum(iip.ChecksumCRC32C)},
+	{"checksum-mismatch", "frame with a wrong checksum closes the connection", caseChecksumMismatch},
+	{"sequence", "with sequence numbers negotiated, both sides number frames per channel", caseSequence},
+	{"sequence-mismatch", "frame with a wrong sequence number closes the connection", caseSequenceMismatch},
+	{"empty-data", "with empty data negotiated, requests and responses may have empty data", caseEmptyData},
+	{"one-way", "one-way message gets no response", caseOneWay},
+	{"reset", "reset frame removes the channel, its id can be reused", caseReset},
+	{"invalid-status", "frame with an unknown status closes the connection", caseInvalidStatus},
+	{"bad-status-order", "continuation frame without a first frame closes the connection", caseBadStatusOrder},
+	{"path-too-long", "path longer than max_path_len closes the connection", casePathTooLong},
+	{"data-too-large", "data length larger than max_packet_size closes the connection", caseDataTooLarge},
+	{"close-command", "status 8 closes the connection", caseCloseCommand},
+	{"close-reason", "with close reason negotiated, a protocol violation closes the connection with a status 8 carrying a non-zero code", caseCloseReason},
+}
+
+func caseHandshake(t *Tester) error {
+	resp, err := t.Handshake(iip.RequestHandshake{})
+	if err != nil {
+		return err
+	}
+	if resp.Version == 0 {
+		return fmt.Errorf("handshake response without version")
+	}
+	if resp.MaxPacketSize == 0 || resp.MaxPacketSize > iip.MaxPacketSize || resp.MaxPathLen == 0 || resp.MaxPathLen > iip.MaxPathLen {
+		return fmt.Errorf("invalid limits, max_packet_size: %d, max_path_len: %d", resp.MaxPacketSize, resp.MaxPathLen)
+	}
+	if resp.Features != 0 || resp.Checksum != 0 {
+		return fmt.Errorf("server enabled features or checksum not requested")
+	}
+	return openEcho(t)
+}
+
+func caseHandshakeLimits(t *Tester) error {
+	resp, err := t.Handshake(iip.RequestHandshake{MaxPacketSize: 64 * 1024, MaxPathLen: 100})
+	if err != nil {
+		return err
+	}
+	if resp.MaxPacketSize > 64*1024 || resp.MaxPathLen > 100 {
+		return fmt.Errorf("limits larger than requested, max_packet_size: %d, max_path_len: %d", resp.MaxPacketSize, resp.MaxPathLen)
+	}
+	return openEcho(t)
+}
+
+func caseNoHandshake(t *Tester) error {
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	return t.Echo(1, []byte("hello"), 0)
+}
+
+func caseNewChannel(t *Tester) error {
+	if _, err := t.Handshake(iip.RequestHandshake{}); err != nil {
+		return err
+	}
+	for _, id := range []uint32{1, 3, 101} {
+		if err := t.OpenChannel(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func caseNewChannelLegacy(t *Tester) error {
+	if err := t.Send(&Frame{Status: iip.StatusC1, Path: iip.PathNewChannel, Data: []byte("{}")}); err != nil {
+		return err
+	}
+	f, err := t.RecvChannel(0)
+	if err != nil {
+		return err
+	}
+	var resp iip.ResponseNewChannel
+	if err := json.Unmarshal(f.Data, &resp); err != nil {
+		return fmt.Errorf("invalid new channel response, %s", err.Error())
+	}
+	if resp.Code != 0 || resp.ChannelId != 1 {
+		return fmt.Errorf("new channel without id fail, code: %d, channel id: %d, message: %s", resp.Code, resp.ChannelId, resp.Message)
+	}
+	return t.Echo(1, []byte("hello"), 0)
+}
+
+func caseNewChannelInvalid(t *Tester) error {
+	if _, err := t.Handshake(iip.RequestHandshake{}); err != nil {
+		return err
+	}
+	resp, err := t.NewChannel(0)
+	if err != nil {
+		return err
+	}
+	if resp.Code == 0 {
+		return fmt.Errorf("new channel with id 0 accepted")
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	if resp, err = t.NewChannel(1); err != nil {
+		return err
+	}
+	if resp.Code == 0 {
+		return fmt.Errorf("new channel with an id in use accepted")
+	}
+	return t.Echo(1, []byte("hello"), 0)
+}
+
+func caseEcho(t *Tester) error {
+	if _, err := t.Handshake(iip.RequestHandshake{}); err != nil {
+		return err
+	}
+	return openEcho(t)
+}
+
+//新建1号channel并完成一次echo
+func openEcho(t *Tester) error {
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	return t.Echo(1, []byte("hello"), 0)
+}
+
+func caseEchoMultiFrame(t *Tester) error {
+	if _, err := t.Handshake(iip.RequestHandshake{}); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	if err := t.Echo(1, []byte("0123456789abcdefghij"), 7); err != nil {
+		return err
+	}
+	//两帧：C0 + C3
+	return t.Echo(1, []byte("first,second"), 6)
+}
+
+func caseEchoLarge(t *Tester) error {
+	if _, err := t.Handshake(iip.RequestHandshake{}); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return t.Echo(1, data, 16*1024)
+}
+
+func caseSequentialRequests(t *Tester) error {
+	if _, err := t.Handshake(iip.RequestHandshake{}); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	for i := 0; i < 5; i++ {
+		if err := t.Echo(1, []byte(fmt.Sprintf("request %d", i)), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func caseInterleavedChannels(t *Tester) error {
+	if _, err := t.Handshake(iip.RequestHandshake{}); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(3); err != nil {
+		return err
+	}
+	a := RequestFrames(1, EchoPath, []byte("aaaaaaaaaa"), 5)
+	b := RequestFrames(3, EchoPath, []byte("bbbbbbbbbb"), 5)
+	if err := t.Send(a[0], b[0], b[1], a[1]); err != nil {
+		return err
+	}
+	for _, v := range []struct {
+		id   uint32
+		data string
+	}{{1, "aaaaaaaaaa"}, {3, "bbbbbbbbbb"}} {
+		resp, _, err := t.RecvResponse(v.id)
+		if err != nil {
+			return err
+		}
+		if string(resp) != v.data {
+			return fmt.Errorf("echo mismatch on channel %d: %q", v.id, resp)
+		}
+	}
+	return nil
+}
+
+func caseDeleteChannel(t *Tester) error {
+	if _, err := t.Handshake(iip.RequestHandshake{}); err != nil {
+		return err
+	}
+	if err := openEcho(t); err != nil {
+		return err
+	}
+	//未协商FeatureCloseAck时delete_channel没有响应，发出之后即可复用该id
+	if err := t.Send(&Frame{Status: iip.StatusC1, Path: iip.PathDeleteChannel, ChannelId: 1, Data: []byte("{}")}); err != nil {
+		return err
+	}
+	return openEcho(t)
+}
+
+func caseCloseAck(t *Tester) error {
+	if err := t.HandshakeFeature(iip.FeatureCloseAck); err != nil {
+		return err
+	}
+	if err := openEcho(t); err != nil {
+		return err
+	}
+	if err := t.Send(&Frame{Status: iip.StatusC1, Path: iip.PathDeleteChannel, ChannelId: 1, Data: []byte("{}")}); err != nil {
+		return err
+	}
+	f, err := t.RecvChannel(1)
+	if err != nil {
+		return err
+	}
+	if f.Path != iip.PathDeleteChannelAck {
+		return fmt.Errorf("expect close ack, got status: %d, path: %s", f.Status, f.Path)
+	}
+	return openEcho(t)
+}
+
+//新建channel的请求超时之后client发出关闭通知，通知可能先于新建请求被server处理：该id不应再被创建
+func caseDeleteBeforeNewChannel(t *Tester) error {
+	if _, err := t.Handshake(iip.RequestHandshake{}); err != nil {
+		return err
+	}
+	if err := t.Send(&Frame{Status: iip.StatusC1, Path: iip.PathDeleteChannel, ChannelId: 3, Data: []byte("{}")}); err != nil {
+		return err
+	}
+	resp, err := t.NewChannel(3)
+	if err != nil {
+		return err
+	}
+	if resp.Code == 0 {
+		return fmt.Errorf("new channel with an id deleted before accepted")
+	}
+	return openEcho(t)
+}
+
+//错误响应：普通响应数据或者错误帧，均为{"code":..,"message":..}
+func errorResponse(data []byte) (*iip.ResponseHandleFail, error) {
+	var ret iip.ResponseHandleFail
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, fmt.Errorf("invalid error response %q, %s", data, err.Error())
+	}
+	if ret.Code == 0 {
+		return nil, fmt.Errorf("error response with code 0")
+	}
+	return &ret, nil
+}
+
+func caseUnknownPath(t *Tester) error {
+	if _, err := t.Handshake(iip.RequestHandshake{}); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	resp, last, err := t.Request(1, "/conformance/no-such-path", []byte("x"), 0)
+	if err != nil {
+		return err
+	}
+	if last.Status == iip.StatusS11 {
+		return fmt.Errorf("error frame without error frame negotiated")
+	}
+	if _, err := errorResponse(resp); err != nil {
+		return err
+	}
+	return t.Echo(1, []byte("after error"), 0)
+}
+
+func caseUnknownChannel(t *Tester) error {
+	if _, err := t.Handshake(iip.RequestHandshake{}); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	if err := t.Send(&Frame{Status: iip.StatusC1, Path: EchoPath, ChannelId: 99, Data: []byte("x")}); err != nil {
+		return err
+	}
+	//server可以丢弃该帧，也可以重置该channel，但不能响应或者关闭连接
+	if err := t.Echo(1, []byte("hello"), 0); err != nil {
+		return err
+	}
+	for _, f := range t.pending {
+		if f.ChannelId == 99 && f.Status != iip.StatusR12 {
+			return fmt.Errorf("unexpected frame on a channel not open, status: %d", f.Status)
+		}
+	}
+	return nil
+}
+
+func caseUnknownChannelReset(t *Tester) error {
+	if err := t.HandshakeFeature(iip.FeatureReset); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	if err := t.Send(&Frame{Status: iip.StatusC1, Path: EchoPath, ChannelId: 99, Data: []byte("x")}); err != nil {
+		return err
+	}
+	f, err := t.RecvChannel(99)
+	if err != nil {
+		return err
+	}
+	if f.Status != iip.StatusR12 {
+		return fmt.Errorf("expect reset frame, got status: %d", f.Status)
+	}
+	if _, err := errorResponse(f.Data); err != nil {
+		return err
+	}
+	return t.Echo(1, []byte("hello"), 0)
+}
+
+func caseErrorFrame(t *Tester) error {
+	if err := t.HandshakeFeature(iip.FeatureErrorFrame); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	resp, last, err := t.Request(1, "/conformance/no-such-path", []byte("x"), 0)
+	if err != nil {
+		return err
+	}
+	if last.Status != iip.StatusS11 {
+		return fmt.Errorf("expect error frame, got status %d", last.Status)
+	}
+	if _, err := errorResponse(resp); err != nil {
+		return err
+	}
+	return t.Echo(1, []byte("after error"), 0)
+}
+
+func caseMetadata(t *Tester) error {
+	if err := t.HandshakeFeature(iip.FeatureMetadata); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	frames := RequestFrames(1, EchoPath, []byte("hello metadata"), 5)
+	frames[0].Meta = map[string]string{iip.MetaRequestId: "conformance-1", "k": strings.Repeat("v", 300)}
+	if err := t.Send(frames...); err != nil {
+		return err
+	}
+	resp, last, err := t.RecvResponse(1)
+	if err != nil {
+		return err
+	}
+	if last.Status == iip.StatusS11 || string(resp) != "hello metadata" {
+		return fmt.Errorf("echo mismatch: %q", resp)
+	}
+	return nil
+}
+
+func caseChecksum(checksum byte) func(t *Tester) error {
+	return func(t *Tester) error {
+		resp, err := t.Handshake(iip.RequestHandshake{Checksum: checksum})
+		if err != nil {
+			return err
+		}
+		if resp.Checksum == iip.ChecksumNone {
+			return Skip("checksum %d not supported", checksum)
+		}
+		if resp.Checksum != checksum {
+			return fmt.Errorf("server chose checksum %d, requested %d", resp.Checksum, checksum)
+		}
+		if err := t.OpenChannel(1); err != nil {
+			return err
+		}
+		return t.Echo(1, []byte("checksummed"), 4)
+	}
+}
+
+func caseChecksumMismatch(t *Tester) error {
+	resp, err := t.Handshake(iip.RequestHandshake{Checksum: iip.ChecksumCRC32})
+	if err != nil {
+		return err
+	}
+	if resp.Checksum == iip.ChecksumNone {
+		return Skip("checksum not supported")
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	frame := Encode(&Frame{Status: iip.StatusC1, Path: EchoPath, ChannelId: 1, Data: []byte("hello")}, t.format)
+	frame[len(frame)-1] ^= 0xff
+	if err := t.SendRaw(frame); err != nil {
+		return err
+	}
+	return t.ExpectClosed()
+}
+
+func caseSequence(t *Tester) error {
+	if err := t.HandshakeFeature(iip.FeatureSequence); err != nil {
+		return err
+	}
+	//Tester按channel为发出的帧编号，并校验server发出的帧序号
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(3); err != nil {
+		return err
+	}
+	for _, id := range []uint32{1, 3, 1} {
+		if err := t.Echo(id, []byte("sequenced request"), 5); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func caseSequenceMismatch(t *Tester) error {
+	if err := t.HandshakeFeature(iip.FeatureSequence); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	if err := t.Echo(1, []byte("hello"), 0); err != nil {
+		return err
+	}
+	//重复上一帧的序号
+	t.writeSeq[1]--
+	if err := t.Send(&Frame{Status: iip.StatusC1, Path: EchoPath, ChannelId: 1, Data: []byte("dup")}); err != nil {
+		return err
+	}
+	return t.ExpectClosed()
+}
+
+func caseEmptyData(t *Tester) error {
+	if err := t.HandshakeFeature(iip.FeatureEmptyData); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	if err := t.Echo(1, nil, 0); err != nil {
+		return err
+	}
+	//多帧请求的结束帧为空
+	if err := t.Send(&Frame{Status: iip.StatusC0, Path: EchoPath, ChannelId: 1, Data: []byte("hello")}, &Frame{Status: iip.StatusC3, Path: EchoPath, ChannelId: 1}); err != nil {
+		return err
+	}
+	resp, _, err := t.RecvResponse(1)
+	if err != nil {
+		return err
+	}
+	if string(resp) != "hello" {
+		return fmt.Errorf("echo mismatch, sent 5 bytes, received %d bytes", len(resp))
+	}
+	return nil
+}
+
+func caseOneWay(t *Tester) error {
+	if err := t.HandshakeFeature(iip.FeatureOneWay); err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	if err := t.Send(&Frame{Status: iip.StatusO13, Path: EchoPath, ChannelId: 1, Data: []byte("one-way")}); err != nil {
+		return err
+	}
+	//紧随其后的请求的响应必须是该channel上的第一帧
+	return t.Echo(1, []byte("request"), 0)
+}
+
+func caseReset(t *Tester) error {
+	if err := t.HandshakeFeature(iip.FeatureReset); err != nil {
+		return err
+	}
+	if err := openEcho(t); err != nil {
+		return err
+	}
+	data, _ := json.Marshal(&iip.ResponseHandleFail{Code: -1, Message: "conformance reset"})
+	if err := t.Send(&Frame{Status: iip.StatusR12, ChannelId: 1, Data: data}); err != nil {
+		return err
+	}
+	return openEcho(t)
+}
+
+func caseInvalidStatus(t *Tester) error {
+	if err := caseEcho(t); err != nil {
+		return err
+	}
+	frame := Encode(&Frame{Status: iip.StatusC1, Path: EchoPath, ChannelId: 1, Data: []byte("x")}, t.format)
+	frame[0] = 99
+	if err := t.SendRaw(frame); err != nil {
+		return err
+	}
+	return t.ExpectClosed()
+}
+
+func caseBadStatusOrder(t *Tester) error {
+	if err := caseEcho(t); err != nil {
+		return err
+	}
+	if err := t.Send(&Frame{Status: iip.StatusC3, Path: EchoPath, ChannelId: 1, Data: []byte("x")}); err != nil {
+		return err
+	}
+	return t.ExpectClosed()
+}
+
+func casePathTooLong(t *Tester) error {
+	resp, err := t.Handshake(iip.RequestHandshake{MaxPathLen: 64})
+	if err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	path := "/" + strings.Repeat("p", int(resp.MaxPathLen))
+	if err := t.Send(&Frame{Status: iip.StatusC1, Path: path, ChannelId: 1, Data: []byte("x")}); err != nil {
+		return err
+	}
+	return t.ExpectClosed()
+}
+
+func caseDataTooLarge(t *Tester) error {
+	resp, err := t.Handshake(iip.RequestHandshake{MaxPacketSize: 4096})
+	if err != nil {
+		return err
+	}
+	if err := t.OpenChannel(1); err != nil {
+		return err
+	}
+	//只发送帧头，server应在读取数据之前按长度拒绝
+	frame := Encode(&Frame{Status: iip.StatusC1, Path: EchoPath, ChannelId: 1}, t.format)
+	binary.BigEndian.PutUint32(frame[len(frame)-4:], resp.MaxPacketSize+1)
+	if err := t.SendRaw(frame); err != nil {
+		return err
+	}
+	return t.ExpectClosed()
+}
+
+func caseCloseCommand(t *Tester) error {
+	if err := caseEcho(t); err != nil {
+		return err
+	}
+	if err := t.Send(&Frame{Status: iip.Status8}); err != nil {
+		return err
+	}
+	return t.ExpectClosed()
+}
+
+func caseCloseReason(t *Tester) error {
+	if err := t.HandshakeFeature(iip.FeatureCloseReason); err != nil {
+		return err
+	}
+	if err := openEcho(t); err != nil {
+		return err
+	}
+	if err := t.Send(&Frame{Status: iip.StatusC3, Path: EchoPath, ChannelId: 1, Data: []byte("x")}); err != nil {
+		return err
+	}
+	for {
+		f, err := t.read()
+		if err != nil {
+			return fmt.Errorf("connection closed without a close frame, %s", err.Error())
+		}
+		if f.Status != iip.Status8 {
+			continue
+		}
+		if len(f.Data) == 0 {
+			return fmt.Errorf("close frame without reason")
+		}
+		_, err = errorResponse(f.Data)
+		return err
+	}
+}
@@ -0,0 +1,484 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//conformance是iip协议的一致性测试：以TCP连接被测的server(任何语言的实现)，逐个执行脚本化的帧序列(合法及非法)，
+//检查server的响应以及应当关闭连接时的行为；Vectors是帧编码的测试向量，可用于验证其他语言实现的帧解析器。
+//被测的server须在EchoPath注册一个原样返回请求数据(多帧请求合并之后)的handler，Go的参考实现见ServeReference。
+//命令行工具见cmd/iipconform：
+//	iipconform -addr 127.0.0.1:9090     测试指定的server
+//	iipconform -vectors > vectors.json  输出测试向量
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//被测server须注册的echo路径
+const EchoPath = "/conformance/echo"
+
+//帧格式，对应握手协商的结果
+type Format struct {
+	Checksum    byte `json:"checksum,omitempty"`     //0无校验，1为crc32 IEEE，2为crc32 Castagnoli
+	Meta        bool `json:"meta,omitempty"`         //携带元数据块(features & 64)
+	Seq         bool `json:"seq,omitempty"`          //携带帧序号(features & 16384)
+	CloseReason bool `json:"close_reason,omitempty"` //关闭连接的帧携带原因(features & 131072)
+}
+
+//一帧
+type Frame struct {
+	Status    byte              `json:"status"`
+	Path      string            `json:"path,omitempty"`
+	ChannelId uint32            `json:"channel_id"`
+	Seq       uint32            `json:"seq,omitempty"`
+	Meta      map[string]string `json:"meta,omitempty"`
+	Data      []byte            `json:"data,omitempty"`
+}
+
+//按格式编码一帧，元数据按key排序；Status8只有1个字节，携带原因时其后为4字节的长度及Data
+func Encode(f *Frame, format Format) []byte {
+	var bt [4]byte
+	if f.Status == iip.Status8 {
+		if !format.CloseReason {
+			return []byte{iip.Status8}
+		}
+		binary.BigEndian.PutUint32(bt[:], uint32(len(f.Data)))
+		return append(append([]byte{iip.Status8}, bt[:]...), f.Data...)
+	}
+	ret := append([]byte{f.Status}, f.Path...)
+	ret = append(ret, 0)
+	if format.Meta {
+		keys := make([]string, 0, len(f.Meta))
+		for k := range f.Meta {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var meta []byte
+		for _, k := range keys {
+			meta = append(meta, byte(len(k)))
+			meta = append(meta, k...)
+			binary.BigEndian.PutUint16(bt[:2], uint16(len(f.Meta[k])))
+			meta = append(meta, bt[:2]...)
+			meta = append(meta, f.Meta[k]...)
+		}
+		binary.BigEndian.PutUint16(bt[:2], uint16(len(meta)))
+		ret = append(ret, bt[:2]...)
+		ret = append(ret, meta...)
+	}
+	binary.BigEndian.PutUint32(bt[:], f.ChannelId)
+	ret = append(ret, bt[:]...)
+	if format.Seq {
+		binary.BigEndian.PutUint32(bt[:], f.Seq)
+		ret = append(ret, bt[:]...)
+	}
+	binary.BigEndian.PutUint32(bt[:], uint32(len(f.Data)))
+	ret = append(ret, bt[:]...)
+	ret = append(ret, f.Data...)
+	if table := checksumTable(format.Checksum); table != nil {
+		binary.BigEndian.PutUint32(bt[:], crc32.Checksum(ret, table))
+		ret = append(ret, bt[:]...)
+	}
+	return ret
+}
+
+func checksumTable(checksum byte) *crc32.Table {
+	switch checksum {
+	case iip.ChecksumCRC32:
+		return crc32.IEEETable
+	case iip.ChecksumCRC32C:
+		return crc32.MakeTable(crc32.Castagnoli)
+	}
+	return nil
+}
+
+//以格式配置iip的帧解析器
+func newFrameReader(r io.Reader, format Format) (*iip.FrameReader, error) {
+	ret := iip.NewFrameReader(r)
+	ret.SetSequence(format.Seq)
+	ret.SetCloseReason(format.CloseReason)
+	return ret, ret.SetFormat(format.Checksum, format.Meta)
+}
+
+func frameOf(pkt *iip.Packet) *Frame {
+	ret := &Frame{Status: pkt.Status, Path: pkt.Path, ChannelId: pkt.ChannelId, Seq: pkt.Seq, Meta: pkt.Meta}
+	if len(pkt.Data) > 0 {
+		ret.Data = append([]byte(nil), pkt.Data...)
+	}
+	pkt.Release()
+	return ret
+}
+
+//一个用例
+type Case struct {
+	Name        string
+	Description string
+	Run         func(t *Tester) error
+}
+
+//用例的结果
+type Result struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Skipped  bool          `json:"skipped,omitempty"` //server未在握手中同意用例依赖的特性
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type skipError struct {
+	reason string
+}
+
+func (m *skipError) Error() string {
+	return m.reason
+}
+
+//用例因server不支持依赖的特性而跳过
+func Skip(format string, args ...interface{}) error {
+	return &skipError{fmt.Sprintf(format, args...)}
+}
+
+type Options struct {
+	Timeout time.Duration          //每次读取响应、等待连接关闭的超时，默认3秒
+	Filter  func(name string) bool //只执行返回true的用例，nil表示全部
+}
+
+//对addr上的server执行全部用例，每个用例使用新的连接
+func Run(addr string, options Options) []Result {
+	if options.Timeout <= 0 {
+		options.Timeout = time.Second * 3
+	}
+	var ret []Result
+	for _, c := range Cases {
+		if options.Filter != nil && !options.Filter(c.Name) {
+			continue
+		}
+		ret = append(ret, RunCase(addr, c, options.Timeout))
+	}
+	return ret
+}
+
+//执行一个用例
+func RunCase(addr string, c Case, timeout time.Duration) Result {
+	start := time.Now()
+	ret := Result{Name: c.Name}
+	t, err := Dial(addr, timeout)
+	if err == nil {
+		err = c.Run(t)
+		t.Close()
+	}
+	ret.Duration = time.Since(start)
+	var skip *skipError
+	switch {
+	case err == nil:
+		ret.Passed = true
+	case errors.As(err, &skip):
+		ret.Skipped, ret.Error = true, err.Error()
+	default:
+		ret.Error = err.Error()
+	}
+	return ret
+}
+
+//连接被测server的测试端，扮演client
+type Tester struct {
+	conn     net.Conn
+	source   *connReader
+	reader   *iip.FrameReader
+	format   Format
+	timeout  time.Duration
+	writeSeq map[uint32]uint32
+	readSeq  map[uint32]uint32
+	pending  []*Frame //读取某个channel的帧时先到达的其他channel的帧
+	features uint32   //握手协商生效的特性
+	limits   iip.ResponseHandshake
+}
+
+func Dial(addr string, timeout time.Duration) (*Tester, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Tester{conn: conn, source: &connReader{conn: conn}, timeout: timeout, writeSeq: make(map[uint32]uint32), readSeq: make(map[uint32]uint32)}
+	ret.reader, _ = newFrameReader(ret.source, Format{})
+	return ret, nil
+}
+
+//记录连接最近一次的读错误，帧解析器返回的错误不保留底层错误的类型
+type connReader struct {
+	conn net.Conn
+	err  error
+}
+
+func (m *connReader) Read(p []byte) (int, error) {
+	n, err := m.conn.Read(p)
+	if err != nil {
+		m.err = err
+	}
+	return n, err
+}
+
+func (m *Tester) Close() error {
+	return m.conn.Close()
+}
+
+//握手协商生效的特性
+func (m *Tester) Features() uint32 {
+	return m.features
+}
+
+//设置此后收发帧的格式
+func (m *Tester) SetFormat(format Format) error {
+	m.format = format
+	m.reader.SetSequence(format.Seq)
+	m.reader.SetCloseReason(format.CloseReason)
+	return m.reader.SetFormat(format.Checksum, format.Meta)
+}
+
+//按当前格式发送帧，协商了帧序号时按channel分配序号
+func (m *Tester) Send(frames ...*Frame) error {
+	var buf []byte
+	for _, f := range frames {
+		if m.format.Seq && f.Status != iip.Status8 {
+			f.Seq = m.writeSeq[f.ChannelId]
+			m.writeSeq[f.ChannelId]++
+		}
+		buf = append(buf, Encode(f, m.format)...)
+	}
+	return m.SendRaw(buf)
+}
+
+//发送原始字节
+func (m *Tester) SendRaw(data []byte) error {
+	m.conn.SetWriteDeadline(time.Now().Add(m.timeout))
+	_, err := m.conn.Write(data)
+	return err
+}
+
+//读取下一帧，协商了帧序号时校验server发出的序号
+func (m *Tester) Recv() (*Frame, error) {
+	if len(m.pending) > 0 {
+		ret := m.pending[0]
+		m.pending = m.pending[1:]
+		return ret, nil
+	}
+	return m.read()
+}
+
+func (m *Tester) read() (*Frame, error) {
+	m.conn.SetReadDeadline(time.Now().Add(m.timeout))
+	pkt, err := m.reader.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	ret := frameOf(pkt)
+	if m.format.Seq && ret.Status != iip.Status8 {
+		if expected := m.readSeq[ret.ChannelId]; ret.Seq != expected {
+			return nil, fmt.Errorf("server frame sequence mismatch, channel id: %d, expected: %d, got: %d", ret.ChannelId, expected, ret.Seq)
+		}
+		m.readSeq[ret.ChannelId]++
+	}
+	return ret, nil
+}
+
+//读取channelId上的下一帧，其他channel的帧留给之后的读取
+func (m *Tester) RecvChannel(channelId uint32) (*Frame, error) {
+	for i, f := range m.pending {
+		if f.ChannelId == channelId {
+			m.pending = append(m.pending[:i], m.pending[i+1:]...)
+			return f, nil
+		}
+	}
+	for {
+		f, err := m.read()
+		if err != nil {
+			return nil, err
+		}
+		if f.ChannelId == channelId {
+			return f, nil
+		}
+		m.pending = append(m.pending, f)
+	}
+}
+
+//以基本格式发送握手请求，成功时按响应切换帧格式
+func (m *Tester) Handshake(req iip.RequestHandshake) (*iip.ResponseHandshake, error) {
+	if req.Version == 0 {
+		req.Version = iip.ProtocolVersion
+	}
+	if req.MaxPacketSize == 0 {
+		req.MaxPacketSize = iip.MaxPacketSize
+	}
+	if req.MaxPathLen == 0 {
+		req.MaxPathLen = iip.MaxPathLen
+	}
+	data, _ := json.Marshal(&req)
+	if err := m.Send(&Frame{Status: iip.StatusC1, Path: iip.PathHandshake, Data: data}); err != nil {
+		return nil, err
+	}
+	f, err := m.RecvChannel(0)
+	if err != nil {
+		return nil, fmt.Errorf("read handshake response fail, %s", err.Error())
+	}
+	if f.Status != iip.StatusS5 || f.Path != iip.PathHandshake {
+		return nil, fmt.Errorf("unexpected handshake response, status: %d, path: %s", f.Status, f.Path)
+	}
+	var resp iip.ResponseHandshake
+	if err := json.Unmarshal(f.Data, &resp); err != nil {
+		return nil, fmt.Errorf("invalid handshake response, %s", err.Error())
+	}
+	if resp.Code != 0 {
+		return &resp, fmt.Errorf("handshake fail, code: %d, message: %s", resp.Code, resp.Message)
+	}
+	if req.Features&resp.Features != resp.Features {
+		return &resp, fmt.Errorf("server granted features not requested: %d", resp.Features&^req.Features)
+	}
+	m.features, m.limits = resp.Features, resp
+	err = m.SetFormat(Format{Checksum: resp.Checksum, Meta: resp.Features&iip.FeatureMetadata != 0, Seq: resp.Features&iip.FeatureSequence != 0,
+		CloseReason: resp.Features&iip.FeatureCloseReason != 0})
+	return &resp, err
+}
+
+//握手并要求server同意feature，不同意时跳过用例
+func (m *Tester) HandshakeFeature(feature uint32) error {
+	if _, err := m.Handshake(iip.RequestHandshake{Features: feature}); err != nil {
+		return err
+	}
+	if m.features&feature == 0 {
+		return Skip("feature %d not supported", feature)
+	}
+	return nil
+}
+
+//在0号channel上请求新建channel
+func (m *Tester) NewChannel(id uint32) (*iip.ResponseNewChannel, error) {
+	data, _ := json.Marshal(&iip.RequestNewChannel{ChannelId: id})
+	if err := m.Send(&Frame{Status: iip.StatusC1, Path: iip.PathNewChannel, Data: data}); err != nil {
+		return nil, err
+	}
+	f, err := m.RecvChannel(0)
+	if err != nil {
+		return nil, fmt.Errorf("read new channel response fail, %s", err.Error())
+	}
+	if f.Status != iip.StatusS5 {
+		return nil, fmt.Errorf("unexpected new channel response status: %d", f.Status)
+	}
+	var resp iip.ResponseNewChannel
+	if err := json.Unmarshal(f.Data, &resp); err != nil {
+		return nil, fmt.Errorf("invalid new channel response, %s", err.Error())
+	}
+	return &resp, nil
+}
+
+//新建channel，失败时返回错误
+func (m *Tester) OpenChannel(id uint32) error {
+	resp, err := m.NewChannel(id)
+	if err != nil {
+		return err
+	}
+	if resp.Code != 0 || resp.ChannelId != id {
+		return fmt.Errorf("new channel %d fail, code: %d, message: %s", id, resp.Code, resp.Message)
+	}
+	return nil
+}
+
+//将请求按frameSize分帧，frameSize<=0时为单帧
+func RequestFrames(channelId uint32, path string, data []byte, frameSize int) []*Frame {
+	if frameSize <= 0 || len(data) <= frameSize {
+		return []*Frame{{Status: iip.StatusC1, Path: path, ChannelId: channelId, Data: data}}
+	}
+	var ret []*Frame
+	for len(data) > 0 {
+		n := frameSize
+		if n > len(data) {
+			n = len(data)
+		}
+		status := iip.StatusC2
+		if len(ret) == 0 {
+			status = iip.StatusC0
+		}
+		ret = append(ret, &Frame{Status: status, Path: path, ChannelId: channelId, Data: data[:n]})
+		data = data[n:]
+	}
+	if last := ret[len(ret)-1]; last.Status == iip.StatusC0 {
+		last.Status = iip.StatusC1
+	} else {
+		last.Status = iip.StatusC3
+	}
+	return ret
+}
+
+//读取channel上的一个完整响应，返回合并的数据及结束帧(S5、S7或者错误帧S11)
+func (m *Tester) RecvResponse(channelId uint32) ([]byte, *Frame, error) {
+	var ret []byte
+	for first := true; ; first = false {
+		f, err := m.RecvChannel(channelId)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read response fail, %s", err.Error())
+		}
+		switch {
+		case f.Status == iip.StatusS11 && first:
+			return f.Data, f, nil
+		case (f.Status == iip.StatusS4 || f.Status == iip.StatusS5) && first,
+			(f.Status == iip.StatusS6 || f.Status == iip.StatusS7) && !first:
+			ret = append(ret, f.Data...)
+			if f.Status == iip.StatusS5 || f.Status == iip.StatusS7 {
+				return ret, f, nil
+			}
+		default:
+			return nil, nil, fmt.Errorf("unexpected response frame, status: %d, channel id: %d", f.Status, channelId)
+		}
+	}
+}
+
+//发送请求(按frameSize分帧)并读取完整的响应
+func (m *Tester) Request(channelId uint32, path string, data []byte, frameSize int) ([]byte, *Frame, error) {
+	if err := m.Send(RequestFrames(channelId, path, data, frameSize)...); err != nil {
+		return nil, nil, err
+	}
+	return m.RecvResponse(channelId)
+}
+
+//发送请求到EchoPath，检查响应与请求相同
+func (m *Tester) Echo(channelId uint32, data []byte, frameSize int) error {
+	resp, last, err := m.Request(channelId, EchoPath, data, frameSize)
+	if err != nil {
+		return err
+	}
+	if last.Status == iip.StatusS11 {
+		return fmt.Errorf("echo fail, error frame: %s", string(resp))
+	}
+	if !bytes.Equal(resp, data) {
+		return fmt.Errorf("echo mismatch, sent %d bytes, received %d bytes", len(data), len(resp))
+	}
+	return nil
+}
+
+//等待server关闭连接：读到EOF(或连接被重置)、或者收到Status8
+func (m *Tester) ExpectClosed() error {
+	deadline := time.Now().Add(m.timeout)
+	for time.Now().Before(deadline) {
+		f, err := m.read()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(m.source.err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil
+		}
+		if f.Status == iip.Status8 {
+			return nil
+		}
+	}
+	return fmt.Errorf("connection not closed by server")
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package conformance
+
+import (
+	"net"
+
+	"github.com/truexf/iip"
+)
+
+//参考实现的配置，连接及channel的队列足以容纳全部用例
+var ReferenceConfig = iip.ServerConfig{
+	MaxConnections:        1000,
+	MaxChannelsPerConn:    1000,
+	ChannelPacketQueueLen: 1000,
+	TcpWriteQueueLen:      1000,
+	TcpReadBufferSize:     1 << 20,
+	TcpWriteBufferSize:    1 << 20,
+}
+
+//在EchoPath注册echo handler的Go参考server，在lsn上accept，用于验证用例本身或者作为其他语言实现的client的对端
+func ServeReference(lsn net.Listener) (*iip.Server, error) {
+	server, err := iip.NewServer(ReferenceConfig, lsn.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	if err := server.RegisterHandler(EchoPath, &echoHandler{}); err != nil {
+		return nil, err
+	}
+	server.Serve(lsn)
+	return server, nil
+}
+
+const ctxEchoRequest = "/ctx/conformance/echo_request"
+
+//原样返回请求数据；单向消息的返回值被server丢弃
+type echoHandler struct {
+}
+
+func (m *echoHandler) Handle(c *iip.Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	buf, _ := c.GetCtxData(ctxEchoRequest).([]byte)
+	//data的缓冲区在handler返回后被回收，须拷贝
+	buf = append(buf, data...)
+	if !dataCompleted {
+		c.SetCtxData(ctxEchoRequest, buf)
+		return nil, iip.ErrPacketContinue
+	}
+	c.RemoveCtxData(ctxEchoRequest)
+	if buf == nil {
+		//空请求的响应同样为空，nil表示没有响应
+		buf = []byte{}
+	}
+	return buf, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package conformance
+
+import (
+	"fmt"
+
+	"github.com/truexf/iip"
+)
+
+//帧状态转换的测试项：channel上一个方向相邻两帧的状态及其是否合法。
+//请求方向由server校验client发来的帧，响应方向由client校验server发来的帧；Prev为255表示Current是channel上的第一帧。
+//重置(R12)、单向消息(O13)由读循环单独处理，不属于任何方向的状态转换，在这里总是非法
+type Transition struct {
+	Direction string `json:"direction"` //request或response
+	Prev      byte   `json:"prev"`
+	Current   byte   `json:"current"`
+	Valid     bool   `json:"valid"`
+}
+
+func (m *Transition) Name() string {
+	return fmt.Sprintf("%s-%d-%d", m.Direction, m.Prev, m.Current)
+}
+
+//一个方向的规则：首帧在空闲时合法，后续帧在消息进行中合法，半关闭之后没有合法的数据帧
+type direction struct {
+	name      string
+	first     []byte //首帧，完成的首帧之后仍为空闲
+	completed []byte //完成请求/响应的状态
+	cont      []byte //后续帧
+	halfClose byte
+}
+
+var directions = []direction{
+	{"request", []byte{iip.StatusC0, iip.StatusC1}, []byte{iip.StatusC1, iip.StatusC3}, []byte{iip.StatusC2, iip.StatusC3}, iip.StatusC9},
+	{"response", []byte{iip.StatusS4, iip.StatusS5, iip.StatusS11}, []byte{iip.StatusS5, iip.StatusS7, iip.StatusS11}, []byte{iip.StatusS6, iip.StatusS7}, iip.StatusS10},
+}
+
+func contains(s []byte, v byte) bool {
+	for _, b := range s {
+		if b == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *direction) valid(prev, current byte) bool {
+	if current == iip.Status8 {
+		return true
+	}
+	idle := prev == 255 || contains(m.completed, prev)
+	active := (contains(m.first, prev) || contains(m.cont, prev)) && !contains(m.completed, prev)
+	switch {
+	case contains(m.first, current), current == m.halfClose:
+		return idle
+	case contains(m.cont, current):
+		return active
+	}
+	return false
+}
+
+//两个方向上全部状态(0~13及一个未定义的状态99)两两组合的转换
+var Transitions = func() []*Transition {
+	statuses := []byte{255}
+	for i := iip.StatusC0; i <= iip.StatusO13; i++ {
+		statuses = append(statuses, i)
+	}
+	statuses = append(statuses, 99)
+	var ret []*Transition
+	for _, d := range directions {
+		for _, prev := range statuses {
+			for _, current := range statuses[1:] {
+				ret = append(ret, &Transition{Direction: d.name, Prev: prev, Current: current, Valid: d.valid(prev, current)})
+			}
+		}
+	}
+	return ret
+}()
+
+//以iip的CheckClientPacketStatus、CheckServerPacketStatus检查全部状态转换
+func VerifyTransitions() []VectorResult {
+	ret := make([]VectorResult, 0, len(Transitions))
+	for _, v := range Transitions {
+		check := iip.CheckClientPacketStatus
+		if v.Direction == "response" {
+			check = iip.CheckServerPacketStatus
+		}
+		r := VectorResult{Name: v.Name(), Passed: true}
+		err := check(v.Prev, v.Current)
+		if v.Valid && err != nil {
+			r.Passed, r.Error = false, err.Error()
+		} else if !v.Valid && err == nil {
+			r.Passed, r.Error = false, "invalid transition accepted"
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/truexf/iip"
+)
+
+//帧编码的测试向量：合法的向量给出编码及解析的结果，非法的向量应被解析器拒绝。
+//长度限制为默认值(max_packet_size 16MB，max_path_len 512)
+type Vector struct {
+	Name   string `json:"name"`
+	Format Format `json:"format"`
+	Hex    string `json:"hex"`
+	Valid  bool   `json:"valid"`
+	Frame  *Frame `json:"frame,omitempty"` //合法向量解析的结果
+}
+
+func validVector(name string, format Format, f *Frame) *Vector {
+	return &Vector{Name: name, Format: format, Hex: hex.EncodeToString(Encode(f, format)), Valid: true, Frame: f}
+}
+
+//在合法帧的编码上修改得到的非法向量
+func invalidVector(name string, format Format, f *Frame, modify func(b []byte) []byte) *Vector {
+	return &Vector{Name: name, Format: format, Hex: hex.EncodeToString(modify(Encode(f, format)))}
+}
+
+func errorData(code int, message string) []byte {
+	ret, _ := json.Marshal(&iip.ResponseHandleFail{Code: code, Message: message})
+	return ret
+}
+
+var Vectors = func() []*Vector {
+	echo := func(status byte, data string) *Frame {
+		return &Frame{Status: status, Path: EchoPath, ChannelId: 1, Data: []byte(data)}
+	}
+	same := func(b []byte) []byte { return b }
+	return []*Vector{
+		validVector("request", Format{}, echo(iip.StatusC1, "hello")),
+		validVector("request-first-frame", Format{}, echo(iip.StatusC0, "hel")),
+		validVector("request-continuation-without-path", Format{}, &Frame{Status: iip.StatusC3, ChannelId: 1, Data: []byte("lo")}),
+		validVector("response", Format{}, &Frame{Status: iip.StatusS5, Path: EchoPath, ChannelId: 1, Data: []byte("hello")}),
+		validVector("response-end-empty", Format{}, &Frame{Status: iip.StatusS7, ChannelId: 1}),
+		validVector("system-request-channel-0", Format{}, &Frame{Status: iip.StatusC1, Path: iip.PathNewChannel, Data: []byte(`{"channel_id":1}`)}),
+		validVector("close-connection", Format{}, &Frame{Status: iip.Status8}),
+		validVector("close-connection-reason", Format{CloseReason: true}, &Frame{Status: iip.Status8, Data: errorData(133, "server shutting down")}),
+		validVector("close-connection-without-reason", Format{CloseReason: true}, &Frame{Status: iip.Status8}),
+		validVector("half-close", Format{}, &Frame{Status: iip.StatusC9, ChannelId: 1}),
+		validVector("error-frame", Format{}, &Frame{Status: iip.StatusS11, Path: EchoPath, ChannelId: 1, Data: errorData(116, "no handler")}),
+		validVector("reset", Format{}, &Frame{Status: iip.StatusR12, ChannelId: 1, Data: errorData(-1, "reset")}),
+		validVector("one-way", Format{}, echo(iip.StatusO13, "event")),
+		validVector("request-empty-data", Format{}, echo(iip.StatusC1, "")), //连接上须协商features & 65536
+		validVector("large-channel-id", Format{}, &Frame{Status: iip.StatusC1, Path: EchoPath, ChannelId: 0xfffffffd, Data: []byte{0, 1, 2, 0xff}}),
+		validVector("metadata", Format{Meta: true}, &Frame{Status: iip.StatusC1, Path: EchoPath, ChannelId: 1, Meta: map[string]string{"request-id": "r1", "traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}, Data: []byte("hello")}),
+		validVector("metadata-empty", Format{Meta: true}, echo(iip.StatusC1, "hello")),
+		validVector("metadata-empty-value", Format{Meta: true}, &Frame{Status: iip.StatusC1, Path: EchoPath, ChannelId: 1, Meta: map[string]string{"k": ""}, Data: []byte("hello")}),
+		validVector("checksum-crc32", Format{Checksum: iip.ChecksumCRC32}, echo(iip.StatusC1, "hello")),
+		validVector("checksum-crc32c", Format{Checksum: iip.ChecksumCRC32C}, echo(iip.StatusC1, "hello")),
+		validVector("sequence", Format{Seq: true}, &Frame{Status: iip.StatusC1, Path: EchoPath, ChannelId: 1, Seq: 7, Data: []byte("hello")}),
+		validVector("all-options", Format{Checksum: iip.ChecksumCRC32C, Meta: true, Seq: true}, &Frame{Status: iip.StatusS5, Path: EchoPath, ChannelId: 3, Seq: 42, Meta: map[string]string{"k": "v"}, Data: []byte("hello")}),
+		invalidVector("status-out-of-range", Format{}, echo(iip.StatusC1, "hello"), func(b []byte) []byte { b[0] = 14; return b }),
+		invalidVector("truncated-header", Format{}, echo(iip.StatusC1, "hello"), func(b []byte) []byte { return b[:len(b)-9] }),
+		invalidVector("truncated-data", Format{}, echo(iip.StatusC1, "hello"), func(b []byte) []byte { return b[:len(b)-1] }),
+		invalidVector("path-without-terminator", Format{}, echo(iip.StatusC1, "hello"), func(b []byte) []byte { return b[:1+len(EchoPath)] }),
+		invalidVector("path-too-long", Format{}, &Frame{Status: iip.StatusC1, Path: "/" + strings.Repeat("p", int(iip.MaxPathLen)), ChannelId: 1, Data: []byte("x")}, same),
+		invalidVector("data-too-large", Format{}, echo(iip.StatusC1, ""), func(b []byte) []byte {
+			copy(b[len(b)-4:], []byte{0x01, 0x00, 0x00, 0x01})
+			return b
+		}),
+		invalidVector("close-reason-too-long", Format{CloseReason: true}, &Frame{Status: iip.Status8, Data: []byte("x")}, func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[1:5], iip.MaxCloseReasonLen+1)
+			return b
+		}),
+		invalidVector("half-close-with-data", Format{}, &Frame{Status: iip.StatusC9, ChannelId: 1, Data: []byte("x")}, same),
+		invalidVector("half-close-with-path", Format{}, &Frame{Status: iip.StatusC9, Path: EchoPath, ChannelId: 1}, same),
+		invalidVector("checksum-mismatch", Format{Checksum: iip.ChecksumCRC32}, echo(iip.StatusC1, "hello"), func(b []byte) []byte { b[len(b)-5] ^= 1; return b }),
+		invalidVector("metadata-truncated", Format{Meta: true}, &Frame{Status: iip.StatusC1, Path: EchoPath, ChannelId: 1, Meta: map[string]string{"k": "v"}, Data: []byte("x")}, func(b []byte) []byte {
+			//元数据块的长度比其中的项少1个字节
+			b[len(EchoPath)+2]--
+			return b
+		}),
+	}
+}()
+
+//向量的检查结果
+type VectorResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+//以iip的帧解析器检查全部测试向量
+func VerifyVectors() []VectorResult {
+	ret := make([]VectorResult, 0, len(Vectors))
+	for _, v := range Vectors {
+		r := VectorResult{Name: v.Name}
+		if err := verifyVector(v); err != nil {
+			r.Error = err.Error()
+		} else {
+			r.Passed = true
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+func verifyVector(v *Vector) error {
+	data, err := hex.DecodeString(v.Hex)
+	if err != nil {
+		return err
+	}
+	reader, err := newFrameReader(bytes.NewReader(data), v.Format)
+	if err != nil {
+		return err
+	}
+	pkt, err := reader.ReadFrame()
+	if !v.Valid {
+		if err == nil {
+			pkt.Release()
+			return fmt.Errorf("invalid frame accepted")
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if reader.FrameLen() != len(data) {
+		pkt.Release()
+		return fmt.Errorf("frame length %d, encoded %d bytes", reader.FrameLen(), len(data))
+	}
+	got, want := frameOf(pkt), *v.Frame
+	if len(want.Meta) == 0 {
+		want.Meta = nil
+	}
+	if len(want.Data) == 0 {
+		want.Data = nil
+	}
+	if len(got.Meta) == 0 {
+		got.Meta = nil
+	}
+	if !reflect.DeepEqual(got, &want) {
+		return fmt.Errorf("decoded %+v, want %+v", got, want)
+	}
+	return nil
+}
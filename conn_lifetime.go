@@ -0,0 +1,99 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//server端连接的空闲超时及最大存活时间：空闲超时的连接直接关闭；超过最大存活时间的连接进入排空(draining)状态，
+//不再接受新建channel，已有的channel在请求处理完成并静止之后逐个关闭，全部关闭或者超过宽限期之后关闭连接，
+//使长期存活的client连接不会永久占用server资源，并促使client重新建立连接(如重新负载均衡)
+package iip
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//设置连接的空闲超时、最大存活时间及排空宽限期，在start之前调用，0表示不限制
+func (m *Connection) setLifetime(idleTimeout, maxAge, maxAgeGrace time.Duration) {
+	m.idleTimeout, m.maxAge, m.maxAgeGrace = idleTimeout, maxAge, maxAgeGrace
+	if m.maxAgeGrace <= 0 {
+		m.maxAgeGrace = time.Second * 30
+	}
+}
+
+//连接是否处于排空状态
+func (m *Connection) Draining() bool {
+	return atomic.LoadInt32(&m.draining) == 1
+}
+
+func (m *Connection) touch() {
+	atomic.StoreInt64(&m.lastActive, time.Now().UnixNano())
+}
+
+func (m *Connection) lifetimeLoop(done chan int) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var drainStart time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if m.idleTimeout > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&m.lastActive))) > m.idleTimeout {
+				m.Close(ErrConnectionIdle)
+				return
+			}
+			if m.maxAge <= 0 || now.Sub(m.createTime) < m.maxAge {
+				continue
+			}
+			if m.startDrain("max age reached") {
+				drainStart = now
+			}
+			if m.drainTick(now, drainStart, m.maxAgeGrace, ErrConnectionMaxAge) {
+				return
+			}
+		}
+	}
+}
+
+//进入排空状态，并向client发送GOAWAY通知，已经处于排空状态时返回false
+func (m *Connection) startDrain(reason string) bool {
+	if !atomic.CompareAndSwapInt32(&m.draining, 0, 1) {
+		return false
+	}
+	log.Logf("connection %s %s, draining", m.key, reason)
+	if m.Role == RoleServer {
+		m.sendGoAway(reason)
+	}
+	return true
+}
+
+//排空的一个检查周期：关闭静止的channel，channel全部关闭或者超过宽限期时以err关闭连接并返回true
+func (m *Connection) drainTick(now, drainStart time.Time, grace time.Duration, err error) bool {
+	if now.Sub(drainStart) > grace {
+		m.Close(err)
+		return true
+	}
+	//关闭静止超过一个检查周期的channel，减少与对端正在发出的请求竞争
+	remain := 0
+	var quiet []*Channel
+	m.ChannelsLock.RLock()
+	for id, c := range m.Channels {
+		if id == 0 {
+			continue
+		}
+		remain++
+		if atomic.LoadInt32(&c.busy) == 0 && now.Sub(c.LastActive()) > time.Second {
+			quiet = append(quiet, c)
+		}
+	}
+	m.ChannelsLock.RUnlock()
+	for _, c := range quiet {
+		c.Close(err)
+	}
+	if remain == 0 {
+		//等待刚入队的关闭通知写出
+		m.closeGraceful(err, grace-now.Sub(drainStart))
+		return true
+	}
+	return false
+}
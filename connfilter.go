@@ -0,0 +1,155 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//accept的准入控制，在创建连接(启动读写循环)之前进行，以尽量低的代价拒绝滥用的来源：
+//AcceptRate限制每秒accept的连接数，超过时暂停accept，未处理的连接请求留在内核的backlog中；
+//DenyCIDRs、AllowCIDRs按对端ip过滤，命中拒绝列表或者配置了允许列表而未命中时关闭连接；
+//之后调用ConnFilter，返回false时关闭连接。被拒绝的连接只计数，不记录日志，见Server.RejectedConnections
+package iip
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//连接过滤器，accept之后、创建连接之前以对端地址调用，返回false时立即关闭连接。
+//在accept循环中同步调用，不应阻塞
+type ConnFilter func(addr net.Addr) bool
+
+//按CIDR的允许、拒绝列表
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+//解析CIDR列表，不带前缀长度的ip视为单个地址
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip: %s", v)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr: %s", v)
+		}
+		ret = append(ret, ipNet)
+	}
+	return ret, nil
+}
+
+//两个列表都为空时返回nil
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	ret := &ipFilter{}
+	var err error
+	if ret.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if ret.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func containsIP(list []*net.IPNet, ip net.IP) bool {
+	for _, v := range list {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//拒绝列表优先；配置了允许列表时只接受其中的地址
+func (m *ipFilter) permit(ip net.IP) bool {
+	if ip == nil {
+		return len(m.allow) == 0
+	}
+	if containsIP(m.deny, ip) {
+		return false
+	}
+	return len(m.allow) == 0 || containsIP(m.allow, ip)
+}
+
+//地址中的ip，不是ip地址(如内存连接)时返回nil
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+//按配置重建ip过滤器及accept限速，配置有误时返回错误，不做修改
+func (m *Server) initConnFilter(config *ServerConfig) error {
+	filter, err := newIPFilter(config.AllowCIDRs, config.DenyCIDRs)
+	if err != nil {
+		return err
+	}
+	m.ipFilter.Store(filter)
+	burst := float64(config.AcceptBurst)
+	if m.acceptLimiter == nil {
+		m.acceptLimiter = newTokenBucket(config.AcceptRate, burst)
+	} else {
+		m.acceptLimiter.setRate(config.AcceptRate, burst)
+	}
+	return nil
+}
+
+//按AcceptRate在accept之前等待，server停止时返回false
+func (m *Server) throttleAccept() bool {
+	wait := m.acceptLimiter.reserve(1)
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(wait):
+		return true
+	case <-m.closeNotify:
+		return false
+	}
+}
+
+//accept的连接是否准入，拒绝时计数
+func (m *Server) admitConn(netConn net.Conn) bool {
+	addr := netConn.RemoteAddr()
+	if filter, _ := m.ipFilter.Load().(*ipFilter); filter != nil && !filter.permit(addrIP(addr)) {
+		atomic.AddInt64(&m.rejectedConns, 1)
+		return false
+	}
+	if filter := m.getConfig().ConnFilter; filter != nil && !filter(addr) {
+		atomic.AddInt64(&m.rejectedConns, 1)
+		return false
+	}
+	return true
+}
+
+//被ip列表、ConnFilter或按ip的连接数上限拒绝的连接数
+func (m *Server) RejectedConnections() int64 {
+	return atomic.LoadInt64(&m.rejectedConns)
+}
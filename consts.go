@@ -6,13 +6,53 @@ package iip
 
 //系统常量定义
 const (
-	MaxPathLen        uint32 = 512              //packet的path字段最大字节数
-	MaxPacketSize     uint32 = 16 * 1024 * 1024 //packet最大字节数
+	MaxPathLen        uint32 = 512              //packet的path字段最大字节数，ServerConfig/ClientConfig未配置时的默认值，同时也是配置的上限
+	MaxPacketSize     uint32 = 16 * 1024 * 1024 //packet最大字节数，ServerConfig/ClientConfig未配置时的默认值，同时也是配置的上限
 	PacketReadBufSize uint32 = 16 * 1024        //从他tcp fd读取数据用于缓存解析的缓冲区的大小
+	MaxMetaLen        uint32 = 8 * 1024         //帧元数据编码后的最大字节数
+	MaxCloseReasonLen uint32 = 1024             //关闭连接的帧携带的原因的最大字节数
 
 	//系统路径
-	PathNewChannel    string = "/sys/new_channel"
-	PathDeleteChannel string = "/sys/delete_channel"
+	PathNewChannel       string = "/sys/new_channel"
+	PathDeleteChannel    string = "/sys/delete_channel"
+	PathDeleteChannelAck string = "/sys/delete_channel_ack" //对PathDeleteChannel及重置帧的确认，见closeack.go
+	PathProbe            string = "/sys/probe"
+	PathHandshake        string = "/sys/handshake"
+	PathPushChannel      string = "/sys/push_channel"
+	PathSysStats         string = "/sys/stats"    //server统计，须开启ServerConfig.SysEndpoints
+	PathSysChannels      string = "/sys/channels" //server全部连接及其channel的统计，须开启ServerConfig.SysEndpoints
+	PathSysHealth        string = "/sys/health"   //server健康状态，总是开启，见health.go
+	PathGoAway           string = "/sys/goaway"   //server通知client连接即将关闭，不要再在其上新建channel
+
+	//协议版本
+	ProtocolVersion uint32 = 1
+
+	//特性位，由/sys/probe返回
+	FeatureTenant       uint32 = 1 << 0  //多租户
+	FeatureScheduler    uint32 = 1 << 1  //延时推送
+	FeatureMiddleware   uint32 = 1 << 2  //服务端中间件
+	FeaturePanicRecover uint32 = 1 << 3  //handler panic恢复
+	FeatureChecksum     uint32 = 1 << 4  //帧校验
+	FeatureServerPush   uint32 = 1 << 5  //server推送channel
+	FeatureMetadata     uint32 = 1 << 6  //帧元数据，握手时协商
+	FeatureHalfClose    uint32 = 1 << 7  //channel半关闭，握手时协商
+	FeatureErrorFrame   uint32 = 1 << 8  //错误帧，握手时协商
+	FeatureGoAway       uint32 = 1 << 9  //GOAWAY通知，握手时协商
+	FeatureTrailer      uint32 = 1 << 10 //响应trailer，响应的结束帧可以为空，握手时协商
+	FeatureReset        uint32 = 1 << 11 //channel重置帧，握手时协商
+	FeatureEncryption   uint32 = 1 << 12 //PSK加密，配置PSK后在握手时协商
+	FeatureOneWay       uint32 = 1 << 13 //单向消息，握手时协商
+	FeatureSequence     uint32 = 1 << 14 //帧序号，client配置SequenceCheck后在握手时协商
+	FeatureCloseAck     uint32 = 1 << 15 //channel关闭确认，握手时协商
+	FeatureEmptyData    uint32 = 1 << 16 //空数据帧，请求、响应及单向消息的数据可以为空，握手时协商
+	FeatureCloseReason  uint32 = 1 << 17 //关闭连接的帧(Status8)携带原因，握手时协商，见closereason.go
+
+	//channel写调度的权重
+	DefaultChannelWeight = 16
+	MaxChannelWeight     = 256
+
+	//握手时协商的特性
+	handshakeFeatures = FeatureMetadata | FeatureHalfClose | FeatureErrorFrame | FeatureGoAway | FeatureTrailer | FeatureReset | FeatureOneWay | FeatureSequence | FeatureCloseAck | FeatureEmptyData | FeatureCloseReason
 
 	//角色
 	RoleClient byte = 0
@@ -23,18 +63,35 @@ const (
 	PacketTypeResponse byte = 4
 
 	//packet.status
-	StatusC0 byte = 0 //请求首帧，请求未完成
-	StatusC1 byte = 1 //请求首帧，请求完成
-	StatusC2 byte = 2 //请求后续帧，请求未完成
-	StatusC3 byte = 3 //请求后续帧，请求完成
-	StatusS4 byte = 4 //响应首帧，响应未完成
-	StatusS5 byte = 5 //表示响应首帧，响应完成
-	StatusS6 byte = 6 //表示响应后续帧，响应未完成
-	StatusS7 byte = 7 //表示响应后续帧，响应完成
-	Status8  byte = 8 //关闭连接
-
-	//系统Context常量
+	StatusC0  byte = 0  //请求首帧，请求未完成
+	StatusC1  byte = 1  //请求首帧，请求完成
+	StatusC2  byte = 2  //请求后续帧，请求未完成
+	StatusC3  byte = 3  //请求后续帧，请求完成
+	StatusS4  byte = 4  //响应首帧，响应未完成
+	StatusS5  byte = 5  //表示响应首帧，响应完成
+	StatusS6  byte = 6  //表示响应后续帧，响应未完成
+	StatusS7  byte = 7  //表示响应后续帧，响应完成
+	Status8   byte = 8  //关闭连接
+	StatusC9  byte = 9  //请求方半关闭：不再发送数据，仍接收对端的数据，帧数据为空
+	StatusS10 byte = 10 //响应方半关闭：不再发送数据，仍接收对端的数据，帧数据为空
+	StatusS11 byte = 11 //错误响应，单帧、响应完成，数据为ResponseHandleFail的json
+	StatusR12 byte = 12 //重置：中止channel上正在进行的请求/响应并关闭channel，双方都可以发送，数据为ResponseHandleFail的json
+	StatusO13 byte = 13 //单向消息：client发送，单帧，不需要响应，见oneway.go
+
+	//帧校验算法
+	ChecksumNone   byte = 0
+	ChecksumCRC32  byte = 1 //crc32 IEEE
+	ChecksumCRC32C byte = 2 //crc32 Castagnoli
+
+	//帧元数据的key
+	MetaRequestId      string = "request-id"      //请求id，client未携带时由server生成，见accesslog.go
+	MetaRequestSeq     string = "request-seq"     //流水线请求的序号，server在响应中带回，见pipeline.go
+	MetaIdempotencyKey string = "idempotency-key" //请求的幂等键，见journal.go
+
+	//系统Context常量。CtxServer、CtxClient仅为兼容保留，内部不再读取，应使用Channel.Server()、Channel.Client()等访问方法，见owner.go
 	CtxServer       string = "/ctx/sys/server"
-	CtxClient       string = "/ctx/sys/server"
-	CtxResponseChan string = "/ctx/sys/response_chan"
+	CtxClient       string = "/ctx/sys/client"
+	CtxResponseChan string = "/ctx/sys/response_chan" //已不再使用，等待响应的请求登记在channel的pending表中，见pending.go
+	CtxTenant       string = "/ctx/sys/tenant"
+	CtxIdentity     string = "/ctx/sys/identity"
 )
@@ -0,0 +1,40 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//连接及channel的context：Connection.Context()在连接关闭时被取消，Channel.Context()派生自所在连接的context，
+//在channel关闭(包括被重置、连接关闭)时被取消。handler进行下游I/O时以此作为ctx，client中途断开时自动停止；
+//HandlerContext及ContextHandler的ctx均派生自Channel.Context()
+package iip
+
+import "context"
+
+//连接的context，连接关闭时被取消
+func (m *Connection) Context() context.Context {
+	return m.ctx
+}
+
+//channel的context，channel关闭时被取消，可以通过ChannelFromContext取得channel。首次调用时创建
+func (m *Channel) Context() context.Context {
+	m.ctxLock.Lock()
+	defer m.ctxLock.Unlock()
+	if m.ctx == nil {
+		m.ctx, m.ctxCancel = context.WithCancel(context.WithValue(m.conn.Context(), channelCtxKey{}, m))
+		//已经关闭的channel返回已取消的context
+		select {
+		case <-m.closeNotify:
+			m.ctxCancel()
+		default:
+		}
+	}
+	return m.ctx
+}
+
+//取消channel的context，在关闭通知之后调用
+func (m *Channel) cancelContext() {
+	m.ctxLock.Lock()
+	defer m.ctxLock.Unlock()
+	if m.ctxCancel != nil {
+		m.ctxCancel()
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//结构化的handler：ContextHandler在请求数据接收完整(多帧已合并)之后调用一次，不必像PathHandler那样自行累积分片；
+//ctx携带时限(NewTimeoutHandler)、取消(channel关闭、被对端重置时)及对端信息(PeerFromContext)，
+//响应通过ResponseWriter写出，可以一次写完，也可以流式地逐段写出(见response.go)。
+//ContextHandler经NewContextHandler适配为PathHandler，与原有的handler、中间件、worker及超时包装共存
+package iip
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+)
+
+//结构化handler的请求
+type Request struct {
+	Path      string
+	Data      []byte            //完整的请求数据，开启ServerConfig.RecycleRequests时handler返回后不应再使用
+	Meta      map[string]string //请求首帧携带的元数据，不应修改
+	RequestId string            //请求id，见Channel.RequestId
+	Channel   *Channel
+}
+
+//结构化的handler。返回nil时响应结束(没有写入数据时为空响应)；尚未发送任何数据时返回的错误作为错误响应返回给client，
+//已经发送了部分响应时channel被重置
+type ContextHandler interface {
+	Handle(ctx context.Context, req *Request, w ResponseWriter) error
+}
+
+//函数适配为ContextHandler
+type ContextHandlerFunc func(ctx context.Context, req *Request, w ResponseWriter) error
+
+func (f ContextHandlerFunc) Handle(ctx context.Context, req *Request, w ResponseWriter) error {
+	return f(ctx, req, w)
+}
+
+//请求的对端信息
+type Peer struct {
+	Addr        net.Addr          //对端地址
+	Identity    *Identity         //握手认证得到的身份，未认证时为nil
+	Certificate *x509.Certificate //TLS双向认证时对端的证书，否则为nil
+}
+
+type peerCtxKey struct{}
+
+//ContextHandler的ctx中携带的对端信息
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	ret, ok := ctx.Value(peerCtxKey{}).(*Peer)
+	return ret, ok
+}
+
+//将ContextHandler适配为PathHandler
+func NewContextHandler(handler ContextHandler) PathHandler {
+	return NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		ctx, cancel := c.requestContext()
+		defer cancel()
+		return handler.Handle(ctx, &Request{Path: path, Data: request, Meta: c.RequestMeta(), RequestId: c.RequestId(), Channel: c}, w)
+	})
+}
+
+//注册path的ContextHandler
+func (m *Server) RegisterContextHandler(path string, handler ContextHandler) error {
+	return m.RegisterHandler(path, NewContextHandler(handler))
+}
+
+//handler调用的ctx：在HandlerContext之上携带对端信息，HandlerContext派生自Channel.Context()，channel关闭时被取消
+func (m *Channel) requestContext() (context.Context, context.CancelFunc) {
+	peer := &Peer{Addr: m.RemoteAddr(), Identity: m.Identity(), Certificate: m.PeerCertificate()}
+	ctx, cancel := context.WithCancel(context.WithValue(m.HandlerContext(), peerCtxKey{}, peer))
+	m.requestCancel.Store(cancel)
+	return ctx, cancel
+}
+
+//收到对端的重置帧时在读循环中调用
+func (m *Channel) cancelRequest() {
+	if cancel, ok := m.requestCancel.Load().(context.CancelFunc); ok {
+		cancel()
+	}
+}
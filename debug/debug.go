@@ -0,0 +1,186 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//debug：通过expvar及net/http暴露iip server、client的统计数据，便于已有的http运维工具采集。
+//与net/http/pprof类似，导入本包即在http.DefaultServeMux上注册/debug/iip/，并以expvar变量"iip"发布；
+//server、client须通过AddServer、AddClient登记。路径(相对于/debug/iip/)：
+//	stats     全部server、client的统计(json)，即expvar变量"iip"的内容
+//	channels  全部连接及其channel，?debug=1时以文本输出，类似pprof的goroutine dump
+package debug
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//登记的server、client，以名称区分
+type Registry struct {
+	servers map[string]*iip.Server
+	clients map[string]*iip.Client
+	lock    sync.RWMutex
+}
+
+//stats输出的内容
+type Snapshot struct {
+	Servers map[string]iip.ServerStats       `json:"servers"`
+	Clients map[string][]iip.ConnectionStats `json:"clients"`
+}
+
+//channels输出的内容
+type ChannelsDump struct {
+	Servers map[string][]iip.ConnectionChannels `json:"servers"`
+	Clients map[string][]iip.ConnectionChannels `json:"clients"`
+}
+
+//导入本包时注册的默认Registry
+var Default = NewRegistry()
+
+func init() {
+	http.Handle("/debug/iip/", http.StripPrefix("/debug/iip", Default))
+	expvar.Publish("iip", expvar.Func(func() interface{} { return Default.Snapshot() }))
+}
+
+func NewRegistry() *Registry {
+	return &Registry{servers: make(map[string]*iip.Server), clients: make(map[string]*iip.Client)}
+}
+
+//在默认Registry中登记server
+func AddServer(name string, svr *iip.Server) {
+	Default.AddServer(name, svr)
+}
+
+//在默认Registry中登记client
+func AddClient(name string, client *iip.Client) {
+	Default.AddClient(name, client)
+}
+
+//从默认Registry中移除名为name的server、client
+func Remove(name string) {
+	Default.Remove(name)
+}
+
+func (m *Registry) AddServer(name string, svr *iip.Server) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.servers[name] = svr
+}
+
+func (m *Registry) AddClient(name string, client *iip.Client) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.clients[name] = client
+}
+
+func (m *Registry) Remove(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.servers, name)
+	delete(m.clients, name)
+}
+
+func (m *Registry) Snapshot() *Snapshot {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ret := &Snapshot{Servers: make(map[string]iip.ServerStats), Clients: make(map[string][]iip.ConnectionStats)}
+	for name, svr := range m.servers {
+		ret.Servers[name] = svr.Stats()
+	}
+	for name, client := range m.clients {
+		ret.Clients[name] = client.ConnectionsSnapshot()
+	}
+	return ret
+}
+
+func (m *Registry) Channels() *ChannelsDump {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ret := &ChannelsDump{Servers: make(map[string][]iip.ConnectionChannels), Clients: make(map[string][]iip.ConnectionChannels)}
+	for name, svr := range m.servers {
+		ret.Servers[name] = svr.ChannelsSnapshot()
+	}
+	for name, client := range m.clients {
+		ret.Clients[name] = client.ChannelsSnapshot()
+	}
+	return ret
+}
+
+func (m *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "", "/stats":
+		writeJSON(w, m.Snapshot())
+	case "/channels":
+		if r.URL.Query().Get("debug") == "1" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			m.Channels().WriteTo(w)
+			return
+		}
+		writeJSON(w, m.Channels())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+//以文本格式输出，每个连接一行，其下每个channel缩进一行
+func (m *ChannelsDump) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	write := func(format string, args ...interface{}) error {
+		k, err := fmt.Fprintf(w, format, args...)
+		n += int64(k)
+		return err
+	}
+	dump := func(kind string, all map[string][]iip.ConnectionChannels) error {
+		names := make([]string, 0, len(all))
+		for name := range all {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			conns := all[name]
+			if err := write("%s %s: %d connections\n", kind, name, len(conns)); err != nil {
+				return err
+			}
+			for _, v := range conns {
+				c := v.Connection
+				if err := write("connection %s role=%d channels=%d uptime=%s idle=%s read=%dB/%d write=%dB/%d queue=%d/%dB queue_high=%d/%d received=%d received_high=%d draining=%v\n",
+					c.RemoteAddr, c.Role, c.Channels, c.Uptime.Round(time.Millisecond), time.Since(c.LastActive).Round(time.Millisecond),
+					c.ReadBytes, c.ReadPackets, c.WriteBytes, c.WritePackets, c.WriteQueueLen, c.PendingWriteBytes, c.WriteQueueHigh, c.WriteQueueCap, c.ReceivedQueueLen, c.ReceivedQueueHigh, c.Draining); err != nil {
+					return err
+				}
+				for _, ch := range v.Channels {
+					if err := write("\tchannel %d age=%s idle=%s read=%dB/%d write=%dB/%d queued=%d queued_high=%d/%d busy=%v push=%v send_closed=%v peer_send_closed=%v\n",
+						ch.Id, time.Since(ch.NewTime).Round(time.Millisecond), time.Since(ch.LastActive).Round(time.Millisecond),
+						ch.ReadBytes, ch.ReadPackets, ch.WriteBytes, ch.WritePackets, ch.ReceivedQueue, ch.ReceivedHigh, ch.ReceivedCap, ch.Busy, ch.Push, ch.SendClosed, ch.PeerSendClosed); err != nil {
+						return err
+					}
+				}
+			}
+			if err := write("\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := dump("server", m.Servers); err != nil {
+		return n, err
+	}
+	return n, dump("client", m.Clients)
+}
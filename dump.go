@@ -0,0 +1,163 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//帧的文本输出：FrameDumper将帧输出为一行可读的文本(状态名、channel、path、长度、元数据及数据的十六进制预览)，
+//可以直接输出ParseFrame/FrameReader解析的帧，也可以作为PacketTap输出连接上收发的帧，cmd/iipdump以此解码抓包数据：
+//	12:00:00.000001 127.0.0.1:52000 -> C1(request) ch=1 path=/echo len=5 | 68 65 6c 6c 6f |hello|
+package iip
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var statusNames = [...]string{
+	StatusC0:  "request begin",
+	StatusC1:  "request",
+	StatusC2:  "request continue",
+	StatusC3:  "request end",
+	StatusS4:  "response begin",
+	StatusS5:  "response",
+	StatusS6:  "response continue",
+	StatusS7:  "response end",
+	Status8:   "close connection",
+	StatusC9:  "request half close",
+	StatusS10: "response half close",
+	StatusS11: "error",
+	StatusR12: "reset",
+	StatusO13: "one-way",
+}
+
+var statusPrefixes = [...]string{"C", "C", "C", "C", "S", "S", "S", "S", "", "C", "S", "S", "R", "O"}
+
+//帧状态的名称，如C1(request)，未知的状态为unknown(n)
+func StatusName(status byte) string {
+	if int(status) >= len(statusNames) {
+		return fmt.Sprintf("unknown(%d)", status)
+	}
+	return fmt.Sprintf("%s%d(%s)", statusPrefixes[status], status, statusNames[status])
+}
+
+//将帧输出为可读的文本，每帧一行，可以并发使用
+type FrameDumper struct {
+	Writer   io.Writer
+	HexBytes int //数据预览的字节数，0表示32，负数表示不预览
+	lock     sync.Mutex
+}
+
+func NewFrameDumper(w io.Writer) *FrameDumper {
+	return &FrameDumper{Writer: w}
+}
+
+//输出一帧
+func (m *FrameDumper) Dump(pkt *Packet) error {
+	return m.writeLine(m.Format(pkt))
+}
+
+//一帧的文本，不含换行
+func (m *FrameDumper) Format(pkt *Packet) string {
+	return m.format(pkt.Status, pkt.ChannelId, pkt.Seq, pkt.Path, pkt.Meta, pkt.Data, len(pkt.Data))
+}
+
+//输出一条tap记录，前缀为时间、连接及方向(->表示写出，<-表示读入)
+func (m *FrameDumper) DumpEvent(event *TapEvent) error {
+	direction := "<-"
+	if event.Direction == TapOutbound {
+		direction = "->"
+	}
+	line := fmt.Sprintf("%s %s %s %s", event.Time.Format("15:04:05.000000"), event.Conn, direction,
+		m.format(event.Status, event.ChannelId, 0, event.Path, event.Meta, event.Data, len(event.Data)))
+	return m.writeLine(line)
+}
+
+//PacketTap，输出连接上收发的帧
+func (m *FrameDumper) Tap(conn *Connection, event *TapEvent) {
+	m.DumpEvent(event)
+}
+
+func (m *FrameDumper) writeLine(line string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, err := io.WriteString(m.Writer, line+"\n")
+	return err
+}
+
+func (m *FrameDumper) format(status byte, channelId, seq uint32, path string, meta map[string]string, data []byte, dataLen int) string {
+	var sb strings.Builder
+	sb.WriteString(StatusName(status))
+	if status == Status8 {
+		//协商FeatureCloseReason之后携带的原因
+		if len(data) > 0 {
+			e := decodeErrorFrame(data)
+			fmt.Fprintf(&sb, " code=%d message=%q", e.Code, e.Message)
+		}
+		return sb.String()
+	}
+	fmt.Fprintf(&sb, " ch=%d", channelId)
+	if seq != 0 {
+		fmt.Fprintf(&sb, " seq=%d", seq)
+	}
+	if path != "" {
+		fmt.Fprintf(&sb, " path=%s", path)
+	}
+	fmt.Fprintf(&sb, " len=%d", dataLen)
+	if len(meta) > 0 {
+		keys := make([]string, 0, len(meta))
+		for k := range meta {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		sb.WriteString(" meta={")
+		for i, k := range keys {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			fmt.Fprintf(&sb, "%s=%q", k, meta[k])
+		}
+		sb.WriteByte('}')
+	}
+	if n := m.hexBytes(); n > 0 && len(data) > 0 {
+		sb.WriteString(" | ")
+		sb.WriteString(hexPreview(data, n))
+	}
+	return sb.String()
+}
+
+func (m *FrameDumper) hexBytes() int {
+	if m.HexBytes == 0 {
+		return 32
+	}
+	return m.HexBytes
+}
+
+//数据前n个字节的十六进制及可打印字符，超过n个字节时以...结尾
+func hexPreview(data []byte, n int) string {
+	more := len(data) > n
+	if more {
+		data = data[:n]
+	}
+	var sb strings.Builder
+	for i, v := range data {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%02x", v)
+	}
+	sb.WriteString(" |")
+	for _, v := range data {
+		if v >= 0x20 && v < 0x7f {
+			sb.WriteByte(v)
+		} else {
+			sb.WriteByte('.')
+		}
+	}
+	sb.WriteByte('|')
+	if more {
+		sb.WriteString("...")
+	}
+	return sb.String()
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//client的服务端地址：地址列表由Resolver提供(默认由NewClient的serverAddr得到，可以是逗号分隔的多个地址，
+//主机名解析为全部IPv4地址，如k8s的headless service)，新建channel时由Balancer选择地址。
+//地址从列表中移除后，其上的连接进入排空状态，不再在其上新建channel，没有channel时被关闭
+package iip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type endpointSet struct {
+	addrs []string
+	ready chan struct{} //收到第一次地址更新后关闭
+	once  sync.Once
+	lock  sync.RWMutex
+}
+
+func newEndpointSet() *endpointSet {
+	return &endpointSet{ready: make(chan struct{})}
+}
+
+//更新地址列表，返回移除的地址
+func (m *endpointSet) update(addrs []string) (added, removed []string) {
+	m.lock.Lock()
+	old := make(map[string]bool, len(m.addrs))
+	for _, v := range m.addrs {
+		old[v] = true
+	}
+	seen := make(map[string]bool, len(addrs))
+	var list []string
+	for _, v := range addrs {
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		list = append(list, v)
+		if !old[v] {
+			added = append(added, v)
+		}
+	}
+	for _, v := range m.addrs {
+		if !seen[v] {
+			removed = append(removed, v)
+		}
+	}
+	m.addrs = list
+	m.lock.Unlock()
+	m.once.Do(func() { close(m.ready) })
+	return added, removed
+}
+
+func (m *endpointSet) list() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.addrs
+}
+
+func (m *endpointSet) contains(addr string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, v := range m.addrs {
+		if v == addr {
+			return true
+		}
+	}
+	return false
+}
+
+//启动地址解析
+func (m *Client) startResolver() error {
+	resolver := m.config.Resolver
+	if resolver == nil {
+		resolver = serverAddrResolver(m.serverAddr, m.config.ResolveInterval)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-m.closeNotify
+		cancel()
+	}()
+	if err := resolver.Watch(ctx, m.updateEndpoints); err != nil {
+		cancel()
+		return err
+	}
+	return nil
+}
+
+func (m *Client) updateEndpoints(addrs []string) {
+	added, removed := m.endpoints.update(addrs)
+	if len(added) > 0 || len(removed) > 0 {
+		log.Logf("server endpoints changed, added: %v, removed: %v", added, removed)
+	}
+	if len(removed) == 0 {
+		return
+	}
+	for _, conn := range m.connectionList() {
+		//内存连接不受地址变化影响
+		if conn.endpoint == "" || m.endpoints.contains(conn.endpoint) {
+			continue
+		}
+		conn.startDrain("endpoint removed")
+		conn.ChannelsLock.RLock()
+		idle := len(conn.Channels) <= 1
+		conn.ChannelsLock.RUnlock()
+		if idle {
+			conn.Close(fmt.Errorf("endpoint %s removed", conn.endpoint))
+		}
+	}
+}
+
+func (m *Client) connectionList() []*Connection {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	return append([]*Connection(nil), m.connections...)
+}
+
+//各地址的当前状态，尚未收到地址时最多等待连接超时时间
+func (m *Client) endpointStates() ([]EndpointState, error) {
+	timeout := m.config.TcpConnectTimeout
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+	select {
+	case <-m.endpoints.ready:
+	case <-time.After(timeout):
+	case <-m.closeNotify:
+	}
+	addrs := m.endpoints.list()
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no server address available")
+	}
+	index := make(map[string]int, len(addrs))
+	ret := make([]EndpointState, len(addrs))
+	unhealthy := make([]int, len(addrs))
+	for i, v := range addrs {
+		index[v] = i
+		ret[i].Addr = v
+	}
+	for _, conn := range m.connectionList() {
+		i, ok := index[conn.endpoint]
+		if !ok {
+			continue
+		}
+		ret[i].Connections++
+		if !conn.Healthy() {
+			unhealthy[i]++
+		}
+		conn.ChannelsLock.RLock()
+		for id, c := range conn.Channels {
+			if id == 0 {
+				continue
+			}
+			ret[i].Channels++
+			if atomic.LoadInt32(&c.busy) == 1 {
+				ret[i].Pending++
+			}
+		}
+		conn.ChannelsLock.RUnlock()
+	}
+	//连接全部不健康的地址不参与选择，全部地址都不健康时不做排除
+	healthy := make([]EndpointState, 0, len(ret))
+	for i, v := range ret {
+		if v.Connections == 0 || unhealthy[i] < v.Connections {
+			healthy = append(healthy, v)
+		}
+	}
+	if len(healthy) > 0 {
+		return healthy, nil
+	}
+	return ret, nil
+}
+
+//关闭client：停止地址解析，关闭全部连接
+func (m *Client) Close() {
+	if !atomic.CompareAndSwapInt32(&m.closed, 0, 1) {
+		return
+	}
+	close(m.closeNotify)
+	m.pool.Close()
+	for _, conn := range m.connectionList() {
+		conn.Close(fmt.Errorf("client closed"))
+	}
+}
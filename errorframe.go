@@ -0,0 +1,63 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//错误帧：握手协商FeatureErrorFrame之后，server的handler返回的错误以状态StatusS11的单帧发送，
+//数据为ResponseHandleFail的json，client据此区分"handler返回了错误"与"handler返回了形似错误json的数据"，
+//DoRequest返回对应的*Error。未协商时错误仍以普通响应数据的形式发送
+package iip
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+)
+
+//错误是否由对端的handler返回（经错误帧传回），而不是本端产生
+func (m *Error) Remote() bool {
+	return m.remote
+}
+
+//按错误码比较，使errors.Is(err, ErrRateLimited)对经错误帧传回的错误同样有效；错误属于target的类别时同样为true，见errors.go
+func (m *Error) Is(target error) bool {
+	if target == context.DeadlineExceeded {
+		return m.Timeout()
+	}
+	t, ok := target.(*Error)
+	return ok && t.Code != -1 && (t.Code == m.Code || errorKinds[m.Code] == t.Code)
+}
+
+//发送错误响应，对端不支持错误帧或者错误超过帧大小时作为普通响应数据发送
+func (m *Channel) sendError(path string, err *Error) error {
+	return m.sendErrorMeta(path, err, nil)
+}
+
+//发送错误响应，meta随错误帧发出
+func (m *Channel) sendErrorMeta(path string, err *Error, meta map[string]string) error {
+	data := ErrorResponse(err).Data()
+	if !m.conn.HasFeature(FeatureErrorFrame) || len(data) > int(m.conn.MaxPacketSize()) {
+		return m.SendPacket(&Packet{Type: PacketTypeResponse, Path: path, ChannelId: m.Id, Data: data, Meta: meta, channel: m})
+	}
+	if err := m.errClosed(); err != nil {
+		return err
+	}
+	if m.SendClosed() {
+		return ErrSendClosed
+	}
+	pkt := acquirePacket()
+	pkt.Type, pkt.Status, pkt.Path, pkt.ChannelId, pkt.Data, pkt.Meta, pkt.channel = PacketTypeResponse, StatusS11, path, m.Id, data, meta, m
+	m.sendLock.Lock()
+	defer m.sendLock.Unlock()
+	m.conn.enqueuePacket(pkt, -1, nil)
+	atomic.AddInt64(&m.WritePacketCount, 1)
+	return nil
+}
+
+//解析错误帧的数据
+func decodeErrorFrame(data []byte) *Error {
+	var fail ResponseHandleFail
+	if err := json.Unmarshal(data, &fail); err != nil {
+		return &Error{Code: -1, Message: "invalid error frame, " + err.Error(), remote: true}
+	}
+	return &Error{Code: fail.Code, Message: fail.Message, Details: fail.Details, remote: true}
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//错误的分类：SendPacket、DoRequest、handler的调用等返回的错误都可以用errors.Is/errors.As判断，不必匹配错误信息的字符串。
+//	errors.As(err, &e)(e为*Error)得到错误码，错误由对端的handler返回、经错误帧传回时e.Remote()为true；
+//	errors.Is(err, ErrXxx)按错误码比较，对经错误帧传回的错误同样有效；
+//	类别：ErrTimeout(各种超时，同时满足errors.Is(err, context.DeadlineExceeded))、ErrTooLarge(超过大小的限制)、
+//	ErrOverloaded(限流、写队列满、channel或连接数超限)、ErrProtocol(对端违反协议：非法的帧、状态转换、帧序号、校验和)、
+//	ErrClosed(channel或连接已关闭)，具体的错误属于其类别，如errors.Is(ErrRequestTimeout, ErrTimeout)为true；
+//	关闭及读帧失败的错误以Unwrap保留原因，如连接因对端违反协议而关闭之后，channel上的请求返回的错误满足
+//	errors.Is(err, ErrClosed)及errors.Is(err, ErrProtocol)，连接被对端断开时满足errors.Is(err, io.EOF)
+package iip
+
+import "fmt"
+
+//错误码所属的类别，类别自身及不属于任何类别的错误码不在表中
+var errorKinds = map[int]int{
+	103: 130, //ErrRequestTimeout
+	108: 130, //ErrChannelIdle
+	109: 130, //ErrChannelDeadline
+	110: 130, //ErrConnectionIdle
+	119: 130, //ErrHandlerTimeout
+	120: 131, //ErrRequestTooLarge
+	129: 131, //ErrResponseTooLarge
+	106: 121, //ErrRateLimited
+	113: 121, //ErrTooManyChannels
+	115: 121, //ErrWriteQueueFull
+	125: 121, //ErrTooManyConnections
+}
+
+//错误的原因，没有时为nil
+func (m *Error) Unwrap() error {
+	return m.cause
+}
+
+//是否为超时，与net.Error的Timeout相同
+func (m *Error) Timeout() bool {
+	return m.Is(ErrTimeout)
+}
+
+//属于kind类别的错误，cause为其原因
+func kindError(kind error, cause error, format string, args ...interface{}) error {
+	return &Error{Code: kind.(*Error).Code, Message: fmt.Sprintf(format, args...), cause: cause}
+}
+
+//对端违反协议
+func protocolError(format string, args ...interface{}) error {
+	return kindError(ErrProtocol, nil, format, args...)
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//事件循环模式：ServerConfig.EventLoops大于0时，server端的channel不再各自占用一个处理goroutine(handleServerLoop)，
+//帧进入channel的接收队列时将channel放入server范围的就绪队列，由EventLoops个共享的goroutine轮流处理：
+//每次取出一个channel，处理其接收队列中已有的帧(最多eventLoopBatch帧，之后放回队尾，避免一个繁忙的channel独占)，
+//队列为空时channel回到空闲状态，不占用任何goroutine。同一channel同一时刻只在一个goroutine中处理，帧的顺序及处理语义与
+//handleServerLoop相同。连接仍各有一个读goroutine及写goroutine，由Go运行时基于epoll的netpoller等待，
+//goroutine数由 连接数×(2+channel数) 降为 连接数×2+EventLoops，适用于大量连接、每个连接多个channel但大多空闲的场景。
+//handler在共享的goroutine中执行，阻塞的handler占用其中一个，handler可能长时间阻塞时同时开启Workers(见workerpool.go)，
+//请求的处理交给worker，事件循环只负责接收；双向流的处理函数仍各自占用一个goroutine
+package iip
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//channel每次被调度时最多处理的帧数
+const eventLoopBatch = 16
+
+//channel在事件循环中的调度状态
+const (
+	loopIdle      int32 = iota //接收队列为空，不在就绪队列中
+	loopScheduled              //在就绪队列中或者正在处理，期间计入连接的WaitGroup
+	loopStopped                //channel已关闭或者不再处理之后的帧，不再调度
+)
+
+//就绪队列，同一channel在其中最多出现一次
+type eventLoop struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	ready  []*Channel
+	closed bool
+}
+
+//启动事件循环，在NewServer中调用
+func (m *Server) startEventLoops(loops int) {
+	m.eventLoop = &eventLoop{}
+	m.eventLoop.cond = sync.NewCond(&m.eventLoop.lock)
+	for i := 0; i < loops; i++ {
+		go m.eventLoop.run(m)
+	}
+}
+
+func (m *eventLoop) run(server *Server) {
+	for {
+		c := m.pop()
+		if c == nil {
+			return
+		}
+		if c.runEvents(server) && !m.push(c) {
+			c.stopEvents()
+		}
+	}
+}
+
+//放入就绪队列，已关闭时返回false
+func (m *eventLoop) push(c *Channel) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return false
+	}
+	m.ready = append(m.ready, c)
+	m.cond.Signal()
+	return true
+}
+
+//取出就绪的channel，队列为空时等待，已关闭时返回nil
+func (m *eventLoop) pop() *Channel {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for len(m.ready) == 0 && !m.closed {
+		m.cond.Wait()
+	}
+	if m.closed {
+		return nil
+	}
+	ret := m.ready[0]
+	m.ready[0] = nil
+	m.ready = m.ready[1:]
+	return ret
+}
+
+//server停止时调用，就绪队列中的channel不再处理
+func (m *eventLoop) close() {
+	m.lock.Lock()
+	ready := m.ready
+	m.ready, m.closed = nil, true
+	m.cond.Broadcast()
+	m.lock.Unlock()
+	for _, c := range ready {
+		c.stopEvents()
+	}
+}
+
+//就绪队列中的channel数
+func (m *eventLoop) len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.ready)
+}
+
+//帧进入接收队列之后调用：事件循环模式下空闲的channel被放入就绪队列。
+//调用者(读循环、公平分派)在连接的WaitGroup中，此时计入WaitGroup是安全的
+func (m *Channel) scheduleEvents() {
+	if m.conn.server == nil || m.conn.server.eventLoop == nil || m.conn.Role != RoleServer {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&m.loopState, loopIdle, loopScheduled) {
+		return
+	}
+	m.conn.loops.Add(1)
+	if !m.conn.server.eventLoop.push(m) {
+		m.stopEvents()
+	}
+}
+
+//处理接收队列中已有的帧，最多eventLoopBatch帧。返回true表示队列中仍有帧，channel须放回就绪队列
+func (m *Channel) runEvents(server *Server) bool {
+	for i := 0; i < eventLoopBatch; i++ {
+		select {
+		case <-m.closeNotify:
+			m.stopEvents()
+			return false
+		default:
+		}
+		select {
+		case pkt := <-m.receivedQueue:
+			if !m.serveReceived(server, pkt) {
+				m.stopEvents()
+				return false
+			}
+		default:
+			atomic.StoreInt32(&m.loopState, loopIdle)
+			//置为空闲之前进入队列的帧未能调度channel，由本次继续处理
+			if len(m.receivedQueue) > 0 && atomic.CompareAndSwapInt32(&m.loopState, loopIdle, loopScheduled) {
+				return true
+			}
+			m.conn.loops.Done()
+			return false
+		}
+	}
+	return true
+}
+
+//不再调度channel，只由持有调度的一方调用一次
+func (m *Channel) stopEvents() {
+	atomic.StoreInt32(&m.loopState, loopStopped)
+	m.conn.loops.Done()
+}
+
+//事件循环模式下就绪队列中等待处理的channel数，未开启时为0
+func (m *Server) EventLoopQueueLen() int {
+	if m.eventLoop == nil {
+		return 0
+	}
+	return m.eventLoop.len()
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+//在n个channel上并发地各发出rounds个请求，其中包括需要分帧的大请求
+func concurrentEcho(t *testing.T, client *Client, n, rounds int) []*ClientChannel {
+	t.Helper()
+	channels := make([]*ClientChannel, n)
+	for i := range channels {
+		c, err := client.NewChannel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		channels[i] = c
+	}
+	errs := make(chan error, n)
+	for i, c := range channels {
+		go func(i int, c *ClientChannel) {
+			for j := 0; j < rounds; j++ {
+				data := []byte(fmt.Sprintf("%d-%d", i, j))
+				if j == rounds-1 {
+					data = bytes.Repeat(data, 64*1024/len(data))
+				}
+				ret, err := c.DoRequest(testEchoPath, data, time.Second*10)
+				if err == nil && !bytes.Equal(ret, data) {
+					err = fmt.Errorf("channel %d round %d: %d bytes echoed, expected %d", i, j, len(ret), len(data))
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i, c)
+	}
+	for range channels {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return channels
+}
+
+func TestEventLoopServesChannels(t *testing.T) {
+	for _, config := range []ServerConfig{{EventLoops: 2}, {EventLoops: 2, Workers: 4, ChannelOrdered: true}} {
+		t.Run(fmt.Sprintf("workers=%d", config.Workers), func(t *testing.T) {
+			_, addr := newTestServer(t, config, WithFrameSize(16*1024))
+			client := newTestClient(t, addr, ClientConfig{})
+			concurrentEcho(t, client, 20, 5)
+		})
+	}
+}
+
+//事件循环模式下server端的channel不占用处理goroutine，channel关闭之后server可以正常停止
+func TestEventLoopNoGoroutinePerChannel(t *testing.T) {
+	const n = 40
+	server, addr := newTestServer(t, ServerConfig{EventLoops: 1})
+	client := newTestClient(t, addr, ClientConfig{})
+	if _, err := client.NewChannel(); err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+	channels := concurrentEcho(t, client, n, 1)
+	//client端每个channel一个处理goroutine，server端没有
+	if delta, _ := waitGoroutines(before+n+n/4, time.Second*5); delta > before+n+n/4 {
+		t.Fatalf("%d goroutines for %d channels", delta-before, n)
+	}
+	for _, c := range channels {
+		c.Close(nil)
+	}
+	waitFor(t, "server channels closed", func() bool {
+		stats := server.ConnectionsSnapshot()
+		return len(stats) == 1 && stats[0].Channels == 1
+	})
+	stopped := make(chan struct{})
+	go func() {
+		server.Stop(fmt.Errorf("test finished"))
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("server stop blocked")
+	}
+}
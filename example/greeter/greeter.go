@@ -0,0 +1,22 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//iipgen示例：根据Greeter接口生成client桩及server注册代码(greeter_iip.go)
+package greeter
+
+import "context"
+
+//go:generate go run github.com/truexf/iip/cmd/iipgen -type Greeter
+
+type HelloRequest struct {
+	Name string `json:"name"`
+}
+
+type HelloResponse struct {
+	Greeting string `json:"greeting"`
+}
+
+type Greeter interface {
+	SayHello(ctx context.Context, req *HelloRequest) (*HelloResponse, error)
+}
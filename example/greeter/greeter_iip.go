@@ -0,0 +1,34 @@
+// Code generated by iipgen from greeter.go. DO NOT EDIT.
+
+package greeter
+
+import (
+	"context"
+
+	"github.com/truexf/iip"
+)
+
+const (
+	GreeterSayHelloPath = "/greeter/say_hello"
+)
+
+// Greeter的client桩
+type GreeterClient struct {
+	channel *iip.ClientChannel
+}
+
+func NewGreeterClient(c *iip.ClientChannel) *GreeterClient {
+	return &GreeterClient{channel: c}
+}
+
+func (m *GreeterClient) SayHello(ctx context.Context, req *HelloRequest) (*HelloResponse, error) {
+	return iip.Call[HelloRequest, HelloResponse](ctx, m.channel, GreeterSayHelloPath, req)
+}
+
+// 在server上注册Greeter的全部方法
+func RegisterGreeterServer(server *iip.Server, impl Greeter) error {
+	if err := iip.RegisterTyped(server, GreeterSayHelloPath, impl.SayHello); err != nil {
+		return err
+	}
+	return nil
+}
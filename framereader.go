@@ -0,0 +1,321 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//帧解析：从字节流中逐帧读取并校验，连接的读循环以及协议测试、模糊测试(go test -fuzz)共用同一份解析代码。
+//解析只校验帧本身的合法性(状态值、长度、元数据、校验和)，帧与channel状态之间的约束由读循环检查
+package iip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+type FrameReader struct {
+	reader        *bufio.Reader
+	conn          *Connection //非nil时帧格式和长度限制取自连接，握手之后随协商结果变化
+	format        frameFormat
+	maxPacketSize uint32
+	maxPathLen    uint32
+	frameLen      int
+	btsHeader     [4]byte
+	btsMeta       []byte
+	aad           []byte          //以PSK加密时认证的帧头
+	deadline      *deadlineReader //非nil时限制读取一帧的时间，见readtimeout.go
+}
+
+//创建帧解析器，默认不带元数据块和校验和，长度限制为MaxPacketSize、MaxPathLen
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{
+		reader:        newBufReader(r),
+		format:        newFrameFormat(ChecksumNone, false),
+		maxPacketSize: MaxPacketSize,
+		maxPathLen:    MaxPathLen,
+	}
+}
+
+//连接的读循环使用的解析器
+func newConnFrameReader(conn *Connection) *FrameReader {
+	//利用bufio，每次从内核多读一些数据上来处理，减少对内核内存的读次数
+	if conn.readDeadlineRequired() {
+		deadline := newDeadlineReader(conn)
+		return &FrameReader{reader: bufio.NewReaderSize(deadline, int(PacketReadBufSize)), conn: conn, deadline: deadline}
+	}
+	return &FrameReader{reader: bufio.NewReaderSize(conn.tcpConn, int(PacketReadBufSize)), conn: conn}
+}
+
+func newBufReader(r io.Reader) *bufio.Reader {
+	if ret, ok := r.(*bufio.Reader); ok {
+		return ret
+	}
+	return bufio.NewReaderSize(r, int(PacketReadBufSize))
+}
+
+//设置帧格式：校验算法，以及是否携带元数据块，与握手协商的结果对应
+func (m *FrameReader) SetFormat(checksum byte, meta bool) error {
+	if !isValidChecksum(checksum) {
+		return fmt.Errorf("unsupported checksum: %d", checksum)
+	}
+	m.format = newFrameFormat(checksum, meta) | m.format&(frameFormatSeq|frameFormatCloseReason)
+	return nil
+}
+
+//设置是否携带帧序号，与握手协商的FeatureSequence对应。帧序号只解析、不校验，校验由连接的读循环进行
+func (m *FrameReader) SetSequence(seq bool) {
+	if seq {
+		m.format |= frameFormatSeq
+	} else {
+		m.format &^= frameFormatSeq
+	}
+}
+
+//设置关闭连接的帧(Status8)是否携带原因，与握手协商的FeatureCloseReason对应
+func (m *FrameReader) SetCloseReason(closeReason bool) {
+	if closeReason {
+		m.format |= frameFormatCloseReason
+	} else {
+		m.format &^= frameFormatCloseReason
+	}
+}
+
+//设置长度限制，0表示默认值，超过默认值时取默认值
+func (m *FrameReader) SetLimits(maxPacketSize, maxPathLen uint32) {
+	m.maxPacketSize = normalizeLimit(maxPacketSize, MaxPacketSize)
+	m.maxPathLen = normalizeLimit(maxPathLen, MaxPathLen)
+}
+
+//最近一次读取的帧的字节数
+func (m *FrameReader) FrameLen() int {
+	return m.frameLen
+}
+
+//读取并校验一帧。Status8(关闭连接)只有1个字节，返回的packet只设置了Status；协商FeatureCloseReason之后其Data为关闭的原因，见closereason.go。
+//返回的packet的Type由调用者按收发方向设置，不再使用时调用Release回收
+func (m *FrameReader) ReadFrame() (*Packet, error) {
+	m.frameLen = 0
+	//read status
+	status, err := m.reader.ReadByte()
+	if err != nil {
+		return nil, readFrameError(err)
+	}
+	if status == Status8 {
+		m.frameLen = 1
+		pkt := acquirePacket()
+		pkt.Status = status
+		format := m.format
+		if m.conn != nil {
+			format = m.conn.readFrameFormat()
+		}
+		if format.closeReason() {
+			if err := m.readCloseReason(pkt); err != nil {
+				pkt.Release()
+				return nil, err
+			}
+		}
+		return pkt, nil
+	}
+	if status > StatusO13 {
+		return nil, protocolError("invalid status value: %d", status)
+	}
+	if m.deadline != nil {
+		m.deadline.beginFrame()
+		defer m.deadline.endFrame()
+	}
+	//收到帧的首字节之后再确定帧格式，此时握手过程中对格式的设置已经生效
+	format, maxPacketSize, maxPathLen := m.format, m.maxPacketSize, m.maxPathLen
+	if m.conn != nil {
+		format, maxPacketSize, maxPathLen = m.conn.readFrameFormat(), m.conn.MaxPacketSize(), m.conn.MaxPathLen()
+	}
+	//以PSK加密时由认证标签校验整个帧，不再有校验和
+	var opener *frameCipher
+	var aad []byte
+	if format.sealed() && m.conn != nil {
+		opener = m.conn.opener
+		aad = append(m.aad[:0], status)
+		format = format.withChecksum(ChecksumNone)
+	}
+	table := checksumTable(format.checksum())
+	var checksum uint32
+	if table != nil {
+		m.btsHeader[0] = status
+		checksum = crc32.Update(0, table, m.btsHeader[:1])
+	}
+
+	//read path
+	path, err := m.reader.ReadSlice(0)
+	if err == bufio.ErrBufferFull {
+		return nil, protocolError("read path len > max-path-len")
+	}
+	if err != nil {
+		return nil, readFrameError(err)
+	}
+	if len(path)-1 > int(maxPathLen) {
+		return nil, protocolError("read path len > max-path-len")
+	}
+	if table != nil {
+		checksum = crc32.Update(checksum, table, path)
+	}
+	if opener != nil {
+		aad = append(aad, path...)
+	}
+	pathStr := string(path[:len(path)-1])
+	if isHalfCloseStatus(status) && pathStr != "" {
+		return nil, protocolError("invalid half close frame, path: %s", pathStr)
+	}
+	frameLen := len(path) + 1
+
+	//read meta
+	var meta map[string]string
+	if format.meta() {
+		if m.btsMeta == nil {
+			m.btsMeta = make([]byte, 2+MaxMetaLen)
+		}
+		var rawMeta []byte
+		if meta, rawMeta, err = readMeta(m.reader, m.btsMeta); err != nil {
+			return nil, fmt.Errorf("read meta fail, %w", err)
+		}
+		if table != nil {
+			checksum = crc32.Update(checksum, table, rawMeta)
+		}
+		if opener != nil {
+			aad = append(aad, rawMeta...)
+		}
+		frameLen += len(rawMeta)
+	}
+
+	//read channelID
+	if _, err = io.ReadFull(m.reader, m.btsHeader[:]); err != nil {
+		return nil, readFrameError(err)
+	}
+	channelId := binary.BigEndian.Uint32(m.btsHeader[:])
+	if table != nil {
+		checksum = crc32.Update(checksum, table, m.btsHeader[:])
+	}
+	if opener != nil {
+		aad = append(aad, m.btsHeader[:]...)
+	}
+
+	//read seq
+	var seq uint32
+	if format.sequence() {
+		if _, err = io.ReadFull(m.reader, m.btsHeader[:]); err != nil {
+			return nil, readFrameError(err)
+		}
+		seq = binary.BigEndian.Uint32(m.btsHeader[:])
+		if table != nil {
+			checksum = crc32.Update(checksum, table, m.btsHeader[:])
+		}
+		if opener != nil {
+			aad = append(aad, m.btsHeader[:]...)
+		}
+		frameLen += 4
+	}
+
+	//read datalen
+	if _, err = io.ReadFull(m.reader, m.btsHeader[:]); err != nil {
+		return nil, readFrameError(err)
+	}
+	dataLen := binary.BigEndian.Uint32(m.btsHeader[:])
+	if table != nil {
+		checksum = crc32.Update(checksum, table, m.btsHeader[:])
+	}
+	//加密的数据包含认证标签，以下按明文的长度检查
+	plainLen := dataLen
+	if opener != nil {
+		aad = append(aad, m.btsHeader[:]...)
+		if dataLen < pskOverhead {
+			return nil, protocolError("invalid sealed data len: %d", dataLen)
+		}
+		plainLen -= pskOverhead
+	}
+	if plainLen > maxPacketSize {
+		return nil, protocolError("read data len meta > max-packet-size")
+	}
+	//半关闭帧的数据为空；协商FeatureTrailer之后，响应的后续结束帧(只携带trailer)可以为空；
+	//协商FeatureEmptyData之后任何帧的数据都可以为空。不属于连接的解析器不检查协商结果
+	emptyAllowed := m.conn == nil || m.conn.HasFeature(FeatureEmptyData) || (status == StatusS7 && m.conn.HasFeature(FeatureTrailer))
+	if (plainLen == 0 && !emptyAllowed && !isHalfCloseStatus(status)) || (plainLen != 0 && isHalfCloseStatus(status)) {
+		return nil, protocolError("invalid data len: %d, status: %d", plainLen, status)
+	}
+	frameLen += 8 + int(dataLen)
+
+	//read data
+	pkt := acquirePacket()
+	pkt.Status, pkt.Path, pkt.ChannelId, pkt.Meta, pkt.Seq = status, pathStr, channelId, meta, seq
+	var consumption *frameConsumption
+	var streamed bool
+	if m.conn != nil {
+		consumption = m.conn.frameConsumer(pkt)
+	}
+	if consumption != nil && opener == nil && plainLen >= consumption.threshold {
+		//大帧不分配缓冲区，consumer直接从读缓冲中读取，未读完的数据被丢弃，见framestream.go
+		//校验和在数据读完时由checksumReader校验，consumer在数据末尾得到校验的结果
+		r := &checksumReader{r: &io.LimitedReader{R: m.reader, N: int64(dataLen)}, src: m.reader, pkt: pkt, table: table, sum: checksum}
+		consumption.consume(pkt, r, int(dataLen))
+		if _, err = io.Copy(io.Discard, r); err == nil && r.r.N > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			err = r.verify()
+		}
+		if err != nil {
+			pkt.Release()
+			if err == r.err {
+				return nil, err
+			}
+			return nil, readFrameError(err)
+		}
+		streamed, consumption = true, nil
+	} else {
+		pkt.buf = getBuffer(int(dataLen))
+		pkt.Data = pkt.buf
+		if _, err = io.ReadFull(m.reader, pkt.Data); err != nil {
+			pkt.Release()
+			return nil, readFrameError(err)
+		}
+		if table != nil {
+			checksum = crc32.Update(checksum, table, pkt.Data)
+		}
+	}
+	if opener != nil {
+		m.aad = aad
+		if pkt.Data, err = opener.open(pkt.Data, aad); err != nil {
+			pkt.Release()
+			return nil, protocolError("frame decryption fail, channel id: %d, path: %s", channelId, pathStr)
+		}
+	}
+
+	//read checksum
+	if table != nil && !streamed {
+		if _, err = io.ReadFull(m.reader, m.btsHeader[:]); err != nil {
+			pkt.Release()
+			return nil, readFrameError(err)
+		}
+		if binary.BigEndian.Uint32(m.btsHeader[:]) != checksum {
+			pkt.Release()
+			return nil, protocolError("frame checksum mismatch, channel id: %d, path: %s", channelId, pathStr)
+		}
+	}
+	if table != nil {
+		frameLen += 4
+	}
+	if consumption != nil {
+		consumption.consumeBuffered(pkt)
+	}
+	m.frameLen = frameLen
+	return pkt, nil
+}
+
+//底层reader的读错误，包括帧不完整时的EOF
+func readFrameError(err error) error {
+	return fmt.Errorf("read data fail, %w", err)
+}
+
+//从r中解析一帧，帧格式及长度限制为默认值，见NewFrameReader。
+//r不是*bufio.Reader时可能预读帧之后的数据，连续解析多帧应使用FrameReader
+func ParseFrame(r io.Reader) (*Packet, error) {
+	return NewFrameReader(r).ReadFrame()
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+//flags的低2位为校验算法，其余各位分别对应元数据块、帧序号、关闭原因
+func fuzzFrameFormat(flags byte) frameFormat {
+	ret := newFrameFormat(flags&3%3, flags&4 != 0)
+	if flags&8 != 0 {
+		ret |= frameFormatSeq
+	}
+	if flags&16 != 0 {
+		ret |= frameFormatCloseReason
+	}
+	return ret
+}
+
+func fuzzFrameReader(data []byte, format frameFormat) *FrameReader {
+	r := NewFrameReader(bytes.NewReader(data))
+	r.SetFormat(format.checksum(), format.meta())
+	r.SetSequence(format.sequence())
+	r.SetCloseReason(format.closeReason())
+	return r
+}
+
+func FuzzReadFrame(f *testing.F) {
+	pkts := []*Packet{
+		{Status: StatusC1, Path: "/test/echo", ChannelId: 1, Seq: 1, Data: []byte("hello")},
+		{Status: StatusS5, Path: "/test/echo", ChannelId: 2, Seq: 7, Data: []byte("world"), Meta: map[string]string{"k": "v"}},
+		{Status: StatusC0, Path: "/a", ChannelId: 3, Data: bytes.Repeat([]byte{0xab}, 300)},
+		{Status: StatusC9, ChannelId: 4},
+	}
+	for flags := byte(0); flags < 32; flags++ {
+		format := fuzzFrameFormat(flags)
+		var buf bytes.Buffer
+		for _, pkt := range pkts {
+			if _, err := writePacket(pkt, &buf, format, nil); err != nil {
+				f.Fatal(err)
+			}
+		}
+		if format.closeReason() {
+			buf.Write(appendCloseFrame(nil, ErrClosed.(*Error)))
+		} else {
+			buf.WriteByte(Status8)
+		}
+		f.Add(flags, buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, flags byte, data []byte) {
+		format := fuzzFrameFormat(flags)
+		r := fuzzFrameReader(data, format)
+		consumed := 0
+		for {
+			pkt, err := r.ReadFrame()
+			if err != nil {
+				return
+			}
+			consumed += r.FrameLen()
+			if r.FrameLen() <= 0 || consumed > len(data) {
+				t.Fatalf("frame len %d, consumed %d of %d bytes", r.FrameLen(), consumed, len(data))
+			}
+			if pkt.Status == Status8 {
+				pkt.Release()
+				continue
+			}
+			//解析成功的帧重新编码之后应解析出相同的内容
+			var buf bytes.Buffer
+			if _, err := writePacket(pkt, &buf, format, nil); err != nil {
+				t.Fatal(err)
+			}
+			again, err := fuzzFrameReader(buf.Bytes(), format).ReadFrame()
+			if err != nil {
+				t.Fatalf("re-read frame fail, %s", err)
+			}
+			if again.Status != pkt.Status || again.Path != pkt.Path || again.ChannelId != pkt.ChannelId || again.Seq != pkt.Seq ||
+				!bytes.Equal(again.Data, pkt.Data) || (len(pkt.Meta) > 0 || len(again.Meta) > 0) && !reflect.DeepEqual(again.Meta, pkt.Meta) {
+				t.Fatalf("frame changed after re-encode: %+v, %+v", pkt, again)
+			}
+			again.Release()
+			pkt.Release()
+		}
+	})
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//大帧的流式读取：读循环默认为每一帧分配dataLen字节的缓冲区，16MB的帧即占用16MB内存，即使handler只是将其写入磁盘。
+//以RegisterFrameConsumer为path注册FrameConsumer之后，该path的请求帧在读循环中同步交给consumer，consumer须在返回之前读完数据，
+//读循环在consumer返回之后才解析下一帧，未读完的数据被丢弃。数据不小于ServerConfig.StreamFrameThreshold的帧不分配缓冲区，
+//consumer直接从连接的读缓冲中读取；较小的帧照常读入内存、校验之后再交给consumer，consumer因此按顺序看到请求的每一帧。
+//帧数据由consumer消费之后，帧以空数据照常交给该path注册的handler，handler在请求完成(dataCompleted)时返回响应。
+//注意：
+//	consumer阻塞读循环，连接上其他channel的帧在此期间不被读取，FrameReadTimeout同样计入consumer的耗时；
+//	流式读取的帧在数据读完时才校验校验和：不匹配时r在数据末尾返回校验错误而不是io.EOF，连接随后被关闭。
+//	r返回io.EOF之前读出的数据都未经校验，consumer应在读到io.EOF之后再提交(如重命名临时文件)，否则须由应用丢弃已写出的数据；
+//	协商ChecksumNone的连接没有校验和，数据始终未经校验；
+//	以PSK加密的连接须先解密整个帧，帧总是读入内存之后再交给consumer；
+//	consumer在限流、内存预算、租户准入及MaxRequestSize的检查之前调用，流式读取的帧不计入这些限制；
+//	consumer返回错误时以该错误重置channel(见reset.go)，请求的后续帧被丢弃
+package iip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+//StreamFrameThreshold为0时流式读取的帧数据的最小字节数
+const DefaultStreamFrameThreshold = 64 * 1024
+
+//在读循环中同步消费请求帧的数据。r的长度为size，last表示请求的最后一帧。
+//r读到io.EOF表示数据完整且校验和正确，校验和不匹配时r在数据末尾返回错误。
+//返回错误时channel被重置，*Error的错误码及消息原样返回给client，其他错误的错误码为-1
+type FrameConsumer interface {
+	ConsumeFrame(c *Channel, path string, r io.Reader, size int, last bool) error
+}
+
+//函数适配为FrameConsumer
+type FrameConsumerFunc func(c *Channel, path string, r io.Reader, size int, last bool) error
+
+func (f FrameConsumerFunc) ConsumeFrame(c *Channel, path string, r io.Reader, size int, last bool) error {
+	return f(c, path, r, size, last)
+}
+
+//注册path的FrameConsumer，path还须以RegisterHandler注册handler以返回响应
+func (m *Server) RegisterFrameConsumer(path string, consumer FrameConsumer) error {
+	if consumer == nil {
+		return fmt.Errorf("consumer is nil")
+	}
+	if len(path) > int(MaxPathLen) {
+		return fmt.Errorf("path is too large, must <= %d", MaxPathLen)
+	}
+	if isSysPath(path) {
+		return errReservedPath(path)
+	}
+	m.consumerLock.Lock()
+	defer m.consumerLock.Unlock()
+	if m.frameConsumers == nil {
+		m.frameConsumers = make(map[string]FrameConsumer)
+	}
+	m.frameConsumers[path] = consumer
+	return nil
+}
+
+func (m *Server) UnRegisterFrameConsumer(path string) {
+	m.consumerLock.Lock()
+	defer m.consumerLock.Unlock()
+	delete(m.frameConsumers, path)
+}
+
+func (m *Server) getFrameConsumer(path string) FrameConsumer {
+	m.consumerLock.RLock()
+	defer m.consumerLock.RUnlock()
+	return m.frameConsumers[path]
+}
+
+//读循环中正在消费的一帧
+type frameConsumption struct {
+	consumer  FrameConsumer
+	channel   *Channel
+	threshold uint32
+}
+
+//解析完帧头之后调用：帧属于注册了FrameConsumer的path时返回消费的方式，否则返回nil，帧照常读入内存
+func (m *Connection) frameConsumer(pkt *Packet) *frameConsumption {
+	svr := m.server
+	if m.Role != RoleServer || svr == nil || pkt.ChannelId == 0 || pkt.Status > StatusC3 {
+		return nil
+	}
+	consumer := svr.getFrameConsumer(pkt.Path)
+	if consumer == nil {
+		return nil
+	}
+	config := svr.getConfig()
+	if config.authRequired() && atomic.LoadInt32(&m.authenticated) == 0 {
+		return nil
+	}
+	channel := m.getChannel(pkt.ChannelId)
+	if channel == nil || channel.push || channel.getStream() != nil || atomic.LoadInt32(&channel.rejected) == 1 {
+		return nil
+	}
+	threshold := config.StreamFrameThreshold
+	if threshold == 0 {
+		threshold = DefaultStreamFrameThreshold
+	}
+	return &frameConsumption{consumer: consumer, channel: channel, threshold: threshold}
+}
+
+//以r调用consumer，出错或panic时重置channel
+func (m *frameConsumption) consume(pkt *Packet, r io.Reader, size int) {
+	c := m.channel
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("consume frame of %s panic: %v\n%s", pkt.Path, r, debug.Stack())
+				err = ErrHandlerPanic
+			}
+		}()
+		return m.consumer.ConsumeFrame(c, pkt.Path, r, size, pkt.Status == StatusC1 || pkt.Status == StatusC3)
+	}()
+	if err == nil {
+		return
+	}
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: -1, Message: "consume frame fail:" + err.Error()}
+	}
+	c.reject(pkt.Path, e)
+}
+
+//流式读取帧数据，同时累加校验和，数据读完时读取帧尾的校验和并比较
+type checksumReader struct {
+	r        *io.LimitedReader
+	src      io.Reader //帧尾校验和的来源
+	pkt      *Packet
+	table    *crc32.Table
+	sum      uint32
+	verified bool
+	err      error
+}
+
+func (m *checksumReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	if m.table != nil && n > 0 {
+		m.sum = crc32.Update(m.sum, m.table, p[:n])
+	}
+	if err == io.EOF && m.r.N <= 0 {
+		if e := m.verify(); e != nil {
+			return n, e
+		}
+	}
+	return n, err
+}
+
+//读取并比较帧尾的校验和，只进行一次，数据须已读完
+func (m *checksumReader) verify() error {
+	if m.table == nil || m.verified {
+		return m.err
+	}
+	m.verified = true
+	var bt [4]byte
+	if _, err := io.ReadFull(m.src, bt[:]); err != nil {
+		m.err = readFrameError(err)
+	} else if binary.BigEndian.Uint32(bt[:]) != m.sum {
+		m.err = protocolError("frame checksum mismatch, channel id: %d, path: %s", m.pkt.ChannelId, m.pkt.Path)
+	}
+	return m.err
+}
+
+//帧数据已读入内存并校验，交给consumer之后丢弃
+func (m *frameConsumption) consumeBuffered(pkt *Packet) {
+	m.consume(pkt, bytes.NewReader(pkt.Data), len(pkt.Data))
+	pkt.Data = nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestChecksumReaderVerifiesAtEOF(t *testing.T) {
+	table := checksumTable(ChecksumCRC32C)
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	frame := func(sum uint32) *checksumReader {
+		var buf bytes.Buffer
+		buf.Write(data)
+		binary.Write(&buf, binary.BigEndian, sum)
+		buf.WriteString("next")
+		return &checksumReader{r: &io.LimitedReader{R: &buf, N: int64(len(data))}, src: &buf, pkt: &Packet{ChannelId: 1}, table: table}
+	}
+	sum := crc32.Checksum(data, table)
+
+	r := frame(sum)
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read valid frame: %d bytes, %v", len(got), err)
+	}
+	if err := r.verify(); err != nil {
+		t.Fatal(err)
+	}
+	if rest, _ := io.ReadAll(r.src); string(rest) != "next" {
+		t.Fatalf("checksum not consumed exactly, rest: %q", rest)
+	}
+
+	//校验和不匹配时consumer在数据末尾得到错误而不是io.EOF
+	r = frame(sum + 1)
+	got, err = io.ReadAll(r)
+	if err == nil || !bytes.Equal(got, data) {
+		t.Fatalf("read corrupted frame: %d bytes, %v", len(got), err)
+	}
+	if r.verify() != err {
+		t.Fatalf("verify returned a different error: %v", r.verify())
+	}
+}
+
+func TestStreamedFrameChecksum(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{Checksum: ChecksumCRC32C})
+	const path = "/test/consume"
+	consumed := make(chan error, 1)
+	var received []byte
+	var streamed bool
+	err := server.RegisterFrameConsumer(path, FrameConsumerFunc(func(c *Channel, path string, r io.Reader, size int, last bool) error {
+		if _, ok := r.(*checksumReader); ok {
+			streamed = true
+		}
+		data, err := io.ReadAll(r)
+		received = append(received, data...)
+		if last {
+			consumed <- err
+		}
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.RegisterHandler(path, NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		_, err := w.Write([]byte("ok"))
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, addr, ClientConfig{Checksum: ChecksumCRC32C})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), DefaultStreamFrameThreshold/5)
+	if _, err := channel.DoRequest(path, data, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-consumed; err != nil {
+		t.Fatalf("streamed frame not verified: %v", err)
+	}
+	if !streamed {
+		t.Fatal("no frame was streamed")
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %d bytes, sent %d", len(received), len(data))
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//GOAWAY：server的连接进入排空状态(超过最大存活时间、Server.Drain)时，在0号channel上向client发送GOAWAY通知，
+//client随即停止在该连接上新建channel，而不必等到新建channel被拒绝，已有的channel继续工作直至被server关闭，
+//channel全部关闭之后client即关闭该连接。GOAWAY须在握手时协商FeatureGoAway
+package iip
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type GoAway struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+func (m *Connection) sendGoAway(reason string) {
+	if !m.HasFeature(FeatureGoAway) {
+		return
+	}
+	bts, _ := json.Marshal(&GoAway{Reason: reason})
+	c := m.getChannel(0)
+	if c == nil {
+		return
+	}
+	if err := c.SendPacketTimeout(&Packet{Type: PacketTypeResponse, Path: PathGoAway, ChannelId: 0, Data: bts, channel: c}, 0); err != nil {
+		log.Warnf("send goaway to %s fail, %s", m.key, err.Error())
+	}
+}
+
+//client端在读循环中处理GOAWAY
+func (m *Connection) handleGoAway(pkt *Packet) {
+	defer pkt.Release()
+	var goAway GoAway
+	json.Unmarshal(pkt.Data, &goAway)
+	if atomic.CompareAndSwapInt32(&m.draining, 0, 1) {
+		log.Logf("connection %s goaway received, %s", m.key, goAway.Reason)
+	}
+	m.closeIfDrained()
+}
+
+//client端的连接进入排空状态之后不再新建channel，channel(不含0号channel)全部关闭时即关闭连接，不必等待server关闭。
+//在进入排空状态及channel关闭时调用
+func (m *Connection) closeIfDrained() {
+	if m.Role != RoleClient || !m.Draining() || m.closeInitiated() {
+		return
+	}
+	m.ChannelsLock.RLock()
+	n := len(m.Channels)
+	if _, ok := m.Channels[0]; ok {
+		n--
+	}
+	m.ChannelsLock.RUnlock()
+	if n > 0 {
+		return
+	}
+	//channel的关闭通知可能仍在写队列中
+	go m.closeGraceful(fmt.Errorf("connection drained"), time.Second)
+}
+
+//排空连接：发送GOAWAY，关闭静止的channel，channel全部关闭或者超过宽限期grace之后关闭连接
+func (m *Connection) Drain(grace time.Duration) {
+	if !m.startDrain("shutting down") {
+		return
+	}
+	m.goLoop(func() { m.drainLoop(time.Now(), grace, m.closeNotify) })
+}
+
+func (m *Connection) drainLoop(drainStart time.Time, grace time.Duration, done chan int) {
+	ticker := time.NewTicker(time.Millisecond * 200)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if m.drainTick(now, drainStart, grace, ErrConnDraining) {
+				return
+			}
+		}
+	}
+}
+
+//优雅关闭server：停止accept新连接，排空全部连接，连接全部关闭或者超过grace之后停止server
+func (m *Server) Drain(grace time.Duration) {
+	if !atomic.CompareAndSwapInt32(&m.draining, 0, 1) {
+		return
+	}
+	for _, lsn := range m.getListeners() {
+		lsn.Close()
+	}
+	deadline := time.Now().Add(grace)
+	for _, conn := range m.connectionList() {
+		conn.Drain(grace)
+	}
+	for time.Now().Before(deadline) {
+		m.connLock.Lock()
+		n := len(m.connections)
+		m.connLock.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	m.Stop(fmt.Errorf("server drained"))
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func serverConnections(server *Server) []*Connection {
+	server.connLock.Lock()
+	defer server.connLock.Unlock()
+	ret := make([]*Connection, 0, len(server.connections))
+	for _, v := range server.connections {
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+//server排空了client已有的全部连接而client尚未得知时，新建channel依次尝试每个连接，最终在新建的连接上完成；
+//被拒绝的连接没有channel，随即被client关闭
+func TestNewChannelSkipsDrainingConnections(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{})
+	//每个连接只能有一个channel(另有0号channel)
+	client := newTestClient(t, addr, ClientConfig{MaxChannelsPerConn: 2})
+	var channels []*ClientChannel
+	for i := 0; i < 3; i++ {
+		c, err := client.NewChannel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		channels = append(channels, c)
+	}
+	if n := len(client.ConnectionsSnapshot()); n != 3 {
+		t.Fatalf("%d client connections, expected 3", n)
+	}
+	//不发送GOAWAY，client只能从新建channel的拒绝得知
+	for _, v := range serverConnections(server) {
+		atomic.StoreInt32(&v.draining, 1)
+	}
+	for _, c := range channels {
+		c.Close(nil)
+	}
+	c, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret, err := c.DoRequest(testEchoPath, []byte("x"), time.Second*5); err != nil || string(ret) != "x" {
+		t.Fatalf("request: %q, %v", ret, err)
+	}
+	waitFor(t, "drained connections closed", func() bool { return len(client.ConnectionsSnapshot()) == 1 })
+	if c.internalChannel.conn.Draining() {
+		t.Fatal("new channel on a draining connection")
+	}
+}
+
+//收到GOAWAY之后，client在最后一个channel关闭时关闭连接，不等待server关闭
+func TestDrainedConnectionClosedAfterLastChannel(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{})
+	client := newTestClient(t, addr, ClientConfig{})
+	c, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := c.internalChannel.conn
+	//只发送GOAWAY，不启动server端的排空，连接只能由client关闭
+	for _, v := range serverConnections(server) {
+		atomic.StoreInt32(&v.draining, 1)
+		v.sendGoAway("test")
+	}
+	waitFor(t, "goaway", conn.Draining)
+	//已有的channel继续工作
+	if ret, err := c.DoRequest(testEchoPath, []byte("x"), time.Second*5); err != nil || string(ret) != "x" {
+		t.Fatalf("request on draining connection: %q, %v", ret, err)
+	}
+	if conn.isClosed() {
+		t.Fatal("connection closed while a channel is open")
+	}
+	c.Close(nil)
+	waitFor(t, "client connection closed", conn.isClosed)
+	waitFor(t, "server connection closed", func() bool { return len(serverConnections(server)) == 0 })
+}
+
+//Server.Drain停止accept、通知client，进行中的请求正常完成，client关闭channel之后drain随即结束
+func TestServerDrain(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{Workers: 2})
+	registerSleepHandler(t, server)
+	client := newTestClient(t, addr, ClientConfig{})
+	c, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	if err := c.DoRequestAsync("/test/sleep", []byte("300"), time.Second*5, func(resp []byte, err error) { done <- err }); err != nil {
+		t.Fatal(err)
+	}
+	const grace = time.Second * 5
+	start := time.Now()
+	drained := make(chan struct{})
+	go func() {
+		server.Drain(grace)
+		close(drained)
+	}()
+	conn := c.internalChannel.conn
+	waitFor(t, "goaway", conn.Draining)
+	//已有的连接排空中，listener已关闭，不能再新建channel
+	if _, err := client.NewChannel(); err == nil {
+		t.Fatal("new channel on a draining server")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("in-flight request: %v", err)
+	}
+	c.Close(nil)
+	select {
+	case <-drained:
+	case <-time.After(grace):
+		t.Fatal("drain not finished")
+	}
+	if elapsed := time.Since(start); elapsed >= grace {
+		t.Fatalf("drain waited the whole grace period, %v", elapsed)
+	}
+	waitFor(t, "client connection closed", conn.isClosed)
+}
+
+//超过宽限期仍在处理的请求随连接关闭，而不是等到请求超时
+func TestServerDrainGraceExpired(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{Workers: 2})
+	registerSleepHandler(t, server)
+	client := newTestClient(t, addr, ClientConfig{})
+	c, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	if err := c.DoRequestAsync("/test/sleep", []byte("2000"), time.Second*5, func(resp []byte, err error) { done <- err }); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	server.Drain(time.Millisecond * 300)
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Fatalf("drain took %v", elapsed)
+	}
+	//连接的排空与server的停止同时到期，以先到者的原因关闭
+	if err := <-done; !errors.Is(err, ErrConnDraining) && !errors.Is(err, ErrShutdown) {
+		t.Fatalf("expected connection draining or shutdown, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9 && !js && !wasip1
+
+//grace：iip server程序的不停机替换。收到SIGUSR2(或SIGHUP)时，将监听socket传给重新exec的新进程，
+//新进程在继承的socket上继续accept，旧进程停止accept，向已有连接发送GOAWAY并排空，连接全部关闭后退出。
+//监听socket在两个进程之间共享，替换期间到达的连接留在内核的backlog中，不会被拒绝。用法：
+//	svr, _ := iip.NewServer(config, "")
+//	if err := grace.Serve(svr, ":9090", time.Minute); err != nil { ... }
+package grace
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//新进程从该环境变量得知继承的监听socket个数，socket的fd从3开始
+const envListenFDs = "IIP_GRACE_LISTEN_FDS"
+
+//继承的监听socket，按地址索引，只在Listen中取用一次
+var inherited = make(map[string]net.Listener)
+
+func init() {
+	n, _ := strconv.Atoi(os.Getenv(envListenFDs))
+	os.Unsetenv(envListenFDs)
+	for i := 0; i < n; i++ {
+		f := os.NewFile(uintptr(3+i), "listener")
+		lsn, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		inherited[lsn.Addr().String()] = lsn
+	}
+}
+
+//当前进程是否由Restart启动
+func Inherited() bool {
+	return len(inherited) > 0
+}
+
+//返回从父进程继承的addr上的监听socket，没有时新建
+func Listen(addr string) (net.Listener, error) {
+	if tcpAddr, err := net.ResolveTCPAddr("tcp4", addr); err == nil {
+		for k, lsn := range inherited {
+			if a, ok := lsn.Addr().(*net.TCPAddr); ok && a.Port == tcpAddr.Port && (tcpAddr.IP == nil || tcpAddr.IP.Equal(a.IP)) {
+				delete(inherited, k)
+				return lsn, nil
+			}
+		}
+	}
+	return net.Listen("tcp4", addr)
+}
+
+//以相同的命令行参数及环境启动新进程，并将listeners传给新进程
+func Restart(listeners ...net.Listener) (*os.Process, error) {
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, lsn := range listeners {
+		fl, ok := lsn.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("listener %s can not be passed to child process", lsn.Addr().String())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", envListenFDs, len(files)))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
+
+//在addr上运行server直至被替换或者终止：SIGUSR2、SIGHUP时启动新进程接替，之后排空并返回；
+//SIGINT、SIGTERM时排空并返回。排空最多等待grace
+func Serve(svr *iip.Server, addr string, grace time.Duration) error {
+	lsn, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	svr.Serve(lsn)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	for sig := range signals {
+		if sig == syscall.SIGUSR2 || sig == syscall.SIGHUP {
+			process, err := Restart(lsn)
+			if err != nil {
+				//新进程启动失败时继续服务
+				iip.GetLogger().Errorf("grace restart fail, %s", err.Error())
+				continue
+			}
+			iip.GetLogger().Logf("grace restart, new process %d", process.Pid)
+		}
+		svr.Drain(grace)
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//channel的半关闭：一端发送半关闭帧(client为StatusC9，server为StatusS10)表示本端的数据已经发送完毕，
+//但仍继续接收对端的数据，如client流式发送完请求后等待server的响应流。两个方向都关闭后channel被回收，
+//不再需要PathDeleteChannel通知。半关闭须在握手时协商FeatureHalfClose
+package iip
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	halfClosedLocal  int32 = 1 //本端已半关闭
+	halfClosedRemote int32 = 2 //对端已半关闭
+	halfClosedEOF    int32 = 4 //对端的半关闭帧已被handle循环处理，其之前到达的数据都已交付
+	halfClosedBoth   int32 = halfClosedLocal | halfClosedRemote
+	halfClosedDone   int32 = halfClosedBoth | halfClosedEOF
+)
+
+func isHalfCloseStatus(status byte) bool {
+	return status == StatusC9 || status == StatusS10
+}
+
+//设置半关闭标志，返回设置之后的状态，重复设置时返回0
+func (m *Channel) setHalfClosed(flag int32) int32 {
+	for {
+		old := atomic.LoadInt32(&m.halfClosed)
+		if old&flag != 0 {
+			return 0
+		}
+		if atomic.CompareAndSwapInt32(&m.halfClosed, old, old|flag) {
+			return old | flag
+		}
+	}
+}
+
+//本端是否已经半关闭，半关闭之后SendPacket返回ErrSendClosed
+func (m *Channel) SendClosed() bool {
+	return atomic.LoadInt32(&m.halfClosed)&halfClosedLocal != 0
+}
+
+//对端是否已经半关闭，即对端不会再发送数据
+func (m *Channel) PeerSendClosed() bool {
+	return atomic.LoadInt32(&m.halfClosed)&halfClosedRemote != 0
+}
+
+//半关闭channel：通知对端本端不再发送数据，之后仍可以接收对端的数据。
+//须在当前消息发送完整之后调用，重复调用无效果
+func (m *Channel) CloseSend() error {
+	if err := m.errClosed(); err != nil {
+		return err
+	}
+	if m.Id == 0 {
+		return fmt.Errorf("system channel can not be half closed")
+	}
+	if !m.conn.HasFeature(FeatureHalfClose) {
+		return fmt.Errorf("peer does not support half close")
+	}
+	m.sendLock.Lock()
+	if m.SendClosed() {
+		m.sendLock.Unlock()
+		return nil
+	}
+	pkt := acquirePacket()
+	pkt.Type, pkt.Status, pkt.ChannelId, pkt.channel = PacketTypeRequest, StatusC9, m.Id, m
+	if m.conn.Role == RoleServer {
+		pkt.Type, pkt.Status = PacketTypeResponse, StatusS10
+	}
+	m.conn.enqueuePacket(pkt, -1, nil)
+	state := m.setHalfClosed(halfClosedLocal)
+	m.sendLock.Unlock()
+	m.halfClosedChanged(state)
+	return nil
+}
+
+//收到对端的半关闭帧，在读循环中调用，之后半关闭帧经receivedQueue交给handle循环
+func (m *Channel) peerCloseSend() {
+	if m.Id != 0 {
+		m.halfClosedChanged(m.setHalfClosed(halfClosedRemote))
+	}
+}
+
+//handle循环处理到对端的半关闭帧
+func (m *Channel) peerEOF() {
+	if m.Id != 0 {
+		m.halfClosedChanged(m.setHalfClosed(halfClosedEOF))
+	}
+}
+
+//两个方向都关闭后立即释放channel id，保证半关闭帧先于id的复用到达对端；
+//对端半关闭之前到达的数据全部交付之后再关闭channel
+func (m *Channel) halfClosedChanged(state int32) {
+	if state&halfClosedBoth == halfClosedBoth {
+		m.conn.removeChannel(m)
+	}
+	if state == halfClosedDone {
+		m.close(fmt.Errorf("both sides closed"), false)
+	}
+}
@@ -9,8 +9,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
+type RequestNewChannel struct {
+	ChannelId uint32 `json:"channel_id"`
+}
+
 type ResponseNewChannel struct {
 	Code      int    `json:"code"`
 	Message   string `json:"message,omitempty"`
@@ -22,9 +27,23 @@ type ResponseDeleteChannel struct {
 	Message string `json:"message,omitempty"`
 }
 
+type ResponseProbe struct {
+	Code               int    `json:"code"`
+	Message            string `json:"message,omitempty"`
+	Version            uint32 `json:"version"`
+	Features           uint32 `json:"features"`
+	PathCount          int    `json:"path_count"`
+	MaxPathLen         uint32 `json:"max_path_len"`
+	MaxPacketSize      uint32 `json:"max_packet_size"`
+	FrameSize          uint32 `json:"frame_size,omitempty"`
+	MaxConnections     int    `json:"max_connections"`
+	MaxChannelsPerConn int    `json:"max_channels_per_conn"`
+}
+
 type ResponseHandleFail struct {
 	Code    int    `json:"code"`
 	Message string `json:"message,omitempty"`
+	Details string `json:"details,omitempty"`
 }
 
 func (m *ResponseHandleFail) Data() []byte {
@@ -36,7 +55,7 @@ func (m *ResponseHandleFail) Data() []byte {
 }
 
 func ErrorResponse(err *Error) *ResponseHandleFail {
-	return &ResponseHandleFail{Code: err.Code, Message: err.Message}
+	return &ResponseHandleFail{Code: err.Code, Message: err.Message, Details: err.Details}
 }
 
 //管理PathHandler,从属于一个client或server
@@ -57,6 +76,12 @@ func (m *PathHandlerManager) getHandler(path string) PathHandler {
 	return nil
 }
 
+func (m *PathHandlerManager) count() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.HanderMap)
+}
+
 func (m *PathHandlerManager) registerHandler(path string, handler PathHandler) error {
 	if handler == nil {
 		return fmt.Errorf("hander is nil")
@@ -64,13 +89,20 @@ func (m *PathHandlerManager) registerHandler(path string, handler PathHandler) e
 	if len(path) > int(MaxPathLen) {
 		return fmt.Errorf("path is too large, must <= %d", MaxPathLen)
 	}
+	if isSysPath(path) {
+		return errReservedPath(path)
+	}
+	m.register(path, handler)
+	return nil
+}
+
+func (m *PathHandlerManager) register(path string, handler PathHandler) {
 	m.Lock()
 	defer m.Unlock()
 	if m.HanderMap == nil {
 		m.HanderMap = make(map[string]PathHandler)
 	}
 	m.HanderMap[path] = handler
-	return nil
 }
 
 func (m *PathHandlerManager) unRegisterHandler(path string) {
@@ -87,6 +119,16 @@ type Handler interface {
 	Handle(c *Channel, request *Packet, dataCompleted bool) ([]byte, error)
 }
 
+//函数适配为Handler
+type HandlerFunc func(c *Channel, request *Packet, dataCompleted bool) ([]byte, error)
+
+func (f HandlerFunc) Handle(c *Channel, request *Packet, dataCompleted bool) ([]byte, error) {
+	return f(c, request, dataCompleted)
+}
+
+//中间件，包装next并返回新的Handler，用于日志、鉴权、统计、限流等可组合的处理层
+type Middleware func(next Handler) Handler
+
 //path-handler接口，PathHandler在packet-handler基础上执行，有serverHandler或clientHandler在Handle函数内部调用
 type PathHandler interface {
 	Handle(c *Channel, path string, data []byte, dataCompleted bool) ([]byte, error)
@@ -95,36 +137,50 @@ type PathHandler interface {
 type serverHandler struct {
 	DefaultContext
 	pathHandlerManager *PathHandlerManager
+	sys                *sysMux  //系统path的分派，见sysmux.go
+	pathCounters       sync.Map //path -> *pathMetrics
 }
 
 func (m *serverHandler) Handle(c *Channel, request *Packet, dataCompleted bool) ([]byte, error) {
 	if request == nil || request.Path == "" || request.channel == nil || request.channel.conn == nil {
 		return nil, fmt.Errorf("invalid request")
 	}
-	switch request.Path {
-	case PathNewChannel:
-		c := request.channel.conn.newChannel(false, 100)
-		bts, _ := json.Marshal(&ResponseNewChannel{Code: 0, ChannelId: c.Id})
-		return bts, nil
-	case PathDeleteChannel:
-		request.channel.Close(fmt.Errorf("close by peer command"))
-		bts, _ := json.Marshal(&ResponseDeleteChannel{Code: 0})
-		return bts, nil
-	default:
-		pathHandler := m.pathHandlerManager.getHandler(request.Path)
-		if pathHandler == nil {
-			bts, _ := json.Marshal(&ResponseHandleFail{Code: -1, Message: "no handler"})
-			return bts, nil
-		} else {
-			ret, err := pathHandler.Handle(c, request.Path, request.Data, dataCompleted)
-			if err != nil {
-				bts, _ := json.Marshal(&ResponseHandleFail{Code: -1, Message: "handler fail:" + err.Error()})
-				return bts, nil
-			} else {
-				return ret, nil
-			}
+	if isSysPath(request.Path) {
+		return m.sys.handle(c, request, dataCompleted)
+	}
+	var pathHandler PathHandler
+	tenant := request.channel.conn.tenant()
+	if tenant != nil {
+		if err := tenant.admitRequest(request); err != nil {
+			return nil, &Error{Code: -1, Message: err.Error()}
 		}
+		svr := request.channel.conn.server
+		pathHandler = tenant.getHandler(request.Path, svr)
+	} else {
+		pathHandler = m.pathHandlerManager.getHandler(request.Path)
+	}
+	if pathHandler == nil {
+		return nil, ErrNoHandler
+	}
+	ret, err := pathHandler.Handle(c, request.Path, request.Data, dataCompleted)
+	if err == ErrResponseSent {
+		m.countPath(request.Path, nil)
+	} else if err != ErrPacketContinue {
+		m.countPath(request.Path, err)
+	}
+	if err == ErrPacketContinue || err == ErrResponseSent {
+		return nil, err
+	} else if err != nil {
+		//*Error原样作为错误帧返回，其他错误的错误码为-1
+		if _, ok := err.(*Error); ok {
+			return nil, err
+		}
+		return nil, &Error{Code: -1, Message: "handler fail:" + err.Error(), cause: err}
+	}
+	if tenant != nil {
+		atomic.AddInt64(&tenant.stats.WriteBytes, int64(len(ret)))
 	}
+	return ret, nil
 }
 
 type clientHandler struct {
@@ -0,0 +1,251 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//连接建立后的握手：client在0号channel上发送/sys/handshake，双方交换各自的限制并取较小值作为连接的生效值，
+//同时协商发送时的分帧大小、帧校验算法及是否携带帧元数据；配置了PSK时协商加密，见psk.go；
+//server配置了Authenticator或CertAuthorizer时在握手中认证client
+package iip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+type RequestHandshake struct {
+	Version       uint32            `json:"version"`
+	MaxPacketSize uint32            `json:"max_packet_size"`
+	MaxPathLen    uint32            `json:"max_path_len"`
+	FrameSize     uint32            `json:"frame_size,omitempty"` //本端期望的每帧数据最大字节数，0表示不限制(即MaxPacketSize)
+	Checksum      byte              `json:"checksum,omitempty"`
+	Features      uint32            `json:"features,omitempty"` //本端支持的需协商的特性，见handshakeFeatures
+	Credentials   map[string]string `json:"credentials,omitempty"`
+	Nonce         []byte            `json:"nonce,omitempty"`  //配置了PSK时client的随机数，见psk.go
+	Proof         []byte            `json:"proof,omitempty"`  //client持有PSK的证明
+	Cipher        string            `json:"cipher,omitempty"` //配置了PSK时的加密算法，空为aes-256-gcm
+}
+
+type ResponseHandshake struct {
+	Code          int    `json:"code"`
+	Message       string `json:"message,omitempty"`
+	Version       uint32 `json:"version"`
+	MaxPacketSize uint32 `json:"max_packet_size"`
+	MaxPathLen    uint32 `json:"max_path_len"`
+	FrameSize     uint32 `json:"frame_size,omitempty"` //协商生效的每帧数据最大字节数，0表示不限制
+	Checksum      byte   `json:"checksum,omitempty"`
+	Features      uint32 `json:"features,omitempty"` //双方都支持、协商生效的特性
+	Nonce         []byte `json:"nonce,omitempty"`    //以PSK加密时server的随机数
+	Proof         []byte `json:"proof,omitempty"`    //server持有PSK的证明
+}
+
+//规范化配置的限制值：0表示使用默认值，且不能超过协议上限
+func normalizeLimit(v uint32, max uint32) uint32 {
+	if v == 0 || v > max {
+		return max
+	}
+	return v
+}
+
+func minLimit(a, b uint32) uint32 {
+	if b == 0 || a <= b {
+		return a
+	}
+	return b
+}
+
+//连接当前生效的packet最大字节数
+func (m *Connection) MaxPacketSize() uint32 {
+	return atomic.LoadUint32(&m.maxPacketSize)
+}
+
+//连接当前生效的path最大字节数
+func (m *Connection) MaxPathLen() uint32 {
+	return atomic.LoadUint32(&m.maxPathLen)
+}
+
+//连接发送时每帧数据的最大字节数，超过的数据被分为多帧发送，不超过MaxPacketSize
+func (m *Connection) FrameSize() uint32 {
+	maxPacketSize := m.MaxPacketSize()
+	if ret := atomic.LoadUint32(&m.frameSize); ret != 0 && ret < maxPacketSize {
+		return ret
+	}
+	return maxPacketSize
+}
+
+func (m *Connection) setFrameSize(frameSize uint32) {
+	atomic.StoreUint32(&m.frameSize, frameSize)
+}
+
+//协商分帧大小：0表示该端不限制，取双方限制中的较小值
+func minFrameSize(a, b uint32) uint32 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func (m *Connection) setLimits(maxPacketSize, maxPathLen uint32) {
+	atomic.StoreUint32(&m.maxPacketSize, normalizeLimit(maxPacketSize, MaxPacketSize))
+	atomic.StoreUint32(&m.maxPathLen, normalizeLimit(maxPathLen, MaxPathLen))
+}
+
+//server端在读循环中处理握手请求。
+//协商出的帧格式对读方向立即生效；对写方向，在握手响应写出之后生效。
+//每个连接只处理第一个握手请求，之后的握手不再重新认证、绑定租户或者改变已协商的限制与帧格式，以ErrProtocol拒绝
+func (m *Connection) handleHandshake(request *Packet) {
+	defer request.Release()
+	resp := &ResponseHandshake{Version: ProtocolVersion}
+	if !atomic.CompareAndSwapInt32(&m.handshaken, 0, 1) {
+		resp.Code, resp.Message = ErrProtocol.(*Error).Code, "handshake already done"
+		bts, _ := json.Marshal(resp)
+		pkt := acquirePacket()
+		pkt.Type, pkt.Status, pkt.Path, pkt.ChannelId, pkt.Data, pkt.channel = PacketTypeResponse, StatusS5, PathHandshake, 0, bts, m.getChannel(0)
+		m.enqueuePacket(pkt, -1, nil)
+		return
+	}
+	var req RequestHandshake
+	checksum := ChecksumNone
+	svr := m.server
+	if err := json.Unmarshal(request.Data, &req); err != nil {
+		resp.Code, resp.Message = -1, "invalid handshake request"
+		if svr != nil && svr.getConfig().authRequired() {
+			resp.Code = ErrAuthFailed.(*Error).Code
+		}
+	} else if err := svr.acceptPSK(m, &req, resp); err != nil {
+		resp.Code, resp.Message = ErrAuthFailed.(*Error).Code, "authentication failed, "+err.Error()
+	} else if err := svr.authenticate(m, req.Credentials); err != nil {
+		resp.Code, resp.Message = ErrAuthFailed.(*Error).Code, "authentication failed, "+err.Error()
+	} else {
+		m.setLimits(minLimit(m.MaxPacketSize(), req.MaxPacketSize), minLimit(m.MaxPathLen(), req.MaxPathLen))
+		m.setFrameSize(minFrameSize(atomic.LoadUint32(&m.frameSize), req.FrameSize))
+		checksum = req.Checksum
+		if checksum == ChecksumNone {
+			if svr != nil {
+				checksum = svr.getConfig().Checksum
+			}
+		}
+		if !isValidChecksum(checksum) || resp.Nonce != nil {
+			checksum = ChecksumNone
+		}
+		resp.MaxPacketSize, resp.MaxPathLen, resp.Checksum = m.MaxPacketSize(), m.MaxPathLen(), checksum
+		resp.FrameSize = atomic.LoadUint32(&m.frameSize)
+		resp.Features = req.Features & handshakeFeatures
+		m.setFeatures(resp.Features)
+	}
+	bts, _ := json.Marshal(resp)
+	pkt := acquirePacket()
+	pkt.Type, pkt.Status, pkt.Path, pkt.ChannelId, pkt.Data, pkt.channel = PacketTypeResponse, StatusS5, PathHandshake, 0, bts, m.getChannel(0)
+	if resp.Code == ErrAuthFailed.(*Error).Code {
+		//握手响应写出之后关闭连接
+		log.Errorf("connection %s %s", m.tcpConn.RemoteAddr().String(), resp.Message)
+		pkt.written = func() { m.Close(fmt.Errorf(resp.Message)) }
+	}
+	format := newFrameFormat(checksum, resp.Features&FeatureMetadata != 0)
+	if resp.Code == 0 && resp.Nonce != nil {
+		format |= frameFormatSealed
+	}
+	if resp.Code == 0 && resp.Features&FeatureSequence != 0 {
+		format |= frameFormatSeq
+	}
+	if resp.Code == 0 && resp.Features&FeatureCloseReason != 0 {
+		format |= frameFormatCloseReason
+	}
+	if format != newFrameFormat(ChecksumNone, false) {
+		m.setReadFrameFormat(format)
+		pkt.written = func() { m.setWriteFrameFormat(format) }
+	}
+	m.enqueuePacket(pkt, -1, nil)
+}
+
+func (m *Connection) setFeatures(features uint32) {
+	atomic.StoreUint32(&m.features, features)
+}
+
+//握手协商生效的特性是否包含feature
+func (m *Connection) HasFeature(feature uint32) bool {
+	return atomic.LoadUint32(&m.features)&feature != 0
+}
+
+//client端发起握手，对端不支持握手时保持本端的限制
+func (m *Client) handshake(conn *Connection) error {
+	timeout := m.config.TcpConnectTimeout
+	if timeout <= 0 {
+		timeout = time.Second * 3
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var credentials map[string]string
+	if m.config.Credentials != nil {
+		var err error
+		if credentials, err = m.config.Credentials(); err != nil {
+			return fmt.Errorf("handshake fail, %s", err.Error())
+		}
+	}
+	hs := &RequestHandshake{
+		Version:       ProtocolVersion,
+		MaxPacketSize: conn.MaxPacketSize(),
+		MaxPathLen:    conn.MaxPathLen(),
+		FrameSize:     m.config.FrameSize,
+		Checksum:      m.config.Checksum,
+		Features:      m.handshakeFeatures(),
+		Credentials:   credentials,
+	}
+	psk := m.config.PSK
+	if len(psk) > 0 {
+		var err error
+		if hs.Nonce, err = newPSKNonce(); err != nil {
+			return fmt.Errorf("handshake fail, %s", err.Error())
+		}
+		hs.Proof = pskProof(psk, "iip client", hs.Nonce)
+		hs.Cipher = pskCipherName(m.config.PSKCipher)
+	}
+	req, _ := json.Marshal(hs)
+	c := &ClientChannel{internalChannel: conn.getChannel(0), client: m}
+	bts, err := c.doRequestContext(ctx, PathHandshake, req)
+	if err != nil {
+		//保留server应答的错误，如ErrTooManyConnections
+		return fmt.Errorf("handshake fail, %w", err)
+	}
+	var resp ResponseHandshake
+	if err := json.Unmarshal(bts, &resp); err != nil {
+		return fmt.Errorf("handshake fail, %s", err.Error())
+	}
+	if resp.Code == ErrAuthFailed.(*Error).Code {
+		return &Error{Code: resp.Code, Message: resp.Message}
+	}
+	if resp.Code != 0 {
+		if len(psk) > 0 {
+			return fmt.Errorf("handshake fail, server does not support encryption")
+		}
+		log.Warnf("server does not support handshake: %s", resp.Message)
+		conn.setFrameSize(m.config.FrameSize)
+		return nil
+	}
+	conn.setLimits(minLimit(conn.MaxPacketSize(), resp.MaxPacketSize), minLimit(conn.MaxPathLen(), resp.MaxPathLen))
+	//分帧大小在握手完成之后才生效，握手请求本身不分帧
+	conn.setFrameSize(minFrameSize(m.config.FrameSize, resp.FrameSize))
+	if !isValidChecksum(resp.Checksum) {
+		return fmt.Errorf("handshake fail, unsupported checksum algorithm: %d", resp.Checksum)
+	}
+	//server在握手响应之后的帧开始使用新的帧格式，此时client尚未发出新的帧
+	format := newFrameFormat(resp.Checksum, resp.Features&FeatureMetadata != 0)
+	if len(psk) > 0 {
+		if err := conn.verifyPSK(m.config.PSKCipher, psk, hs.Nonce, &resp); err != nil {
+			return fmt.Errorf("handshake fail, %s", err.Error())
+		}
+		format = format.withChecksum(ChecksumNone) | frameFormatSealed
+	}
+	if resp.Features&FeatureSequence != 0 {
+		format |= frameFormatSeq
+	}
+	if resp.Features&FeatureCloseReason != 0 {
+		format |= frameFormatCloseReason
+	}
+	conn.setReadFrameFormat(format)
+	conn.setWriteFrameFormat(format)
+	conn.setFeatures(resp.Features)
+	return nil
+}
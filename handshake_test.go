@@ -0,0 +1,98 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+//分帧大小小于握手及new_channel请求的json时，握手仍然完成协商，协商之后的请求按分帧大小拆分
+func TestSmallFrameSizeNegotiates(t *testing.T) {
+	for _, frameSize := range []uint32{10, 40} {
+		_, addr := newTestServer(t, ServerConfig{})
+		client := newTestClient(t, addr, ClientConfig{FrameSize: frameSize})
+		c, err := client.NewChannel()
+		if err != nil {
+			t.Fatalf("frame size %d, new channel fail, %s", frameSize, err.Error())
+		}
+		conn := c.internalChannel.conn
+		if !conn.HasFeature(FeatureMetadata) {
+			t.Fatalf("frame size %d, handshake not negotiated", frameSize)
+		}
+		if conn.FrameSize() != frameSize {
+			t.Fatalf("frame size %d, negotiated %d", frameSize, conn.FrameSize())
+		}
+		request := bytes.Repeat([]byte("0123456789"), 10)
+		resp, err := c.DoRequest(testEchoPath, request, time.Second*3)
+		if err != nil {
+			t.Fatalf("frame size %d, request fail, %s", frameSize, err.Error())
+		}
+		if !bytes.Equal(resp, request) {
+			t.Fatalf("frame size %d, response mismatch", frameSize)
+		}
+	}
+}
+
+//已握手的连接再次握手被拒绝，不会重复绑定租户、改变已协商的结果
+func TestRepeatedHandshakeRejected(t *testing.T) {
+	server, tenant, addr := newTenantTestServer(t, TenantConfig{Name: "a", MaxConnections: 1})
+	client := newTestClient(t, addr, ClientConfig{Checksum: ChecksumCRC32C})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := channel.internalChannel.conn
+	waitTenantStats(t, tenant, 1, 1)
+
+	req, _ := json.Marshal(&RequestHandshake{Version: ProtocolVersion, Checksum: ChecksumNone, MaxPacketSize: 1024})
+	sys := &ClientChannel{internalChannel: conn.getChannel(0), client: client}
+	for i := 0; i < 2; i++ {
+		bts, err := sys.doRequestContext(context.Background(), PathHandshake, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp ResponseHandshake
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != ErrProtocol.(*Error).Code {
+			t.Fatalf("repeated handshake not rejected: %+v", resp)
+		}
+	}
+	waitTenantStats(t, tenant, 1, 1)
+	//连接仍以第一次握手的结果工作
+	data := bytes.Repeat([]byte("x"), 4096)
+	if ret, err := channel.DoRequest(testEchoPath, data, time.Second*5); err != nil || !bytes.Equal(ret, data) {
+		t.Fatalf("request after repeated handshake: %d bytes, %v", len(ret), err)
+	}
+	if n := len(server.ConnectionsSnapshot()); n != 1 {
+		t.Fatalf("%d connections on server", n)
+	}
+}
+
+//连接已绑定租户时bindTenant不再计数
+func TestBindTenantOnce(t *testing.T) {
+	server, tenant, addr := newTenantTestServer(t, TenantConfig{Name: "a"})
+	client := newTestClient(t, addr, ClientConfig{})
+	if _, err := client.NewChannel(); err != nil {
+		t.Fatal(err)
+	}
+	var conn *Connection
+	server.connLock.Lock()
+	for _, v := range server.connections {
+		conn = v
+	}
+	server.connLock.Unlock()
+	if err := server.bindTenant(conn); err != nil {
+		t.Fatal(err)
+	}
+	if n := tenant.Stats().Connections; n != 1 {
+		t.Fatalf("tenant connections: %d", n)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//健康检查：server总是应答/sys/health(不受SysEndpoints控制)；client配置HealthCheck后定期在每个连接的0号channel上请求/sys/health，
+//连续失败达到阈值的连接被标记为不健康，不再在其上新建channel，其地址也不再被Balancer选择，但继续探测，连续成功之后恢复
+package iip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HealthServing    = "serving"
+	HealthDraining   = "draining"    //连接或server正在排空
+	HealthNotServing = "not_serving" //ServerConfig.HealthCheck返回了错误
+)
+
+type HealthCheckConfig struct {
+	Interval           time.Duration                                   //探测间隔，默认5秒
+	Timeout            time.Duration                                   //单次探测的超时，默认1秒
+	UnhealthyThreshold int                                             //连续失败多少次标记为不健康，默认3
+	HealthyThreshold   int                                             //不健康的连接连续成功多少次恢复，默认1
+	OnStateChange      func(conn *Connection, healthy bool, err error) //连接健康状态变化时调用，err为最近一次探测的错误
+}
+
+type connHealth struct {
+	unhealthy int32
+	fails     int //以下只由探测goroutine访问
+	oks       int
+	checking  int32
+}
+
+//连接是否健康，未开启健康检查时总是健康
+func (m *Connection) Healthy() bool {
+	return atomic.LoadInt32(&m.health.unhealthy) == 0
+}
+
+//server的健康状态
+func (m *Server) healthStatus(conn *Connection) (string, string) {
+	if atomic.LoadInt32(&m.draining) == 1 || conn.Draining() {
+		return HealthDraining, ""
+	}
+	if check := m.getConfig().HealthCheck; check != nil {
+		if err := check(); err != nil {
+			return HealthNotServing, err.Error()
+		}
+	}
+	return HealthServing, ""
+}
+
+func (m *Client) healthLoop(config HealthCheckConfig) {
+	if config.Interval <= 0 {
+		config.Interval = time.Second * 5
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second
+	}
+	if config.UnhealthyThreshold <= 0 {
+		config.UnhealthyThreshold = 3
+	}
+	if config.HealthyThreshold <= 0 {
+		config.HealthyThreshold = 1
+	}
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closeNotify:
+			return
+		case <-ticker.C:
+		}
+		for _, conn := range m.connectionList() {
+			if conn.Draining() || !atomic.CompareAndSwapInt32(&conn.health.checking, 0, 1) {
+				continue
+			}
+			go func(conn *Connection) {
+				defer atomic.StoreInt32(&conn.health.checking, 0)
+				m.checkHealth(conn, config)
+			}(conn)
+		}
+	}
+}
+
+func (m *Client) checkHealth(conn *Connection, config HealthCheckConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	err := m.probeHealth(ctx, conn)
+	cancel()
+	h := &conn.health
+	if err == nil {
+		h.fails = 0
+		if atomic.LoadInt32(&h.unhealthy) == 0 {
+			return
+		}
+		if h.oks++; h.oks < config.HealthyThreshold {
+			return
+		}
+		h.oks = 0
+		atomic.StoreInt32(&h.unhealthy, 0)
+		log.Logf("connection %s healthy", conn.key)
+	} else {
+		h.oks = 0
+		if atomic.LoadInt32(&h.unhealthy) == 1 {
+			return
+		}
+		if h.fails++; h.fails < config.UnhealthyThreshold {
+			return
+		}
+		h.fails = 0
+		atomic.StoreInt32(&h.unhealthy, 1)
+		log.Warnf("connection %s unhealthy, %s", conn.key, err.Error())
+	}
+	if config.OnStateChange != nil {
+		config.OnStateChange(conn, err == nil, err)
+	}
+}
+
+//请求/sys/health，server没有该path(旧版本)时视为健康
+func (m *Client) probeHealth(ctx context.Context, conn *Connection) error {
+	bts, err := m.sysRequest(ctx, conn, PathSysHealth, []byte("{}"))
+	if err != nil {
+		if e, ok := err.(*Error); ok && e.Code == ErrNoHandler.(*Error).Code {
+			return nil
+		}
+		return err
+	}
+	var resp ResponseSysHealth
+	if err := json.Unmarshal(bts, &resp); err != nil {
+		return err
+	}
+	if resp.Code == ErrNoHandler.(*Error).Code {
+		return nil
+	}
+	if resp.Code != 0 {
+		return fmt.Errorf(resp.Message)
+	}
+	if resp.Status != HealthServing {
+		if resp.Message != "" {
+			return fmt.Errorf("server %s, %s", resp.Status, resp.Message)
+		}
+		return fmt.Errorf("server %s", resp.Status)
+	}
+	return nil
+}
+
+//client在连接的0号channel上发出的请求(新建channel、探测等)，同一连接上串行进行，
+//0号channel同时只能有一个等待中的响应
+func (m *Client) sysRequest(ctx context.Context, conn *Connection, path string, data []byte) ([]byte, error) {
+	conn.sysLock.Lock()
+	defer conn.sysLock.Unlock()
+	c := &ClientChannel{internalChannel: conn.getChannel(0), client: m}
+	return c.doRequestContext(ctx, path, data)
+}
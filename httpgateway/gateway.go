@@ -0,0 +1,164 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//http/1.1网关：将http请求映射为iip请求(默认url path即iip path，body即请求数据)，通过iip client转发，
+//再将iip响应写回http，使浏览器、curl等可以直接访问iip服务。响应以流式接收(见ClientChannel.DoRequestReader)，
+//每收到一帧即写出并Flush，以chunked编码发送，网关不在内存中持有完整的响应
+package httpgateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//将http请求映射为iip的path及请求数据
+type Mapper func(r *http.Request) (path string, data []byte, err error)
+
+type Config struct {
+	PathPrefix     string        //url path中需要去掉的前缀，如/api
+	Timeout        time.Duration //单个请求的超时，默认10秒
+	MaxBodySize    int64         //http请求body最大字节数，默认iip.MaxPacketSize
+	MaxIdleChannel int           //空闲channel池的大小，默认64
+	ContentType    string        //响应的Content-Type，默认application/octet-stream
+	ForwardHeaders []string      //作为iip帧元数据转发的http头，key为头名称的小写形式
+	Mapper         Mapper        //为nil时使用DefaultMapper
+}
+
+//http网关，实现http.Handler
+type Gateway struct {
+	config   Config
+	client   *iip.Client
+	channels *iip.ChannelPool
+}
+
+func NewGateway(client *iip.Client, config Config) *Gateway {
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second * 10
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = int64(iip.MaxPacketSize)
+	}
+	if config.MaxIdleChannel <= 0 {
+		config.MaxIdleChannel = 64
+	}
+	if config.ContentType == "" {
+		config.ContentType = "application/octet-stream"
+	}
+	ret := &Gateway{
+		config:   config,
+		client:   client,
+		channels: iip.NewChannelPool(client, config.MaxIdleChannel),
+	}
+	if ret.config.Mapper == nil {
+		ret.config.Mapper = ret.DefaultMapper
+	}
+	return ret
+}
+
+//默认映射：去掉PathPrefix后的url path作为iip path；GET/HEAD/DELETE请求以url query作为请求数据，其他方法以body作为请求数据
+func (m *Gateway) DefaultMapper(r *http.Request) (string, []byte, error) {
+	path := strings.TrimPrefix(r.URL.Path, m.config.PathPrefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodDelete:
+		return path, []byte(r.URL.RawQuery), nil
+	default:
+		data, err := io.ReadAll(io.LimitReader(r.Body, m.config.MaxBodySize+1))
+		if err != nil {
+			return "", nil, err
+		}
+		if int64(len(data)) > m.config.MaxBodySize {
+			return "", nil, fmt.Errorf("request body is too large")
+		}
+		return path, data, nil
+	}
+}
+
+func (m *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, data, err := m.config.Mapper(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), m.config.Timeout)
+	defer cancel()
+	for _, v := range m.config.ForwardHeaders {
+		if value := r.Header.Get(v); value != "" {
+			ctx = iip.WithRequestMeta(ctx, strings.ToLower(v), value)
+		}
+	}
+
+	c, err := m.channels.GetContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if len(data) == 0 && !c.Channel().Connection().HasFeature(iip.FeatureEmptyData) {
+		//对端未协商FeatureEmptyData时请求数据不能为空
+		data = []byte("{}")
+	}
+	resp, err := c.DoRequestReader(ctx, path, data)
+	if err != nil {
+		m.channels.Discard(c, err)
+		if e, ok := err.(*iip.Error); ok && e.Remote() {
+			//iip handler返回的错误，以ResponseHandleFail的json作为响应body
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write(iip.ErrorResponse(e).Data())
+		} else if errors.Is(err, iip.ErrTimeout) {
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", m.config.ContentType)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		resp.Close()
+		m.channels.Discard(c, fmt.Errorf("response of head request discarded"))
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				resp.Close()
+				m.channels.Discard(c, werr)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			resp.Close()
+			m.channels.Put(c)
+			return
+		}
+		if err != nil {
+			//响应已经开始，中止http响应，使http client得知响应不完整
+			resp.Close()
+			m.channels.Discard(c, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+//关闭空闲的channel
+func (m *Gateway) Close() {
+	m.channels.Close()
+}
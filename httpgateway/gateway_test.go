@@ -0,0 +1,122 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package httpgateway
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//启动iip server及转发到它的http网关，测试结束时关闭
+func newTestGateway(t *testing.T, register func(server *iip.Server)) string {
+	t.Helper()
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := iip.NewServer(iip.ServerConfig{MaxConnections: 10, MaxChannelsPerConn: 100, ChannelPacketQueueLen: 100, TcpWriteQueueLen: 100}, lsn.Addr().String())
+	if err != nil {
+		lsn.Close()
+		t.Fatal(err)
+	}
+	register(server)
+	server.Serve(lsn)
+	t.Cleanup(func() { server.Stop(fmt.Errorf("test finished")) })
+	client, err := iip.NewClient(iip.ClientConfig{MaxConnections: 1, MaxChannelsPerConn: 100, ChannelPacketQueueLen: 100, TcpWriteQueueLen: 100,
+		TcpConnectTimeout: time.Second * 3, TcpReadBufferSize: 1 << 20, TcpWriteBufferSize: 1 << 20}, lsn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	gateway := NewGateway(client, Config{PathPrefix: "/api", Timeout: time.Second * 5})
+	t.Cleanup(gateway.Close)
+	ts := httptest.NewServer(gateway)
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+//协商了空数据帧时，空的body原样作为空的请求数据发出
+func TestGatewayEmptyBody(t *testing.T) {
+	url := newTestGateway(t, func(server *iip.Server) {
+		server.RegisterHandler("/len", iip.NewWriterHandler(func(c *iip.Channel, path string, request []byte, w iip.ResponseWriter) error {
+			_, err := fmt.Fprintf(w, "%d", len(request))
+			return err
+		}))
+	})
+	resp, err := http.Post(url+"/api/len", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "0" {
+		t.Fatalf("status %d, body %q", resp.StatusCode, body)
+	}
+}
+
+//响应的各段在handler写出时即转发给http client，不等待响应结束
+func TestGatewayStreamsResponse(t *testing.T) {
+	next := make(chan struct{})
+	url := newTestGateway(t, func(server *iip.Server) {
+		server.RegisterHandler("/stream", iip.NewWriterHandler(func(c *iip.Channel, path string, request []byte, w iip.ResponseWriter) error {
+			for _, s := range []string{"first\n", "second\n"} {
+				if _, err := io.WriteString(w, s); err != nil {
+					return err
+				}
+				if err := w.Flush(); err != nil {
+					return err
+				}
+				<-next
+			}
+			return nil
+		}))
+	})
+	resp, err := http.Post(url+"/api/stream", "text/plain", strings.NewReader("go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != -1 {
+		t.Fatalf("status %d, content length %d", resp.StatusCode, resp.ContentLength)
+	}
+	reader := bufio.NewReader(resp.Body)
+	for _, want := range []string{"first\n", "second\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil || line != want {
+			t.Fatalf("read %q, %v, expected %q", line, err, want)
+		}
+		next <- struct{}{}
+	}
+	if rest, err := io.ReadAll(reader); err != nil || len(rest) != 0 {
+		t.Fatalf("after response: %q, %v", rest, err)
+	}
+}
+
+func TestGatewayRemoteError(t *testing.T) {
+	url := newTestGateway(t, func(server *iip.Server) {
+		server.RegisterHandler("/fail", iip.NewWriterHandler(func(c *iip.Channel, path string, request []byte, w iip.ResponseWriter) error {
+			return iip.ErrRateLimited
+		}))
+	})
+	resp, err := http.Get(url + "/api/fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("Content-Type") != "application/json" ||
+		!strings.Contains(string(body), fmt.Sprintf("%d", iip.ErrRateLimited.(*iip.Error).Code)) {
+		t.Fatalf("status %d, body %q", resp.StatusCode, body)
+	}
+}
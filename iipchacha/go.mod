@@ -0,0 +1,12 @@
+module github.com/truexf/iip/iipchacha
+
+go 1.18
+
+require github.com/truexf/iip v0.0.0
+
+require (
+	golang.org/x/crypto v0.9.0
+	golang.org/x/sys v0.8.0 // indirect
+)
+
+replace github.com/truexf/iip => ../
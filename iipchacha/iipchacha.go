@@ -0,0 +1,28 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//iip.PSKCipher的ChaCha20-Poly1305实现，用于ClientConfig.PSKCipher/ServerConfig.PSKCipher，
+//适合没有AES硬件加速的嵌入式设备，client与server须配置相同的算法。
+//独立为一个module，使iip本身不依赖第三方库
+package iipchacha
+
+import (
+	"crypto/cipher"
+
+	"github.com/truexf/iip"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+//ChaCha20-Poly1305
+var Cipher iip.PSKCipher = chachaCipher{}
+
+type chachaCipher struct{}
+
+func (chachaCipher) Name() string {
+	return "chacha20-poly1305"
+}
+
+func (chachaCipher) New(key []byte) (cipher.AEAD, error) {
+	return chacha20poly1305.New(key)
+}
@@ -0,0 +1,13 @@
+module github.com/truexf/iip/iipcodec
+
+go 1.18
+
+require (
+	github.com/truexf/iip v0.0.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.34.2
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+
+replace github.com/truexf/iip => ../
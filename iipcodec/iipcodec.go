@@ -0,0 +1,54 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//iip.Codec的protobuf及msgpack实现，用于ClientConfig.Codec/ServerConfig.Codec。
+//独立为一个module，使iip本身不依赖第三方库
+package iipcodec
+
+import (
+	"fmt"
+
+	"github.com/truexf/iip"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	ProtoCodec   iip.Codec = protoCodec{} //请求、响应类型须为protobuf生成的message
+	MsgpackCodec iip.Codec = msgpackCodec{}
+)
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string {
+	return "proto"
+}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+	return nil, fmt.Errorf("%T is not a proto.Message", v)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	return fmt.Errorf("%T is not a proto.Message", v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
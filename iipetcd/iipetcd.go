@@ -0,0 +1,138 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//基于etcd的服务注册与发现：server以带租约的key注册地址，client的Resolver监听key前缀，
+//地址列表随server的上线、下线(租约过期)实时变化。独立模块，避免iip依赖etcd
+package iipetcd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/truexf/iip"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type resolver struct {
+	client *clientv3.Client
+	prefix string
+}
+
+//监听prefix下的全部key，key的值为server地址(ip:port)，用作iip.ClientConfig.Resolver
+func NewResolver(client *clientv3.Client, prefix string) iip.Resolver {
+	return &resolver{client: client, prefix: prefix}
+}
+
+func (m *resolver) Watch(ctx context.Context, update func(addrs []string)) error {
+	resp, err := m.client.Get(ctx, m.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	addrs := make(map[string]string)
+	for _, kv := range resp.Kvs {
+		addrs[string(kv.Key)] = string(kv.Value)
+	}
+	update(addrList(addrs))
+	go m.watch(ctx, resp.Header.Revision+1, addrs, update)
+	return nil
+}
+
+func (m *resolver) watch(ctx context.Context, rev int64, addrs map[string]string, update func(addrs []string)) {
+	for ctx.Err() == nil {
+		wch := m.client.Watch(ctx, m.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev))
+		for wresp := range wch {
+			if err := wresp.Err(); err != nil {
+				iip.GetLogger().Warnf("watch %s fail, %s", m.prefix, err.Error())
+				break
+			}
+			for _, ev := range wresp.Events {
+				if ev.Type == clientv3.EventTypeDelete {
+					delete(addrs, string(ev.Kv.Key))
+				} else {
+					addrs[string(ev.Kv.Key)] = string(ev.Kv.Value)
+				}
+			}
+			rev = wresp.Header.Revision + 1
+			update(addrList(addrs))
+		}
+		//监听中断(如修订号已被压缩)时重新读取全量
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		resp, err := m.client.Get(ctx, m.prefix, clientv3.WithPrefix())
+		if err != nil {
+			continue
+		}
+		for k := range addrs {
+			delete(addrs, k)
+		}
+		for _, kv := range resp.Kvs {
+			addrs[string(kv.Key)] = string(kv.Value)
+		}
+		rev = resp.Header.Revision + 1
+		update(addrList(addrs))
+	}
+}
+
+func addrList(addrs map[string]string) []string {
+	ret := make([]string, 0, len(addrs))
+	for _, v := range addrs {
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+//server地址的注册
+type Registration struct {
+	client  *clientv3.Client
+	key     string
+	leaseId clientv3.LeaseID
+	cancel  context.CancelFunc
+	once    sync.Once
+}
+
+//以prefix+addr为key注册server地址addr，租约ttl秒(默认10秒)，后台自动续约，
+//进程退出而未调用Deregister时，租约过期后地址被移除
+func Register(ctx context.Context, client *clientv3.Client, prefix string, addr string, ttl int64) (*Registration, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("empty address")
+	}
+	if ttl <= 0 {
+		ttl = 10
+	}
+	lease, err := client.Grant(ctx, ttl)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimSuffix(prefix, "/") + "/" + addr
+	if _, err := client.Put(ctx, key, addr, clientv3.WithLease(lease.ID)); err != nil {
+		return nil, err
+	}
+	kaCtx, cancel := context.WithCancel(context.Background())
+	ka, err := client.KeepAlive(kaCtx, lease.ID)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		for range ka {
+		}
+	}()
+	return &Registration{client: client, key: key, leaseId: lease.ID, cancel: cancel}, nil
+}
+
+//注销：停止续约并撤销租约，地址立即从etcd移除。应在server.Drain之前调用，使client不再在其上新建channel
+func (m *Registration) Deregister(ctx context.Context) error {
+	var err error
+	m.once.Do(func() {
+		m.cancel()
+		_, err = m.client.Revoke(ctx, m.leaseId)
+	})
+	return err
+}
@@ -0,0 +1,22 @@
+module github.com/truexf/iip/iipkcp
+
+go 1.21
+
+require (
+	github.com/truexf/iip v0.0.0
+	github.com/xtaci/kcp-go/v5 v5.6.19
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
+	github.com/klauspost/reedsolomon v1.12.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/templexxx/cpu v0.1.1 // indirect
+	github.com/templexxx/xorsimd v0.4.3 // indirect
+	github.com/tjfoc/gmsm v1.4.1 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/net v0.23.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+)
+
+replace github.com/truexf/iip => ../
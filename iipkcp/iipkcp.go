@@ -0,0 +1,106 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//KCP传输：以KCP(基于UDP的可靠、有序传输)承载iip的帧，适用于高延迟、有丢包的链路。
+//导入本包之后，client的服务端地址及server的监听地址可以使用kcp://host:port，见iip.RegisterTransport。
+//KCP没有连接建立过程，Dial的超时由iip的握手保证；对端失联时连接不会出错，应配合ServerConfig.IdleTimeout及client的健康检查使用。
+//独立模块，避免iip依赖kcp-go
+package iipkcp
+
+import (
+	"net"
+	"time"
+
+	"github.com/truexf/iip"
+	kcp "github.com/xtaci/kcp-go/v5"
+)
+
+type Config struct {
+	Block        kcp.BlockCrypt //包加密，nil表示不加密
+	DataShards   int            //前向纠错(FEC)的数据分片数，0表示不使用FEC
+	ParityShards int            //前向纠错的校验分片数
+	NoDelay      bool           //快速模式：关闭拥塞控制、快速重传、立即确认，以带宽换取延迟
+	Interval     int            //内部时钟间隔(毫秒)，快速模式默认10，否则默认40
+	SendWindow   int            //发送窗口(包数)，默认1024
+	RecvWindow   int            //接收窗口(包数)，默认1024
+	MTU          int            //默认1350
+	SocketBuffer int            //server端UDP socket的读写缓冲区大小，0表示使用系统默认值
+}
+
+type transport struct {
+	config Config
+}
+
+func init() {
+	iip.RegisterTransport("kcp", New(Config{NoDelay: true}))
+}
+
+//以config创建KCP传输层，可以以其他scheme注册不同的配置，如iip.RegisterTransport("kcp-fec", iipkcp.New(Config{DataShards: 10, ParityShards: 3}))
+func New(config Config) iip.Transport {
+	if config.Interval <= 0 {
+		config.Interval = 40
+		if config.NoDelay {
+			config.Interval = 10
+		}
+	}
+	if config.SendWindow <= 0 {
+		config.SendWindow = 1024
+	}
+	if config.RecvWindow <= 0 {
+		config.RecvWindow = 1024
+	}
+	if config.MTU <= 0 {
+		config.MTU = 1350
+	}
+	return &transport{config: config}
+}
+
+func (m *transport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	sess, err := kcp.DialWithOptions(addr, m.config.Block, m.config.DataShards, m.config.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	m.setup(sess)
+	return sess, nil
+}
+
+func (m *transport) Listen(addr string) (net.Listener, error) {
+	lsn, err := kcp.ListenWithOptions(addr, m.config.Block, m.config.DataShards, m.config.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	if m.config.SocketBuffer > 0 {
+		lsn.SetReadBuffer(m.config.SocketBuffer)
+		lsn.SetWriteBuffer(m.config.SocketBuffer)
+	}
+	return &listener{Listener: lsn, transport: m}, nil
+}
+
+//iip的帧是字节流，会话使用流模式，小帧由KCP合并发送
+func (m *transport) setup(sess *kcp.UDPSession) {
+	sess.SetStreamMode(true)
+	sess.SetWriteDelay(false)
+	if m.config.NoDelay {
+		sess.SetNoDelay(1, m.config.Interval, 2, 1)
+	} else {
+		sess.SetNoDelay(0, m.config.Interval, 0, 0)
+	}
+	sess.SetACKNoDelay(m.config.NoDelay)
+	sess.SetWindowSize(m.config.SendWindow, m.config.RecvWindow)
+	sess.SetMtu(m.config.MTU)
+}
+
+type listener struct {
+	*kcp.Listener
+	transport *transport
+}
+
+func (m *listener) Accept() (net.Conn, error) {
+	sess, err := m.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	m.transport.setup(sess)
+	return sess, nil
+}
@@ -0,0 +1,17 @@
+module github.com/truexf/iip/iipotel
+
+go 1.21
+
+require (
+	github.com/truexf/iip v0.0.0
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	go.opentelemetry.io/otel/metric v1.28.0 // indirect
+)
+
+replace github.com/truexf/iip => ../
@@ -0,0 +1,146 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//基于OpenTelemetry的iip链路追踪：client拦截器为每个DoRequest创建client span，并将追踪上下文写入请求的帧元数据；
+//server中间件从帧元数据中提取追踪上下文，为每个请求创建server span。
+//需要双方在握手时协商FeatureMetadata，否则追踪上下文不会跨进程传递
+package iipotel
+
+import (
+	"context"
+
+	"github.com/truexf/iip"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/truexf/iip/iipotel"
+
+//channel上下文中保存当前请求的span及context
+const (
+	ctxSpan    = "/ctx/iipotel/span"
+	ctxContext = "/ctx/iipotel/context"
+)
+
+type config struct {
+	tracerProvider trace.TracerProvider
+	propagators    propagation.TextMapPropagator
+}
+
+type Option func(*config)
+
+//指定TracerProvider，默认使用otel.GetTracerProvider()
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+//指定追踪上下文的传播格式，默认使用otel.GetTextMapPropagator()
+func WithPropagators(p propagation.TextMapPropagator) Option {
+	return func(c *config) {
+		c.propagators = p
+	}
+}
+
+func newConfig(opts []Option) *config {
+	ret := &config{
+		tracerProvider: otel.GetTracerProvider(),
+		propagators:    otel.GetTextMapPropagator(),
+	}
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret
+}
+
+func requestAttributes(path string, size int) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("rpc.system", "iip"),
+		attribute.String("rpc.method", path),
+		attribute.Int("iip.request.size", size),
+	)
+}
+
+//client拦截器，通过iip.Client.AddInterceptor添加。
+//span的父span取自DoRequestContext的ctx
+func ClientInterceptor(opts ...Option) iip.ClientInterceptor {
+	cfg := newConfig(opts)
+	tracer := cfg.tracerProvider.Tracer(instrumentationName)
+	return func(ctx context.Context, c *iip.ClientChannel, path string, requestData []byte, invoker iip.RequestInvoker) ([]byte, error) {
+		ctx, span := tracer.Start(ctx, path, trace.WithSpanKind(trace.SpanKindClient), requestAttributes(path, len(requestData)))
+		defer span.End()
+		carrier := propagation.MapCarrier{}
+		cfg.propagators.Inject(ctx, carrier)
+		for k, v := range carrier {
+			ctx = iip.WithRequestMeta(ctx, k, v)
+		}
+		ret, err := invoker(ctx, c, path, requestData)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetAttributes(attribute.Int("iip.response.size", len(ret)))
+		}
+		return ret, err
+	}
+}
+
+//server中间件，通过iip.Server.Use添加。
+//分片到达的请求从首帧开始计时，直至handler返回完整的响应；0号系统channel上的请求不追踪
+func Middleware(opts ...Option) iip.Middleware {
+	cfg := newConfig(opts)
+	tracer := cfg.tracerProvider.Tracer(instrumentationName)
+	return func(next iip.Handler) iip.Handler {
+		return iip.HandlerFunc(func(c *iip.Channel, request *iip.Packet, dataCompleted bool) (ret []byte, err error) {
+			if c.Id == 0 {
+				return next.Handle(c, request, dataCompleted)
+			}
+			span, _ := c.GetCtxData(ctxSpan).(trace.Span)
+			if span == nil {
+				ctx := cfg.propagators.Extract(context.Background(), propagation.MapCarrier(request.Meta))
+				ctx, span = tracer.Start(ctx, request.Path, trace.WithSpanKind(trace.SpanKindServer), requestAttributes(request.Path, 0))
+				c.SetCtxData(ctxSpan, span)
+				c.SetCtxData(ctxContext, ctx)
+			}
+			span.AddEvent("frame", trace.WithAttributes(attribute.Int("iip.frame.size", len(request.Data))))
+			finish := func() {
+				c.RemoveCtxData(ctxSpan)
+				c.RemoveCtxData(ctxContext)
+				span.End()
+			}
+			defer func() {
+				if r := recover(); r != nil {
+					span.SetStatus(codes.Error, "handler panic")
+					finish()
+					panic(r)
+				}
+			}()
+			ret, err = next.Handle(c, request, dataCompleted)
+			if err == iip.ErrPacketContinue {
+				return ret, err
+			}
+			if err != nil && err != iip.ErrResponseSent {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			} else if err == nil {
+				span.SetAttributes(attribute.Int("iip.response.size", len(ret)))
+			}
+			finish()
+			return ret, err
+		})
+	}
+}
+
+//当前channel上正在处理的请求的追踪context，供PathHandler创建子span，
+//不在追踪的请求中时返回context.Background()
+func ContextFromChannel(c *iip.Channel) context.Context {
+	if ctx, ok := c.GetCtxData(ctxContext).(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
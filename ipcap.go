@@ -0,0 +1,99 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//按对端ip的并发连接数上限(MaxConnectionsPerIP)，避免单个出错的client占满server的全部连接。
+//超出上限的连接不创建connection，由一个短暂的goroutine读取client的握手请求之后，以0号channel上的错误帧
+//(状态StatusS11，数据为ErrTooManyConnections的json)应答握手，client的握手因此以该错误失败。之后等待client关闭连接
+//(最长rejectReadTimeout)，不发送Status8：client收到Status8时立即关闭连接，尚未交付的错误帧会被丢弃。
+//内存连接等没有ip的连接不受限制
+package iip
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+//同时处理中的拒绝数上限，超过时直接关闭连接
+const maxPendingRejects = 256
+
+//拒绝连接时等待client握手请求、等待client关闭连接的时间上限
+const rejectReadTimeout = time.Second
+
+//占用对端ip的一个连接数配额，返回占用的ip，没有ip或者不限制时返回空串；达到上限时返回false
+func (m *Server) acquireIPSlot(addr net.Addr) (string, bool) {
+	max := m.getConfig().MaxConnectionsPerIP
+	if max <= 0 {
+		return "", true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return "", true
+	}
+	key := ip.String()
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	if m.ipConns == nil {
+		m.ipConns = make(map[string]int)
+	}
+	if m.ipConns[key] >= max {
+		return key, false
+	}
+	m.ipConns[key]++
+	return key, true
+}
+
+//释放acquireIPSlot占用的配额，调用者须持有connLock
+func (m *Server) releaseIPSlotLocked(ip string) {
+	if ip == "" {
+		return
+	}
+	if n := m.ipConns[ip]; n > 1 {
+		m.ipConns[ip] = n - 1
+	} else {
+		delete(m.ipConns, ip)
+	}
+}
+
+func (m *Server) releaseIPSlot(ip string) {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	m.releaseIPSlotLocked(ip)
+}
+
+//对端ip当前的连接数
+func (m *Server) ConnectionsFromIP(ip net.IP) int {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	return m.ipConns[ip.String()]
+}
+
+//以错误帧应答client的握手之后关闭连接，见文件头
+func (m *Server) rejectTooManyConns(netConn net.Conn, ip string) {
+	atomic.AddInt64(&m.rejectedConns, 1)
+	if atomic.AddInt32(&m.pendingRejects, 1) > maxPendingRejects {
+		atomic.AddInt32(&m.pendingRejects, -1)
+		netConn.Close()
+		return
+	}
+	go func() {
+		defer atomic.AddInt32(&m.pendingRejects, -1)
+		defer netConn.Close()
+		netConn.SetDeadline(time.Now().Add(rejectReadTimeout))
+		//握手请求以基本帧格式发送，读到即可应答，读取失败时仍然尝试应答
+		if pkt, err := ParseFrame(netConn); err == nil {
+			pkt.Release()
+		}
+		err := ErrTooManyConnections.(*Error)
+		data := ErrorResponse(&Error{Code: err.Code, Message: fmt.Sprintf("%s: %s, max %d", err.Message, ip, m.getConfig().MaxConnectionsPerIP)}).Data()
+		frame, _ := CreateNetPacket(&Packet{Status: StatusS11, Path: PathHandshake, Data: data})
+		if _, err := netConn.Write(frame); err != nil {
+			return
+		}
+		netConn.SetDeadline(time.Now().Add(rejectReadTimeout))
+		io.Copy(io.Discard, netConn)
+	}()
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+//超过对端ip的连接数上限时，client的握手以ErrTooManyConnections失败，连接关闭之后配额被释放
+func TestMaxConnectionsPerIP(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{MaxConnectionsPerIP: 2})
+	ip := net.ParseIP("127.0.0.1")
+	var clients []*Client
+	for i := 0; i < 2; i++ {
+		client := newTestClient(t, addr, ClientConfig{})
+		if _, err := client.NewChannel(); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+	if n := server.ConnectionsFromIP(ip); n != 2 {
+		t.Fatalf("%d connections from %s, expected 2", n, ip)
+	}
+	rejected := newTestClient(t, addr, ClientConfig{})
+	if _, err := rejected.NewChannel(); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("expected too many connections, got %v", err)
+	}
+	if n := server.RejectedConnections(); n != 1 {
+		t.Fatalf("%d rejected connections, expected 1", n)
+	}
+	if n := server.ConnectionsFromIP(ip); n != 2 {
+		t.Fatalf("%d connections from %s after rejection, expected 2", n, ip)
+	}
+	clients[0].Close()
+	waitFor(t, "ip slot released", func() bool { return server.ConnectionsFromIP(ip) == 1 })
+	channel, err := rejected.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret, err := channel.DoRequest(testEchoPath, []byte("x"), time.Second*5); err != nil || string(ret) != "x" {
+		t.Fatalf("request: %q, %v", ret, err)
+	}
+}
+
+//未设置上限时不统计对端ip的连接数
+func TestMaxConnectionsPerIPUnlimited(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{})
+	for i := 0; i < 3; i++ {
+		if _, err := newTestClient(t, addr, ClientConfig{}).NewChannel(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := server.ConnectionsFromIP(net.ParseIP("127.0.0.1")); n != 0 {
+		t.Fatalf("%d connections counted without a limit", n)
+	}
+}
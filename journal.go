@@ -0,0 +1,221 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//客户端请求日志(write-ahead journal)：请求发出前记录，收到响应后记录完成，
+//应用在崩溃恢复时可据此判断哪些请求已经发出而结果未知，从而安全地重发或对账。
+//请求的幂等键以元数据MetaIdempotencyKey发给server(需协商FeatureMetadata)，server的handler通过Channel.RequestMeta取得，
+//据此识别重发的请求
+package iip
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	JournalOpBegin    = "begin"    //请求即将发出
+	JournalOpComplete = "complete" //收到响应，请求完成
+	JournalOpFail     = "fail"     //请求失败，结果未知，仍视为未完成
+)
+
+type JournalEntry struct {
+	Key   string    `json:"key"`
+	Op    string    `json:"op"`
+	Path  string    `json:"path,omitempty"`
+	Data  []byte    `json:"data,omitempty"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+//请求日志接口
+type Journal interface {
+	//请求发出前调用，返回错误时请求不会发出
+	Begin(key string, path string, data []byte) error
+	//请求结束后调用，err为nil表示收到了响应
+	Complete(key string, err error) error
+	//已经Begin但尚未成功完成的请求
+	Pending() ([]*JournalEntry, error)
+}
+
+var journalKeySeq uint64
+
+//生成幂等键
+func NewIdempotencyKey() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(atomic.AddUint64(&journalKeySeq, 1), 36)
+}
+
+//以拦截器的方式为DoRequest/DoRequestContext添加请求日志，幂等键依次取自ctx中的请求元数据MetaIdempotencyKey
+//(调用者以WithRequestMeta设置，重发时沿用原来的键)、keyFunc从请求中提取的键，都没有时自动生成；
+//幂等键随请求元数据发给server。自动生成的键在每次重试(见retry.go)时都不同，需要server去重时应由调用者提供
+func JournalInterceptor(journal Journal, keyFunc func(path string, requestData []byte) string) ClientInterceptor {
+	return func(ctx context.Context, c *ClientChannel, path string, requestData []byte, invoker RequestInvoker) ([]byte, error) {
+		key := RequestMetaFromContext(ctx)[MetaIdempotencyKey]
+		if key == "" && keyFunc != nil {
+			key = keyFunc(path, requestData)
+		}
+		if key == "" {
+			key = NewIdempotencyKey()
+		}
+		if err := journal.Begin(key, path, requestData); err != nil {
+			return nil, fmt.Errorf("journal begin fail, %s", err.Error())
+		}
+		ret, err := invoker(WithRequestMeta(ctx, MetaIdempotencyKey, key), c, path, requestData)
+		if jerr := journal.Complete(key, err); jerr != nil {
+			log.Errorf("journal complete %s fail, %s", key, jerr.Error())
+		}
+		return ret, err
+	}
+}
+
+//基于文件的Journal实现，每条记录为一行json，Begin记录落盘(fsync)后才发出请求
+type FileJournal struct {
+	file    *os.File
+	pending map[string]*JournalEntry
+	lock    sync.Mutex
+}
+
+//打开(或创建)journal文件，并回放已有记录以恢复未完成的请求
+func OpenFileJournal(fileName string) (*FileJournal, error) {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ret := &FileJournal{file: f, pending: make(map[string]*JournalEntry)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), int(MaxPacketSize)*2)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			//最后一行可能因崩溃而不完整，忽略
+			continue
+		}
+		ret.apply(&entry)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (m *FileJournal) apply(entry *JournalEntry) {
+	switch entry.Op {
+	case JournalOpBegin:
+		m.pending[entry.Key] = entry
+	case JournalOpComplete:
+		delete(m.pending, entry.Key)
+	case JournalOpFail:
+		if v, ok := m.pending[entry.Key]; ok {
+			v.Error = entry.Error
+		}
+	}
+}
+
+func (m *FileJournal) write(entry *JournalEntry, sync bool) error {
+	bts, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	bts = append(bts, '\n')
+	if _, err := m.file.Write(bts); err != nil {
+		return err
+	}
+	if sync {
+		return m.file.Sync()
+	}
+	return nil
+}
+
+func (m *FileJournal) Begin(key string, path string, data []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entry := &JournalEntry{Key: key, Op: JournalOpBegin, Path: path, Data: data, Time: time.Now()}
+	if err := m.write(entry, true); err != nil {
+		return err
+	}
+	m.apply(entry)
+	return nil
+}
+
+func (m *FileJournal) Complete(key string, err error) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entry := &JournalEntry{Key: key, Op: JournalOpComplete, Time: time.Now()}
+	if err != nil {
+		entry.Op, entry.Error = JournalOpFail, err.Error()
+	}
+	if werr := m.write(entry, false); werr != nil {
+		return werr
+	}
+	m.apply(entry)
+	return nil
+}
+
+func (m *FileJournal) Pending() ([]*JournalEntry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make([]*JournalEntry, 0, len(m.pending))
+	for _, v := range m.pending {
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+//应用完成对账后调用，将请求标记为完成，不再出现在Pending中
+func (m *FileJournal) Resolve(key string) error {
+	return m.Complete(key, nil)
+}
+
+//压缩journal文件，只保留未完成的请求
+func (m *FileJournal) Compact() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tmpName := m.file.Name() + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, v := range m.pending {
+		bts, err := json.Marshal(v)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(bts)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmpName, m.file.Name()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(m.file.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	m.file.Close()
+	m.file = f
+	return nil
+}
+
+func (m *FileJournal) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.file.Close()
+}
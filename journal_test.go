@@ -0,0 +1,119 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//注册/test/idempotency：返回请求元数据中的幂等键；/test/fail：总是返回错误
+func newJournalTestClient(t *testing.T, journal Journal, keyFunc func(path string, requestData []byte) string) *Client {
+	t.Helper()
+	server, addr := newTestServer(t, ServerConfig{})
+	err := server.RegisterHandler("/test/idempotency", NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		_, err := w.Write([]byte(c.RequestMeta()[MetaIdempotencyKey]))
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.RegisterHandler("/test/fail", NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		return ErrRateLimited
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, addr, ClientConfig{})
+	client.AddInterceptor(JournalInterceptor(journal, keyFunc))
+	return client
+}
+
+func openTestJournal(t *testing.T) *FileJournal {
+	t.Helper()
+	journal, err := OpenFileJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { journal.Close() })
+	return journal
+}
+
+//记录Begin的幂等键
+type keyRecorder struct {
+	Journal
+	keys []string
+}
+
+func (m *keyRecorder) Begin(key string, path string, data []byte) error {
+	m.keys = append(m.keys, key)
+	return m.Journal.Begin(key, path, data)
+}
+
+func TestJournalSendsIdempotencyKey(t *testing.T) {
+	journal := openTestJournal(t)
+	recorder := &keyRecorder{Journal: journal}
+	client := newJournalTestClient(t, recorder, nil)
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := channel.DoRequest("/test/idempotency", []byte("x"), time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.keys) != 1 || string(ret) != recorder.keys[0] || string(ret) == "" {
+		t.Fatalf("server received key %q, journal keys %v", ret, recorder.keys)
+	}
+	if pending, _ := journal.Pending(); len(pending) != 0 {
+		t.Fatalf("%d pending entries after success", len(pending))
+	}
+}
+
+func TestJournalKeySources(t *testing.T) {
+	client := newJournalTestClient(t, openTestJournal(t), func(path string, requestData []byte) string { return "from-" + string(requestData) })
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret, err := channel.DoRequest("/test/idempotency", []byte("data"), time.Second*5); err != nil || string(ret) != "from-data" {
+		t.Fatalf("key from keyFunc: %q, %v", ret, err)
+	}
+	//调用者设置的键优先
+	ctx, cancel := context.WithTimeout(WithRequestMeta(context.Background(), MetaIdempotencyKey, "order-1"), time.Second*5)
+	defer cancel()
+	if ret, err := channel.DoRequestContext(ctx, "/test/idempotency", []byte("data")); err != nil || string(ret) != "order-1" {
+		t.Fatalf("key from ctx: %q, %v", ret, err)
+	}
+}
+
+//失败的请求留在journal中，重新打开后仍可取得
+func TestJournalPendingAfterFailure(t *testing.T) {
+	journal := openTestJournal(t)
+	client := newJournalTestClient(t, journal, nil)
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channel.DoRequest("/test/fail", []byte("payload"), time.Second*5); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected rate limited error, got %v", err)
+	}
+	journal.Close()
+	reopened, err := OpenFileJournal(journal.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	pending, err := reopened.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Path != "/test/fail" || string(pending[0].Data) != "payload" || pending[0].Error == "" {
+		t.Fatalf("pending entries: %+v", pending)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//连接的goroutine的生命周期：读循环、写循环、空闲及存活时间检查、排空，以及各channel的处理循环、流处理函数
+//都经goLoop启动并计入连接的WaitGroup，Connection.Close之后它们全部退出，Wait等待其退出，用于测试及优雅关闭。
+//连接及channel的关闭逻辑只执行一次(closeStarted不再复位)，并发或重复的Close直接返回；closeNotify经sync.Once关闭且不再置为nil，
+//等待它的goroutine总能被唤醒。关闭之后的发送返回ErrClosed(附带关闭的原因)，不会向已关闭的Go channel发送而panic；
+//读循环向channel接收队列的阻塞投递、写队列的阻塞入队在channel或连接关闭时放弃，不会永久阻塞。
+//Close立即关闭socket，写队列中的帧被丢弃；CloseGraceful先在时限内等待写队列中的帧写出，排空连接时以此关闭连接
+package iip
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+//启动连接的goroutine，连接已关闭时不启动并返回false
+func (m *Connection) goLoop(f func()) bool {
+	m.ChannelsLock.Lock()
+	defer m.ChannelsLock.Unlock()
+	return m.goLoopLocked(f)
+}
+
+//同goLoop，调用者持有ChannelsLock
+func (m *Connection) goLoopLocked(f func()) bool {
+	if m.stopped {
+		return false
+	}
+	m.loops.Add(1)
+	go func() {
+		defer m.loops.Done()
+		f()
+	}()
+	return true
+}
+
+//连接关闭之后不再启动新的goroutine、不再加入channel，返回此时的全部channel
+func (m *Connection) stopLoops() []*Channel {
+	m.ChannelsLock.Lock()
+	defer m.ChannelsLock.Unlock()
+	m.stopped = true
+	ret := make([]*Channel, 0, len(m.Channels))
+	for _, v := range m.Channels {
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+//等待连接的全部goroutine退出，通常在Close之后调用。handler在channel的处理循环中调用，
+//Wait同样等待进行中的handler返回，因此不能在handler或连接的其他goroutine中调用
+func (m *Connection) Wait() {
+	m.loops.Wait()
+}
+
+//关闭通知，重复调用无效果
+func (m *Connection) notifyClosed() {
+	m.notifyOnce.Do(func() {
+		close(m.closeNotify)
+		m.ctxCancel()
+	})
+}
+
+//连接的关闭是否已经开始，此时连接可能尚未完成关闭，但写循环已不可依赖
+func (m *Connection) closeInitiated() bool {
+	return atomic.LoadUint32(&m.closeStarted) == 1
+}
+
+//连接是否已关闭
+func (m *Connection) isClosed() bool {
+	return atomic.LoadUint32(&m.closed) == 1
+}
+
+//连接已关闭时返回ErrClosed，附带关闭的原因
+func (m *Connection) errClosed() error {
+	if !m.isClosed() {
+		return nil
+	}
+	return closedError("connection", m.err)
+}
+
+//关闭通知，重复调用无效果
+func (m *Channel) notifyClosed() {
+	m.notifyOnce.Do(func() {
+		close(m.closeNotify)
+		m.cancelContext()
+	})
+}
+
+//channel是否已关闭
+func (m *Channel) isClosed() bool {
+	return atomic.LoadUint32(&m.closed) == 1
+}
+
+//channel关闭的原因，未关闭时返回nil
+func (m *Channel) closedErr() error {
+	if !m.isClosed() {
+		return nil
+	}
+	return m.err
+}
+
+//channel已关闭时返回ErrClosed，附带关闭的原因
+func (m *Channel) errClosed() error {
+	if !m.isClosed() {
+		return nil
+	}
+	return closedError("channel", m.err)
+}
+
+//与ErrClosed的错误码相同，errors.Is(err, ErrClosed)为true，errors.Is对关闭的原因同样有效
+func closedError(what string, cause error) error {
+	return kindError(ErrClosed, cause, "%s is closed, %s", what, cause.Error())
+}
+
+//在读循环中将帧投递到channel的接收队列，队列满时等待；channel或连接关闭时丢弃该帧并返回false
+func (m *Channel) enqueueReceived(pkt *Packet) bool {
+	if m.tryEnqueueReceived(pkt) {
+		return true
+	}
+	pkt.queued = time.Now().UnixNano()
+	select {
+	case m.receivedQueue <- pkt:
+		m.observeReceived()
+		m.scheduleEvents()
+		return true
+	case <-m.closeNotify:
+	case <-m.conn.closeNotify:
+	}
+	pkt.Release()
+	return false
+}
+
+//接收队列未满时投递，满时返回false，pkt仍由调用者处理
+func (m *Channel) tryEnqueueReceived(pkt *Packet) bool {
+	pkt.queued = time.Now().UnixNano()
+	select {
+	case m.receivedQueue <- pkt:
+		m.observeReceived()
+		m.scheduleEvents()
+		return true
+	default:
+	}
+	return false
+}
+
+//发送channel的关闭通知(PathDeleteChannel)，不阻塞关闭过程：连接已关闭或正在关闭时不发送，写队列满时放弃，
+//对端的channel之后由其空闲超时或者连接关闭回收。通知不经sendLock，对端在任何状态下都处理关闭通知，
+//即使它插在一条未发送完的多帧消息中间，其后的帧也在逗留期内被丢弃
+func (m *Channel) sendCloseNotice() {
+	if m.conn.closeInitiated() {
+		return
+	}
+	pkt := acquirePacket()
+	pkt.Type, pkt.Status, pkt.Path, pkt.ChannelId, pkt.Data, pkt.channel = PacketTypeRequest, StatusC1, PathDeleteChannel, m.Id, []byte("{}"), m
+	if m.conn.Role == RoleServer {
+		pkt.Type, pkt.Status = PacketTypeResponse, StatusS5
+	}
+	if err := m.conn.enqueuePacket(pkt, 0, nil); err != nil {
+		pkt.Release()
+		log.Warnf("close notice of channel %d of %s not sent, %s", m.Id, m.conn.key, err.Error())
+		return
+	}
+	atomic.AddInt64(&m.WritePacketCount, 1)
+	m.closeAck = m.conn.closeAckRequired()
+}
+
+//优雅关闭连接：不再接受新的帧，等待写队列中已有的帧(如handler已经产生的响应)写出之后关闭连接，
+//超过timeout仍未写完时丢弃剩余的帧并返回错误，timeout<=0时等同于Close。返回时连接已关闭
+func (m *Connection) CloseGraceful(timeout time.Duration) error {
+	return m.closeGraceful(fmt.Errorf("closed gracefully"), timeout)
+}
+
+func (m *Connection) closeGraceful(reason error, timeout time.Duration) error {
+	if err := m.errClosed(); err != nil {
+		return err
+	}
+	if m.closeInitiated() || !atomic.CompareAndSwapUint32(&m.graceful, 0, 1) {
+		return closedError("connection", fmt.Errorf("closing"))
+	}
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(time.Millisecond * 10)
+	defer ticker.Stop()
+	for n := atomic.LoadInt64(&m.unwritten); n > 0; n = atomic.LoadInt64(&m.unwritten) {
+		if !time.Now().Before(deadline) {
+			err := fmt.Errorf("graceful close timeout, %d packets not written in %s", n, timeout.String())
+			m.Close(err)
+			return err
+		}
+		select {
+		case <-m.closeNotify:
+			//写失败等原因已关闭连接
+			return m.errClosed()
+		case <-ticker.C:
+		}
+	}
+	m.Close(reason)
+	return nil
+}
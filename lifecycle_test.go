@@ -0,0 +1,58 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+//等待goroutine数回到n以下，超时时返回全部goroutine的调用栈
+func waitGoroutines(n int, timeout time.Duration) (int, string) {
+	deadline := time.Now().Add(timeout)
+	for {
+		current := runtime.NumGoroutine()
+		if current <= n {
+			return current, ""
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			return current, string(buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+//client关闭、server停止之后，连接及channel的goroutine全部退出
+func TestNoGoroutineLeakAfterClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	server, addr := newTestServer(t, ServerConfig{})
+	client := newTestClient(t, addr, ClientConfig{MaxConnections: 2})
+	var conns []*Connection
+	for i := 0; i < 20; i++ {
+		channel, err := client.NewChannel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := channel.DoRequest(testEchoPath, []byte(fmt.Sprint(i)), time.Second*5); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, channel.internalChannel.conn)
+		//一半的channel先于连接关闭
+		if i%2 == 0 {
+			channel.Close(nil)
+		}
+	}
+	client.Close()
+	server.Stop(fmt.Errorf("test finished"))
+	for _, conn := range conns {
+		conn.Wait()
+	}
+	if after, stacks := waitGoroutines(before, time.Second*5); stacks != "" {
+		t.Fatalf("goroutines before: %d, after close: %d\n%s", before, after, stacks)
+	}
+}
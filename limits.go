@@ -0,0 +1,69 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//请求大小及channel接收队列的限制：多帧请求合并后超过MaxRequestSize(合并模式下默认为max packet size，见assemble.go)，或者开启RejectWhenQueueFull时channel的接收队列已满，
+//server以错误(ErrRequestTooLarge/ErrOverloaded)重置该channel，见reset.go，其后续的帧被丢弃，连接上的其他channel不受影响
+package iip
+
+import (
+	"sync/atomic"
+)
+
+//读循环将帧交给channel的处理循环，server端对普通channel上的请求检查大小、接收队列及内存预算(见membudget.go)
+func (m *Connection) deliver(channel *Channel, pkt *Packet, svr *Server) {
+	if svr == nil || channel.Id == 0 || channel.push || channel.getStream() != nil {
+		m.enqueue(channel, pkt)
+		return
+	}
+	if atomic.LoadInt32(&channel.rejected) == 1 {
+		pkt.Release()
+		return
+	}
+	config := svr.getConfig()
+	if pkt.Status == StatusC0 || pkt.Status == StatusC1 {
+		channel.requestBytes = 0
+		if !m.admitMemory(svr, config) {
+			channel.reject(pkt.Path, ErrOverloaded.(*Error))
+			pkt.Release()
+			return
+		}
+	}
+	if err := checkRequestPath(pkt, config.PathRules); err != nil {
+		channel.reject(pkt.Path, err)
+		pkt.Release()
+		return
+	}
+	channel.requestBytes += int64(len(pkt.Data))
+	if limit := requestSizeLimit(config, m); limit > 0 && channel.requestBytes > limit {
+		channel.reject(pkt.Path, ErrRequestTooLarge.(*Error))
+		pkt.Release()
+		return
+	}
+	channel.chargeRead(int64(len(pkt.Data)))
+	if !config.RejectWhenQueueFull {
+		m.enqueue(channel, pkt)
+		return
+	}
+	if !m.tryEnqueue(channel, pkt) {
+		channel.reject(pkt.Path, ErrOverloaded.(*Error))
+		pkt.Release()
+	}
+}
+
+//以err重置channel，在读循环中调用，重置在另外的goroutine中进行，不阻塞读循环。
+//对端不支持重置时先以err响应再关闭channel
+func (m *Channel) reject(path string, err *Error) {
+	if !atomic.CompareAndSwapInt32(&m.rejected, 0, 1) {
+		return
+	}
+	log.Warnf("reject channel %d of %s, path: %s, %s", m.Id, m.conn.key, path, err.Error())
+	go func() {
+		if !m.conn.HasFeature(FeatureReset) {
+			if e := m.sendError(path, err); e != nil {
+				log.Errorf("channel.SendPacket fail, %s", e.Error())
+			}
+		}
+		m.reset(path, err)
+	}()
+}
@@ -33,7 +33,7 @@ func (m *DefaultLogger) Logf(format string, args ...interface{}) {
 	if len(s) == 0 || s[len(s)-1] != '\n' {
 		s += "\n"
 	}
-	fmt.Printf(s)
+	fmt.Print(s)
 
 }
 func (m *DefaultLogger) Warn(s string) {
@@ -57,7 +57,7 @@ func (m *DefaultLogger) Errorf(format string, args ...interface{}) {
 	if len(s) == 0 || s[len(s)-1] != '\n' {
 		s += "\n"
 	}
-	fmt.Errorf(s)
+	os.Stderr.WriteString(s)
 }
 
 var log Logger = &DefaultLogger{}
@@ -65,3 +65,8 @@ var log Logger = &DefaultLogger{}
 func SetLogger(logger Logger) {
 	log = logger
 }
+
+//当前使用的logger，供子包(如proxy)输出日志
+func GetLogger() Logger {
+	return log
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//内存预算：统计server端排队中的数据，包括写队列中待写出的响应、接收队列中以及合并中的请求(请求的帧从读入到处理完成)。
+//连接或者server的总量超过上限(ConnMemoryLimit/MemoryLimit)时，新请求先暂停读取该连接，等待已接收的请求处理完成、
+//写队列写出，最多maxMemoryPause；开启ShedOnMemoryLimit时不等待。仍超过上限时以ErrOverloaded重置新请求的channel。
+//已开始接收的请求的后续帧不受限制，保证其能够完成并释放占用的内存
+package iip
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxMemoryPause     = time.Second
+	memoryPollInterval = time.Millisecond * 10
+)
+
+//已读入、尚未处理完成的请求数据字节数
+func (m *Connection) PendingReadBytes() int64 {
+	return atomic.LoadInt64(&m.pendingRead)
+}
+
+//请求的帧交给channel的处理循环时计入连接的pendingRead
+func (m *Channel) chargeRead(n int64) {
+	atomic.AddInt64(&m.pendingRead, n)
+	atomic.AddInt64(&m.conn.pendingRead, n)
+}
+
+//请求处理完成(或channel关闭)时释放其计入的字节数
+func (m *Channel) releaseRead() {
+	if n := atomic.SwapInt64(&m.pendingRead, 0); n != 0 {
+		atomic.AddInt64(&m.conn.pendingRead, -n)
+	}
+}
+
+//server全部连接排队中的数据字节数，结果缓存memoryPollInterval，避免每个请求都遍历全部连接
+func (m *Server) PendingBytes() int64 {
+	now := time.Now().UnixNano()
+	if now-atomic.LoadInt64(&m.pendingBytesTime) < int64(memoryPollInterval) {
+		return atomic.LoadInt64(&m.pendingBytes)
+	}
+	var ret int64
+	for _, conn := range m.connectionList() {
+		ret += conn.PendingReadBytes() + conn.PendingWriteBytes()
+	}
+	atomic.StoreInt64(&m.pendingBytes, ret)
+	atomic.StoreInt64(&m.pendingBytesTime, now)
+	return ret
+}
+
+func (m *Connection) memoryExceeded(svr *Server, config *ServerConfig) bool {
+	if config.ConnMemoryLimit > 0 && m.PendingReadBytes()+m.PendingWriteBytes() > config.ConnMemoryLimit {
+		return true
+	}
+	return config.MemoryLimit > 0 && svr.PendingBytes() > config.MemoryLimit
+}
+
+//是否接收新的请求，在读循环中调用，等待期间不读取该连接，对client形成反压
+func (m *Connection) admitMemory(svr *Server, config *ServerConfig) bool {
+	if config.ConnMemoryLimit <= 0 && config.MemoryLimit <= 0 {
+		return true
+	}
+	deadline := time.Now().Add(maxMemoryPause)
+	for m.memoryExceeded(svr, config) {
+		if config.ShedOnMemoryLimit || m.isClosed() || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(memoryPollInterval)
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+//请求在release关闭之前一直占用其数据，处理完成后返回数据的长度
+type blockHandler struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *blockHandler) Handle(c *Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	if !dataCompleted {
+		return nil, ErrPacketContinue
+	}
+	m.started <- struct{}{}
+	<-m.release
+	return []byte(fmt.Sprintf("%d", len(data))), nil
+}
+
+func newMemoryTestServer(t *testing.T, config ServerConfig) (*Server, string, *blockHandler) {
+	t.Helper()
+	server, addr := newTestServer(t, config)
+	handler := &blockHandler{started: make(chan struct{}, 10), release: make(chan struct{})}
+	if err := server.RegisterHandler("/test/block", handler); err != nil {
+		t.Fatal(err)
+	}
+	return server, addr, handler
+}
+
+//在新channel上发出占用4KB的请求，等待handler开始处理，返回接收结果的chan
+func blockRequest(t *testing.T, client *Client, handler *blockHandler) chan error {
+	t.Helper()
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	err = channel.DoRequestAsync("/test/block", bytes.Repeat([]byte("x"), 4096), time.Second*10, func(resp []byte, err error) {
+		if err == nil && string(resp) != "4096" {
+			err = fmt.Errorf("unexpected response %q", resp)
+		}
+		done <- err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-handler.started:
+	case <-time.After(time.Second * 5):
+		t.Fatal("blocking request not started")
+	}
+	return done
+}
+
+//开启ShedOnMemoryLimit时，超过连接的内存上限的新请求立即以ErrOverloaded拒绝，占用的内存释放之后恢复
+func TestConnMemoryLimitShed(t *testing.T) {
+	server, addr, handler := newMemoryTestServer(t, ServerConfig{Workers: 2, ConnMemoryLimit: 1024, ShedOnMemoryLimit: true})
+	client := newTestClient(t, addr, ClientConfig{})
+	done := blockRequest(t, client, handler)
+	conns := serverConnections(server)
+	if len(conns) != 1 || conns[0].PendingReadBytes() != 4096 {
+		t.Fatalf("pending read bytes not charged: %d connections", len(conns))
+	}
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channel.DoRequest(testEchoPath, []byte("x"), time.Second*5); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected overloaded, got %v", err)
+	}
+	close(handler.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "pending read bytes released", func() bool { return conns[0].PendingReadBytes() == 0 })
+	channel, err = client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret, err := channel.DoRequest(testEchoPath, []byte("x"), time.Second*5); err != nil || string(ret) != "x" {
+		t.Fatalf("request after release: %q, %v", ret, err)
+	}
+}
+
+//未开启ShedOnMemoryLimit时，新请求等待占用的内存释放之后处理，而不是被拒绝
+func TestConnMemoryLimitPause(t *testing.T) {
+	_, addr, handler := newMemoryTestServer(t, ServerConfig{Workers: 2, ConnMemoryLimit: 1024})
+	client := newTestClient(t, addr, ClientConfig{})
+	done := blockRequest(t, client, handler)
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(maxMemoryPause/4, func() { close(handler.release) })
+	start := time.Now()
+	if ret, err := channel.DoRequest(testEchoPath, []byte("x"), time.Second*5); err != nil || string(ret) != "x" {
+		t.Fatalf("paused request: %q, %v", ret, err)
+	}
+	if elapsed := time.Since(start); elapsed < maxMemoryPause/8 {
+		t.Fatalf("request not paused, finished in %v", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+//server的内存上限统计全部连接，一个连接占用的内存使其他连接的新请求被拒绝
+func TestServerMemoryLimit(t *testing.T) {
+	server, addr, handler := newMemoryTestServer(t, ServerConfig{Workers: 2, MemoryLimit: 1024, ShedOnMemoryLimit: true})
+	done := blockRequest(t, newTestClient(t, addr, ClientConfig{}), handler)
+	waitFor(t, "server pending bytes", func() bool { return server.PendingBytes() >= 4096 })
+	channel, err := newTestClient(t, addr, ClientConfig{}).NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channel.DoRequest(testEchoPath, []byte("x"), time.Second*5); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected overloaded, got %v", err)
+	}
+	close(handler.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "server pending bytes released", func() bool { return server.PendingBytes() == 0 })
+}
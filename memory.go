@@ -0,0 +1,34 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//内存传输：client与server之间以net.Pipe相连，不占用端口，用于handler及client的单元测试
+package iip
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+var memoryConnSeq uint64
+
+//在server与client之间建立一个内存连接，返回client端及server端的connection。
+//连接加入client的连接列表，client.NewChannel优先在其上创建channel；server无需StartListen
+func NewMemoryPair(server *Server, client *Client) (*Connection, *Connection, error) {
+	if !server.tryAcquireConnSlot() {
+		return nil, nil, fmt.Errorf("max connections %d reached", server.getConfig().MaxConnections)
+	}
+	clientNetConn, serverNetConn := net.Pipe()
+	serverConn, err := server.serveConn(serverNetConn, fmt.Sprintf("memory-%d", atomic.AddUint64(&memoryConnSeq, 1)))
+	if err != nil {
+		clientNetConn.Close()
+		return nil, nil, err
+	}
+	clientConn, err := client.addConnection(clientNetConn, "")
+	if err != nil {
+		serverConn.Close(err)
+		return nil, nil, err
+	}
+	return clientConn, serverConn, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//帧元数据：握手协商FeatureMetadata之后，每一帧在path之后携带一个元数据块，用于传递链路追踪上下文等跨进程信息。
+//元数据块格式：2字节元数据长度 + 若干项(1字节key长度 + key + 2字节value长度 + value)，长度为0表示没有元数据；
+//分片发送的请求/响应只在首帧携带元数据
+package iip
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+//帧格式，由握手协商决定：低8位为校验算法，frameFormatMeta表示携带元数据块，frameFormatSealed表示数据以PSK加密(见psk.go)，
+//frameFormatSeq表示携带帧序号(见sequence.go)，frameFormatCloseReason表示关闭连接的帧携带原因(见closereason.go)
+type frameFormat uint32
+
+const (
+	frameFormatMeta        frameFormat = 1 << 8
+	frameFormatSealed      frameFormat = 1 << 9
+	frameFormatSeq         frameFormat = 1 << 10
+	frameFormatCloseReason frameFormat = 1 << 11
+)
+
+func newFrameFormat(checksum byte, meta bool) frameFormat {
+	ret := frameFormat(checksum)
+	if meta {
+		ret |= frameFormatMeta
+	}
+	return ret
+}
+
+func (m frameFormat) checksum() byte {
+	return byte(m)
+}
+
+func (m frameFormat) meta() bool {
+	return m&frameFormatMeta != 0
+}
+
+func (m frameFormat) sealed() bool {
+	return m&frameFormatSealed != 0
+}
+
+func (m frameFormat) sequence() bool {
+	return m&frameFormatSeq != 0
+}
+
+func (m frameFormat) closeReason() bool {
+	return m&frameFormatCloseReason != 0
+}
+
+//替换校验算法，其他标志不变
+func (m frameFormat) withChecksum(checksum byte) frameFormat {
+	return m&^0xff | frameFormat(checksum)
+}
+
+//连接当前写出帧使用的格式
+func (m *Connection) writeFrameFormat() frameFormat {
+	return frameFormat(atomic.LoadUint32(&m.writeFormat))
+}
+
+//连接当前读入帧使用的格式
+func (m *Connection) readFrameFormat() frameFormat {
+	return frameFormat(atomic.LoadUint32(&m.readFormat))
+}
+
+func (m *Connection) setWriteFrameFormat(format frameFormat) {
+	atomic.StoreUint32(&m.writeFormat, uint32(format))
+}
+
+func (m *Connection) setReadFrameFormat(format frameFormat) {
+	atomic.StoreUint32(&m.readFormat, uint32(format))
+}
+
+//元数据编码后的字节数，不含2字节的长度字段
+func metaLen(meta map[string]string) int {
+	ret := 0
+	for k, v := range meta {
+		ret += 1 + len(k) + 2 + len(v)
+	}
+	return ret
+}
+
+func checkMeta(meta map[string]string) error {
+	for k, v := range meta {
+		if len(k) == 0 || len(k) > 255 {
+			return fmt.Errorf("invalid meta key: %q, length must be in [1, 255]", k)
+		}
+		if len(v) > int(MaxMetaLen) {
+			return fmt.Errorf("meta value of %s is too large", k)
+		}
+	}
+	if metaLen(meta) > int(MaxMetaLen) {
+		return kindError(ErrTooLarge, nil, "meta is too large, must be <= %d bytes", MaxMetaLen)
+	}
+	return nil
+}
+
+//将元数据块(含长度字段)追加到dst
+func appendMeta(dst []byte, meta map[string]string) []byte {
+	var bt [2]byte
+	binary.BigEndian.PutUint16(bt[:], uint16(metaLen(meta)))
+	dst = append(dst, bt[:]...)
+	for k, v := range meta {
+		dst = append(dst, byte(len(k)))
+		dst = append(dst, k...)
+		binary.BigEndian.PutUint16(bt[:], uint16(len(v)))
+		dst = append(dst, bt[:]...)
+		dst = append(dst, v...)
+	}
+	return dst
+}
+
+//解析元数据块的内容(不含长度字段)
+func decodeMeta(bts []byte) (map[string]string, error) {
+	if len(bts) == 0 {
+		return nil, nil
+	}
+	ret := make(map[string]string)
+	for len(bts) > 0 {
+		keyLen := int(bts[0])
+		if keyLen == 0 || len(bts) < 1+keyLen+2 {
+			return nil, protocolError("invalid meta")
+		}
+		key := string(bts[1 : 1+keyLen])
+		bts = bts[1+keyLen:]
+		valueLen := int(binary.BigEndian.Uint16(bts))
+		if len(bts) < 2+valueLen {
+			return nil, protocolError("invalid meta")
+		}
+		ret[key] = string(bts[2 : 2+valueLen])
+		bts = bts[2+valueLen:]
+	}
+	return ret, nil
+}
+
+//在读循环中读取一个元数据块，返回元数据及读取的原始字节(用于计算校验和)，buf为可复用的缓冲区
+func readMeta(reader *bufio.Reader, buf []byte) (map[string]string, []byte, error) {
+	buf = buf[:2]
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, nil, err
+	}
+	n := binary.BigEndian.Uint16(buf)
+	if uint32(n) > MaxMetaLen {
+		return nil, nil, protocolError("read meta len > max-meta-len")
+	}
+	buf = buf[:2+int(n)]
+	if _, err := io.ReadFull(reader, buf[2:]); err != nil {
+		return nil, nil, err
+	}
+	meta, err := decodeMeta(buf[2:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, buf, nil
+}
+
+type requestMetaKey struct{}
+
+//返回一个携带请求元数据的context，通过DoRequestContext发出的请求会将其写入请求首帧，
+//对端不支持元数据时被忽略
+func WithRequestMeta(ctx context.Context, key, value string) context.Context {
+	old := RequestMetaFromContext(ctx)
+	meta := make(map[string]string, len(old)+1)
+	for k, v := range old {
+		meta[k] = v
+	}
+	meta[key] = value
+	return context.WithValue(ctx, requestMetaKey{}, meta)
+}
+
+type trailerKey struct{}
+
+//返回一个context，通过DoRequestContext发出的请求完成后，响应的trailer(结束帧携带的元数据)被保存到trailer，
+//对端不支持FeatureTrailer或者没有设置trailer时为nil
+func WithTrailer(ctx context.Context, trailer *map[string]string) context.Context {
+	return context.WithValue(ctx, trailerKey{}, trailer)
+}
+
+func trailerFromContext(ctx context.Context) *map[string]string {
+	ret, _ := ctx.Value(trailerKey{}).(*map[string]string)
+	return ret
+}
+
+//context中携带的请求元数据，返回值不应被修改
+func RequestMetaFromContext(ctx context.Context) map[string]string {
+	meta, _ := ctx.Value(requestMetaKey{}).(map[string]string)
+	return meta
+}
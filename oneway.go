@@ -0,0 +1,155 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//单向消息：client以StatusO13发送不需要响应的消息(如遥测、日志事件)，server以该path注册的handler处理，
+//handler的返回值被忽略，不产生响应。单向消息只有一帧(数据不超过MaxPacketSize)，可以在任何状态的channel上发送，
+//不影响channel上正在进行的请求/响应，须在握手时协商FeatureOneWay。
+//单向消息不保证送达：client写队列满时，以及server超过内存上限、或者开启RejectWhenQueueFull时接收队列满时被丢弃，
+//双方各自的计数见OneWayStats
+package iip
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+//单向消息的计数
+type OneWayStats struct {
+	Sent     int64 `json:"sent,omitempty"`     //client：已写入写队列
+	Received int64 `json:"received,omitempty"` //server：已接收
+	Handled  int64 `json:"handled,omitempty"`  //server：handler处理成功
+	Failed   int64 `json:"failed,omitempty"`   //server：没有handler或者handler返回错误
+	Dropped  int64 `json:"dropped"`            //client：写队列满或者server不支持；server：超过内存上限或者接收队列满
+}
+
+type oneWayCounters struct {
+	sent, received, handled, failed, dropped int64
+}
+
+func (m *oneWayCounters) snapshot() OneWayStats {
+	return OneWayStats{
+		Sent:     atomic.LoadInt64(&m.sent),
+		Received: atomic.LoadInt64(&m.received),
+		Handled:  atomic.LoadInt64(&m.handled),
+		Failed:   atomic.LoadInt64(&m.failed),
+		Dropped:  atomic.LoadInt64(&m.dropped),
+	}
+}
+
+//在channel上发送单向消息，写队列满时不等待，直接丢弃并返回ErrWriteQueueFull
+func (m *ClientChannel) Send(path string, data []byte) error {
+	c := m.internalChannel
+	err := c.sendOneWay(path, data)
+	if err != nil {
+		atomic.AddInt64(&m.client.oneWay.dropped, 1)
+		return err
+	}
+	atomic.AddInt64(&m.client.oneWay.sent, 1)
+	return nil
+}
+
+func (m *Channel) sendOneWay(path string, data []byte) error {
+	if err := m.errClosed(); err != nil {
+		return err
+	}
+	if !m.conn.HasFeature(FeatureOneWay) {
+		return fmt.Errorf("one-way message is not supported by peer")
+	}
+	if m.SendClosed() {
+		return ErrSendClosed
+	}
+	if len(path) > int(m.conn.MaxPathLen()) {
+		return fmt.Errorf("path is too large, must be <= %d bytes", m.conn.MaxPathLen())
+	}
+	if err := ValidatePath(path, m.conn.pathRules()); err != nil {
+		return err
+	}
+	if (len(data) == 0 && !m.conn.HasFeature(FeatureEmptyData)) || len(data) > int(m.conn.MaxPacketSize()) {
+		return fmt.Errorf("invalid one-way message size: %d", len(data))
+	}
+	pkt := acquirePacket()
+	pkt.Type, pkt.Status, pkt.Path, pkt.ChannelId, pkt.Data, pkt.channel = PacketTypeRequest, StatusO13, path, m.Id, data, m
+	m.sendLock.Lock()
+	defer m.sendLock.Unlock()
+	if err := m.conn.enqueuePacket(pkt, 0, nil); err != nil {
+		pkt.Release()
+		return err
+	}
+	atomic.AddInt64(&m.WritePacketCount, 1)
+	return nil
+}
+
+//以client内部的channel池中的channel发送单向消息，见ClientChannel.Send
+func (m *Client) Send(path string, data []byte) error {
+	c, err := m.pool.GetContext(context.Background())
+	if err != nil {
+		atomic.AddInt64(&m.oneWay.dropped, 1)
+		return err
+	}
+	err = c.Send(path, data)
+	m.pool.Put(c)
+	return err
+}
+
+//client发送单向消息的计数
+func (m *Client) OneWayStats() OneWayStats {
+	return m.oneWay.snapshot()
+}
+
+//server接收单向消息的计数
+func (m *Server) OneWayStats() OneWayStats {
+	return m.oneWay.snapshot()
+}
+
+//server端在读循环中接收单向消息：超过内存上限时丢弃；接收队列满时与请求一样暂停读取连接，开启RejectWhenQueueFull时丢弃
+func (m *Connection) deliverOneWay(channel *Channel, pkt *Packet, svr *Server) {
+	counters := &svr.oneWay
+	atomic.AddInt64(&counters.received, 1)
+	config := svr.getConfig()
+	drop := isSysPath(pkt.Path) || channel.getStream() != nil || atomic.LoadInt32(&channel.rejected) == 1
+	if !drop {
+		drop = (config.ConnMemoryLimit > 0 || config.MemoryLimit > 0) && m.memoryExceeded(svr, config)
+	}
+	if !drop {
+		if !config.RejectWhenQueueFull {
+			m.enqueue(channel, pkt)
+			return
+		}
+		if m.tryEnqueue(channel, pkt) {
+			return
+		}
+	}
+	atomic.AddInt64(&counters.dropped, 1)
+	log.Warnf("drop one-way message of %s, channel id: %d, path: %s", m.key, channel.Id, pkt.Path)
+	pkt.Release()
+}
+
+//处理单向消息，在channel的处理goroutine或者server的worker中执行，不产生响应
+func (m *Channel) serveOneWay(server *Server, pkt *Packet) {
+	_, err := server.safeHandle(m, pkt, true)
+	if err != nil && err != ErrPacketContinue {
+		atomic.AddInt64(&server.oneWay.failed, 1)
+		log.Errorf("handle one-way message %s fail, %s", pkt.Path, err.Error())
+	} else {
+		atomic.AddInt64(&server.oneWay.handled, 1)
+	}
+	server.releaseRequest(pkt)
+}
+
+//将单向消息交给worker处理，未开启worker时在channel的处理goroutine中处理
+func (m *Server) dispatchOneWay(c *Channel, pkt *Packet) bool {
+	if m.workers == nil {
+		c.serveOneWay(m, pkt)
+		return true
+	}
+	select {
+	case m.workers <- func() { c.serveOneWay(m, pkt) }:
+		return true
+	case <-c.closeNotify:
+	case <-m.closeNotify:
+	}
+	pkt.Release()
+	return false
+}
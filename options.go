@@ -0,0 +1,392 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//函数式选项：NewServer/NewClient在config之后可以传入若干选项，按顺序修改config，新增设置不再需要修改构造函数的签名。
+//client与server共有的设置(如WithMaxPacketSize、WithTLS)两者都可以使用：
+//	svr, err := iip.NewServer(iip.ServerConfig{}, ":9090", iip.WithMaxPacketSize(1<<20), iip.WithWorkers(64, 0))
+//	client, err := iip.NewClient(iip.ClientConfig{}, "127.0.0.1:9090", iip.WithMaxPacketSize(1<<20), iip.WithConnectTimeout(time.Second))
+package iip
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+//NewServer的选项
+type ServerOption interface {
+	applyServer(config *ServerConfig)
+}
+
+//NewClient的选项
+type ClientOption interface {
+	applyClient(config *ClientConfig)
+}
+
+//client与server都可以使用的选项
+type Option interface {
+	ServerOption
+	ClientOption
+}
+
+type serverOption func(config *ServerConfig)
+
+func (m serverOption) applyServer(config *ServerConfig) {
+	m(config)
+}
+
+type clientOption func(config *ClientConfig)
+
+func (m clientOption) applyClient(config *ClientConfig) {
+	m(config)
+}
+
+type option struct {
+	server func(config *ServerConfig)
+	client func(config *ClientConfig)
+}
+
+func (m option) applyServer(config *ServerConfig) {
+	m.server(config)
+}
+
+func (m option) applyClient(config *ClientConfig) {
+	m.client(config)
+}
+
+//以函数修改ServerConfig，用于没有对应选项的设置
+func WithServerConfig(f func(config *ServerConfig)) ServerOption {
+	return serverOption(f)
+}
+
+//以函数修改ClientConfig，用于没有对应选项的设置
+func WithClientConfig(f func(config *ClientConfig)) ClientOption {
+	return clientOption(f)
+}
+
+//packet最大字节数，见ServerConfig.MaxPacketSize、ClientConfig.MaxPacketSize
+func WithMaxPacketSize(size uint32) Option {
+	return option{
+		server: func(config *ServerConfig) { config.MaxPacketSize = size },
+		client: func(config *ClientConfig) { config.MaxPacketSize = size },
+	}
+}
+
+//path最大字节数
+func WithMaxPathLen(size uint32) Option {
+	return option{
+		server: func(config *ServerConfig) { config.MaxPathLen = size },
+		client: func(config *ClientConfig) { config.MaxPathLen = size },
+	}
+}
+
+//发送时每帧数据的最大字节数
+func WithFrameSize(size uint32) Option {
+	return option{
+		server: func(config *ServerConfig) { config.FrameSize = size },
+		client: func(config *ClientConfig) { config.FrameSize = size },
+	}
+}
+
+//connection的写队列长度
+func WithWriteQueueLen(n uint32) Option {
+	return option{
+		server: func(config *ServerConfig) { config.TcpWriteQueueLen = n },
+		client: func(config *ClientConfig) { config.TcpWriteQueueLen = n },
+	}
+}
+
+//channel的接收队列长度
+func WithChannelQueueLen(n uint32) Option {
+	return option{
+		server: func(config *ServerConfig) { config.ChannelPacketQueueLen = n },
+		client: func(config *ClientConfig) { config.ChannelPacketQueueLen = n },
+	}
+}
+
+//最大连接数
+func WithMaxConnections(n int) Option {
+	return option{
+		server: func(config *ServerConfig) { config.MaxConnections = n },
+		client: func(config *ClientConfig) { config.MaxConnections = n },
+	}
+}
+
+//每个连接最大channel数
+func WithMaxChannelsPerConn(n int) Option {
+	return option{
+		server: func(config *ServerConfig) { config.MaxChannelsPerConn = n },
+		client: func(config *ClientConfig) { config.MaxChannelsPerConn = n },
+	}
+}
+
+//内核socket的读、写缓冲区大小
+func WithSocketBuffers(readSize, writeSize int) Option {
+	return option{
+		server: func(config *ServerConfig) { config.TcpReadBufferSize, config.TcpWriteBufferSize = readSize, writeSize },
+		client: func(config *ClientConfig) { config.TcpReadBufferSize, config.TcpWriteBufferSize = readSize, writeSize },
+	}
+}
+
+//TCP keepalive的间隔，负数表示关闭keepalive
+func WithKeepalive(period time.Duration) Option {
+	return option{
+		server: func(config *ServerConfig) { config.TcpKeepAlive = period },
+		client: func(config *ClientConfig) { config.TcpKeepAlive = period },
+	}
+}
+
+//开启或关闭TCP_NODELAY，关闭时小帧由Nagle算法合并发送，以延迟换取吞吐
+func WithNoDelay(noDelay bool) Option {
+	return option{
+		server: func(config *ServerConfig) { config.TcpDelay = !noDelay },
+		client: func(config *ClientConfig) { config.TcpDelay = !noDelay },
+	}
+}
+
+//关闭连接时的SO_LINGER，负数表示丢弃未发送的数据并发送RST
+func WithLinger(linger time.Duration) Option {
+	return option{
+		server: func(config *ServerConfig) { config.TcpLinger = linger },
+		client: func(config *ClientConfig) { config.TcpLinger = linger },
+	}
+}
+
+//读取一帧的时限，超时未读完整帧时关闭连接
+func WithFrameReadTimeout(timeout time.Duration) Option {
+	return option{
+		server: func(config *ServerConfig) { config.FrameReadTimeout = timeout },
+		client: func(config *ClientConfig) { config.FrameReadTimeout = timeout },
+	}
+}
+
+//帧校验算法
+func WithChecksum(checksum byte) Option {
+	return option{
+		server: func(config *ServerConfig) { config.Checksum = checksum },
+		client: func(config *ClientConfig) { config.Checksum = checksum },
+	}
+}
+
+//RegisterTyped及Call使用的编解码器
+func WithCodec(codec Codec) Option {
+	return option{
+		server: func(config *ServerConfig) { config.Codec = codec },
+		client: func(config *ClientConfig) { config.Codec = codec },
+	}
+}
+
+//连接使用TLS，见tls.go
+func WithTLS(tlsConfig *tls.Config) Option {
+	return option{
+		server: func(config *ServerConfig) { config.TLSConfig = tlsConfig },
+		client: func(config *ClientConfig) { config.TLSConfig = tlsConfig },
+	}
+}
+
+//连接以预共享密钥加密，算法默认为AES-256-GCM(见WithPSKCipher)，见psk.go
+func WithPSK(psk []byte) Option {
+	return option{
+		server: func(config *ServerConfig) { config.PSK = psk },
+		client: func(config *ClientConfig) { config.PSK = psk },
+	}
+}
+
+//PSK加密的算法，见psk.go
+func WithPSKCipher(c PSKCipher) Option {
+	return option{
+		server: func(config *ServerConfig) { config.PSKCipher = c },
+		client: func(config *ClientConfig) { config.PSKCipher = c },
+	}
+}
+
+//channel空闲超时
+func WithChannelIdleTimeout(timeout time.Duration) Option {
+	return option{
+		server: func(config *ServerConfig) { config.ChannelIdleTimeout = timeout },
+		client: func(config *ClientConfig) { config.ChannelIdleTimeout = timeout },
+	}
+}
+
+//channel关闭后的逗留期，见closeack.go
+func WithChannelCloseLinger(linger time.Duration) Option {
+	return option{
+		server: func(config *ServerConfig) { config.ChannelCloseLinger = linger },
+		client: func(config *ClientConfig) { config.ChannelCloseLinger = linger },
+	}
+}
+
+//path的校验规则，见pathrules.go
+func WithPathRules(rules PathRules) Option {
+	return option{
+		server: func(config *ServerConfig) { config.PathRules = &rules },
+		client: func(config *ClientConfig) { config.PathRules = &rules },
+	}
+}
+
+//设置日志输出。logger是进程范围的，与SetLogger相同，在创建server/client时生效
+func WithLogger(logger Logger) Option {
+	return option{
+		server: func(config *ServerConfig) { SetLogger(logger) },
+		client: func(config *ClientConfig) { SetLogger(logger) },
+	}
+}
+
+//连接认证器
+func WithAuthenticator(authenticator Authenticator) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.Authenticator = authenticator })
+}
+
+//按client证书授权
+func WithCertAuthorizer(authorizer CertAuthorizer) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.CertAuthorizer = authorizer })
+}
+
+//连接空闲超时
+func WithIdleTimeout(timeout time.Duration) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.IdleTimeout = timeout })
+}
+
+//连接最大存活时间及排空的宽限期
+func WithMaxConnectionAge(age, grace time.Duration) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.MaxConnectionAge, config.MaxConnectionAgeGrace = age, grace })
+}
+
+//防慢速攻击：连接建立后读完首帧的时限，以及读取帧的过程中每interval至少读入的字节数，见readtimeout.go
+func WithSlowReadLimits(firstFrameTimeout time.Duration, minBytes int, interval time.Duration) ServerOption {
+	return serverOption(func(config *ServerConfig) {
+		config.FirstFrameTimeout, config.MinReadBytes, config.MinReadInterval = firstFrameTimeout, minBytes, interval
+	})
+}
+
+//每秒accept的连接数上限及突发上限，见connfilter.go
+func WithAcceptRate(rate float64, burst int) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.AcceptRate, config.AcceptBurst = rate, burst })
+}
+
+//按对端ip的允许、拒绝列表(CIDR或者单个ip)
+func WithCIDRs(allow, deny []string) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.AllowCIDRs, config.DenyCIDRs = allow, deny })
+}
+
+//每个对端ip的最大并发连接数，见ipcap.go
+func WithMaxConnectionsPerIP(n int) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.MaxConnectionsPerIP = n })
+}
+
+//accept之后、创建连接之前调用的连接过滤器
+func WithConnFilter(filter ConnFilter) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.ConnFilter = filter })
+}
+
+//开启公平分派，见readsched.go
+func WithFairDispatch(maxConsecutiveFrames, queueLen int) ServerOption {
+	return serverOption(func(config *ServerConfig) {
+		config.MaxConsecutiveFrames, config.DispatchQueueLen = maxConsecutiveFrames, queueLen
+	})
+}
+
+//流式交给FrameConsumer的帧数据的最小字节数，见framestream.go
+func WithStreamFrameThreshold(n uint32) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.StreamFrameThreshold = n })
+}
+
+//新建channel的准入回调，见channelpolicy.go
+func WithNewChannelPolicy(policy NewChannelPolicy) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.OnNewChannelRequest = policy })
+}
+
+//处理请求的worker数及worker队列长度，见workerpool.go
+func WithWorkers(workers, queueLen int) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.Workers, config.WorkerQueueLen = workers, queueLen })
+}
+
+//事件循环模式的共享处理goroutine数，见eventloop.go
+func WithEventLoops(loops int) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.EventLoops = loops })
+}
+
+//handler返回后回收请求的数据缓冲区，handler不能在返回后继续使用请求数据，见pool.go
+func WithRecycleRequests() ServerOption {
+	return serverOption(func(config *ServerConfig) { config.RecycleRequests = true })
+}
+
+//多帧请求合并后的最大字节数
+func WithMaxRequestSize(size uint32) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.MaxRequestSize = size })
+}
+
+//合并多帧请求，handler只以完整的请求调用一次
+func WithAssembleRequests() ServerOption {
+	return serverOption(func(config *ServerConfig) { config.AssembleRequests = true })
+}
+
+//连接及server排队中的数据字节数上限，见membudget.go
+func WithMemoryLimit(connLimit, limit int64) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.ConnMemoryLimit, config.MemoryLimit = connLimit, limit })
+}
+
+//请求处理完成后的访问日志
+func WithAccessLog(logger AccessLogger) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.AccessLog = logger })
+}
+
+//耗时超过threshold的请求记录日志
+func WithSlowRequestThreshold(threshold time.Duration) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.SlowRequestThreshold = threshold })
+}
+
+//开启/sys/stats、/sys/channels管理路径
+func WithSysEndpoints(authorizer SysAuthorizer) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.SysEndpoints, config.SysAuthorizer = true, authorizer })
+}
+
+//监听socket设置SO_REUSEPORT，并打开listeners个监听socket
+func WithReusePort(listeners int) ServerOption {
+	return serverOption(func(config *ServerConfig) { config.ReusePort, config.Listeners = true, listeners })
+}
+
+//Do使用的channel数上限
+func WithMaxPoolChannels(n int) ClientOption {
+	return clientOption(func(config *ClientConfig) { config.MaxPoolChannels = n })
+}
+
+//握手时协商帧序号，见sequence.go
+func WithSequenceCheck() ClientOption {
+	return clientOption(func(config *ClientConfig) { config.SequenceCheck = true })
+}
+
+//开启请求流水线，channel上最多depth个请求同时进行，见pipeline.go
+func WithPipelineDepth(depth int) ClientOption {
+	return clientOption(func(config *ClientConfig) { config.PipelineDepth = depth })
+}
+
+//服务器连接超时
+func WithConnectTimeout(timeout time.Duration) ClientOption {
+	return clientOption(func(config *ClientConfig) { config.TcpConnectTimeout = timeout })
+}
+
+//握手时提交给server认证的凭证
+func WithCredentials(credentials CredentialsFunc) ClientOption {
+	return clientOption(func(config *ClientConfig) { config.Credentials = credentials })
+}
+
+//幂等path的请求重试策略
+func WithRetry(policy RetryPolicy) ClientOption {
+	return clientOption(func(config *ClientConfig) { config.Retry = &policy })
+}
+
+//服务端地址解析器
+func WithResolver(resolver Resolver) ClientOption {
+	return clientOption(func(config *ClientConfig) { config.Resolver = resolver })
+}
+
+//新建channel时选择服务端地址的策略
+func WithBalancer(balancer Balancer) ClientOption {
+	return clientOption(func(config *ClientConfig) { config.Balancer = balancer })
+}
+
+//连接的健康检查
+func WithHealthCheck(healthCheck HealthCheckConfig) ClientOption {
+	return clientOption(func(config *ClientConfig) { config.HealthCheck = &healthCheck })
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//channel、连接所属的server或client及连接的地址。server端连接的Client()为nil，client端连接的Server()为nil；
+//以NewConnection直接创建的连接两者都为nil
+package iip
+
+import "net"
+
+//连接所属的server
+func (m *Connection) Server() *Server {
+	return m.server
+}
+
+//连接所属的client
+func (m *Connection) Client() *Client {
+	return m.client
+}
+
+//channel所在的连接
+func (m *Channel) Connection() *Connection {
+	return m.conn
+}
+
+//ClientChannel对应的channel，可以由此取得所在的连接及其协商的特性
+func (m *ClientChannel) Channel() *Channel {
+	return m.internalChannel
+}
+
+//channel所属的server，handler中可以由此取得server的配置、统计等
+func (m *Channel) Server() *Server {
+	return m.conn.server
+}
+
+//channel所属的client
+func (m *Channel) Client() *Client {
+	return m.conn.client
+}
+
+//连接对端的地址
+func (m *Connection) RemoteAddr() net.Addr {
+	return m.tcpConn.RemoteAddr()
+}
+
+//连接本端的地址
+func (m *Connection) LocalAddr() net.Addr {
+	return m.tcpConn.LocalAddr()
+}
+
+//channel所在连接对端的地址，handler可以由此记录client的ip或者按对端做决策
+func (m *Channel) RemoteAddr() net.Addr {
+	return m.conn.RemoteAddr()
+}
+
+//channel所在连接本端的地址
+func (m *Channel) LocalAddr() net.Addr {
+	return m.conn.LocalAddr()
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//path的校验及规范化：帧中的path以\0结尾，含有\0的path会破坏帧的边界，发送前总是以ErrInvalidPath拒绝，不会写出损坏的字节流。
+//配置PathRules之后还校验UTF-8、允许的前缀及段数：发送时不合规的path返回错误；server收到不合规的请求path时以ErrInvalidPath重置该channel(见reset.go)，
+//连接上的其他channel不受影响。Normalize为true时server先将请求path规范化(path.Clean)再校验、分派，/a//b/./c与/a/b/c由同一handler处理。
+//系统path(/sys/)由框架发出，不受AllowPrefixes、MaxSegments限制
+package iip
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+//path的校验规则
+type PathRules struct {
+	RequireUTF8   bool     //path须为合法的UTF-8
+	AllowPrefixes []string //允许的path前缀，空表示不限制
+	MaxSegments   int      //以/分隔的非空段数上限，0表示不限制
+	Normalize     bool     //server将收到的请求path规范化之后再校验、分派
+}
+
+//校验path，rules为nil时只检查\0
+func ValidatePath(p string, rules *PathRules) error {
+	if strings.IndexByte(p, 0) >= 0 {
+		return invalidPath(p, "contains zero byte")
+	}
+	if rules == nil || p == "" {
+		return nil
+	}
+	if rules.RequireUTF8 && !utf8.ValidString(p) {
+		return invalidPath(p, "not valid utf-8")
+	}
+	if isSysPath(p) {
+		return nil
+	}
+	if len(rules.AllowPrefixes) > 0 {
+		allowed := false
+		for _, v := range rules.AllowPrefixes {
+			if strings.HasPrefix(p, v) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return invalidPath(p, "prefix not allowed")
+		}
+	}
+	if rules.MaxSegments > 0 {
+		n := 0
+		for _, v := range strings.Split(p, "/") {
+			if v != "" {
+				n++
+			}
+		}
+		if n > rules.MaxSegments {
+			return invalidPath(p, fmt.Sprintf("%d segments exceed %d", n, rules.MaxSegments))
+		}
+	}
+	return nil
+}
+
+//规范化path：以/开头，合并重复的/，去掉.、..及结尾的/
+func NormalizePath(p string) string {
+	if p == "" {
+		return p
+	}
+	return path.Clean("/" + p)
+}
+
+//与ErrInvalidPath的错误码相同，errors.Is(err, ErrInvalidPath)为true
+func invalidPath(p string, reason string) *Error {
+	return &Error{Code: ErrInvalidPath.(*Error).Code, Message: fmt.Sprintf("invalid path %q, %s", p, reason)}
+}
+
+//连接所属的server或client配置的path规则
+func (m *Connection) pathRules() *PathRules {
+	if m.server != nil {
+		return m.server.getConfig().PathRules
+	}
+	if m.client != nil {
+		return m.client.config.PathRules
+	}
+	return nil
+}
+
+//server端收到请求帧：按规则规范化path并校验
+func checkRequestPath(pkt *Packet, rules *PathRules) *Error {
+	if rules == nil || pkt.Path == "" {
+		return nil
+	}
+	if rules.Normalize {
+		pkt.Path = NormalizePath(pkt.Path)
+	}
+	if err := ValidatePath(pkt.Path, rules); err != nil {
+		return err.(*Error)
+	}
+	return nil
+}
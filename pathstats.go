@@ -0,0 +1,110 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//按path的请求统计：注册了handler的path的请求数、错误数，以及从收到请求首帧到响应入队的耗时分布(自server启动累计)。
+//耗时记入按1/4个2的幂次划分的对数桶，分位数取所在桶的上界，相对误差不超过约19%。
+//ServerConfig.SlowRequestThreshold大于0时，耗时超过该值的请求以Warn级别记录日志
+package iip
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	latencyBuckets   = 128
+	latencyBucketExp = 4 //每个2的幂次划分的桶数
+)
+
+//耗时分布，以原子操作更新
+type latencyHistogram struct {
+	buckets [latencyBuckets]int64
+	count   int64
+	sum     int64
+	max     int64
+}
+
+//耗时d(纳秒)所在的桶：桶i的上界为2^(i/4)微秒
+func latencyBucket(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us <= 1 {
+		return 0
+	}
+	ret := int(math.Ceil(math.Log2(us) * latencyBucketExp))
+	if ret >= latencyBuckets {
+		ret = latencyBuckets - 1
+	}
+	return ret
+}
+
+func latencyBucketBound(i int) time.Duration {
+	return time.Duration(math.Pow(2, float64(i)/latencyBucketExp) * float64(time.Microsecond))
+}
+
+func (m *latencyHistogram) observe(d time.Duration) {
+	atomic.AddInt64(&m.buckets[latencyBucket(d)], 1)
+	atomic.AddInt64(&m.count, 1)
+	atomic.AddInt64(&m.sum, int64(d))
+	for {
+		max := atomic.LoadInt64(&m.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&m.max, max, int64(d)) {
+			break
+		}
+	}
+}
+
+//分位数q(0~1)，没有数据时返回0
+func (m *latencyHistogram) quantile(q float64) time.Duration {
+	count := atomic.LoadInt64(&m.count)
+	if count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(count)))
+	var n int64
+	for i := 0; i < latencyBuckets; i++ {
+		if n += atomic.LoadInt64(&m.buckets[i]); n >= rank {
+			//不超过实际的最大值
+			if ret, max := latencyBucketBound(i), time.Duration(atomic.LoadInt64(&m.max)); ret < max {
+				return ret
+			}
+			break
+		}
+	}
+	return time.Duration(atomic.LoadInt64(&m.max))
+}
+
+//一个path的统计
+type pathMetrics struct {
+	requests int64
+	errors   int64
+	latency  latencyHistogram
+}
+
+func (m *pathMetrics) snapshot() PathCounters {
+	ret := PathCounters{
+		Requests: atomic.LoadInt64(&m.requests),
+		Errors:   atomic.LoadInt64(&m.errors),
+		P50:      m.latency.quantile(0.5),
+		P90:      m.latency.quantile(0.9),
+		P99:      m.latency.quantile(0.99),
+		Max:      time.Duration(atomic.LoadInt64(&m.latency.max)),
+	}
+	if count := atomic.LoadInt64(&m.latency.count); count > 0 {
+		ret.Mean = time.Duration(atomic.LoadInt64(&m.latency.sum) / count)
+	}
+	return ret
+}
+
+//请求完成时记录耗时，只记录已由countPath创建统计的path
+func (m *serverHandler) observeLatency(path string, d time.Duration) {
+	if v, ok := m.pathCounters.Load(path); ok {
+		v.(*pathMetrics).latency.observe(d)
+	}
+}
+
+//按path的请求统计快照
+func (m *Server) PathStats() map[string]PathCounters {
+	return m.handler.pathStats()
+}
@@ -0,0 +1,298 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//等待响应的请求：同步的DoRequest与异步的DoRequestAsync共用channel上的pending表。
+//请求发送之前登记到表中，携带截止时间、结果的交付方式(同步调用者等待的通道或异步的callback)，
+//处理循环收到完整的响应后按发出的顺序交给表头的请求；超时、取消(CancelRequest)或者channel关闭时以错误完成。
+//超时或被取消的请求仍留在表中占位，其迟到的响应到达时被丢弃，不会错交给其后的请求；
+//channel同一时刻只有一个未完成的请求(开启流水线时为ClientConfig.PipelineDepth个，见pipeline.go)，超出的请求返回ErrChannelBusy
+package iip
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//异步请求的回调，resp为完整的响应数据，err为错误响应、超时、取消或者channel关闭的错误
+type ResponseCallback func(resp []byte, err error)
+
+//channel上等待响应的请求，只完成一次
+type pendingRequest struct {
+	deadline time.Time          //截止时间，零值表示不超时
+	ch       chan pendingResult //同步请求：结果交给等待的调用者
+	callback ResponseCallback   //异步请求
+	timer    *time.Timer        //截止时间到达时以ErrRequestTimeout完成
+	seq      string             //开启流水线时请求的序号，随请求首帧的元数据发出
+	frames   chan *Packet       //流式接收的请求：响应的各帧依次交给调用者，见responsereader.go
+	abandon  chan struct{}      //流式接收的调用者不再读取时关闭
+	done     int32
+}
+
+type pendingResult struct {
+	resp *Packet
+	err  error
+}
+
+//channel的pending表，按请求发出的顺序排列
+type pendingTable struct {
+	sync.Mutex
+	queue []*pendingRequest
+	seq   uint64
+	order sync.Mutex //登记与发送在同一临界区内，使表中的顺序与请求发出的顺序一致
+}
+
+//以响应或错误完成请求，已完成时丢弃resp。返回是否由本次调用完成
+func (m *pendingRequest) complete(resp *Packet, err error) bool {
+	if !atomic.CompareAndSwapInt32(&m.done, 0, 1) {
+		if resp != nil {
+			resp.Release()
+		}
+		return false
+	}
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.deliver(resp, err)
+	return true
+}
+
+//截止时间到达，在timer的goroutine中调用
+func (m *pendingRequest) expire() bool {
+	if !atomic.CompareAndSwapInt32(&m.done, 0, 1) {
+		return false
+	}
+	m.deliver(nil, ErrRequestTimeout)
+	return true
+}
+
+func (m *pendingRequest) deliver(resp *Packet, err error) {
+	if m.callback == nil {
+		//ch的缓冲为1，只完成一次，不会阻塞
+		m.ch <- pendingResult{resp: resp, err: err}
+		return
+	}
+	//完整的响应交给callback，不再回收
+	var data []byte
+	if resp != nil {
+		if resp.Status == StatusS11 || resp.Status == StatusR12 {
+			err = decodeErrorFrame(resp.Data)
+		} else {
+			data = resp.Data
+		}
+	}
+	m.callback(data, err)
+}
+
+func (m *pendingRequest) completed() bool {
+	return atomic.LoadInt32(&m.done) != 0
+}
+
+//登记等待响应的请求，须在发送请求之前登记，避免响应先于登记到达而丢失。
+//未完成的请求已达上限时返回ErrChannelBusy，channel已关闭时返回关闭的错误
+func (m *Channel) addPending(p *pendingRequest) error {
+	depth := m.pipelineDepth()
+	m.pending.Lock()
+	defer m.pending.Unlock()
+	//关闭过程在设置closed之后清空pending表，在锁内检查保证登记的请求不会被遗漏
+	if err := m.errClosed(); err != nil {
+		return err
+	}
+	live := 0
+	for _, v := range m.pending.queue {
+		if !v.completed() {
+			live++
+		}
+	}
+	if live >= depth {
+		return ErrChannelBusy
+	}
+	if depth > 1 {
+		m.pending.seq++
+		p.seq = strconv.FormatUint(m.pending.seq, 10)
+	}
+	if !p.deadline.IsZero() {
+		p.timer = time.AfterFunc(time.Until(p.deadline), func() {
+			if p.expire() {
+				m.refreshBusy()
+			}
+		})
+	}
+	m.pending.queue = append(m.pending.queue, p)
+	atomic.StoreInt32(&m.busy, 1)
+	return nil
+}
+
+//登记请求并发送，发送失败时移除登记。timeout<0表示写队列满时一直等待
+func (m *Channel) sendRequest(p *pendingRequest, pkt *Packet, timeout time.Duration) error {
+	m.pending.order.Lock()
+	defer m.pending.order.Unlock()
+	if err := m.addPending(p); err != nil {
+		return err
+	}
+	if p.seq != "" {
+		//ctx中的元数据可能被其他请求共用，不能修改
+		meta := make(map[string]string, len(pkt.Meta)+1)
+		for k, v := range pkt.Meta {
+			meta[k] = v
+		}
+		meta[MetaRequestSeq] = p.seq
+		pkt.Meta = meta
+	}
+	err := m.sendPacket(pkt, timeout)
+	if err != nil {
+		m.dropPending(p)
+	}
+	return err
+}
+
+//请求未能发出，从表中移除，不会有响应到达
+func (m *Channel) dropPending(p *pendingRequest) {
+	m.pending.Lock()
+	for i, v := range m.pending.queue {
+		if v == p {
+			m.pending.queue = append(m.pending.queue[:i], m.pending.queue[i+1:]...)
+			break
+		}
+	}
+	m.pending.Unlock()
+	m.refreshBusy()
+}
+
+//没有未完成的请求时允许空闲检查，用作双向流的channel除外
+func (m *Channel) refreshBusy() {
+	if m.getStream() != nil {
+		return
+	}
+	m.pending.Lock()
+	defer m.pending.Unlock()
+	for _, v := range m.pending.queue {
+		if !v.completed() {
+			return
+		}
+	}
+	atomic.StoreInt32(&m.busy, 0)
+}
+
+//处理循环收到完整的响应，交给序号相同的请求，响应未携带序号时交给表头的请求；
+//对应的请求已超时或被取消时丢弃，没有对应的请求时回收
+func (m *Channel) deliverResponse(resp *Packet) {
+	seq := resp.Meta[MetaRequestSeq]
+	m.pending.Lock()
+	i := -1
+	for j, v := range m.pending.queue {
+		if seq == "" || v.seq == seq {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		m.pending.Unlock()
+		resp.Release()
+		return
+	}
+	p := m.pending.queue[i]
+	m.pending.queue = append(m.pending.queue[:i], m.pending.queue[i+1:]...)
+	m.pending.Unlock()
+	p.complete(resp, nil)
+	m.refreshBusy()
+}
+
+//channel关闭时以关闭的错误完成表中全部的请求
+func (m *Channel) failPending(err error) {
+	m.pending.Lock()
+	queue := m.pending.queue
+	m.pending.queue = nil
+	m.pending.Unlock()
+	for _, v := range queue {
+		v.complete(nil, err)
+	}
+}
+
+//取消channel上未完成的请求，以err(nil时为context.Canceled)完成：同步的调用者返回err，异步请求以err回调。
+//请求已经发出，其迟到的响应被丢弃。返回是否有请求被取消
+func (m *ClientChannel) CancelRequest(err error) bool {
+	if err == nil {
+		err = context.Canceled
+	}
+	c := m.internalChannel
+	c.pending.Lock()
+	queue := append([]*pendingRequest{}, c.pending.queue...)
+	c.pending.Unlock()
+	ret := false
+	for _, v := range queue {
+		if v.complete(nil, err) {
+			ret = true
+		}
+	}
+	c.refreshBusy()
+	return ret
+}
+
+//异步请求：请求发送之后立即返回，响应到达、超时、取消或者channel关闭时调用callback。timeout<=0表示不超时。
+//callback在channel的处理goroutine(超时时在timer的goroutine)中调用，不应阻塞；返回错误时callback不会被调用。
+//未开启流水线时channel同一时刻只承载一个请求，callback调用之前在该channel上发起的请求返回ErrChannelBusy。不经过client的拦截器
+func (m *ClientChannel) DoRequestAsync(path string, requestData []byte, timeout time.Duration, callback ResponseCallback) error {
+	c := m.internalChannel
+	p := &pendingRequest{callback: callback}
+	if timeout > 0 {
+		p.deadline = time.Now().Add(timeout)
+	}
+	err := c.sendRequest(p, &Packet{
+		Type:      PacketTypeRequest,
+		Path:      path,
+		ChannelId: c.Id,
+		Data:      requestData,
+		channel:   c,
+	}, -1)
+	if err != nil {
+		//发送失败由调用者处理，不再回调；发送期间已被超时或channel的关闭完成时callback已调用
+		if atomic.CompareAndSwapInt32(&p.done, 0, 1) {
+			if p.timer != nil {
+				p.timer.Stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+//以client内部的channel池异步完成一次请求，不超时。同时进行的请求数达到ClientConfig.MaxPoolChannels时，
+//等待其他请求完成之后再发送
+func (m *Client) DoRequestAsync(path string, requestData []byte, callback ResponseCallback) error {
+	return m.DoRequestAsyncTimeout(path, requestData, 0, callback)
+}
+
+//同DoRequestAsync，timeout之后以ErrRequestTimeout回调。请求失败的channel不再放回池中
+func (m *Client) DoRequestAsyncTimeout(path string, requestData []byte, timeout time.Duration, callback ResponseCallback) error {
+	c, err := m.pool.Get()
+	if err != nil {
+		return err
+	}
+	err = c.DoRequestAsync(path, requestData, timeout, func(resp []byte, err error) {
+		if err != nil {
+			m.pool.Discard(c, err)
+		} else {
+			m.pool.Put(c)
+		}
+		callback(resp, err)
+	})
+	if err != nil {
+		m.pool.Discard(c, err)
+	}
+	return err
+}
+
+//以client内部的channel池同步完成一次请求，timeout<=0表示不超时
+func (m *Client) DoRequest(path string, requestData []byte, timeout time.Duration) ([]byte, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return m.DoContext(ctx, path, requestData)
+}
@@ -0,0 +1,26 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//请求流水线：ClientConfig.PipelineDepth大于1时，client可以不等前一个请求的响应，在同一channel上继续发出请求，
+//最多PipelineDepth个请求同时进行，高延迟链路上不必为了并发而打开大量channel。
+//请求首帧的元数据携带channel内递增的序号MetaRequestSeq，server在响应(包括错误响应)的首帧上原样带回，client按序号匹配响应；
+//server没有带回序号(旧版本的server，或者未协商FeatureMetadata)时按请求发出的顺序匹配。
+//server开启worker时同一channel上的请求可能并发处理，流式响应(见response.go)不携带序号且不能交错，此时server应开启ChannelOrdered
+package iip
+
+//channel上可同时进行的请求数
+func (m *Channel) pipelineDepth() int {
+	if client := m.conn.client; client != nil && client.config.PipelineDepth > 1 {
+		return client.config.PipelineDepth
+	}
+	return 1
+}
+
+//server端：请求携带了序号时，响应首帧上带回的元数据
+func (m *requestState) responseMeta() map[string]string {
+	if m == nil || m.seq == "" {
+		return nil
+	}
+	return map[string]string{MetaRequestSeq: m.seq}
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//请求数据为毫秒数，等待之后原样返回。直接返回响应数据，响应携带请求的序号(流式响应不携带，见pipeline.go)
+type sleepHandler struct{}
+
+func (sleepHandler) Handle(c *Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	if !dataCompleted {
+		return nil, ErrPacketContinue
+	}
+	ms, _ := strconv.Atoi(string(data))
+	time.Sleep(time.Duration(ms) * time.Millisecond)
+	return append([]byte(nil), data...), nil
+}
+
+func registerSleepHandler(t *testing.T, server *Server) {
+	t.Helper()
+	if err := server.RegisterHandler("/test/sleep", sleepHandler{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//未开启流水线时channel同一时刻只承载一个请求
+func TestPipelineDisabledBusy(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{})
+	registerSleepHandler(t, server)
+	client := newTestClient(t, addr, ClientConfig{})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	if err := channel.DoRequestAsync("/test/sleep", []byte("100"), time.Second*5, func(resp []byte, err error) { done <- err }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channel.DoRequest("/test/sleep", []byte("0"), time.Second*5); !errors.Is(err, ErrChannelBusy) {
+		t.Fatalf("expected channel busy, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+//server以worker并发处理、响应乱序返回时，client按序号把响应交给对应的请求；超过PipelineDepth的请求返回ErrChannelBusy
+func TestPipelineOutOfOrderResponses(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{Workers: 4})
+	registerSleepHandler(t, server)
+	client := newTestClient(t, addr, ClientConfig{PipelineDepth: 4})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		req, resp string
+		err       error
+	}
+	results := make(chan result, 4)
+	//先发出的请求处理得更久，响应与请求的顺序相反
+	for i := 0; i < 4; i++ {
+		req := fmt.Sprintf("%d", 200-i*50)
+		err := channel.DoRequestAsync("/test/sleep", []byte(req), time.Second*5, func(resp []byte, err error) {
+			results <- result{req: req, resp: string(resp), err: err}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := channel.DoRequest("/test/sleep", []byte("0"), time.Second*5); !errors.Is(err, ErrChannelBusy) {
+		t.Fatalf("expected channel busy over pipeline depth, got %v", err)
+	}
+	var order []string
+	for i := 0; i < 4; i++ {
+		r := <-results
+		if r.err != nil || r.resp != r.req {
+			t.Fatalf("request %s got %q, %v", r.req, r.resp, r.err)
+		}
+		order = append(order, r.req)
+	}
+	if order[0] == "200" {
+		t.Fatalf("responses were not reordered: %v", order)
+	}
+	if ret, err := channel.DoRequest("/test/sleep", []byte("0"), time.Second*5); err != nil || string(ret) != "0" {
+		t.Fatalf("request after pipeline: %q, %v", ret, err)
+	}
+}
+
+//同一channel上并发的同步请求各自收到自己的响应，超时的请求的迟到响应不会交给其后的请求
+func TestPipelineConcurrentRequests(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{Workers: 4})
+	registerSleepHandler(t, server)
+	client := newTestClient(t, addr, ClientConfig{PipelineDepth: 8})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channel.DoRequest("/test/sleep", []byte("200"), time.Millisecond*50); !errors.Is(err, ErrRequestTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			req := strconv.Itoa(i * 10)
+			ret, err := channel.DoRequest("/test/sleep", []byte(req), time.Second*5)
+			if err == nil && string(ret) != req {
+				err = fmt.Errorf("request %s got %q", req, ret)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil && !errors.Is(err, ErrChannelBusy) {
+			t.Fatal(err)
+		}
+	}
+}
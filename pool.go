@@ -0,0 +1,101 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//Packet及数据缓冲区的对象池，降低高QPS下每一帧分配内存带来的GC压力
+package iip
+
+import (
+	"reflect"
+	"sync"
+)
+
+//缓冲区按容量分级，最大一级为MaxPacketSize
+var bufferClasses = [...]int{
+	512,
+	4 * 1024,
+	16 * 1024,
+	64 * 1024,
+	256 * 1024,
+	1024 * 1024,
+	4 * 1024 * 1024,
+	int(MaxPacketSize),
+}
+
+var bufferPools [len(bufferClasses)]sync.Pool
+
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return &Packet{}
+	},
+}
+
+func bufferClass(size int) int {
+	for i, v := range bufferClasses {
+		if size <= v {
+			return i
+		}
+	}
+	return -1
+}
+
+//从缓冲池中取得一个长度为size的缓冲区，size超过最大分级时直接分配
+func getBuffer(size int) []byte {
+	idx := bufferClass(size)
+	if idx < 0 {
+		return make([]byte, size)
+	}
+	if v := bufferPools[idx].Get(); v != nil {
+		return (*(v.(*[]byte)))[:size]
+	}
+	return make([]byte, size, bufferClasses[idx])
+}
+
+//归还缓冲区，容量不符合分级的缓冲区直接丢弃
+func putBuffer(bts []byte) {
+	idx := bufferClass(cap(bts))
+	if idx < 0 || cap(bts) != bufferClasses[idx] {
+		return
+	}
+	bts = bts[:0]
+	bufferPools[idx].Put(&bts)
+}
+
+//判断a是否引用了buf的底层数组
+func sharesBuffer(a, buf []byte) bool {
+	if cap(a) == 0 || cap(buf) == 0 {
+		return false
+	}
+	pa := reflect.ValueOf(a).Pointer()
+	pb := reflect.ValueOf(buf).Pointer()
+	return pa >= pb && pa < pb+uintptr(cap(buf))
+}
+
+//从对象池中取得一个Packet，该Packet可以通过Release回收
+func acquirePacket() *Packet {
+	ret := packetPool.Get().(*Packet)
+	ret.pooled = true
+	return ret
+}
+
+//回收Packet及其数据缓冲区，之后不能再使用Packet及其Data。
+//ServerConfig.RecycleRequests开启时，框架在handler返回后对读循环产生的request packet调用Release，handler如需在返回后继续使用Data，
+//必须自行拷贝；未开启时(默认)请求数据在handler返回后仍归handler所有，不会被复用。
+//对于不是由对象池产生的Packet，Release什么也不做
+func (m *Packet) Release() {
+	if m == nil || !m.pooled {
+		return
+	}
+	if m.buf != nil {
+		putBuffer(m.buf)
+	}
+	*m = Packet{}
+	packetPool.Put(m)
+}
+
+//handler返回后回收请求，未开启RecycleRequests时请求及其数据交给GC，handler可以在返回后继续持有
+func (m *Server) releaseRequest(pkt *Packet) {
+	if m.getConfig().RecycleRequests {
+		pkt.Release()
+	}
+}
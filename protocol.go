@@ -6,11 +6,11 @@
 package iip
 
 import (
-	"bufio"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"math"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -29,25 +29,24 @@ func isClientStatusCompleted(status byte) bool {
 	return status == StatusC1 || status == StatusC3
 }
 
-func isClientStatusUncompleted(status byte) bool {
-	return status == StatusC0 || status == StatusC2
-}
-
 func isServerStatusCompleted(status byte) bool {
-	return status == StatusS5 || status == StatusS7
-}
-
-func isServerStatusUncompleted(status byte) bool {
-	return status == StatusS4 || status == StatusS6
+	return status == StatusS5 || status == StatusS7 || status == StatusS11
 }
 
 type Packet struct {
-	Type      byte   `json:"type"` //0 request, 4 response
-	Status    byte   `json:"status"`
-	Path      string `json:"path"`
-	ChannelId uint32 `json:"channel_id"`
-	Data      []byte `json:"data"`
+	Type      byte              `json:"type"` //0 request, 4 response
+	Status    byte              `json:"status"`
+	Path      string            `json:"path"`
+	ChannelId uint32            `json:"channel_id"`
+	Data      []byte            `json:"data"`
+	Meta      map[string]string `json:"meta,omitempty"`    //元数据，只存在于首帧(协商FeatureTrailer后响应的结束帧携带trailer)，握手协商FeatureMetadata后才会发送
+	Trailer   map[string]string `json:"trailer,omitempty"` //client收到的完整响应中，结束帧携带的元数据，见response.go
+	Seq       uint32            `json:"seq,omitempty"`     //帧序号，握手协商FeatureSequence后存在，由写循环设置，见sequence.go
 	channel   *Channel
+	pooled    bool   //Packet由对象池产生
+	buf       []byte //由缓冲池分配的数据缓冲区，Release时归还
+	written   func() //写循环写出该帧之后调用
+	queued    int64  //放入channel接收队列的时间(UnixNano)，见readsched.go
 }
 
 /*
@@ -64,129 +63,252 @@ type Packet struct {
 	8关闭连接
 * 文本路径（只存在于请求首帧。与unix路径格式相同，类似于url的path，用于指明请求的路径,限制不能大于1024字节）
 * \0
+* 元数据块（握手协商FeatureMetadata后存在：2字节长度 + 元数据项，见metadata.go）
 * 4字节channel识符（多路复用的流身份ID，无符号整数，请求方自增实现）
+* 4字节帧序号（握手协商FeatureSequence后存在，见sequence.go）
 * 4字节数据长度（限制一个帧的数据长度不能大于16MB）
 * 数据
 */
 func CreateNetPacket(pkt *Packet) ([]byte, error) {
-	if len(pkt.Path) > int(MaxPathLen) {
-		return nil, fmt.Errorf("path is too large, must be <= %d bytes", MaxPathLen)
+	if err := checkNetPacket(pkt); err != nil {
+		return nil, err
 	}
-	if len(pkt.Data) > int(MaxPacketSize) {
-		return nil, fmt.Errorf("data is too large, must be <= %d bytes", MaxPacketSize)
-	}
-	pktLen := 1 + len(pkt.Path) + 4 + 4 + len(pkt.Data)
-	pktData := make([]byte, 0, pktLen)
-	pktData = append(pktData, pkt.Status)          //packet type
-	pktData = append(pktData, []byte(pkt.Path)...) //path
-	pktData = append(pktData, 0)                   //\0
-	bt := make([]byte, 4)
-	binary.BigEndian.PutUint32(bt, pkt.ChannelId)
-	pktData = append(pktData, bt...) //channel id
-	binary.BigEndian.PutUint32(bt, uint32(len(pkt.Data)))
-	pktData = append(pktData, bt...)       //data length
+	format := newFrameFormat(ChecksumNone, false)
+	pktData := make([]byte, 0, packetHeaderLen(pkt, format)+len(pkt.Data))
+	pktData = appendPacketHeader(pktData, pkt, format, len(pkt.Data))
 	pktData = append(pktData, pkt.Data...) //data
 	return pktData, nil
 }
 
-func WritePacket(pkt *Packet, writer io.Writer) (int, error) {
-	data, err := CreateNetPacket(pkt)
-	if err != nil {
-		return 0, err
+func checkNetPacket(pkt *Packet) error {
+	if len(pkt.Path) > int(MaxPathLen) {
+		return kindError(ErrTooLarge, nil, "path is too large, must be <= %d bytes", MaxPathLen)
 	}
-	n, err := writer.Write(data)
-	if err != nil {
-		return n, err
+	if err := ValidatePath(pkt.Path, nil); err != nil {
+		return err
 	}
-	if n != len(data) {
-		return n, fmt.Errorf("writepacket not complete, totoal %d bytes, %d bytes writted. ", len(data), n)
+	if len(pkt.Data) > int(MaxPacketSize) {
+		return kindError(ErrTooLarge, nil, "data is too large, must be <= %d bytes", MaxPacketSize)
 	}
-	if pkt.channel != nil {
-		pkt.channel.WriteBytes += int64(n)
+	return nil
+}
+
+//帧头长度：status + path + \0 + [meta] + channel id + [seq] + data length
+func packetHeaderLen(pkt *Packet, format frameFormat) int {
+	ret := 1 + len(pkt.Path) + 1 + 4 + 4
+	if format.meta() {
+		ret += 2 + metaLen(pkt.Meta)
 	}
-	return n, nil
+	if format.sequence() {
+		ret += 4
+	}
+	return ret
 }
 
-func CheckClientPacketStatus(prev, current byte) error {
-	switch current {
-	case StatusC0, StatusC1:
-		if prev != 255 && !isClientStatusCompleted(prev) {
-			return fmt.Errorf("invalid protocol, prev status: %d, current %d", prev, current)
-		}
-	case StatusC2, StatusC3:
-		if !isClientStatusUncompleted(prev) {
-			return fmt.Errorf("invalid protocol, prev status: %d, current %d", prev, current)
-		}
-	case Status8:
-		return nil
-	default:
-		return fmt.Errorf("invalid status value: %d", current)
+//按帧格式将帧头追加到dst，包括元数据块及帧序号，dataLen为帧中数据的字节数(加密时包含认证标签)
+func appendPacketHeader(dst []byte, pkt *Packet, format frameFormat, dataLen int) []byte {
+	dst = append(dst, pkt.Status)  //packet type
+	dst = append(dst, pkt.Path...) //path
+	dst = append(dst, 0)           //\0
+	if format.meta() {
+		dst = appendMeta(dst, pkt.Meta) //meta
 	}
-	return nil
+	var bt [4]byte
+	binary.BigEndian.PutUint32(bt[:], pkt.ChannelId)
+	dst = append(dst, bt[:]...) //channel id
+	if format.sequence() {
+		binary.BigEndian.PutUint32(bt[:], pkt.Seq)
+		dst = append(dst, bt[:]...) //seq
+	}
+	binary.BigEndian.PutUint32(bt[:], uint32(dataLen))
+	dst = append(dst, bt[:]...) //data length
+	return dst
 }
 
-func CheckServerPacketStatus(prev, current byte) error {
-	switch current {
-	case StatusS4, StatusS5:
-		if prev != 255 && !isServerStatusCompleted(prev) {
-			return fmt.Errorf("invalid protocol, prev status: %d, current %d", prev, current)
-		}
-	case StatusS6, StatusS7:
-		if !isServerStatusUncompleted(prev) {
-			return fmt.Errorf("invalid protocol, prev status: %d, current %d", prev, current)
-		}
-	case Status8:
-		return nil
-	default:
-		return fmt.Errorf("invalid status value: %d", current)
+//帧头缓冲池，避免每一帧都分配新的帧头
+var packetHeaderPool = sync.Pool{
+	New: func() interface{} {
+		bts := make([]byte, 0, 64)
+		return &bts
+	},
+}
+
+//帧头从缓冲池中取得，Data单独写出（对于*net.TCPConn使用writev），避免将整个帧拷贝到一个新的缓冲区
+func WritePacket(pkt *Packet, writer io.Writer) (int, error) {
+	return writePacket(pkt, writer, newFrameFormat(ChecksumNone, false), nil)
+}
+
+//按照协商的帧格式写出一帧：携带元数据块，以及校验算法不为ChecksumNone时在数据之后追加4字节校验和；
+//以PSK加密时以sealer加密数据，不再追加校验和，见psk.go
+func writePacket(pkt *Packet, writer io.Writer, format frameFormat, sealer *frameCipher) (int, error) {
+	if err := checkNetPacket(pkt); err != nil {
+		return 0, err
 	}
-	return nil
+	hdr := packetHeaderPool.Get().(*[]byte)
+	dataLen := len(pkt.Data)
+	if format.sealed() {
+		dataLen += pskOverhead
+	}
+	header := appendPacketHeader((*hdr)[:0], pkt, format, dataLen)
+	data := pkt.Data
+	if format.sealed() {
+		buf := getBuffer(dataLen)
+		defer putBuffer(buf)
+		data = sealer.seal(buf[:0], pkt.Data, header)
+	}
+	total := len(header) + len(data)
+	bufs := net.Buffers{header, data}
+	if table := checksumTable(format.checksum()); table != nil && !format.sealed() {
+		var sum [4]byte
+		binary.BigEndian.PutUint32(sum[:], crc32.Update(crc32.Checksum(header, table), table, pkt.Data))
+		bufs = append(bufs, sum[:])
+		total += 4
+	}
+	n64, err := bufs.WriteTo(writer)
+	*hdr = header[:0]
+	packetHeaderPool.Put(hdr)
+	n := int(n64)
+	if err != nil {
+		return n, err
+	}
+	if n != total {
+		return n, fmt.Errorf("writepacket not complete, totoal %d bytes, %d bytes writted. ", total, n)
+	}
+	if pkt.channel != nil {
+		atomic.AddInt64(&pkt.channel.WriteBytes, int64(n))
+	}
+	return n, nil
 }
 
 //channel的实现
 type Channel struct {
-	DefaultErrorHolder
-	DefaultContext
-	Id               uint32
-	NewTime          time.Time
-	WritePacketCount int64
+	//以原子操作访问的64位字段放在最前，保证在32位平台上按8字节对齐，见sizes.go
+	WritePacketCount int64 //原子访问，关闭通知及重置帧不经sendLock发送
 	ReadPacketCount  int64
 	ReadBytes        int64
 	WriteBytes       int64
-	sendLock         sync.Mutex
-	conn             *Connection
-	receivedQueue    chan *Packet //received streamed packet from peer side
-	packetStatus     byte         //recent received packet status
-	closeNotify      chan int
-	closeLock        uint32
+	lastActive       int64 //最近一次收发帧的时间(UnixNano)
+	receivedHigh     int64 //接收队列长度的最高水位，见stats.go
+	waitMax          int64 //帧在接收队列中等待处理的最长时间，见readsched.go
+	waitTotal        int64
+	waitCount        int64
+	streamedBytes    int64 //流式响应发送的字节数，见response.go
+	pendingRead      int64 //当前请求计入连接pendingRead的字节数，见membudget.go
+
+	DefaultErrorHolder
+	DefaultContext
+	Id            uint32
+	NewTime       time.Time
+	sendLock      sync.Mutex
+	conn          *Connection
+	receivedQueue chan *Packet //received streamed packet from peer side
+	peerState     streamState  //对端发来的帧的状态，只由读循环访问，见streamstate.go
+	closeNotify   chan int
+	closeStarted  uint32    //close已开始，不再复位，见lifecycle.go
+	closed        uint32    //已关闭，err已确定
+	notifyOnce    sync.Once //关闭closeNotify
+	push          bool      //由server发起的推送channel
+	legacyId      bool      //id由server为旧版client按顺序分配，不属于任何一端的命名空间
+	tenant        *Tenant   //channel计入的租户，由ChannelsLock保护，见sysmux.go
+	rateLimited   bool      //当前请求被限流，丢弃其后续帧，在请求完成时响应ErrRateLimited
+	busy          int32     //server正在处理的请求数(开启worker时可能大于1)，或client正在等待响应，不为0时不做空闲检查
+	deadlineTimer *time.Timer
+	deadlineLock  sync.Mutex
+	halfClosed    int32              //半关闭状态，见halfclose.go
+	stream        atomic.Value       //*Stream，channel用作双向流时设置
+	weight        int32              //写调度权重，见writesched.go
+	request       *requestState      //server端正在接收的请求，只由serveReceived访问，见accesslog.go
+	requestId     atomic.Value       //string，最近开始处理的请求的id
+	requestMeta   atomic.Value       //map[string]string，最近开始处理的请求首帧携带的元数据
+	requestCancel atomic.Value       //context.CancelFunc，取消最近开始的ContextHandler调用，见ctxhandler.go
+	handlerCtx    atomic.Value       //handlerContext，当前handler调用的context，见timeout_handler.go
+	requestBytes  int64              //server端正在接收的请求已收到的数据字节数，只由读循环访问，见limits.go
+	assembling    *Packet            //server端合并中的请求首帧，只由serveReceived访问，见assemble.go
+	assembled     []byte             //合并中的请求数据
+	assembleOn    bool               //当前请求以合并模式接收，首帧到达时确定
+	rejected      int32              //channel因超限被拒绝，正在关闭
+	generation    uint32             //本端分配的id的代数，见channelid.go
+	closeAck      bool               //本端已发出关闭通知或重置帧，id在对端确认之后复用，见closeack.go
+	loopState     int32              //事件循环模式下的调度状态，见eventloop.go
+	pending       pendingTable       //client等待响应的请求，见pending.go
+	ctx           context.Context    //channel的context，首次调用Context()时创建，见context.go
+	ctxCancel     context.CancelFunc //channel关闭时调用
+	ctxLock       sync.Mutex
 }
 
+//发送packet，写队列满时一直等待
 func (m *Channel) SendPacket(pkt *Packet) error {
-	if m.err != nil {
-		return fmt.Errorf("current channel is invalid, %s", m.err.Error())
+	return m.sendPacket(pkt, -1)
+}
+
+//发送packet，写队列满时最多等待timeout，超时返回ErrWriteQueueFull；timeout为0时不等待。
+//分片发送的packet在部分分片入队之后超时，channel被关闭，因为对端收到的消息已不完整
+func (m *Channel) SendPacketTimeout(pkt *Packet, timeout time.Duration) error {
+	if timeout < 0 {
+		timeout = 0
+	}
+	return m.sendPacket(pkt, timeout)
+}
+
+func (m *Channel) sendPacket(pkt *Packet, timeout time.Duration) error {
+	if err := m.errClosed(); err != nil {
+		return err
+	}
+	if pkt.Path != PathDeleteChannel && m.SendClosed() {
+		return ErrSendClosed
+	}
+	if len(pkt.Data) == 0 && !m.conn.HasFeature(FeatureEmptyData) {
+		return fmt.Errorf("empty data is not supported by peer")
+	}
+	if len(pkt.Path) > int(m.conn.MaxPathLen()) {
+		return kindError(ErrTooLarge, nil, "path is too large, must be <= %d bytes", m.conn.MaxPathLen())
+	}
+	if err := ValidatePath(pkt.Path, m.conn.pathRules()); err != nil {
+		return err
+	}
+	if err := checkMeta(pkt.Meta); err != nil {
+		return err
+	}
+	maxPacketSize := int(m.conn.FrameSize())
+	//0号channel及系统path的消息由对端整帧解析，不按分帧大小拆分
+	if m.Id == 0 || isSysPath(pkt.Path) {
+		maxPacketSize = int(m.conn.MaxPacketSize())
+	}
+	atomic.StoreInt64(&m.lastActive, time.Now().UnixNano())
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
 	}
 	m.sendLock.Lock()
 	defer m.sendLock.Unlock()
-	if len(pkt.Data) <= int(MaxPacketSize) {
+	if len(pkt.Data) <= maxPacketSize {
 		if m.conn.Role == RoleClient {
 			pkt.Status = 1
 		} else if m.conn.Role == RoleServer {
 			pkt.Status = 5
 		}
-		m.conn.tcpWriteQueue <- pkt
-		m.WritePacketCount++
+		if err := m.conn.enqueuePacket(pkt, timeout, expired); err != nil {
+			return err
+		}
+		atomic.AddInt64(&m.WritePacketCount, 1)
 		return nil
 	}
 	remainDataSize := len(pkt.Data)
 	firstSend := true
 	for {
-		chunkSize := int(MaxPacketSize)
-		if remainDataSize < int(MaxPacketSize) {
+		chunkSize := maxPacketSize
+		if remainDataSize < maxPacketSize {
 			chunkSize = remainDataSize
 		}
 		start := len(pkt.Data) - remainDataSize
 		end := start + chunkSize
-		chunk := &Packet{Type: pkt.Type, Path: pkt.Path, ChannelId: m.Id, Data: pkt.Data[start:end], channel: m}
+		chunk := acquirePacket()
+		chunk.Type, chunk.Path, chunk.ChannelId, chunk.Data, chunk.channel = pkt.Type, pkt.Path, m.Id, pkt.Data[start:end], m
+		if firstSend {
+			chunk.Meta = pkt.Meta
+		}
 		if chunkSize == remainDataSize {
 			if m.conn.Role == RoleClient {
 				if firstSend {
@@ -222,7 +344,13 @@ func (m *Channel) SendPacket(pkt *Packet) error {
 		} else {
 			return fmt.Errorf("protocol error")
 		}
-		m.conn.tcpWriteQueue <- chunk
+		if err := m.conn.enqueuePacket(chunk, timeout, expired); err != nil {
+			chunk.Release()
+			if !firstSend {
+				go m.Close(err)
+			}
+			return err
+		}
 
 		firstSend = false
 		remainDataSize -= chunkSize
@@ -231,265 +359,603 @@ func (m *Channel) SendPacket(pkt *Packet) error {
 		}
 	}
 
-	m.WritePacketCount++
+	atomic.AddInt64(&m.WritePacketCount, 1)
 	return nil
 }
 
 func (m *Channel) handleServerLoop() {
-	var pktWholeRequest *Packet
-	handler := m.conn.GetCtxData(CtxServer).(*Server).handler
+	server := m.conn.server
 	for {
 		select {
 		case <-m.closeNotify:
 			return
 		case pkt := <-m.receivedQueue:
-			if pkt.Status == Status8 {
-				m.Close(fmt.Errorf("closed by peer command"))
+			if !m.serveReceived(server, pkt) {
 				return
 			}
+		}
+	}
+}
 
-			//merge
-			if pktWholeRequest == nil {
-				pktWholeRequest = pkt
-			} else {
-				pktWholeRequest.Data = append(pktWholeRequest.Data, pkt.Data...)
-				pktWholeRequest.Status = pkt.Status
-			}
-
-			//handle
-			ret, err := handler.Handle(m, pkt, isClientStatusCompleted(pkt.Status))
-			if err != nil && err != ErrPacketContinue {
-				log.Errorf("handle pkt %s fail, %s", pkt.Path, err.Error())
-				err = ErrHandleError
-			} else if ret == nil {
-				log.Errorf("handle pkt %s fail, %s", pkt.Path, "no response data")
-				err = ErrHandleNoResponse
-			} else {
-				retPkt := &Packet{
-					Type:      PacketTypeResponse,
-					Path:      pkt.Path,
-					ChannelId: pkt.ChannelId,
-					Data:      ret,
-					channel:   m,
-				}
-				if err := m.SendPacket(retPkt); err != nil {
-					log.Errorf("channel.SendPacket fail, %s", err.Error())
-				}
-			}
-			//ErrPacketContine表示数据还没有接收完整，暂时无响应
-			if err != nil && err != ErrPacketContinue {
-				errExt, ok := err.(*Error)
-				if !ok {
-					errExt = &Error{Code: -1, Message: err.Error()}
-				}
-				retPkt := &Packet{
-					Type:      PacketTypeResponse,
-					Path:      pkt.Path,
-					ChannelId: pkt.ChannelId,
-					Data:      ErrorResponse(errExt).Data(),
-					channel:   m,
-				}
-				if err := m.SendPacket(retPkt); err != nil {
-					log.Errorf("channel.SendPacket fail, %s", err.Error())
-				}
-			}
+//处理接收队列中的一帧，在channel的处理goroutine(handleServerLoop)或者事件循环(见eventloop.go)中执行，
+//同一channel同一时刻只在一处执行。返回false表示channel已关闭或者不再处理之后的帧
+func (m *Channel) serveReceived(server *Server, pkt *Packet) bool {
+	m.dequeued(pkt)
+	if pkt.Status == Status8 {
+		pkt.Release()
+		m.Close(fmt.Errorf("closed by peer command"))
+		return false
+	}
+	if pkt.Status == StatusO13 {
+		return server.dispatchOneWay(m, pkt)
+	}
+	if s := m.getStream(); s != nil {
+		return s.deliver(pkt)
+	}
+	if isHalfCloseStatus(pkt.Status) {
+		pkt.Release()
+		m.peerEOF()
+		return true
+	}
+	if pkt.Status == StatusR12 {
+		//接收中的请求被client放弃(重置)
+		err := decodeErrorFrame(pkt.Data)
+		if m.request != nil {
+			m.endRequest(server, m.request, m.request.path, 0, err)
+			m.request = nil
+		}
+		pkt.Release()
+		m.close(err, false)
+		return false
+	}
 
-			if isServerStatusCompleted(pkt.Status) {
-				pktWholeRequest = nil
-			}
+	if pkt.Status == StatusC0 || pkt.Status == StatusC1 {
+		m.rateLimited = !server.admitRate(m, pkt)
+		//首条消息的path注册了流处理函数时，该channel转为双向流
+		if handler := server.getStreamHandler(pkt.Path); handler != nil && !m.rateLimited && m.Id != 0 {
+			s := newStream(m, pkt.Path)
+			m.releaseRead()
+			s.deliver(pkt)
+			m.conn.goLoop(func() { server.serveStream(s, handler) })
+			return true
+		}
+		if m.Id != 0 {
+			m.beginRequest(pkt)
+		}
+	}
+	if m.request != nil {
+		m.request.bytesIn += len(pkt.Data)
+	}
+	req, limited := m.request, m.rateLimited
+	if isClientStatusCompleted(pkt.Status) {
+		m.request = nil
+	}
+	if pkt.Status == StatusC0 || pkt.Status == StatusC1 {
+		m.assembleOn = server.getConfig().AssembleRequests && m.Id != 0
+	}
+	if m.assembleOn && !limited {
+		if pkt = m.assemble(pkt); pkt == nil {
+			return true
+		}
+	}
+	return server.dispatch(m, pkt, req, limited)
+}
 
+//处理请求的一帧并发送响应，在channel的处理goroutine或者server的worker中执行，见workerpool.go
+func (m *Channel) serveRequest(server *Server, pkt *Packet, req *requestState, limited bool) {
+	var ret []byte
+	var err error
+	if limited {
+		err = ErrPacketContinue
+		if isClientStatusCompleted(pkt.Status) {
+			err = ErrRateLimited
+		}
+	} else {
+		atomic.AddInt32(&m.busy, 1)
+		ret, err = server.safeHandle(m, pkt, isClientStatusCompleted(pkt.Status))
+		atomic.AddInt32(&m.busy, -1)
+	}
+	bytesOut := len(ret)
+	recycle := server.getConfig().RecycleRequests
+	if err == ErrResponseSent {
+		//handler已通过ResponseWriter发送了完整的响应
+		err, bytesOut = nil, int(atomic.SwapInt64(&m.streamedBytes, 0))
+	} else if err != nil && err != ErrPacketContinue {
+		log.Errorf("handle pkt %s fail, %s", pkt.Path, err.Error())
+		//*Error(如ErrHandlerPanic)原样响应，其他错误统一为ErrHandleError
+		if _, ok := err.(*Error); !ok {
+			err = ErrHandleError
+		}
+	} else if err == ErrPacketContinue {
+		//数据还没有接收完整，暂时无响应
+	} else if ret == nil && bytesOut == 0 {
+		log.Errorf("handle pkt %s fail, %s", pkt.Path, "no response data")
+		err = ErrHandleNoResponse
+	} else if len(ret) == 0 && !m.conn.HasFeature(FeatureEmptyData) {
+		//handler返回非nil的空数据表示空响应，对端不接受空数据帧时按无响应处理
+		log.Errorf("handle pkt %s fail, %s", pkt.Path, "empty response data is not supported by peer")
+		err = ErrHandleNoResponse
+	} else if ret != nil {
+		retPkt := acquirePacket()
+		retPkt.Type, retPkt.Path, retPkt.ChannelId, retPkt.Data, retPkt.channel = PacketTypeResponse, pkt.Path, pkt.ChannelId, ret, m
+		retPkt.Meta = req.responseMeta()
+		//handler直接返回了request的数据（如echo），缓冲区随响应写出后再回收
+		if recycle && sharesBuffer(ret, pkt.buf) {
+			retPkt.buf, pkt.buf = pkt.buf, nil
+		}
+		if err := m.SendPacket(retPkt); err != nil {
+			log.Errorf("channel.SendPacket fail, %s", err.Error())
+		}
+	}
+	//ErrPacketContine表示数据还没有接收完整，暂时无响应
+	if err != nil && err != ErrPacketContinue {
+		errExt, ok := err.(*Error)
+		if !ok {
+			errExt = &Error{Code: -1, Message: err.Error()}
+		}
+		if err := m.sendErrorMeta(pkt.Path, errExt, req.responseMeta()); err != nil {
+			log.Errorf("channel.SendPacket fail, %s", err.Error())
 		}
 	}
+
+	if err != ErrPacketContinue {
+		m.endRequest(server, req, pkt.Path, bytesOut, err)
+		m.releaseRead()
+	}
+	//handler返回后回收request，见pool.go
+	if recycle {
+		pkt.Release()
+	}
 }
 
 func (m *Channel) handleClientLoop() {
 	// merge 1 or 1+ packet into an whole response
 	var pktWholeResponse *Packet
-	handler := m.conn.GetCtxData(CtxClient).(*Client).handler
+	var streaming *pendingRequest //正在流式接收响应的请求，见responsereader.go
+	client := m.conn.client
+	handler := client.handler
+	if m.push {
+		handler = client.pushHandler
+	}
 	for {
 		select {
 		case <-m.closeNotify:
 			return
 		case pkt := <-m.receivedQueue:
+			m.dequeued(pkt)
 			if pkt.Status == Status8 {
+				pkt.Release()
 				m.Close(fmt.Errorf("closed by peer command"))
 				return
 			}
+			if s := m.getStream(); s != nil {
+				if !s.deliver(pkt) {
+					return
+				}
+				continue
+			}
+			if isHalfCloseStatus(pkt.Status) {
+				pkt.Release()
+				m.peerEOF()
+				continue
+			}
 
-			//merge
+			//流式接收的请求，各帧直接交给调用者，不合并
+			if streaming == nil && pktWholeResponse == nil {
+				streaming = m.streamingPending(pkt)
+			}
+			if streaming != nil {
+				reset, last := pkt.Status == StatusR12, isServerStatusCompleted(pkt.Status) || pkt.Status == StatusR12
+				var resetErr error
+				if reset {
+					resetErr = decodeErrorFrame(pkt.Data)
+				}
+				if !m.deliverFrame(streaming, pkt, last) {
+					return
+				}
+				if last {
+					streaming = nil
+				}
+				if reset {
+					m.close(resetErr, false)
+					return
+				}
+				continue
+			}
+
+			//重置帧丢弃已接收的部分响应，作为完整的错误响应交付
+			reset := pkt.Status == StatusR12
+			var resetErr error
+			if reset {
+				resetErr = decodeErrorFrame(pkt.Data)
+				if pktWholeResponse != nil {
+					pktWholeResponse.Release()
+					pktWholeResponse = nil
+				}
+			}
+
+			//merge，pkt合并之后被回收，其后只能使用pktWholeResponse
+			completed := isServerStatusCompleted(pkt.Status) || reset
+			trailer := pkt.Meta
 			if pktWholeResponse == nil {
 				pktWholeResponse = pkt
+			} else if exceedsBuffered(len(pktWholeResponse.Data), len(pkt.Data)) {
+				pktWholeResponse.Release()
+				pkt.Release()
+				m.close(ErrResponseTooLarge, true)
+				return
 			} else {
 				pktWholeResponse.Data = append(pktWholeResponse.Data, pkt.Data...)
 				pktWholeResponse.Status = pkt.Status
+				pkt.Release()
 			}
 
 			//handle
-			_, err := handler.Handle(m, pktWholeResponse, isServerStatusCompleted(pkt.Status))
+			_, err := handler.Handle(m, pktWholeResponse, completed)
 			if err != nil {
-				log.Errorf("handle pkt %s fail, %s", pkt.Path, err.Error())
+				log.Errorf("handle pkt %s fail, %s", pktWholeResponse.Path, err.Error())
 			}
 
-			if isServerStatusCompleted(pkt.Status) {
-				if c := m.GetCtxData(CtxResponseChan); c != nil {
-					cc := c.(chan *Packet)
-					cc <- pktWholeResponse
+			if completed {
+				if m.conn.HasFeature(FeatureTrailer) {
+					pktWholeResponse.Trailer = trailer
 				}
+				m.deliverResponse(pktWholeResponse)
 				pktWholeResponse = nil
 			}
+			if reset {
+				m.close(resetErr, false)
+				return
+			}
 		}
 	}
 }
 
+//关闭channel，并在该channel上发送PathDeleteChannel帧通知对端关闭
 func (m *Channel) Close(err error) {
-	if !atomic.CompareAndSwapUint32(&m.closeLock, 0, 1) {
+	m.close(err, true)
+}
+
+//notify为false时不通知对端：由对端发起的关闭，或者连接已经关闭
+func (m *Channel) close(err error, notify bool) {
+	if !atomic.CompareAndSwapUint32(&m.closeStarted, 0, 1) {
 		return
 	}
-	defer atomic.StoreUint32(&m.closeLock, 0)
-	m.SendPacket(&Packet{Type: 8, ChannelId: m.Id, channel: m})
+	if notify && m.Id != 0 {
+		m.sendCloseNotice()
+	}
+	m.stopDeadline()
+	m.releaseRead()
 	m.conn.removeChannel(m)
-	if err != nil {
-		m.err = err
-	} else {
-		m.err = fmt.Errorf("unknown")
+	m.conn.closeIfDrained()
+	if err == nil {
+		err = fmt.Errorf("unknown")
 	}
+	m.err = err
+	atomic.StoreUint32(&m.closed, 1)
 	log.Errorf("channel closed: %s", err.Error())
-	if m.closeNotify != nil {
-		close(m.closeNotify)
-		m.closeNotify = nil
-	}
+	m.notifyClosed()
+	m.failPending(closedError("channel", err))
 }
 
 type Connection struct {
+	//以原子操作访问的64位字段放在最前，保证在32位平台上按8字节对齐，见sizes.go
+	stats        connStats
+	pendingWrite int64 //写队列中待写出的数据字节数
+	unwritten    int64 //已入队、尚未写出的帧数，见CloseGraceful
+	pendingRead  int64 //server端已读入、尚未处理完成的请求数据字节数，见membudget.go
+	lastActive   int64 //最近一次收发帧的时间(UnixNano)
+
 	DefaultErrorHolder
 	DefaultContext
-	Role          byte //0 client, 4 server
-	Channels      map[uint32]*Channel
-	MaxChannelId  uint32
-	FreeChannleId map[uint32]struct{}
-	ChannelsLock  sync.RWMutex
-	tcpConn       *net.TCPConn
-	tcpWriteQueue chan *Packet
-	closeNotify   chan int
-	closeLock     uint32
+	Role           byte //0 client, 4 server
+	Channels       map[uint32]*Channel
+	ChannelsLock   sync.RWMutex
+	channelIds     channelIdSpace         //本端命名空间中channel id的分配，见channelid.go
+	legacyId       uint32                 //为未携带channel_id的旧版client按顺序分配的最近一个id，由ChannelsLock保护，见channelid.go
+	closeLinger    time.Duration          //channel关闭的逗留期，见closeack.go
+	closedChannels map[uint32]int64       //逗留期内关闭的channel及其关闭时间(UnixNano)
+	closedCount    int                    //记录过的关闭的channel数，用于定期清理closedChannels
+	cancelled      map[uint32]int64       //对端在本端创建之前就已删除的channel及其删除时间(UnixNano)，见closeack.go
+	closing        map[uint32]*time.Timer //本端发起关闭、等待对端确认的id
+	tcpConn        net.Conn
+	key            string //连接在server中的key，tcp连接为对端地址
+	endpoint       string //client端连接对应的服务端地址(可能带有scheme，见transport.go)，内存连接为空
+	writeSched     *writeScheduler
+	writeLock      sync.Mutex      //写循环写出一帧与关闭时写出关闭连接的帧互斥，见closereason.go
+	writeBroken    bool            //写出失败(之后的字节不再构成完整的帧)或已写出关闭连接的帧，由writeLock保护
+	dispatcher     *readDispatcher //公平分派，nil表示不开启，见readsched.go
+	runChannel     uint32          //读循环最近一帧的channel id及连续收到该channel的帧数
+	runLen         int
+	graceful       uint32 //CloseGraceful已开始，不再接受新的帧
+	closeNotify    chan int
+	closeStarted   uint32            //Close已开始，不再复位，见lifecycle.go
+	closed         uint32            //已关闭，err已确定
+	notifyOnce     sync.Once         //关闭closeNotify
+	loops          sync.WaitGroup    //连接启动的goroutine，见Connection.Wait
+	stopped        bool              //连接已关闭，不再启动goroutine、不再加入channel，由ChannelsLock保护
+	maxPacketSize  uint32            //生效的packet最大字节数，握手后为双方配置的较小值
+	maxPathLen     uint32            //生效的path最大字节数，握手后为双方配置的较小值
+	frameSize      uint32            //发送时每帧数据的最大字节数，握手后为双方配置的较小值，0表示与maxPacketSize相同
+	readFormat     uint32            //读入帧的格式(frameFormat)，握手后生效
+	writeFormat    uint32            //写出帧的格式(frameFormat)，握手后生效
+	sealer         *frameCipher      //以PSK加密时写出帧的加密状态，握手后生效，见psk.go
+	opener         *frameCipher      //以PSK加密时读入帧的解密状态
+	writeSeq       map[uint32]uint32 //按channel id的下一个写出帧序号，只在写循环中使用，见sequence.go
+	readSeq        map[uint32]uint32 //按channel id的下一个读入帧序号，只在读循环中使用
+	taps           tapList           //连接上注册的tap，见tap.go
+	ownerTaps      *tapList          //所属server或client上注册的tap
+	session        *Session          //应用保存的按连接的状态，见session.go
+	ipSlot         string            //server端连接占用的按ip连接数配额，见ipcap.go
+
+	channelIdleTimeout time.Duration //channel空闲超时，0表示不检查
+	frameReadTimeout   time.Duration //读取一帧的时限，0表示不限制，见readtimeout.go
+	firstFrameTimeout  time.Duration //建立连接后读完首帧的时限，0表示不限制
+	minReadBytes       int           //读取帧的过程中每minReadInterval至少读入的字节数，0表示不检查
+	minReadInterval    time.Duration
+	createTime         time.Time
+	idleTimeout        time.Duration //server端连接的空闲超时
+	maxAge             time.Duration //server端连接的最大存活时间
+	maxAgeGrace        time.Duration //超过最大存活时间后的排空宽限期
+	draining           int32
+	features           uint32       //握手协商生效的特性
+	authenticated      int32        //server端连接已在握手中通过认证
+	handshaken         int32        //server端连接已处理过握手请求，之后的握手请求被拒绝，见handshake.go
+	requestLimiter     *tokenBucket //server端连接的请求速率限制
+	byteLimiter        *tokenBucket //server端连接的读入字节速率限制
+	health             connHealth
+	sysLock            sync.Mutex      //client端0号channel上的请求串行进行，见Client.sysRequest
+	server             *Server         //server端连接所属的server，启动之前设置，见owner.go
+	client             *Client         //client端连接所属的client
+	ctx                context.Context //连接的context，关闭时被取消，见context.go
+	ctxCancel          context.CancelFunc
 }
 
-func NewConnection(netConn *net.TCPConn, role byte, writeQueueLen int) (*Connection, error) {
+func NewConnection(netConn net.Conn, role byte, writeQueueLen int) (*Connection, error) {
+	ret, err := createConnection(netConn, role, writeQueueLen)
+	if err != nil {
+		return nil, err
+	}
+	ret.start()
+	return ret, nil
+}
+
+//创建connection但不启动读写循环，调用者可以在start之前完成context及限制的设置
+func createConnection(netConn net.Conn, role byte, writeQueueLen int) (*Connection, error) {
 	if role != RoleClient && role != RoleServer {
 		return nil, fmt.Errorf("invalid role value")
 	}
 	ret := &Connection{
 		Role:          role,
 		Channels:      make(map[uint32]*Channel),
-		FreeChannleId: make(map[uint32]struct{}),
 		tcpConn:       netConn,
-		tcpWriteQueue: make(chan *Packet, writeQueueLen),
+		key:           netConn.RemoteAddr().String(),
+		writeSched:    newWriteScheduler(writeQueueLen),
 		closeNotify:   make(chan int, 1),
+		maxPacketSize: MaxPacketSize,
+		maxPathLen:    MaxPathLen,
+		closeLinger:   DefaultChannelCloseLinger,
+		createTime:    time.Now(),
 	}
-	ret.newChannel(true, 100)
-	if role == RoleClient {
-		go ret.clientReadLoop()
-	} else {
-		go ret.serverReadLoop()
+	ret.lastActive = ret.createTime.UnixNano()
+	ret.ctx, ret.ctxCancel = context.WithCancel(context.Background())
+	ret.session = newSession(ret)
+	return ret, nil
+}
+
+//创建0号系统channel并启动读写循环
+func (m *Connection) start() {
+	m.newChannelWithId(0, 100, false, nil)
+	m.goLoop(m.readLoop)
+	m.goLoop(m.writeLoop)
+	if m.dispatcher != nil {
+		m.goLoop(func() { m.dispatcher.run(m.closeNotify) })
+	}
+	if m.channelIdleTimeout > 0 {
+		m.goLoop(func() { m.channelIdleLoop(m.closeNotify) })
 	}
-	go ret.writeLoop()
+	if m.idleTimeout > 0 || m.maxAge > 0 {
+		m.goLoop(func() { m.lifetimeLoop(m.closeNotify) })
+	}
+}
 
-	return ret, nil
+//将packet放入写队列。timeout<0时一直等待；timeout为0时队列满立即返回ErrWriteQueueFull；否则等待至expired
+func (m *Connection) enqueuePacket(pkt *Packet, timeout time.Duration, expired <-chan time.Time) error {
+	//先计数再检查状态，CloseGraceful或者看到这一帧，或者这里看到graceful而拒绝它
+	atomic.AddInt64(&m.unwritten, 1)
+	//写循环在连接关闭后退出，之后入队的帧不会再写出
+	if m.closeInitiated() || atomic.LoadUint32(&m.graceful) == 1 {
+		atomic.AddInt64(&m.unwritten, -1)
+		return closedError("connection", fmt.Errorf("closing"))
+	}
+	n := int64(len(pkt.Data))
+	atomic.AddInt64(&m.pendingWrite, n)
+	if err := m.acquireWriteSlot(timeout, expired); err != nil {
+		atomic.AddInt64(&m.pendingWrite, -n)
+		atomic.AddInt64(&m.unwritten, -1)
+		return err
+	}
+	raiseHighWater(&m.stats.writeQueueHigh, int64(len(m.writeSched.slots)))
+	m.writeSched.push(pkt)
+	return nil
+}
+
+func (m *Connection) acquireWriteSlot(timeout time.Duration, expired <-chan time.Time) error {
+	slots := m.writeSched.slots
+	if timeout < 0 {
+		//写循环在连接关闭后退出，不再释放写队列的位置
+		select {
+		case slots <- struct{}{}:
+			return nil
+		case <-m.closeNotify:
+			return m.errClosed()
+		}
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if timeout > 0 {
+		select {
+		case slots <- struct{}{}:
+			return nil
+		case <-expired:
+		case <-m.closeNotify:
+			return m.errClosed()
+		}
+	}
+	return ErrWriteQueueFull
+}
+
+//写队列中待写出的数据字节数，持续增长说明对端读取缓慢
+func (m *Connection) PendingWriteBytes() int64 {
+	return atomic.LoadInt64(&m.pendingWrite)
+}
+
+//channel所在连接的写队列中待写出的数据字节数
+func (m *Channel) PendingWriteBytes() int64 {
+	return m.conn.PendingWriteBytes()
 }
 
 func (m *Connection) writeLoop() {
 	for {
-		select {
-		case pkt := <-m.tcpWriteQueue:
-			if _, err := WritePacket(pkt, m.tcpConn); err != nil {
-				m.Close(err)
+		pkt := m.writeSched.pop()
+		if pkt == nil {
+			select {
+			case <-m.writeSched.notify:
+				continue
+			case <-m.closeNotify:
 				return
 			}
-		case <-m.closeNotify:
+		}
+		<-m.writeSched.slots
+		format := m.writeFrameFormat()
+		if format.sequence() {
+			m.nextSequence(pkt)
+		}
+		m.writeLock.Lock()
+		n, err := writePacket(pkt, m.tcpConn, format, m.sealer)
+		if err != nil {
+			m.writeBroken = true
+		}
+		m.writeLock.Unlock()
+		atomic.AddInt64(&m.pendingWrite, -int64(len(pkt.Data)))
+		atomic.AddInt64(&m.unwritten, -1)
+		if err == nil {
+			m.stats.addWrite(n)
+			m.tap(TapOutbound, pkt, n)
+		}
+		m.touch()
+		if err == nil && pkt.written != nil {
+			pkt.written()
+		}
+		pkt.Release()
+		if err != nil {
+			m.Close(err)
 			return
 		}
 	}
 }
 
 func (m *Connection) Close(err error) {
-	if !atomic.CompareAndSwapUint32(&m.closeLock, 0, 1) {
+	//只关闭一次；关闭过程中(如session的关闭回调)再次调用直接返回
+	if !atomic.CompareAndSwapUint32(&m.closeStarted, 0, 1) {
 		return
 	}
-	defer atomic.StoreUint32(&m.closeLock, 0)
 	if err != nil {
 		m.err = err
 	} else {
 		m.err = fmt.Errorf("unknown")
 	}
+	atomic.StoreUint32(&m.closed, 1)
 	log.Errorf("connection closed, role %d, remote addr: %s, error: %s", m.Role, m.tcpConn.RemoteAddr().String(), m.err.Error())
 
-	svr := m.GetCtxData(CtxServer)
-	if svr != nil {
-		svr.(*Server).removeConn(m.tcpConn.RemoteAddr().String())
-	} else {
-		client := m.GetCtxData(CtxClient)
-		if client != nil {
-			client.(*Client).removeConnection(m)
-		}
+	if m.server != nil {
+		m.server.removeConn(m.key)
+	} else if m.client != nil {
+		m.client.removeConnection(m)
+	}
+
+	m.sendCloseFrame(m.err)
+	closeNetConn(m.tcpConn)
+	for _, v := range m.stopLoops() {
+		v.close(closedError("connection", m.err), false)
 	}
+	m.session.close()
+	m.notifyClosed()
+}
 
-	m.tcpConn.CloseWrite()
-	m.tcpConn.CloseRead()
-	m.tcpConn.Close()
-	for _, v := range m.Channels {
-		v.Close(fmt.Errorf("connection is closed"))
+//channel id的命名空间：0为系统channel，client发起的channel为奇数，server发起的推送channel为偶数。
+//本端只分配、回收属于自己命名空间的id
+func (m *Connection) ownsChannelId(id uint32) bool {
+	if id == 0 {
+		return false
 	}
-	if m.closeNotify != nil {
-		close(m.closeNotify)
-		m.closeNotify = nil
+	if m.Role == RoleClient {
+		return id%2 == 1
 	}
+	return id%2 == 0
 }
 
-func (m *Connection) makeNewChannelId() uint32 {
+//以指定的id创建channel，id已被占用时返回错误。tenant为channel计入的租户，channel移出连接时释放，见removeChannel
+func (m *Connection) newChannelWithId(id uint32, queueLen uint32, push bool, tenant *Tenant) (*Channel, error) {
+	ret := m.makeChannel(id, queueLen, push)
+	ret.tenant = tenant
 	m.ChannelsLock.Lock()
 	defer m.ChannelsLock.Unlock()
-	var ret uint32 = 0
-	if len(m.FreeChannleId) > 0 {
-		for k := range m.FreeChannleId {
-			ret = k
-			delete(m.FreeChannleId, k)
-			return ret
-		}
-		return ret
+	if m.stopped {
+		return nil, m.errClosed()
 	}
-	if m.MaxChannelId < math.MaxUint32 {
-		ret = m.MaxChannelId + 1
-		m.MaxChannelId++
-		return ret
+	if _, ok := m.Channels[id]; ok {
+		return nil, fmt.Errorf("channel id %d already in use", id)
 	}
-	return 0
+	if m.cancelledBeforeCreated(id) {
+		return nil, fmt.Errorf("channel id %d was deleted by peer before created", id)
+	}
+	m.addChannel(ret)
+	return ret, nil
 }
 
-func (m *Connection) newChannel(sys bool, queueLen uint32) *Channel {
-	ret := &Channel{
-		Id:            0,
-		NewTime:       time.Now(),
+func (m *Connection) makeChannel(id uint32, queueLen uint32, push bool) *Channel {
+	now := time.Now()
+	return &Channel{
+		Id:            id,
+		push:          push,
+		NewTime:       now,
+		lastActive:    now.UnixNano(),
 		conn:          m,
 		receivedQueue: make(chan *Packet, queueLen),
-		packetStatus:  255,
+		peerState:     newStreamState(m.Role),
 		closeNotify:   make(chan int, 1),
 	}
-	if !sys {
-		ret.Id = m.makeNewChannelId()
-	}
+}
 
-	m.ChannelsLock.Lock()
-	defer m.ChannelsLock.Unlock()
-	m.Channels[ret.Id] = ret
+//加入channel并启动其处理goroutine，调用者持有ChannelsLock
+func (m *Connection) addChannel(c *Channel) {
+	m.Channels[c.Id] = c
+	delete(m.closedChannels, c.Id)
 	if m.Role == RoleServer {
-		ret.SetCtxData(CtxServer, m.GetCtxData(CtxServer))
-		go ret.handleServerLoop()
+		c.SetCtxData(CtxServer, m.server)
+		//事件循环模式下收到帧时才被调度，见eventloop.go
+		if m.server.eventLoop == nil {
+			m.goLoopLocked(c.handleServerLoop)
+		}
 	} else if m.Role == RoleClient {
-		ret.SetCtxData(CtxClient, m.GetCtxData(CtxClient))
-		go ret.handleClientLoop()
+		c.SetCtxData(CtxClient, m.client)
+		m.goLoopLocked(c.handleClientLoop)
 	}
+}
 
-	return ret
+//丢弃一个尚未被对端确认的channel，不向对端发送任何数据
+func (m *Connection) discardChannel(c *Channel) {
+	m.removeChannel(c)
+	//连接关闭时channel可能已被关闭
+	if atomic.CompareAndSwapUint32(&c.closeStarted, 0, 1) {
+		c.err = fmt.Errorf("channel discarded")
+		atomic.StoreUint32(&c.closed, 1)
+		c.notifyClosed()
+	}
 }
 
 func (m *Connection) getChannel(channelId uint32) *Channel {
@@ -506,155 +972,147 @@ func (m *Connection) removeChannel(c *Channel) {
 	if c != nil {
 		m.ChannelsLock.Lock()
 		defer m.ChannelsLock.Unlock()
-		delete(m.Channels, c.Id)
-		m.FreeChannleId[c.Id] = struct{}{}
-	}
-}
-
-func (m *Connection) clientReadLoop() {
-	//利用bufio，每次从内核多读一些数据上来处理，减少对内核内存的读次数
-	bufReader := bufio.NewReaderSize(m.tcpConn, int(PacketReadBufSize))
-	btsChannelId := make([]byte, 4)
-	btsDataLen := make([]byte, 4)
-	for {
-		if m.err != nil {
-			break
-		}
-		//read status
-		status, err := bufReader.ReadByte()
-		if err != nil {
-			m.Close(fmt.Errorf("read data fail, %s", err.Error()))
+		//id可能已被释放并复用于新的channel
+		if v, ok := m.Channels[c.Id]; !ok || v != c {
 			return
 		}
-		if status == Status8 {
-			m.Close(fmt.Errorf("connection closed by peer command"))
-			return
+		//释放channel创建时计入的租户，连接关闭时租户已先于channel解除绑定
+		if c.tenant != nil {
+			c.tenant.releaseChannel()
+			c.tenant = nil
 		}
-
-		//read path
-		path, err := bufReader.ReadSlice(0)
-		if err != nil {
-			m.Close(fmt.Errorf("read data fail, %s", err.Error()))
-			return
-		}
-		pathStr := string(path[:len(path)-1])
-
-		//read channelID
-		if _, err = io.ReadFull(bufReader, btsChannelId); err != nil {
-			m.Close(fmt.Errorf("read data fail, %s", err.Error()))
-			return
-		}
-		channelId := binary.BigEndian.Uint32(btsChannelId)
-		channel := m.getChannel(channelId)
-		if channel == nil {
-			m.Close(fmt.Errorf("invalid channel id: %d", channelId))
-			return
-		}
-		if err := CheckServerPacketStatus(channel.packetStatus, status); err != nil {
-			log.Errorf(err.Error())
-			m.Close(err)
-			return
+		delete(m.Channels, c.Id)
+		m.lingerClosed(c.Id)
+		if m.ownsChannelId(c.Id) && !c.legacyId {
+			m.releaseChannelId(c.Id, c.closeAck)
 		}
+	}
+}
 
-		//read datalen
-		if _, err = io.ReadFull(bufReader, btsDataLen); err != nil {
-			m.Close(fmt.Errorf("read data fail, %s", err.Error()))
-			return
-		}
-		dataLen := binary.BigEndian.Uint32(btsDataLen)
-		if dataLen > MaxPacketSize {
-			m.Close(fmt.Errorf("read data len meta > max-packet-size"))
-			return
-		}
-		if dataLen == 0 {
-			m.Close(fmt.Errorf("invalid data len: %d", dataLen))
-			return
-		}
+//关闭网络连接，tcp连接先关闭读写两个方向
+func closeNetConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+		tcpConn.CloseRead()
+	}
+	conn.Close()
+}
 
-		//read data
-		pkt := &Packet{Type: PacketTypeResponse, Status: status, Path: pathStr, ChannelId: channelId, Data: make([]byte, dataLen), channel: channel}
-		if _, err = io.ReadFull(bufReader, pkt.Data); err != nil {
-			log.Errorf("read data fail, %s", err.Error())
-			m.Close(err)
-			return
-		}
-		channel.packetStatus = status
-		channel.ReadPacketCount++
-		channel.ReadBytes += int64(len(pkt.Data) + 1 + len(pkt.Path) + 1 + 4 + 4)
-		channel.receivedQueue <- pkt
+//读循环中收到的帧的类型，对端帧的状态校验见Channel.peerState
+func (m *Connection) readPacketType() byte {
+	if m.Role == RoleServer {
+		return PacketTypeRequest
 	}
+	return PacketTypeResponse
 }
 
-func (m *Connection) serverReadLoop() {
-	//利用bufio，每次从内核多读一些数据上来处理，减少对内核内存的读次数
-	bufReader := bufio.NewReaderSize(m.tcpConn, int(PacketReadBufSize))
-	btsChannelId := make([]byte, 4)
-	btsDataLen := make([]byte, 4)
+func (m *Connection) readLoop() {
+	frameReader := newConnFrameReader(m)
+	packetType := m.readPacketType()
+	//配置了Authenticator或CertAuthorizer时，认证通过之前只接受握手
+	svr := m.server
+	authRequired := m.Role == RoleServer && svr != nil && svr.getConfig().authRequired()
 	for {
-		if m.err != nil {
+		if m.isClosed() {
 			break
 		}
-		//read status
-		status, err := bufReader.ReadByte()
+		pkt, err := frameReader.ReadFrame()
 		if err != nil {
-			m.Close(fmt.Errorf("read data fail, %s", err.Error()))
-			return
-		}
-		if status == Status8 {
-			m.Close(fmt.Errorf("connection closed by peer command"))
+			m.Close(err)
 			return
 		}
-
-		//read path
-		path, err := bufReader.ReadSlice(0)
-		if err != nil {
-			m.Close(fmt.Errorf("read data fail, %s", err.Error()))
+		m.tap(TapInbound, pkt, frameReader.FrameLen())
+		if pkt.Status == Status8 {
+			err := peerCloseError(pkt.Data)
+			pkt.Release()
+			m.Close(err)
 			return
 		}
-		pathStr := string(path[:len(path)-1])
-
-		//read channelID
-		if _, err = io.ReadFull(bufReader, btsChannelId); err != nil {
-			m.Close(fmt.Errorf("read data fail, %s", err.Error()))
-			return
+		status, pathStr, channelId, frameLen := pkt.Status, pkt.Path, pkt.ChannelId, frameReader.FrameLen()
+		m.stats.addRead(frameLen)
+		if m.readFrameFormat().sequence() {
+			if err := m.checkSequence(pkt); err != nil {
+				pkt.Release()
+				m.Close(err)
+				return
+			}
 		}
-		channelId := binary.BigEndian.Uint32(btsChannelId)
+		//channel已在本端关闭时，对端在收到关闭通知之前发出的帧被丢弃
 		channel := m.getChannel(channelId)
+		isDelete := channelId != 0 && pathStr == PathDeleteChannel
+		isReset := channelId != 0 && status == StatusR12
+		//关闭确认不属于任何channel，同id的新channel可能已经建立
+		if channelId != 0 && pathStr == PathDeleteChannelAck && m.HasFeature(FeatureCloseAck) {
+			pkt.Release()
+			m.closeAcked(channelId, nil)
+			continue
+		}
+		isOneWay := m.Role == RoleServer && channelId != 0 && status == StatusO13
+		if channel != nil && !isDelete && !isReset && !isOneWay {
+			if err := channel.peerState.advance(status); err != nil {
+				pkt.Release()
+				log.Errorf(err.Error())
+				m.Close(err)
+				return
+			}
+		}
+		pkt.Type, pkt.channel = packetType, channel
 		if channel == nil {
-			m.Close(fmt.Errorf("invalid channel id: %d", channelId))
-			return
+			m.discardFrame(pkt)
+			continue
 		}
-		if err := CheckClientPacketStatus(channel.packetStatus, status); err != nil {
-			log.Errorf(err.Error())
-			m.Close(err)
-			return
+		//关闭通知在读循环中同步处理，保证其后到达的同id的帧属于新的channel
+		//确认先于id的释放入队，见Connection.releaseChannelId
+		if isDelete {
+			pkt.Release()
+			m.sendCloseAck(channelId)
+			channel.close(fmt.Errorf("closed by peer"), false)
+			continue
 		}
-
-		//read datalen
-		if _, err = io.ReadFull(bufReader, btsDataLen); err != nil {
-			m.Close(fmt.Errorf("read data fail, %s", err.Error()))
-			return
+		//重置在任何状态下都有效，同样在读循环中同步移除channel
+		if isReset {
+			m.sendCloseAck(channelId)
+			channel.peerReset(pkt)
+			continue
 		}
-		dataLen := binary.BigEndian.Uint32(btsDataLen)
-		if dataLen > MaxPacketSize {
-			m.Close(fmt.Errorf("read data len meta > max-packet-size"))
-			return
+		//半关闭在读循环中同步处理，理由同上；半关闭帧随后交给handle循环，标志此前的数据已全部交付
+		if isHalfCloseStatus(status) {
+			channel.peerCloseSend()
+			m.enqueue(channel, pkt)
+			continue
 		}
-		if dataLen == 0 {
-			m.Close(fmt.Errorf("invalid data len: %d", dataLen))
-			return
+		m.touch()
+		//单向消息不改变channel的状态，未认证的连接没有0号以外的channel
+		if isOneWay {
+			channel.addRead(frameLen)
+			m.throttleRead(channelId, status, frameLen)
+			m.deliverOneWay(channel, pkt, svr)
+			continue
 		}
-
-		//read data
-		pkt := &Packet{Type: PacketTypeResponse, Status: status, Path: pathStr, ChannelId: channelId, Data: make([]byte, dataLen), channel: channel}
-		if _, err = io.ReadFull(bufReader, pkt.Data); err != nil {
-			log.Errorf("read data fail, %s", err.Error())
-			m.Close(err)
+		atomic.StoreInt64(&channel.lastActive, atomic.LoadInt64(&m.lastActive))
+		channel.addRead(frameLen)
+		m.throttleRead(channelId, status, frameLen)
+		if authRequired && atomic.LoadInt32(&m.authenticated) == 0 && !(channelId == 0 && pathStr == PathHandshake) {
+			pkt.Release()
+			m.Close(kindError(ErrAuthFailed, nil, "unauthenticated"))
 			return
 		}
-		channel.packetStatus = status
-		channel.ReadPacketCount++
-		channel.ReadBytes += int64(len(pkt.Data) + 1 + len(pkt.Path) + 1 + 4 + 4)
-		channel.receivedQueue <- pkt
+		if channelId == 0 {
+			//握手在读循环中同步处理，保证其后的帧按协商的结果解析
+			if m.Role == RoleServer && pathStr == PathHandshake {
+				m.handleHandshake(pkt)
+				continue
+			}
+			//推送channel的通告在读循环中同步处理，保证随后到达的推送帧能找到对应的channel
+			if m.Role == RoleClient && pathStr == PathPushChannel {
+				m.handlePushChannelAnnounce(pkt)
+				continue
+			}
+			if m.Role == RoleClient && pathStr == PathGoAway {
+				m.handleGoAway(pkt)
+				continue
+			}
+		}
+		m.deliver(channel, pkt, svr)
 	}
 }
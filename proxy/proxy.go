@@ -0,0 +1,223 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//iip反向代理：作为server的中间件，按path前缀将请求转发给一组上游iip server之一，
+//对上游维护连接及channel池、定期健康检查，上游不可用时切换到下一个上游重试。是构建iip api网关的基础
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+var (
+	ErrNoUpstream          error = &iip.Error{Code: 301, Message: "no upstream"}
+	ErrUpstreamUnavailable error = &iip.Error{Code: 302, Message: "upstream unavailable"}
+	ErrUpstreamTimeout     error = &iip.Error{Code: 303, Message: "upstream timeout"}
+)
+
+//分片到达的请求在channel上下文中累积，直至数据完整后再转发
+const ctxProxyRequest = "/ctx/proxy/request"
+
+//路由：path以Prefix开头的请求转发给Upstreams之一(ip:port)，Prefix最长者优先
+type Route struct {
+	Prefix    string
+	Upstreams []string
+}
+
+type Config struct {
+	Routes              []Route
+	Client              iip.ClientConfig //连接上游使用的client配置
+	Timeout             time.Duration    //单次转发的超时，默认10秒
+	Retries             int              //上游不可用时切换上游重试的次数，默认为路由的上游数量-1
+	HealthCheckInterval time.Duration    //健康检查(/sys/probe)的间隔，默认5秒
+	MaxIdleChannel      int              //每个上游的空闲channel池大小，默认64
+}
+
+type upstream struct {
+	addr     string
+	client   *iip.Client
+	channels *iip.ChannelPool
+	healthy  int32
+}
+
+type route struct {
+	prefix    string
+	upstreams []*upstream
+	next      uint32
+}
+
+type Proxy struct {
+	config    Config
+	routes    []*route
+	upstreams map[string]*upstream
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func NewProxy(config Config) (*Proxy, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second * 10
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = time.Second * 5
+	}
+	ret := &Proxy{
+		config:    config,
+		upstreams: make(map[string]*upstream),
+		done:      make(chan struct{}),
+	}
+	for _, v := range config.Routes {
+		if !strings.HasPrefix(v.Prefix, "/") {
+			return nil, fmt.Errorf("invalid route prefix: %s", v.Prefix)
+		}
+		if len(v.Upstreams) == 0 {
+			return nil, fmt.Errorf("route %s has no upstream", v.Prefix)
+		}
+		r := &route{prefix: v.Prefix}
+		for _, addr := range v.Upstreams {
+			u, ok := ret.upstreams[addr]
+			if !ok {
+				client, err := iip.NewClient(config.Client, addr)
+				if err != nil {
+					return nil, err
+				}
+				u = &upstream{addr: addr, client: client, channels: iip.NewChannelPool(client, config.MaxIdleChannel), healthy: 1}
+				ret.upstreams[addr] = u
+			}
+			r.upstreams = append(r.upstreams, u)
+		}
+		ret.routes = append(ret.routes, r)
+	}
+	go ret.healthCheckLoop()
+	return ret, nil
+}
+
+//转发中间件，通过iip.Server.Use添加。未匹配任何路由的请求及0号系统channel上的请求交给next处理
+func (m *Proxy) Middleware() iip.Middleware {
+	return func(next iip.Handler) iip.Handler {
+		return iip.HandlerFunc(func(c *iip.Channel, request *iip.Packet, dataCompleted bool) ([]byte, error) {
+			if c.Id == 0 {
+				return next.Handle(c, request, dataCompleted)
+			}
+			r := m.match(request.Path)
+			if r == nil {
+				return next.Handle(c, request, dataCompleted)
+			}
+			data := request.Data
+			if buf, ok := c.GetCtxData(ctxProxyRequest).([]byte); ok || !dataCompleted {
+				//request的缓冲区在handler返回后被回收，须拷贝
+				buf = append(buf, data...)
+				if !dataCompleted {
+					c.SetCtxData(ctxProxyRequest, buf)
+					return nil, iip.ErrPacketContinue
+				}
+				c.RemoveCtxData(ctxProxyRequest)
+				data = buf
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), m.config.Timeout)
+			defer cancel()
+			for k, v := range request.Meta {
+				ctx = iip.WithRequestMeta(ctx, k, v)
+			}
+			return m.forward(ctx, r, request.Path, data)
+		})
+	}
+}
+
+func (m *Proxy) match(path string) *route {
+	var ret *route
+	for _, v := range m.routes {
+		if strings.HasPrefix(path, v.prefix) && (ret == nil || len(v.prefix) > len(ret.prefix)) {
+			ret = v
+		}
+	}
+	return ret
+}
+
+//按轮询顺序选择上游，优先健康的上游；上游不可用时切换到下一个，超时不重试(请求可能已被执行)
+func (m *Proxy) forward(ctx context.Context, r *route, path string, data []byte) ([]byte, error) {
+	retries := m.config.Retries
+	if retries <= 0 {
+		retries = len(r.upstreams) - 1
+	}
+	//先取模再转换为int，32位平台上计数超过2^31时int为负
+	start := int(atomic.AddUint32(&r.next, 1) % uint32(len(r.upstreams)))
+	candidates := make([]*upstream, 0, len(r.upstreams))
+	for i := range r.upstreams {
+		if u := r.upstreams[(start+i)%len(r.upstreams)]; atomic.LoadInt32(&u.healthy) == 1 {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		//全部上游都被判定为不健康时仍然尝试，健康检查可能滞后
+		for i := range r.upstreams {
+			candidates = append(candidates, r.upstreams[(start+i)%len(r.upstreams)])
+		}
+	}
+	var lastErr error = ErrNoUpstream
+	for i := 0; i < len(candidates) && i <= retries; i++ {
+		u := candidates[i]
+		ret, err := u.channels.DoRequestContext(ctx, path, data)
+		if err == nil {
+			return ret, nil
+		}
+		if errors.Is(err, iip.ErrTimeout) || ctx.Err() != nil {
+			return nil, ErrUpstreamTimeout
+		}
+		//上游handler返回的错误原样返回给client
+		if e, ok := err.(*iip.Error); ok && e.Remote() {
+			return nil, err
+		}
+		iip.GetLogger().Errorf("proxy forward %s to %s fail, %s", path, u.addr, err.Error())
+		atomic.StoreInt32(&u.healthy, 0)
+		lastErr = ErrUpstreamUnavailable
+	}
+	return nil, lastErr
+}
+
+func (m *Proxy) healthCheckLoop() {
+	ticker := time.NewTicker(m.config.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			for _, u := range m.upstreams {
+				ctx, cancel := context.WithTimeout(context.Background(), m.config.HealthCheckInterval)
+				_, err := u.client.Probe(ctx)
+				cancel()
+				if err != nil {
+					atomic.StoreInt32(&u.healthy, 0)
+				} else {
+					atomic.StoreInt32(&u.healthy, 1)
+				}
+			}
+		}
+	}
+}
+
+//上游当前是否健康
+func (m *Proxy) Healthy(addr string) bool {
+	u, ok := m.upstreams[addr]
+	return ok && atomic.LoadInt32(&u.healthy) == 1
+}
+
+//停止健康检查并关闭上游的空闲channel
+func (m *Proxy) Close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, u := range m.upstreams {
+			u.channels.Close()
+		}
+	})
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//预共享密钥(PSK)加密：不便于管理证书的嵌入式部署中，client与server配置相同的PSK后，连接在握手之后以AEAD算法加密每一帧的数据，
+//默认为标准库的AES-256-GCM，ChaCha20-Poly1305(没有AES硬件加速的设备)见iipchacha模块，算法由PSKCipher配置，双方须相同，握手时核对。
+//握手时双方各自生成随机数，以HMAC-SHA256(PSK)证明持有PSK，再由PSK及双方的随机数经HKDF-SHA256导出两个方向各自的密钥；
+//每帧以该方向的帧序号作为nonce，帧头(status、path、元数据、channel id、数据长度)作为附加数据一并认证，帧的数据长度包含16字节的认证标签。
+//加密之后不再使用帧校验。握手本身(包括Credentials)是明文的，server配置了PSK时，没有通过PSK验证的连接在握手时被拒绝
+package iip
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	pskNonceSize = 32
+	pskKeySize   = 32 //AEAD的密钥长度
+	pskAEADNonce = 12 //AEAD的nonce长度
+	pskOverhead  = 16 //AEAD的认证标签长度，加密帧的数据长度包含该标签
+)
+
+//PSK加密的AEAD算法，New以32字节的密钥创建AEAD，其nonce须为12字节、认证标签须为16字节
+type PSKCipher interface {
+	Name() string //算法名称，握手时核对双方的算法
+	New(key []byte) (cipher.AEAD, error)
+}
+
+//AES-256-GCM，PSKCipher为nil时的默认算法
+var AESGCM PSKCipher = aesGCM{}
+
+type aesGCM struct{}
+
+func (aesGCM) Name() string {
+	return "aes-256-gcm"
+}
+
+func (aesGCM) New(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//配置的算法，nil时为AESGCM
+func pskCipherOf(c PSKCipher) PSKCipher {
+	if c == nil {
+		return AESGCM
+	}
+	return c
+}
+
+//握手中的算法名称，默认算法为空
+func pskCipherName(c PSKCipher) string {
+	if c == nil || c.Name() == AESGCM.Name() {
+		return ""
+	}
+	return c.Name()
+}
+
+//连接一个方向的帧加密状态，只在读循环或者写循环中使用
+type frameCipher struct {
+	aead  cipher.AEAD
+	seq   uint64
+	nonce [pskAEADNonce]byte
+}
+
+func (m *frameCipher) nextNonce() []byte {
+	binary.BigEndian.PutUint64(m.nonce[4:], m.seq)
+	m.seq++
+	return m.nonce[:]
+}
+
+//加密plain并追加到dst，header为附加数据
+func (m *frameCipher) seal(dst, plain, header []byte) []byte {
+	return m.aead.Seal(dst, m.nextNonce(), plain, header)
+}
+
+//原地解密data，返回明文
+func (m *frameCipher) open(data, header []byte) ([]byte, error) {
+	return m.aead.Open(data[:0], m.nextNonce(), data, header)
+}
+
+func newPSKNonce() ([]byte, error) {
+	ret := make([]byte, pskNonceSize)
+	if _, err := io.ReadFull(rand.Reader, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+//持有PSK的证明
+func pskProof(psk []byte, label string, nonces ...[]byte) []byte {
+	h := hmac.New(sha256.New, psk)
+	h.Write([]byte(label))
+	for _, v := range nonces {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+//HKDF-SHA256(RFC 5869)导出n字节的密钥，n不超过32
+func hkdfSHA256(secret, salt []byte, info string, n int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:n]
+}
+
+func newFrameCipher(c PSKCipher, psk, salt []byte, info string) (*frameCipher, error) {
+	aead, err := pskCipherOf(c).New(hkdfSHA256(psk, salt, info, pskKeySize))
+	if err != nil {
+		return nil, err
+	}
+	if aead.NonceSize() != pskAEADNonce || aead.Overhead() != pskOverhead {
+		return nil, fmt.Errorf("unsupported psk cipher %s, nonce size: %d, overhead: %d", pskCipherOf(c).Name(), aead.NonceSize(), aead.Overhead())
+	}
+	return &frameCipher{aead: aead}, nil
+}
+
+//由PSK及双方的随机数导出连接的加密状态，须在帧格式切换为加密之前调用
+func (m *Connection) setPSK(c PSKCipher, psk, clientNonce, serverNonce []byte) error {
+	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+	c2s, err := newFrameCipher(c, psk, salt, "iip client to server")
+	if err != nil {
+		return err
+	}
+	s2c, err := newFrameCipher(c, psk, salt, "iip server to client")
+	if err != nil {
+		return err
+	}
+	if m.Role == RoleClient {
+		m.sealer, m.opener = c2s, s2c
+	} else {
+		m.sealer, m.opener = s2c, c2s
+	}
+	return nil
+}
+
+//连接是否以PSK加密
+func (m *Connection) Encrypted() bool {
+	return m.readFrameFormat().sealed()
+}
+
+//server端在握手中验证client持有PSK并生成响应中的随机数及证明
+func (m *Connection) acceptPSK(c PSKCipher, psk []byte, req *RequestHandshake, resp *ResponseHandshake) error {
+	if len(req.Nonce) != pskNonceSize || len(req.Proof) == 0 {
+		return fmt.Errorf("encryption required")
+	}
+	if req.Cipher != pskCipherName(c) {
+		return fmt.Errorf("psk cipher mismatch, server: %s", pskCipherOf(c).Name())
+	}
+	if !hmac.Equal(req.Proof, pskProof(psk, "iip client", req.Nonce)) {
+		return fmt.Errorf("invalid psk")
+	}
+	nonce, err := newPSKNonce()
+	if err != nil {
+		return err
+	}
+	if err := m.setPSK(c, psk, req.Nonce, nonce); err != nil {
+		return err
+	}
+	resp.Nonce, resp.Proof = nonce, pskProof(psk, "iip server", req.Nonce, nonce)
+	return nil
+}
+
+//client端验证server持有PSK
+func (m *Connection) verifyPSK(c PSKCipher, psk, nonce []byte, resp *ResponseHandshake) error {
+	if len(resp.Nonce) != pskNonceSize {
+		return fmt.Errorf("server does not support encryption")
+	}
+	if !hmac.Equal(resp.Proof, pskProof(psk, "iip server", nonce, resp.Nonce)) {
+		return fmt.Errorf("invalid psk")
+	}
+	return m.setPSK(c, psk, nonce, resp.Nonce)
+}
+
+//server端的PSK验证，未配置PSK时直接通过
+func (m *Server) acceptPSK(conn *Connection, req *RequestHandshake, resp *ResponseHandshake) error {
+	if m == nil {
+		return nil
+	}
+	if config := m.getConfig(); len(config.PSK) > 0 {
+		return conn.acceptPSK(config.PSKCipher, config.PSK, req, resp)
+	}
+	return nil
+}
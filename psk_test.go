@@ -0,0 +1,55 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"testing"
+	"time"
+)
+
+//名称不同的AES-256-GCM，模拟client与server的算法不一致
+type renamedCipher struct{}
+
+func (renamedCipher) Name() string {
+	return "renamed"
+}
+
+func (renamedCipher) New(key []byte) (cipher.AEAD, error) {
+	return AESGCM.New(key)
+}
+
+func TestPSKEncryption(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	for _, c := range []PSKCipher{nil, renamedCipher{}} {
+		_, addr := newTestServer(t, ServerConfig{PSK: psk, PSKCipher: c})
+		client := newTestClient(t, addr, ClientConfig{PSK: psk, PSKCipher: c})
+		ch, err := client.NewChannel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ch.internalChannel.conn.Encrypted() {
+			t.Fatalf("cipher %s, connection not encrypted", pskCipherOf(c).Name())
+		}
+		request := bytes.Repeat([]byte("psk"), 1000)
+		resp, err := ch.DoRequest(testEchoPath, request, time.Second*3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(resp, request) {
+			t.Fatalf("cipher %s, response mismatch", pskCipherOf(c).Name())
+		}
+	}
+}
+
+func TestPSKCipherMismatch(t *testing.T) {
+	psk := []byte("0123456789abcdef")
+	_, addr := newTestServer(t, ServerConfig{PSK: psk})
+	client := newTestClient(t, addr, ClientConfig{PSK: psk, PSKCipher: renamedCipher{}})
+	if _, err := client.NewChannel(); err == nil {
+		t.Fatal("connection with a different psk cipher accepted")
+	}
+}
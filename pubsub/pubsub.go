@@ -0,0 +1,317 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//基于iip channel的发布/订阅子系统：
+//client通过系统path订阅topic，server维护topic到订阅者的映射，并通过推送channel将消息发给订阅者；
+//对于消费慢的订阅者，可以选择丢弃最旧的消息(QoSDropOldest)或阻塞发布者(QoSBlock)
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//系统路径
+const (
+	PathSubscribe   = "/sys/pubsub/subscribe"
+	PathUnsubscribe = "/sys/pubsub/unsubscribe"
+	PathPublish     = "/sys/pubsub/publish"
+	PathMessage     = "/sys/pubsub/message"
+)
+
+//慢订阅者的处理策略
+const (
+	QoSDropOldest = "drop_oldest" //队列满时丢弃最旧的消息
+	QoSBlock      = "block"       //队列满时阻塞发布者，直至超时
+)
+
+type RequestSubscribe struct {
+	Topic string `json:"topic"`
+	QoS   string `json:"qos,omitempty"`
+}
+
+type RequestPublish struct {
+	Topic string `json:"topic"`
+	Data  []byte `json:"data"`
+}
+
+type Message struct {
+	Topic string `json:"topic"`
+	Data  []byte `json:"data"`
+}
+
+type Response struct {
+	Code      int    `json:"code"`
+	Message   string `json:"message,omitempty"`
+	Delivered int    `json:"delivered,omitempty"`
+}
+
+type BrokerConfig struct {
+	QueueLen     int           //每个订阅者的消息队列长度，默认1024
+	BlockTimeout time.Duration //QoSBlock模式下发布者最长阻塞时间，默认1秒
+}
+
+//server端的消息代理
+type Broker struct {
+	config      BrokerConfig
+	subscribers map[*iip.Channel]*subscriber //key: 发起订阅的channel
+	topics      map[string]map[*subscriber]struct{}
+	lock        sync.RWMutex
+}
+
+//订阅者，对应client上发起订阅的一个channel。该channel关闭或者退订了全部topic时订阅者被移除，其推送channel随之关闭
+type subscriber struct {
+	dropped   int64 //以原子操作访问，放在最前以保证在32位平台上按8字节对齐
+	broker    *Broker
+	channel   *iip.Channel
+	push      *iip.Channel
+	queue     chan *Message
+	qos       map[string]string //topic -> qos
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+//创建消息代理，并在server上注册订阅、退订、发布的处理器
+func NewBroker(server *iip.Server, config BrokerConfig) (*Broker, error) {
+	if config.QueueLen <= 0 {
+		config.QueueLen = 1024
+	}
+	if config.BlockTimeout <= 0 {
+		config.BlockTimeout = time.Second
+	}
+	ret := &Broker{
+		config:      config,
+		subscribers: make(map[*iip.Channel]*subscriber),
+		topics:      make(map[string]map[*subscriber]struct{}),
+	}
+	if err := server.RegisterSysHandler(PathSubscribe, &subscribeHandler{broker: ret}); err != nil {
+		return nil, err
+	}
+	if err := server.RegisterSysHandler(PathUnsubscribe, &unsubscribeHandler{broker: ret}); err != nil {
+		return nil, err
+	}
+	if err := server.RegisterSysHandler(PathPublish, &publishHandler{broker: ret}); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+//向topic发布消息，返回投递到的订阅者数量
+func (m *Broker) Publish(topic string, data []byte) int {
+	m.lock.RLock()
+	subs := make([]*subscriber, 0, len(m.topics[topic]))
+	for v := range m.topics[topic] {
+		subs = append(subs, v)
+	}
+	m.lock.RUnlock()
+	msg := &Message{Topic: topic, Data: data}
+	delivered := 0
+	for _, v := range subs {
+		if v.enqueue(msg) {
+			delivered++
+		}
+	}
+	return delivered
+}
+
+//topic当前的订阅者数量
+func (m *Broker) Subscribers(topic string) int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.topics[topic])
+}
+
+func (m *Broker) subscribe(c *iip.Channel, topic string, qos string) error {
+	if qos == "" {
+		qos = QoSDropOldest
+	}
+	if qos != QoSDropOldest && qos != QoSBlock {
+		return fmt.Errorf("invalid qos: %s", qos)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	sub, ok := m.subscribers[c]
+	if !ok {
+		push, err := c.OpenPushChannel()
+		if err != nil {
+			return err
+		}
+		sub = &subscriber{
+			broker:  m,
+			channel: c,
+			push:    push,
+			queue:   make(chan *Message, m.config.QueueLen),
+			qos:     make(map[string]string),
+			done:    make(chan struct{}),
+		}
+		m.subscribers[c] = sub
+		go sub.sendLoop()
+	}
+	sub.qos[topic] = qos
+	if m.topics[topic] == nil {
+		m.topics[topic] = make(map[*subscriber]struct{})
+	}
+	m.topics[topic][sub] = struct{}{}
+	return nil
+}
+
+func (m *Broker) unsubscribe(c *iip.Channel, topic string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	sub, ok := m.subscribers[c]
+	if !ok {
+		return
+	}
+	delete(sub.qos, topic)
+	if subs, ok := m.topics[topic]; ok {
+		delete(subs, sub)
+		if len(subs) == 0 {
+			delete(m.topics, topic)
+		}
+	}
+	//退订了全部topic，订阅者随之移除
+	if len(sub.qos) == 0 {
+		m.removeSubscriberLocked(sub)
+	}
+}
+
+//移除订阅者的全部订阅
+func (m *Broker) removeSubscriber(sub *subscriber) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.removeSubscriberLocked(sub)
+}
+
+//调用者持有m.lock
+func (m *Broker) removeSubscriberLocked(sub *subscriber) {
+	for topic := range sub.qos {
+		if subs, ok := m.topics[topic]; ok {
+			delete(subs, sub)
+			if len(subs) == 0 {
+				delete(m.topics, topic)
+			}
+		}
+	}
+	if m.subscribers[sub.channel] == sub {
+		delete(m.subscribers, sub.channel)
+	}
+	sub.closeOnce.Do(func() { close(sub.done) })
+}
+
+func (m *subscriber) enqueue(msg *Message) bool {
+	m.broker.lock.RLock()
+	qos := m.qos[msg.Topic]
+	m.broker.lock.RUnlock()
+	select {
+	case <-m.done:
+		return false
+	default:
+	}
+	if qos == QoSBlock {
+		timer := time.NewTimer(m.broker.config.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case m.queue <- msg:
+			return true
+		case <-m.done:
+			return false
+		case <-timer.C:
+			return false
+		}
+	}
+	for {
+		select {
+		case m.queue <- msg:
+			return true
+		default:
+			//队列满，丢弃最旧的消息
+			select {
+			case <-m.queue:
+				atomic.AddInt64(&m.dropped, 1)
+			default:
+			}
+		}
+	}
+}
+
+//发送订阅消息，直至订阅者被移除。发起订阅的channel关闭时移除订阅者
+func (m *subscriber) sendLoop() {
+	defer m.push.Close(fmt.Errorf("subscriber removed"))
+	closed := m.channel.Context().Done()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-closed:
+			m.broker.removeSubscriber(m)
+			return
+		case msg := <-m.queue:
+			bts, _ := json.Marshal(msg)
+			if err := m.push.Push(PathMessage, bts); err != nil {
+				//推送channel已失效，订阅者随之失效
+				m.broker.removeSubscriber(m)
+				return
+			}
+		}
+	}
+}
+
+type subscribeHandler struct {
+	broker *Broker
+}
+
+func (m *subscribeHandler) Handle(c *iip.Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	if !dataCompleted {
+		return nil, iip.ErrPacketContinue
+	}
+	var req RequestSubscribe
+	if err := json.Unmarshal(data, &req); err != nil || req.Topic == "" {
+		return response(-1, "invalid subscribe request", 0), nil
+	}
+	if err := m.broker.subscribe(c, req.Topic, req.QoS); err != nil {
+		return response(-1, err.Error(), 0), nil
+	}
+	return response(0, "", 0), nil
+}
+
+type unsubscribeHandler struct {
+	broker *Broker
+}
+
+func (m *unsubscribeHandler) Handle(c *iip.Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	if !dataCompleted {
+		return nil, iip.ErrPacketContinue
+	}
+	var req RequestSubscribe
+	if err := json.Unmarshal(data, &req); err != nil || req.Topic == "" {
+		return response(-1, "invalid unsubscribe request", 0), nil
+	}
+	m.broker.unsubscribe(c, req.Topic)
+	return response(0, "", 0), nil
+}
+
+type publishHandler struct {
+	broker *Broker
+}
+
+func (m *publishHandler) Handle(c *iip.Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	if !dataCompleted {
+		return nil, iip.ErrPacketContinue
+	}
+	var req RequestPublish
+	if err := json.Unmarshal(data, &req); err != nil || req.Topic == "" {
+		return response(-1, "invalid publish request", 0), nil
+	}
+	return response(0, "", m.broker.Publish(req.Topic, req.Data)), nil
+}
+
+func response(code int, message string, delivered int) []byte {
+	bts, _ := json.Marshal(&Response{Code: code, Message: message, Delivered: delivered})
+	return bts
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//启动注册了Broker的server及连接它的Subscriber，测试结束时关闭
+func newTestBroker(t *testing.T) (*iip.Server, *Broker, *Subscriber) {
+	t.Helper()
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := iip.NewServer(iip.ServerConfig{MaxConnections: 10, MaxChannelsPerConn: 10, ChannelPacketQueueLen: 100, TcpWriteQueueLen: 100}, lsn.Addr().String())
+	if err != nil {
+		lsn.Close()
+		t.Fatal(err)
+	}
+	broker, err := NewBroker(server, BrokerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Serve(lsn)
+	t.Cleanup(func() { server.Stop(fmt.Errorf("test finished")) })
+	client, err := iip.NewClient(iip.ClientConfig{MaxConnections: 1, MaxChannelsPerConn: 10, ChannelPacketQueueLen: 100, TcpWriteQueueLen: 100,
+		TcpConnectTimeout: time.Second * 3, TcpReadBufferSize: 1 << 20, TcpWriteBufferSize: 1 << 20}, lsn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	sub, err := NewSubscriber(client, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, broker, sub
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+//server上全部连接打开的channel数，包括推送channel
+func serverChannels(server *iip.Server) int {
+	n := 0
+	for _, v := range server.ConnectionsSnapshot() {
+		n += v.Channels
+	}
+	return n
+}
+
+func (m *Broker) subscriberCount() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.subscribers)
+}
+
+func TestPublishDelivers(t *testing.T) {
+	_, broker, sub := newTestBroker(t)
+	received := make(chan string, 1)
+	if err := sub.Subscribe("t", "", func(topic string, data []byte) { received <- string(data) }); err != nil {
+		t.Fatal(err)
+	}
+	if n := broker.Subscribers("t"); n != 1 {
+		t.Fatalf("subscribers: %d", n)
+	}
+	if n, err := sub.Publish("t", []byte("hello")); err != nil || n != 1 {
+		t.Fatalf("publish: %d, %v", n, err)
+	}
+	select {
+	case s := <-received:
+		if s != "hello" {
+			t.Fatalf("received %q", s)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not received")
+	}
+}
+
+//发起订阅的channel关闭后订阅者被移除，推送channel随之关闭
+func TestSubscriberRemovedOnChannelClose(t *testing.T) {
+	server, broker, sub := newTestBroker(t)
+	if err := sub.Subscribe("t", QoSBlock, func(string, []byte) {}); err != nil {
+		t.Fatal(err)
+	}
+	//订阅channel及推送channel
+	waitFor(t, "push channel", func() bool { return serverChannels(server) == 2 })
+	sub.Close()
+	waitFor(t, "subscriber removed", func() bool { return broker.Subscribers("t") == 0 && broker.subscriberCount() == 0 })
+	waitFor(t, "push channel closed", func() bool { return serverChannels(server) == 0 })
+	if n := broker.Publish("t", []byte("x")); n != 0 {
+		t.Fatalf("published to %d removed subscribers", n)
+	}
+}
+
+//退订全部topic后订阅者被移除，之后可以在同一channel上重新订阅
+func TestSubscriberRemovedOnLastUnsubscribe(t *testing.T) {
+	server, broker, sub := newTestBroker(t)
+	for _, topic := range []string{"a", "b"} {
+		if err := sub.Subscribe(topic, "", func(string, []byte) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sub.Unsubscribe("a"); err != nil {
+		t.Fatal(err)
+	}
+	if broker.Subscribers("a") != 0 || broker.Subscribers("b") != 1 || broker.subscriberCount() != 1 {
+		t.Fatalf("after unsubscribe a: a=%d b=%d subscribers=%d", broker.Subscribers("a"), broker.Subscribers("b"), broker.subscriberCount())
+	}
+	if err := sub.Unsubscribe("b"); err != nil {
+		t.Fatal(err)
+	}
+	if n := broker.subscriberCount(); n != 0 {
+		t.Fatalf("subscribers after unsubscribing all topics: %d", n)
+	}
+	//只剩订阅channel
+	waitFor(t, "push channel closed", func() bool { return serverChannels(server) == 1 })
+
+	received := make(chan string, 1)
+	if err := sub.Subscribe("a", "", func(topic string, data []byte) { received <- string(data) }); err != nil {
+		t.Fatal(err)
+	}
+	if n := broker.Publish("a", []byte("again")); n != 1 {
+		t.Fatalf("delivered to %d subscribers", n)
+	}
+	select {
+	case s := <-received:
+		if s != "again" {
+			t.Fatalf("received %q", s)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not received after resubscribe")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/truexf/iip"
+)
+
+//收到订阅消息时的回调
+type MessageHandler func(topic string, data []byte)
+
+//client端的订阅者，一个Subscriber占用client的一个channel，server通过为其打开的推送channel投递消息
+type Subscriber struct {
+	client   *iip.Client
+	channel  *iip.ClientChannel
+	handlers map[string]MessageHandler
+	timeout  time.Duration
+	lock     sync.RWMutex
+}
+
+//创建订阅者，并在client上注册消息的推送处理器。一个client只应创建一个Subscriber
+func NewSubscriber(client *iip.Client, timeout time.Duration) (*Subscriber, error) {
+	channel, err := client.NewChannel()
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = time.Second * 3
+	}
+	ret := &Subscriber{
+		client:   client,
+		channel:  channel,
+		handlers: make(map[string]MessageHandler),
+		timeout:  timeout,
+	}
+	if err := client.RegisterSysPushHandler(PathMessage, ret); err != nil {
+		channel.Close(err)
+		return nil, err
+	}
+	return ret, nil
+}
+
+//订阅topic，qos为空时使用QoSDropOldest
+func (m *Subscriber) Subscribe(topic string, qos string, handler MessageHandler) error {
+	if handler == nil {
+		return fmt.Errorf("handler is nil")
+	}
+	m.lock.Lock()
+	m.handlers[topic] = handler
+	m.lock.Unlock()
+	req, _ := json.Marshal(&RequestSubscribe{Topic: topic, QoS: qos})
+	if err := m.call(PathSubscribe, req); err != nil {
+		m.lock.Lock()
+		delete(m.handlers, topic)
+		m.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+//退订topic
+func (m *Subscriber) Unsubscribe(topic string) error {
+	req, _ := json.Marshal(&RequestSubscribe{Topic: topic})
+	err := m.call(PathUnsubscribe, req)
+	m.lock.Lock()
+	delete(m.handlers, topic)
+	m.lock.Unlock()
+	return err
+}
+
+//通过server向topic发布消息，返回投递到的订阅者数量
+func (m *Subscriber) Publish(topic string, data []byte) (int, error) {
+	req, _ := json.Marshal(&RequestPublish{Topic: topic, Data: data})
+	bts, err := m.channel.DoRequest(PathPublish, req, m.timeout)
+	if err != nil {
+		return 0, err
+	}
+	var resp Response
+	if err := json.Unmarshal(bts, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Code != 0 {
+		return 0, fmt.Errorf(resp.Message)
+	}
+	return resp.Delivered, nil
+}
+
+//关闭订阅者，server端的订阅随之失效
+func (m *Subscriber) Close() {
+	m.client.UnRegisterPushHandler(PathMessage)
+	m.channel.Close(fmt.Errorf("subscriber closed"))
+}
+
+func (m *Subscriber) call(path string, req []byte) error {
+	bts, err := m.channel.DoRequest(path, req, m.timeout)
+	if err != nil {
+		return err
+	}
+	var resp Response
+	if err := json.Unmarshal(bts, &resp); err != nil {
+		return err
+	}
+	if resp.Code != 0 {
+		return fmt.Errorf(resp.Message)
+	}
+	return nil
+}
+
+//实现iip.PathHandler，处理server推送的消息
+func (m *Subscriber) Handle(c *iip.Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	if !dataCompleted {
+		return nil, nil
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	m.lock.RLock()
+	handler := m.handlers[msg.Topic]
+	m.lock.RUnlock()
+	if handler != nil {
+		handler(msg.Topic, msg.Data)
+	}
+	return nil, nil
+}
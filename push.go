@@ -0,0 +1,76 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//server推送channel：server在本端命名空间(偶数id)中创建channel，通过0号channel向client发送通告帧，
+//随后即可在该channel上向client发送非请求的消息(通知、缓存失效等)，client使用RegisterPushHandler注册的handler处理
+package iip
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type PushChannelAnnounce struct {
+	ChannelId uint32 `json:"channel_id"`
+}
+
+//在server端的连接上打开一个推送channel
+func (m *Connection) NewPushChannel() (*Channel, error) {
+	if m.Role != RoleServer {
+		return nil, fmt.Errorf("push channel can only be opened by server")
+	}
+	if err := m.errClosed(); err != nil {
+		return nil, err
+	}
+	queueLen := uint32(100)
+	if svr := m.server; svr != nil && svr.getConfig().ChannelPacketQueueLen > 0 {
+		queueLen = svr.getConfig().ChannelPacketQueueLen
+	}
+	c, err := m.newOwnedChannel(queueLen, true)
+	if err != nil {
+		return nil, err
+	}
+	bts, _ := json.Marshal(&PushChannelAnnounce{ChannelId: c.Id})
+	announce := &Packet{Type: PacketTypeResponse, Path: PathPushChannel, ChannelId: 0, Data: bts, channel: m.getChannel(0)}
+	if err := m.getChannel(0).SendPacket(announce); err != nil {
+		m.discardChannel(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+//在当前channel所在的连接上打开一个推送channel，供server handler使用
+func (m *Channel) OpenPushChannel() (*Channel, error) {
+	return m.conn.NewPushChannel()
+}
+
+//在推送channel上向client发送一条消息
+func (m *Channel) Push(path string, data []byte) error {
+	if !m.push {
+		return fmt.Errorf("channel %d is not a push channel", m.Id)
+	}
+	return m.SendPacket(&Packet{Type: PacketTypeResponse, Path: path, ChannelId: m.Id, Data: data, channel: m})
+}
+
+//是否为server推送channel
+func (m *Channel) IsPush() bool {
+	return m.push
+}
+
+//client端在读循环中处理推送channel的通告
+func (m *Connection) handlePushChannelAnnounce(pkt *Packet) {
+	defer pkt.Release()
+	var announce PushChannelAnnounce
+	if err := json.Unmarshal(pkt.Data, &announce); err != nil || announce.ChannelId == 0 || m.ownsChannelId(announce.ChannelId) {
+		log.Errorf("invalid push channel announce: %s", string(pkt.Data))
+		return
+	}
+	queueLen := uint32(100)
+	if client := m.client; client != nil && client.config.ChannelPacketQueueLen > 0 {
+		queueLen = client.config.ChannelPacketQueueLen
+	}
+	if _, err := m.newChannelWithId(announce.ChannelId, queueLen, true, nil); err != nil {
+		log.Errorf("create push channel fail, %s", err.Error())
+	}
+}
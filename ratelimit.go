@@ -0,0 +1,82 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//server端限流：按连接限制每秒请求数及读入字节数，按path限制每秒请求数(server范围)。
+//字节数超限时暂停读取该连接(背压)；请求数超限时返回ErrRateLimited，或者在配置了RateLimitBackpressure时暂停读取
+package iip
+
+import (
+	"time"
+)
+
+//为新连接创建限流器，在连接启动之前调用
+func (m *Server) initConnRateLimit(conn *Connection) {
+	config := m.getConfig()
+	if config.ConnRequestRate > 0 {
+		conn.requestLimiter = newTokenBucket(config.ConnRequestRate, config.ConnRequestRate)
+	}
+	if config.ConnByteRate > 0 {
+		conn.byteLimiter = newTokenBucket(config.ConnByteRate, config.ConnByteRate)
+	}
+}
+
+//按配置重建path限流器，速率未变的path沿用原来的限流器
+func (m *Server) initPathRateLimit() {
+	old, _ := m.pathLimiters.Load().(map[string]*tokenBucket)
+	limiters := make(map[string]*tokenBucket)
+	for path, rate := range m.getConfig().PathRequestRate {
+		if rate <= 0 {
+			continue
+		}
+		if limiter, ok := old[path]; ok && limiter.getRate() == rate {
+			limiters[path] = limiter
+		} else {
+			limiters[path] = newTokenBucket(rate, rate)
+		}
+	}
+	m.pathLimiters.Store(limiters)
+}
+
+//更新已有连接的限流速率。速率为0时不再限制；连接创建时未限流的，新的速率只对之后建立的连接生效
+func (m *Connection) updateRateLimit(requestRate, byteRate float64) {
+	if m.requestLimiter != nil {
+		m.requestLimiter.setRate(requestRate, requestRate)
+	}
+	if m.byteLimiter != nil {
+		m.byteLimiter.setRate(byteRate, byteRate)
+	}
+}
+
+//在serveReceived中对请求首帧检查连接及path的请求速率，0号系统channel不限流
+func (m *Server) admitRate(c *Channel, request *Packet) bool {
+	if c.Id == 0 {
+		return true
+	}
+	if limiter := c.conn.requestLimiter; limiter != nil && !m.getConfig().RateLimitBackpressure && !limiter.allow(1) {
+		return false
+	}
+	limiters, _ := m.pathLimiters.Load().(map[string]*tokenBucket)
+	if limiter, ok := limiters[request.Path]; ok && !limiter.allow(1) {
+		return false
+	}
+	return true
+}
+
+//在读循环中执行背压：字节数超限，或者请求数超限且配置为背压时，暂停读取直至令牌足够
+func (m *Connection) throttleRead(channelId uint32, status byte, frameLen int) {
+	var wait time.Duration
+	if m.byteLimiter != nil {
+		wait = m.byteLimiter.reserve(float64(frameLen))
+	}
+	if m.requestLimiter != nil && channelId != 0 && (status == StatusC0 || status == StatusC1) {
+		if svr := m.server; svr != nil && svr.getConfig().RateLimitBackpressure {
+			if w := m.requestLimiter.reserve(1); w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//读分派：连接的读循环按到达顺序将帧放入各channel的接收队列，某个channel的接收队列满时读循环阻塞，连接上的其他channel随之停顿；
+//对端连续发送同一channel的大量帧时，其他channel的帧也只能排在其后，处理的先后完全取决于Go的调度。
+//ServerConfig.MaxConsecutiveFrames大于0时开启公平分派：读循环将帧放入分派器中各channel的FIFO，分派goroutine在有待投递帧的channel之间轮询，
+//每一轮从一个channel最多投递MaxConsecutiveFrames帧，channel的接收队列满时跳过该channel，不阻塞其他channel。
+//分派器暂存的帧数受DispatchQueueLen限制，满时读循环等待，对对端形成反压。0号系统channel不经分派器。
+//无论是否开启，连接统计都记录读循环连续收到同一channel的最长帧数，channel统计记录帧在接收队列中等待处理的时间，用于观察多路复用的公平性
+package iip
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//DispatchQueueLen为0时分派器暂存的帧数上限
+const DefaultDispatchQueueLen = 1024
+
+//分派器中一个channel待投递的帧
+type dispatchQueue struct {
+	channel *Channel
+	packets []*Packet
+}
+
+type readDispatcher struct {
+	lock   sync.Mutex
+	queues map[*Channel]*dispatchQueue
+	active []*dispatchQueue //轮询顺序
+	maxRun int              //每一轮从一个channel投递的最大帧数
+	slots  chan struct{}    //暂存的容量
+	notify chan struct{}
+	yields int64 //channel还有待投递的帧而轮到下一个channel的次数
+}
+
+func newReadDispatcher(maxRun, queueLen int) *readDispatcher {
+	if queueLen <= 0 {
+		queueLen = DefaultDispatchQueueLen
+	}
+	return &readDispatcher{
+		queues: make(map[*Channel]*dispatchQueue),
+		maxRun: maxRun,
+		slots:  make(chan struct{}, queueLen),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+//开启公平分派，maxRun<=0表示不开启。在连接启动之前调用
+func (m *Connection) setDispatch(maxRun, queueLen int) {
+	if maxRun > 0 {
+		m.dispatcher = newReadDispatcher(maxRun, queueLen)
+	}
+}
+
+//读循环将帧交给channel：开启公平分派时经分派器，否则直接放入channel的接收队列，队列满时等待。
+//channel或连接关闭时丢弃该帧并返回false
+func (m *Connection) enqueue(channel *Channel, pkt *Packet) bool {
+	m.countRun(channel.Id)
+	if m.dispatcher != nil && channel.Id != 0 {
+		return m.dispatcher.push(channel, pkt, m.closeNotify)
+	}
+	return channel.enqueueReceived(pkt)
+}
+
+//同enqueue，channel的接收队列(开启公平分派时含分派器中待投递的帧)已满时不等待，返回false，pkt仍由调用者处理
+func (m *Connection) tryEnqueue(channel *Channel, pkt *Packet) bool {
+	m.countRun(channel.Id)
+	if m.dispatcher != nil && channel.Id != 0 {
+		return m.dispatcher.tryPush(channel, pkt)
+	}
+	return channel.tryEnqueueReceived(pkt)
+}
+
+//记录读循环连续收到同一channel的帧数，只在读循环中调用
+func (m *Connection) countRun(channelId uint32) {
+	if channelId == m.runChannel {
+		m.runLen++
+	} else {
+		m.runChannel, m.runLen = channelId, 1
+	}
+	raiseHighWater(&m.stats.maxRun, int64(m.runLen))
+}
+
+func (m *readDispatcher) push(channel *Channel, pkt *Packet, done <-chan int) bool {
+	select {
+	case m.slots <- struct{}{}:
+	case <-done:
+		pkt.Release()
+		return false
+	}
+	m.add(channel, pkt)
+	return true
+}
+
+func (m *readDispatcher) tryPush(channel *Channel, pkt *Packet) bool {
+	m.lock.Lock()
+	pending := 0
+	if q, ok := m.queues[channel]; ok {
+		pending = len(q.packets)
+	}
+	m.lock.Unlock()
+	if pending+len(channel.receivedQueue) >= cap(channel.receivedQueue) {
+		return false
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		return false
+	}
+	m.add(channel, pkt)
+	return true
+}
+
+func (m *readDispatcher) add(channel *Channel, pkt *Packet) {
+	m.lock.Lock()
+	q, ok := m.queues[channel]
+	if !ok {
+		q = &dispatchQueue{channel: channel}
+		m.queues[channel] = q
+		m.active = append(m.active, q)
+	}
+	q.packets = append(q.packets, pkt)
+	m.lock.Unlock()
+	m.wake()
+}
+
+//有新的帧，或者某个channel的接收队列有了空位
+func (m *readDispatcher) wake() {
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+//分派goroutine，连接关闭时丢弃暂存的帧并退出
+func (m *readDispatcher) run(done <-chan int) {
+	for {
+		if m.dispatchRound() {
+			continue
+		}
+		select {
+		case <-m.notify:
+		case <-done:
+			m.lock.Lock()
+			for _, q := range m.active {
+				for _, pkt := range q.packets {
+					pkt.Release()
+				}
+			}
+			m.queues, m.active = nil, nil
+			m.lock.Unlock()
+			return
+		}
+	}
+}
+
+//轮询一遍有待投递帧的channel，返回是否投递了帧
+func (m *readDispatcher) dispatchRound() bool {
+	m.lock.Lock()
+	active := append([]*dispatchQueue(nil), m.active...)
+	m.lock.Unlock()
+	progress := false
+	for _, q := range active {
+		n := 0
+		for n < m.maxRun {
+			m.lock.Lock()
+			if len(q.packets) == 0 {
+				m.lock.Unlock()
+				break
+			}
+			pkt := q.packets[0]
+			m.lock.Unlock()
+			if q.channel.isClosed() {
+				m.drop(q)
+				break
+			}
+			if !q.channel.tryEnqueueReceived(pkt) {
+				break
+			}
+			m.lock.Lock()
+			q.packets[0] = nil
+			q.packets = q.packets[1:]
+			m.lock.Unlock()
+			<-m.slots
+			n++
+		}
+		if n > 0 {
+			progress = true
+		}
+		m.lock.Lock()
+		if len(q.packets) == 0 {
+			m.remove(q)
+		} else if n == m.maxRun {
+			m.yields++
+		}
+		m.lock.Unlock()
+	}
+	return progress
+}
+
+//丢弃已关闭的channel的帧
+func (m *readDispatcher) drop(q *dispatchQueue) {
+	m.lock.Lock()
+	packets := q.packets
+	q.packets = nil
+	m.lock.Unlock()
+	for _, pkt := range packets {
+		pkt.Release()
+		<-m.slots
+	}
+}
+
+//调用者持有lock
+func (m *readDispatcher) remove(q *dispatchQueue) {
+	delete(m.queues, q.channel)
+	for i, v := range m.active {
+		if v == q {
+			m.active = append(m.active[:i], m.active[i+1:]...)
+			return
+		}
+	}
+}
+
+//暂存的帧数，以及轮到下一个channel时仍有待投递帧的次数
+func (m *readDispatcher) stats() (int, int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.slots), m.yields
+}
+
+//处理循环从接收队列取出一帧：记录等待时间，唤醒可能因队列满而等待的分派器
+func (m *Channel) dequeued(pkt *Packet) {
+	if pkt.queued != 0 {
+		wait := time.Now().UnixNano() - pkt.queued
+		raiseHighWater(&m.waitMax, wait)
+		atomic.AddInt64(&m.waitTotal, wait)
+		atomic.AddInt64(&m.waitCount, 1)
+	}
+	if d := m.conn.dispatcher; d != nil {
+		d.wake()
+	}
+}
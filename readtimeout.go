@@ -0,0 +1,122 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//帧读取超时：从收到帧的首字节开始计时，超时仍未读完整帧时关闭连接，避免只发送半帧便停止的对端
+//长期占用读循环及已分配的帧内存。帧之间的等待不受限制，空闲连接由IdleTimeout、健康检查处理。
+//防慢速攻击(slowloris)：server端连接须在建立之后的FirstFrameTimeout内发送完整的首帧(通常为握手)，
+//读取帧的过程中每MinReadInterval至少读入MinReadBytes字节，否则关闭连接，逐字节发送的对端无法长期占用连接。
+//读超时只在帧未读完、需要从socket读取时设置，帧已完整在缓冲区中时没有额外开销
+package iip
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+//连接读循环的数据源，在帧的读取过程中为底层连接设置读截止时间
+type deadlineReader struct {
+	conn         net.Conn
+	timeout      time.Duration //读取一帧的时限，0表示不限制
+	firstTimeout time.Duration
+	first        time.Time //完整读入首帧的截止时间，读完首帧后为零值
+	minBytes     int       //读取帧的过程中每interval至少读入的字节数，0表示不检查
+	interval     time.Duration
+	inFrame      bool
+	deadline     time.Time //当前帧的截止时间
+	windowStart  time.Time //最低速率的统计窗口
+	windowBytes  int
+	applied      time.Time //已设置到连接上的截止时间
+}
+
+func newDeadlineReader(conn *Connection) *deadlineReader {
+	ret := &deadlineReader{
+		conn:         conn.tcpConn,
+		timeout:      conn.frameReadTimeout,
+		firstTimeout: conn.firstFrameTimeout,
+		minBytes:     conn.minReadBytes,
+		interval:     conn.minReadInterval,
+	}
+	if ret.firstTimeout > 0 {
+		ret.first = conn.createTime.Add(ret.firstTimeout)
+	}
+	if ret.minBytes > 0 && ret.interval <= 0 {
+		ret.interval = time.Second
+	}
+	return ret
+}
+
+func (m *deadlineReader) Read(p []byte) (int, error) {
+	deadline, cause := m.first, fmt.Sprintf("first frame not completed in %s", m.firstTimeout.String())
+	if m.inFrame {
+		if !m.deadline.IsZero() && (deadline.IsZero() || m.deadline.Before(deadline)) {
+			deadline, cause = m.deadline, fmt.Sprintf("read frame timeout, not completed in %s", m.timeout.String())
+		}
+		if m.minBytes > 0 {
+			if m.windowBytes >= m.minBytes {
+				m.windowStart, m.windowBytes = time.Now(), 0
+			}
+			if end := m.windowStart.Add(m.interval); deadline.IsZero() || end.Before(deadline) {
+				deadline, cause = end, fmt.Sprintf("read too slow, less than %d bytes in %s", m.minBytes, m.interval.String())
+			}
+		}
+	}
+	if !deadline.Equal(m.applied) {
+		if err := m.conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+		m.applied = deadline
+	}
+	n, err := m.conn.Read(p)
+	m.windowBytes += n
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !deadline.IsZero() {
+		return n, fmt.Errorf(cause)
+	}
+	return n, err
+}
+
+//收到帧的首字节
+func (m *deadlineReader) beginFrame() {
+	m.inFrame = true
+	if m.timeout <= 0 && m.minBytes <= 0 {
+		return
+	}
+	now := time.Now()
+	if m.timeout > 0 {
+		m.deadline = now.Add(m.timeout)
+	}
+	m.windowStart, m.windowBytes = now, 0
+}
+
+//帧读取完成或者失败
+func (m *deadlineReader) endFrame() {
+	m.inFrame = false
+	m.deadline = time.Time{}
+	m.first = time.Time{}
+}
+
+//连接的读循环是否需要设置读截止时间
+func (m *Connection) readDeadlineRequired() bool {
+	return m.frameReadTimeout > 0 || m.firstFrameTimeout > 0 || m.minReadBytes > 0
+}
+
+//设置帧读取超时，须在连接启动之前调用，0表示不限制
+func (m *Connection) setFrameReadTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	m.frameReadTimeout = timeout
+}
+
+//设置防慢速攻击的限制，须在连接启动之前调用：firstFrameTimeout为建立连接后读完首帧的时限，
+//读取帧的过程中每interval至少读入minBytes字节，interval为0时为1秒
+func (m *Connection) setSlowReadLimits(firstFrameTimeout time.Duration, minBytes int, interval time.Duration) {
+	if firstFrameTimeout < 0 {
+		firstFrameTimeout = 0
+	}
+	if minBytes < 0 {
+		minBytes = 0
+	}
+	m.firstFrameTimeout, m.minReadBytes, m.minReadInterval = firstFrameTimeout, minBytes, interval
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//配置热更新：UpdateConfig原子地替换server的配置，之后建立的连接使用新的配置，
+//已有的连接在下一次用到相应配置时生效(见UpdateConfig的说明)，无需重启server
+package iip
+
+import (
+	"fmt"
+)
+
+//当前生效的配置
+func (m *Server) getConfig() *ServerConfig {
+	return m.config.Load().(*ServerConfig)
+}
+
+//当前生效的配置的副本
+func (m *Server) Config() ServerConfig {
+	return *m.getConfig()
+}
+
+//替换server的配置。新建立的连接使用新配置的全部设置；对已有的连接：
+//MaxConnections、MaxChannelsPerConn、ChannelPacketQueueLen、PathRequestRate、RateLimitBackpressure、SysEndpoints、SysAuthorizer、
+//MaxRequestSize、RecycleRequests、RejectWhenQueueFull、ConnMemoryLimit、MemoryLimit、ShedOnMemoryLimit、SlowRequestThreshold、AssembleRequests、PathRules、OnNewChannelRequest、StreamFrameThreshold立即生效，ConnRequestRate、ConnByteRate对创建时已限流的连接生效；MaxPacketSize、MaxPathLen、FrameSize、Checksum已在握手时协商，
+//Authenticator、CertAuthorizer、PSK、PSKCipher、TcpWriteQueueLen、TCP socket选项(TcpKeepAlive等)、MinReadBytes、MinReadInterval、MaxConsecutiveFrames、DispatchQueueLen、各超时设置在连接创建时确定，只对新连接生效，TLSConfig在监听时确定。
+//AcceptRate、AcceptBurst、AllowCIDRs、DenyCIDRs、ConnFilter对之后accept的连接生效，CIDR有误时返回错误。
+//Codec只影响之后通过RegisterTyped注册的处理函数。Workers、WorkerQueueLen、EventLoops在NewServer时确定，不可更新，ChannelOrdered立即生效
+func (m *Server) UpdateConfig(config ServerConfig) error {
+	if !isValidChecksum(config.Checksum) {
+		return fmt.Errorf("unsupported checksum: %d", config.Checksum)
+	}
+	if config.MaxConnections < 0 || config.MaxChannelsPerConn < 0 {
+		return fmt.Errorf("invalid config, max connections and max channels must >= 0")
+	}
+	if err := m.initConnFilter(&config); err != nil {
+		return err
+	}
+	m.config.Store(&config)
+	m.initPathRateLimit()
+	m.connLock.Lock()
+	for _, conn := range m.connections {
+		conn.updateRateLimit(config.ConnRequestRate, config.ConnByteRate)
+	}
+	m.connLock.Unlock()
+	//上限调高时唤醒等待中的accept
+	select {
+	case m.connFreed <- struct{}{}:
+	default:
+	}
+	log.Logf("server config updated")
+	return nil
+}
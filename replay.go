@@ -0,0 +1,234 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//重放：从Recorder的记录中还原client发出的请求(client端记录的写出帧，或者server端记录的读入帧)，
+//多帧请求合并为一个请求，并关联记录到的响应；Replayer以client按原来的channel分组重新发出这些请求，
+//同一channel上的请求依次进行，不同channel之间并发，便于在本地复现协议问题。0号channel上的系统请求不重放
+package iip
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+//从记录中还原的一个请求
+type CapturedRequest struct {
+	Conn          string
+	ChannelId     uint32
+	Time          time.Time //请求首帧的时间
+	Path          string
+	Meta          map[string]string
+	Data          []byte
+	OneWay        bool   //单向消息，没有响应
+	Response      []byte //记录到的响应数据，没有记录到完整的响应时为nil
+	ResponseError string //记录到的错误响应
+}
+
+//读取记录，最后一行不完整(记录未正常关闭)时忽略
+func ReadCapture(r io.Reader) ([]*TapEvent, error) {
+	var ret []*TapEvent
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), int(MaxPacketSize)*2)
+	for scanner.Scan() {
+		var event TapEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		ret = append(ret, &event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+//读取记录文件，见ReadCapture
+func LoadCapture(fileName string) ([]*TapEvent, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCapture(f)
+}
+
+//由client发出的帧：client端写出的帧，或者server端读入的帧
+func (m *TapEvent) fromClient() bool {
+	return (m.Role == RoleClient) == (m.Direction == TapOutbound)
+}
+
+//还原记录中的请求，按请求首帧的顺序返回
+func CapturedRequests(events []*TapEvent) []*CapturedRequest {
+	type channelKey struct {
+		conn string
+		id   uint32
+	}
+	var ret []*CapturedRequest
+	requests := make(map[channelKey]*CapturedRequest)  //正在接收的请求
+	waiting := make(map[channelKey][]*CapturedRequest) //等待响应的请求
+	responses := make(map[channelKey]*CapturedRequest) //正在接收响应的请求
+	for _, event := range events {
+		if event.ChannelId == 0 || event.Status == Status8 {
+			continue
+		}
+		key := channelKey{event.Conn, event.ChannelId}
+		if event.fromClient() {
+			switch event.Status {
+			case StatusO13:
+				ret = append(ret, &CapturedRequest{Conn: event.Conn, ChannelId: event.ChannelId, Time: event.Time, Path: event.Path, Meta: event.Meta, Data: event.Data, OneWay: true})
+			case StatusC0, StatusC1:
+				if isSysPath(event.Path) {
+					continue
+				}
+				req := &CapturedRequest{Conn: event.Conn, ChannelId: event.ChannelId, Time: event.Time, Path: event.Path, Meta: event.Meta, Data: event.Data}
+				ret = append(ret, req)
+				requests[key] = req
+			case StatusC2, StatusC3:
+				if req := requests[key]; req != nil {
+					req.Data = append(req.Data, event.Data...)
+				}
+			default:
+				continue
+			}
+			if req := requests[key]; req != nil && (event.Status == StatusC1 || event.Status == StatusC3) {
+				delete(requests, key)
+				waiting[key] = append(waiting[key], req)
+			}
+			continue
+		}
+		switch event.Status {
+		case StatusS4, StatusS5, StatusS11:
+			if reqs := waiting[key]; len(reqs) > 0 {
+				responses[key], waiting[key] = reqs[0], reqs[1:]
+			}
+		}
+		req := responses[key]
+		if req == nil {
+			continue
+		}
+		switch event.Status {
+		case StatusS4, StatusS6:
+			req.Response = append(req.Response, event.Data...)
+		case StatusS5, StatusS7:
+			req.Response = append(req.Response, event.Data...)
+			if req.Response == nil {
+				req.Response = []byte{}
+			}
+			delete(responses, key)
+		case StatusS11:
+			req.Response, req.ResponseError = nil, string(event.Data)
+			delete(responses, key)
+		}
+	}
+	//没有收到结束帧的响应是不完整的
+	for _, req := range responses {
+		req.Response = nil
+	}
+	return ret
+}
+
+//以client重放记录中的请求
+type Replayer struct {
+	Client  *Client
+	Speed   float64       //按记录中请求之间的时间间隔重放的倍速，如2表示两倍速，0表示不等待
+	Timeout time.Duration //每个请求的超时，0表示10秒
+	//每个请求完成后调用，不同channel上的请求并发进行，OnResponse可能被并发调用
+	OnResponse func(req *CapturedRequest, response []byte, err error)
+}
+
+//重放请求直至全部完成或者ctx结束，返回新建channel的错误或者ctx的错误，请求本身的结果交给OnResponse
+func (m *Replayer) Replay(ctx context.Context, requests []*CapturedRequest) error {
+	if m.Client == nil {
+		return fmt.Errorf("replayer has no client")
+	}
+	if len(requests) == 0 {
+		return nil
+	}
+	type channelKey struct {
+		conn string
+		id   uint32
+	}
+	var keys []channelKey
+	groups := make(map[channelKey][]*CapturedRequest)
+	for _, req := range requests {
+		key := channelKey{req.Conn, req.ChannelId}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], req)
+	}
+	start, first := time.Now(), requests[0].Time
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var firstErr error
+	for _, key := range keys {
+		wg.Add(1)
+		go func(reqs []*CapturedRequest) {
+			defer wg.Done()
+			if err := m.replayChannel(ctx, reqs, start, first); err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errLock.Unlock()
+			}
+		}(groups[key])
+	}
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+//在一个新的channel上依次重放同一channel上的请求
+func (m *Replayer) replayChannel(ctx context.Context, reqs []*CapturedRequest, start, first time.Time) error {
+	c, err := m.Client.NewChannel()
+	if err != nil {
+		return err
+	}
+	defer c.Close(nil)
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	for _, req := range reqs {
+		if m.Speed > 0 {
+			delay := time.Duration(float64(req.Time.Sub(first))/m.Speed) - time.Since(start)
+			if delay > 0 {
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var resp []byte
+		if req.OneWay {
+			err = c.Send(req.Path, req.Data)
+		} else {
+			reqCtx, cancel := context.WithTimeout(ctx, timeout)
+			for k, v := range req.Meta {
+				reqCtx = WithRequestMeta(reqCtx, k, v)
+			}
+			resp, err = c.DoRequestContext(reqCtx, req.Path, req.Data)
+			cancel()
+		}
+		if m.OnResponse != nil {
+			m.OnResponse(req, resp, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//channel重置：任一端发送重置帧(StatusR12)中止channel上正在进行的请求/响应并关闭该channel，
+//如client放弃等待中的请求、server拒绝接收中的请求，连接上的其他channel不受影响。
+//重置帧的数据为ResponseHandleFail的json，对端等待中的DoRequest立即返回对应的*Error，而不是等到超时。
+//重置须在握手时协商FeatureReset，未协商时只关闭channel
+package iip
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+//重置channel：通知对端中止当前的请求/响应并关闭channel，err为nil时为ErrChannelReset
+func (m *Channel) Reset(err error) error {
+	if m.Id == 0 {
+		return fmt.Errorf("system channel can not be reset")
+	}
+	if err := m.errClosed(); err != nil {
+		return err
+	}
+	if err == nil {
+		err = ErrChannelReset
+	}
+	errExt, ok := err.(*Error)
+	if !ok {
+		errExt = &Error{Code: -1, Message: err.Error()}
+	}
+	m.reset("", errExt)
+	return nil
+}
+
+//重置channel，见Channel.Reset
+func (m *ClientChannel) Reset(err error) error {
+	return m.internalChannel.Reset(err)
+}
+
+//发送重置帧并关闭channel，重置帧写出之后channel id才被复用，见writeScheduler.whenDrained
+func (m *Channel) reset(path string, err *Error) {
+	if !m.conn.HasFeature(FeatureReset) {
+		m.Close(err)
+		return
+	}
+	data := ErrorResponse(err).Data()
+	if len(data) > int(m.conn.MaxPacketSize()) {
+		data = ErrorResponse(&Error{Code: err.Code, Message: "message too large"}).Data()
+	}
+	pkt := acquirePacket()
+	pkt.Type, pkt.Status, pkt.Path, pkt.ChannelId, pkt.Data, pkt.channel = PacketTypeRequest, StatusR12, path, m.Id, data, m
+	if m.conn.Role == RoleServer {
+		pkt.Type = PacketTypeResponse
+	}
+	//与关闭通知相同，重置帧不等待写队列，见Channel.sendCloseNotice
+	if enqueueErr := m.conn.enqueuePacket(pkt, 0, nil); enqueueErr == nil {
+		atomic.AddInt64(&m.WritePacketCount, 1)
+		m.closeAck = m.conn.closeAckRequired()
+	} else {
+		pkt.Release()
+		log.Warnf("reset frame of channel %d of %s not sent, %s", m.Id, m.conn.key, enqueueErr.Error())
+	}
+	log.Warnf("reset channel %d of %s, %s", m.Id, m.conn.key, err.Error())
+	m.close(err, false)
+}
+
+//在读循环中收到不存在(也不在关闭的逗留期内)的channel的帧：计数并丢弃，协商了FeatureReset时以重置帧通知对端，
+//只影响该channel id，不关闭连接。该id随即进入逗留期，其后续帧被静默丢弃，不会逐帧重置
+func (m *Connection) unknownChannel(pkt *Packet) {
+	atomic.AddInt64(&m.stats.unknownChannelFrames, 1)
+	if svr := m.server; svr != nil {
+		atomic.AddInt64(&svr.unknownChannelFrames, 1)
+	} else if client := m.client; client != nil {
+		atomic.AddInt64(&client.unknownChannelFrames, 1)
+	}
+	log.Warnf("frame of unknown channel %d of %s, path: %s, status: %d", pkt.ChannelId, m.key, pkt.Path, pkt.Status)
+	if !m.HasFeature(FeatureReset) {
+		return
+	}
+	m.ChannelsLock.Lock()
+	m.lingerClosed(pkt.ChannelId)
+	m.ChannelsLock.Unlock()
+	rst := acquirePacket()
+	rst.Type, rst.Status, rst.ChannelId, rst.Data = PacketTypeRequest, StatusR12, pkt.ChannelId, ErrorResponse(ErrUnknownChannel.(*Error)).Data()
+	if m.Role == RoleServer {
+		rst.Type = PacketTypeResponse
+	}
+	//在读循环中调用，写队列满时不等待
+	if err := m.enqueuePacket(rst, 0, nil); err != nil {
+		rst.Release()
+		log.Warnf("reset unknown channel %d of %s fail, %s", pkt.ChannelId, m.key, err.Error())
+	}
+}
+
+//收到不存在的channel的帧数
+func (m *Server) UnknownChannelFrames() int64 {
+	return atomic.LoadInt64(&m.unknownChannelFrames)
+}
+
+//收到不存在的channel的帧数
+func (m *Client) UnknownChannelFrames() int64 {
+	return atomic.LoadInt64(&m.unknownChannelFrames)
+}
+
+//收到对端的重置帧，在读循环中调用：立即移除channel，保证其后到达的同id的帧属于新的channel，
+//重置帧随后交给handle循环，唤醒等待中的请求并关闭channel
+func (m *Channel) peerReset(pkt *Packet) {
+	m.conn.removeChannel(m)
+	//handle循环可能正阻塞在handler中，重置帧要等handler返回才被处理，先取消handler的ctx
+	m.cancelRequest()
+	m.conn.enqueue(m, pkt)
+}
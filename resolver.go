@@ -0,0 +1,146 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//服务端地址解析：Resolver持续提供服务端地址的全量列表，client据此建立、排空连接；
+//内置静态地址及DNS两种实现，基于etcd等注册中心的实现见iipetcd
+package iip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+//服务端地址解析器。Watch启动解析，地址列表变化时以全量地址(ip:port，可以带有scheme，见transport.go)调用update，直至ctx结束；
+//Watch本身不应阻塞，启动失败时返回错误
+type Resolver interface {
+	Watch(ctx context.Context, update func(addrs []string)) error
+}
+
+type staticResolver []string
+
+//固定地址列表
+func NewStaticResolver(addrs []string) Resolver {
+	return staticResolver(addrs)
+}
+
+func (m staticResolver) Watch(ctx context.Context, update func(addrs []string)) error {
+	update(append([]string(nil), m...))
+	return nil
+}
+
+type dnsResolver struct {
+	targets  []string
+	interval time.Duration
+	timeout  time.Duration
+}
+
+//将targets([scheme://]host:port)中的主机名解析为全部IPv4地址，每interval重新解析一次，默认30秒。
+//某个主机名解析失败时沿用其上一次的结果
+func NewDNSResolver(targets []string, interval time.Duration) Resolver {
+	if interval <= 0 {
+		interval = time.Second * 30
+	}
+	return &dnsResolver{targets: targets, interval: interval, timeout: time.Second * 5}
+}
+
+func (m *dnsResolver) Watch(ctx context.Context, update func(addrs []string)) error {
+	for _, target := range m.targets {
+		if _, _, err := net.SplitHostPort(stripScheme(target)); err != nil {
+			return err
+		}
+	}
+	go func() {
+		resolved := make(map[string][]string, len(m.targets))
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			update(m.resolve(ctx, resolved))
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (m *dnsResolver) resolve(ctx context.Context, resolved map[string][]string) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, target := range m.targets {
+		tctx, cancel := context.WithTimeout(ctx, m.timeout)
+		addrs, err := resolveTarget(tctx, target)
+		cancel()
+		if err != nil {
+			log.Warnf("resolve %s fail, %s", target, err.Error())
+			addrs = resolved[target]
+		}
+		resolved[target] = addrs
+		for _, v := range addrs {
+			if !seen[v] {
+				seen[v] = true
+				ret = append(ret, v)
+			}
+		}
+	}
+	return ret
+}
+
+//解析结果保留target的scheme，见transport.go
+func resolveTarget(ctx context.Context, target string) ([]string, error) {
+	scheme, hostport := splitScheme(target)
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return []string{target}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			addr := net.JoinHostPort(ip.IP.String(), port)
+			if scheme != "" {
+				addr = scheme + "://" + addr
+			}
+			ret = append(ret, addr)
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no ipv4 address for %s", host)
+	}
+	return ret, nil
+}
+
+func stripScheme(addr string) string {
+	_, ret := splitScheme(addr)
+	return ret
+}
+
+//NewClient的serverAddr对应的解析器：逗号分隔的多个地址，含主机名时使用DNS解析
+func serverAddrResolver(serverAddr string, interval time.Duration) Resolver {
+	var targets []string
+	dynamic := false
+	for _, v := range strings.Split(serverAddr, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		targets = append(targets, v)
+		if host, _, err := net.SplitHostPort(stripScheme(v)); err == nil && host != "" && net.ParseIP(host) == nil {
+			dynamic = true
+		}
+	}
+	if dynamic {
+		return NewDNSResolver(targets, interval)
+	}
+	return NewStaticResolver(targets)
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//流式响应：handler通过ResponseWriter逐段写出响应，数据每积累到一帧(MaxPacketSize)或者调用Flush时即以S4/S6帧发送，
+//handler返回后以S5/S7帧结束响应，server无需在内存中持有完整的响应。client仍按原有方式接收(DoRequest得到完整响应，
+//DoStreamRequest的handler逐帧收到数据)，对client透明；client也可以以DoRequestReader边收边读(见responsereader.go)。
+//协商FeatureTrailer之后，handler可以先发送初始响应(如"accepted")，处理完成后在结束帧上附加trailer(如最终状态)，
+//client通过WithTrailer取得。同一channel上的响应不能交错，开启worker时应同时开启ChannelOrdered
+package iip
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const ctxWriterRequest = "/ctx/sys/writer_request"
+
+//流式响应的写入器
+type ResponseWriter interface {
+	io.Writer
+	//发送已写入的数据。对端不支持FeatureTrailer时响应的结束帧不能为空，最后写入的1个字节保留到下一次发送或响应结束时
+	Flush() error
+	//设置trailer，随响应的结束帧发送，须协商FeatureMetadata及FeatureTrailer，否则被忽略
+	SetTrailer(key, value string)
+}
+
+//流式响应的处理函数，请求数据接收完整后调用一次，返回后响应结束。
+//尚未发送任何数据时返回错误，错误作为错误响应返回给client；已经发送了部分响应时返回错误，channel被重置(见reset.go)
+type ResponseWriterFunc func(c *Channel, path string, request []byte, w ResponseWriter) error
+
+//以io.Reader提供响应数据的处理函数，读到io.EOF时响应结束，reader实现了io.Closer时在结束后被关闭
+type ResponseReaderFunc func(c *Channel, path string, request []byte) (io.Reader, error)
+
+//将流式响应的处理函数适配为PathHandler
+func NewWriterHandler(fn ResponseWriterFunc) PathHandler {
+	return &writerHandler{fn: fn}
+}
+
+//将以io.Reader提供响应数据的处理函数适配为PathHandler
+func NewReaderHandler(fn ResponseReaderFunc) PathHandler {
+	return NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		r, err := fn(c, path, request)
+		if err != nil {
+			return err
+		}
+		if closer, ok := r.(io.Closer); ok {
+			defer closer.Close()
+		}
+		_, err = io.CopyBuffer(w, r, make([]byte, int(c.conn.FrameSize())))
+		return err
+	})
+}
+
+type writerHandler struct {
+	fn ResponseWriterFunc
+}
+
+func (m *writerHandler) Handle(c *Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	if buf, ok := c.GetCtxData(ctxWriterRequest).([]byte); ok || !dataCompleted {
+		if exceedsBuffered(len(buf), len(data)) {
+			//未配置MaxRequestSize时的兜底，见sizes.go
+			c.RemoveCtxData(ctxWriterRequest)
+			c.reject(path, ErrRequestTooLarge.(*Error))
+			return nil, ErrPacketContinue
+		}
+		//开启RecycleRequests时data的缓冲区在handler返回后被回收，须拷贝
+		buf = append(buf, data...)
+		if !dataCompleted {
+			c.SetCtxData(ctxWriterRequest, buf)
+			return nil, ErrPacketContinue
+		}
+		c.RemoveCtxData(ctxWriterRequest)
+		data = buf
+	}
+	w := &responseWriter{c: c, path: path}
+	if err := m.fn(c, path, data, w); err != nil {
+		if !w.started {
+			return nil, err
+		}
+		//响应已部分发送，重置channel使client的请求以错误结束
+		c.reset(path, &Error{Code: -1, Message: "response aborted, " + err.Error()})
+		return nil, ErrResponseSent
+	}
+	if !w.started && len(w.buf) == 0 && !c.conn.HasFeature(FeatureEmptyData) {
+		return nil, ErrHandleNoResponse
+	}
+	if err := w.send(w.buf, true); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.streamedBytes, w.written)
+	return nil, ErrResponseSent
+}
+
+type responseWriter struct {
+	c       *Channel
+	path    string
+	buf     []byte
+	started bool //已发送首帧
+	written int64
+	trailer map[string]string
+}
+
+func (m *responseWriter) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	frameSize := int(m.c.conn.FrameSize())
+	//保留至少1个字节作为结束帧，见Flush
+	for len(m.buf) > frameSize {
+		if err := m.send(m.buf[:frameSize], false); err != nil {
+			m.buf = m.buf[:0]
+			return 0, err
+		}
+		m.buf = append(m.buf[:0], m.buf[frameSize:]...)
+	}
+	return len(p), nil
+}
+
+func (m *responseWriter) Flush() error {
+	n := len(m.buf)
+	if !m.c.conn.HasFeature(FeatureTrailer) {
+		n--
+	}
+	if n <= 0 {
+		return nil
+	}
+	if err := m.send(m.buf[:n], false); err != nil {
+		return err
+	}
+	m.buf = append(m.buf[:0], m.buf[n:]...)
+	return nil
+}
+
+func (m *responseWriter) SetTrailer(key, value string) {
+	if m.trailer == nil {
+		m.trailer = make(map[string]string)
+	}
+	m.trailer[key] = value
+}
+
+func (m *responseWriter) send(data []byte, final bool) error {
+	if err := m.c.errClosed(); err != nil {
+		return err
+	}
+	if m.c.SendClosed() {
+		return ErrSendClosed
+	}
+	pkt := acquirePacket()
+	pkt.Type, pkt.Path, pkt.ChannelId, pkt.channel = PacketTypeResponse, m.path, m.c.Id, m.c
+	if final && m.c.conn.HasFeature(FeatureTrailer) {
+		if err := checkMeta(m.trailer); err != nil {
+			pkt.Release()
+			return err
+		}
+		pkt.Meta = m.trailer
+	}
+	switch {
+	case !m.started && final:
+		pkt.Status = StatusS5
+	case !m.started:
+		pkt.Status = StatusS4
+	case final:
+		pkt.Status = StatusS7
+	default:
+		pkt.Status = StatusS6
+	}
+	//写出之前data可能被后续的Write覆盖，须拷贝
+	pkt.buf = getBuffer(len(data))
+	copy(pkt.buf, data)
+	pkt.Data = pkt.buf
+	atomic.StoreInt64(&m.c.lastActive, time.Now().UnixNano())
+	m.c.sendLock.Lock()
+	err := m.c.conn.enqueuePacket(pkt, -1, nil)
+	if err == nil && final {
+		atomic.AddInt64(&m.c.WritePacketCount, 1)
+	}
+	m.c.sendLock.Unlock()
+	if err != nil {
+		pkt.Release()
+		return err
+	}
+	m.started = true
+	m.written += int64(len(data))
+	return nil
+}
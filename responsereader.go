@@ -0,0 +1,190 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//流式接收响应：DoRequestReader发出的请求，其响应的各帧由处理循环依次交给调用者，不在内存中合并，
+//与server端的流式响应(见response.go)配合，网关、代理可以边收边转发大的响应。
+//调用者读取缓慢时处理循环等待，接收队列随之积压，由此对server形成背压
+package iip
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+//流式接收的请求交给调用者的帧的缓冲数
+const responseFrameQueueLen = 4
+
+//流式接收的响应，见ClientChannel.DoRequestReader
+type ResponseReader struct {
+	ctx       context.Context
+	conn      *Connection
+	p         *pendingRequest
+	pkt       *Packet //当前帧，data为其中未读取的部分
+	data      []byte
+	last      bool //已收到响应的最后一帧
+	err       error
+	trailer   map[string]string
+	closeOnce sync.Once
+}
+
+//发送请求并流式接收响应：响应的首帧到达之后返回，之后通过ResponseReader的Read逐帧读取数据，每次Read最多返回一帧的数据。
+//handler返回的错误、超时、channel的关闭在首帧之前发生时由DoRequestReader返回，之后发生时由Read返回。
+//读取结束(包括出错)后须调用ResponseReader.Close。ctx中的请求元数据随请求首帧发出，不经过client的拦截器
+func (m *ClientChannel) DoRequestReader(ctx context.Context, path string, requestData []byte) (*ResponseReader, error) {
+	c := m.internalChannel
+	if err := c.errClosed(); err != nil {
+		return nil, err
+	}
+	p := &pendingRequest{ch: make(chan pendingResult, 1), frames: make(chan *Packet, responseFrameQueueLen), abandon: make(chan struct{})}
+	p.deadline, _ = ctx.Deadline()
+	pkt := &Packet{
+		Type:      PacketTypeRequest,
+		Path:      path,
+		ChannelId: c.Id,
+		Data:      requestData,
+		Meta:      RequestMetaFromContext(ctx),
+		channel:   c,
+	}
+	if err := c.sendRequest(p, pkt, sendTimeout(p.deadline)); err != nil {
+		p.complete(nil, err)
+		return nil, err
+	}
+	ret := &ResponseReader{ctx: ctx, conn: c.conn, p: p}
+	//等待首帧，调用者在写出数据之前即可得知错误
+	ret.next()
+	if ret.err != nil {
+		ret.Close()
+		return nil, ret.err
+	}
+	return ret, nil
+}
+
+//读取响应数据，响应结束时返回io.EOF
+func (m *ResponseReader) Read(p []byte) (int, error) {
+	for len(m.data) == 0 {
+		if m.err != nil {
+			return 0, m.err
+		}
+		if m.last {
+			return 0, io.EOF
+		}
+		m.next()
+	}
+	n := copy(p, m.data)
+	m.data = m.data[n:]
+	return n, nil
+}
+
+//响应结束帧携带的trailer，读到io.EOF之后有效，对端不支持FeatureTrailer或者没有设置trailer时为nil
+func (m *ResponseReader) Trailer() map[string]string {
+	return m.trailer
+}
+
+//结束读取，未读取的响应被丢弃，之后到达的帧由处理循环丢弃
+func (m *ResponseReader) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.p.abandon)
+		m.p.complete(nil, context.Canceled)
+		if m.pkt != nil {
+			m.pkt.Release()
+			m.pkt, m.data = nil, nil
+		}
+		for {
+			select {
+			case pkt := <-m.p.frames:
+				pkt.Release()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+//等待下一帧或者请求的失败
+func (m *ResponseReader) next() {
+	select {
+	case pkt := <-m.p.frames:
+		m.frame(pkt)
+	case ret := <-m.p.ch:
+		if ret.err != nil {
+			m.err = ret.err
+			return
+		}
+		//首帧到达之前登记的请求被当作普通请求交付了完整的响应
+		m.frame(ret.resp)
+	case <-m.ctx.Done():
+		err := m.ctx.Err()
+		if err == context.DeadlineExceeded {
+			err = ErrRequestTimeout
+		}
+		m.p.complete(nil, err)
+		m.err = err
+	}
+}
+
+func (m *ResponseReader) frame(pkt *Packet) {
+	if m.pkt != nil {
+		m.pkt.Release()
+		m.pkt = nil
+	}
+	if pkt.Status == StatusS11 || pkt.Status == StatusR12 {
+		m.err = decodeErrorFrame(pkt.Data)
+		pkt.Release()
+		return
+	}
+	m.pkt, m.data = pkt, pkt.Data
+	if isServerStatusCompleted(pkt.Status) {
+		m.last = true
+		if m.conn.HasFeature(FeatureTrailer) {
+			m.trailer = pkt.Meta
+		}
+	}
+}
+
+//处理循环收到响应的首帧时，表中对应的流式接收的请求，对应的请求不是流式接收时返回nil
+func (m *Channel) streamingPending(pkt *Packet) *pendingRequest {
+	seq := pkt.Meta[MetaRequestSeq]
+	m.pending.Lock()
+	defer m.pending.Unlock()
+	for _, v := range m.pending.queue {
+		if seq == "" || v.seq == seq {
+			if v.frames != nil {
+				return v
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+//处理循环将流式接收的响应帧交给调用者，last为响应的最后一帧，此时请求从表中移除。
+//请求已超时、被取消或者调用者不再读取时丢弃该帧；channel关闭时返回false
+func (m *Channel) deliverFrame(p *pendingRequest, pkt *Packet, last bool) bool {
+	if last {
+		claimed := atomic.CompareAndSwapInt32(&p.done, 0, 1)
+		if claimed && p.timer != nil {
+			p.timer.Stop()
+		}
+		m.dropPending(p)
+		if !claimed {
+			pkt.Release()
+			return true
+		}
+	} else if p.completed() {
+		pkt.Release()
+		return true
+	}
+	select {
+	case p.frames <- pkt:
+	case <-p.abandon:
+		pkt.Release()
+	case <-m.closeNotify:
+		pkt.Release()
+		return false
+	}
+	return true
+}
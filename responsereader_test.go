@@ -0,0 +1,155 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+//注册/test/chunks：以chunks个frameSize字节的帧逐段写出响应，每写出一帧之后等待next；/test/error：返回错误
+func newReaderTestServer(t *testing.T, chunks int, next chan struct{}) string {
+	t.Helper()
+	server, addr := newTestServer(t, ServerConfig{})
+	err := server.RegisterHandler("/test/chunks", NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		for i := 0; i < chunks; i++ {
+			if _, err := w.Write(bytes.Repeat([]byte{byte('a' + i)}, 1024)); err != nil {
+				return err
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if next != nil {
+				<-next
+			}
+		}
+		w.SetTrailer("status", "done")
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.RegisterHandler("/test/error", NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		return ErrRateLimited
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+//响应的各帧在handler写出时即可读取，不等待响应结束
+func TestResponseReaderStreams(t *testing.T) {
+	next := make(chan struct{})
+	addr := newReaderTestServer(t, 3, next)
+	client := newTestClient(t, addr, ClientConfig{})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	resp, err := channel.DoRequestReader(ctx, "/test/chunks", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Close()
+	var got []byte
+	buf := make([]byte, 4096)
+	for i := 0; ; i++ {
+		n, err := resp.Read(buf)
+		got = append(got, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		//handler在读到这一段之后才继续写出
+		if len(got)%1024 == 0 && len(got)/1024 <= 3 {
+			next <- struct{}{}
+		}
+	}
+	want := append(append(bytes.Repeat([]byte("a"), 1024), bytes.Repeat([]byte("b"), 1024)...), bytes.Repeat([]byte("c"), 1024)...)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("response: %d bytes, expected %d", len(got), len(want))
+	}
+	if resp.Trailer()["status"] != "done" {
+		t.Fatalf("trailer: %v", resp.Trailer())
+	}
+	//之后的请求仍以普通方式接收
+	if ret, err := channel.DoRequest(testEchoPath, []byte("after"), time.Second*5); err != nil || string(ret) != "after" {
+		t.Fatalf("request after streamed response: %q, %v", ret, err)
+	}
+}
+
+func TestResponseReaderError(t *testing.T) {
+	addr := newReaderTestServer(t, 1, nil)
+	client := newTestClient(t, addr, ClientConfig{})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := channel.DoRequestReader(ctx, "/test/error", []byte("x")); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected rate limited error, got %v", err)
+	}
+	if ret, err := channel.DoRequest(testEchoPath, []byte("after"), time.Second*5); err != nil || string(ret) != "after" {
+		t.Fatalf("request after error: %q, %v", ret, err)
+	}
+}
+
+//读取中途关闭，余下的帧被丢弃，不会被之后的请求收到
+func TestResponseReaderCloseEarly(t *testing.T) {
+	next := make(chan struct{})
+	addr := newReaderTestServer(t, 3, next)
+	client := newTestClient(t, addr, ClientConfig{})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := channel.DoRequestReader(context.Background(), "/test/chunks", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Close()
+	next <- struct{}{}
+	next <- struct{}{}
+	next <- struct{}{}
+	if ret, err := channel.DoRequest(testEchoPath, []byte("after"), time.Second*5); err != nil || string(ret) != "after" {
+		t.Fatalf("request after closed reader: %q, %v", ret, err)
+	}
+}
+
+func TestResponseReaderTimeout(t *testing.T) {
+	next := make(chan struct{})
+	addr := newReaderTestServer(t, 2, next)
+	client := newTestClient(t, addr, ClientConfig{})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	resp, err := channel.DoRequestReader(ctx, "/test/chunks", []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Close()
+	buf := make([]byte, 4096)
+	if n, err := resp.Read(buf); n != 1024 || err != nil {
+		t.Fatalf("first read: %d, %v", n, err)
+	}
+	//handler等待next，第二帧在截止时间之前不会到达
+	if _, err := resp.Read(buf); !errors.Is(err, ErrRequestTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	close(next)
+}
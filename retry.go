@@ -0,0 +1,120 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//client请求重试：对配置为幂等的path，请求因可重试的错误失败时按指数退避重试。
+//原channel已失效(连接断开)或者可能还会收到迟到的响应(超时)时，换用从client的channel池中取得的私有channel重试，
+//调用者的ClientChannel不会被替换或关闭，对调用者透明
+package iip
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts     int                  //包括首次请求在内的最大尝试次数，<=1表示不重试
+	PerTryTimeout   time.Duration        //每次尝试的超时，0表示只受调用者ctx的限制
+	InitialBackoff  time.Duration        //首次重试前的等待时间，之后每次翻倍，默认50毫秒
+	MaxBackoff      time.Duration        //重试等待时间的上限，默认1秒
+	IdempotentPaths []string             //允许重试的幂等path，以*结尾时按前缀匹配
+	Retryable       func(err error) bool //判断错误是否可以重试，默认DefaultRetryable
+}
+
+//默认的可重试错误：超时、写队列满、连接或channel失效，以及server返回的限流、连接排空
+func DefaultRetryable(err error) bool {
+	var e *Error
+	if !errors.As(err, &e) {
+		//非*Error的错误来自连接、channel的失效
+		return true
+	}
+	if e.Remote() {
+		return e.Code == ErrRateLimited.(*Error).Code || e.Code == ErrConnDraining.(*Error).Code
+	}
+	return errors.Is(err, ErrRequestTimeout) || errors.Is(err, ErrWriteQueueFull) || errors.Is(err, ErrConnDraining) ||
+		errors.Is(err, ErrTooManyChannels) || errors.Is(err, ErrClosed)
+}
+
+func (m *RetryPolicy) idempotent(path string) bool {
+	for _, v := range m.IdempotentPaths {
+		if strings.HasSuffix(v, "*") {
+			if strings.HasPrefix(path, v[:len(v)-1]) {
+				return true
+			}
+		} else if v == path {
+			return true
+		}
+	}
+	return false
+}
+
+//重试拦截器，位于全部拦截器的最外层，每次尝试都经过其后添加的拦截器
+func newRetryInterceptor(policy RetryPolicy) ClientInterceptor {
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = time.Millisecond * 50
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = time.Second
+	}
+	if policy.Retryable == nil {
+		policy.Retryable = DefaultRetryable
+	}
+	return func(ctx context.Context, c *ClientChannel, path string, requestData []byte, invoker RequestInvoker) ([]byte, error) {
+		if policy.MaxAttempts <= 1 || !policy.idempotent(path) {
+			return invoker(ctx, c, path, requestData)
+		}
+		backoff := policy.InitialBackoff
+		pool := c.client.pool
+		ch := c //本次尝试使用的channel，调用者的channel或者从池中取得的私有channel
+		for attempt := 1; ; attempt++ {
+			ret, err := policy.try(ctx, ch, path, requestData, invoker)
+			if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || !policy.Retryable(err) {
+				if ch != c {
+					releaseRetryChannel(pool, ch, err)
+				}
+				return ret, err
+			}
+			log.Warnf("request %s fail, %s, retry %d/%d", path, err.Error(), attempt, policy.MaxAttempts-1)
+			select {
+			case <-ctx.Done():
+				if ch != c {
+					releaseRetryChannel(pool, ch, err)
+				}
+				return nil, err
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+			if ch.internalChannel.isClosed() || errors.Is(err, ErrRequestTimeout) {
+				if ch != c {
+					releaseRetryChannel(pool, ch, err)
+				}
+				var rerr error
+				if ch, rerr = pool.get(); rerr != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+}
+
+//归还重试使用的私有channel：请求失败的channel上可能还会到达迟到的响应，关闭而不放回池中
+func releaseRetryChannel(pool *ChannelPool, c *ClientChannel, err error) {
+	if err != nil {
+		c.Close(err)
+		return
+	}
+	pool.put(c)
+}
+
+func (m *RetryPolicy) try(ctx context.Context, c *ClientChannel, path string, requestData []byte, invoker RequestInvoker) ([]byte, error) {
+	if m.PerTryTimeout <= 0 {
+		return invoker(ctx, c, path, requestData)
+	}
+	tryCtx, cancel := context.WithTimeout(ctx, m.PerTryTimeout)
+	defer cancel()
+	return invoker(tryCtx, c, path, requestData)
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//注册一个handler：前fails次调用执行fail，之后原样返回请求数据。返回调用次数的计数器
+func registerFlakyHandler(t *testing.T, server *Server, path string, fails int32, fail func(c *Channel) error) *int32 {
+	t.Helper()
+	calls := new(int32)
+	err := server.RegisterHandler(path, NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		if atomic.AddInt32(calls, 1) <= fails {
+			if err := fail(c); err != nil {
+				return err
+			}
+		}
+		_, err := w.Write(request)
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return calls
+}
+
+func TestRetryRemoteRateLimited(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{})
+	calls := registerFlakyHandler(t, server, "/retry/limited", 2, func(*Channel) error { return ErrRateLimited })
+	client := newTestClient(t, addr, ClientConfig{Retry: &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, IdempotentPaths: []string{"/retry/*"}}})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal := channel.internalChannel
+	ret, err := channel.DoRequest("/retry/limited", []byte("ok"), time.Second*5)
+	if err != nil || string(ret) != "ok" {
+		t.Fatalf("request: %q, %v", ret, err)
+	}
+	if n := atomic.LoadInt32(calls); n != 3 {
+		t.Fatalf("%d attempts, expected 3", n)
+	}
+	//channel仍然可用，重试没有换用其他channel
+	if channel.internalChannel != internal || internal.isClosed() {
+		t.Fatal("caller's channel replaced or closed")
+	}
+}
+
+func TestRetryAttemptsExhausted(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{})
+	calls := registerFlakyHandler(t, server, "/retry/limited", 10, func(*Channel) error { return ErrRateLimited })
+	client := newTestClient(t, addr, ClientConfig{Retry: &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, IdempotentPaths: []string{"/retry/limited"}}})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channel.DoRequest("/retry/limited", []byte("x"), time.Second*5); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected rate limited error, got %v", err)
+	}
+	if n := atomic.LoadInt32(calls); n != 3 {
+		t.Fatalf("%d attempts, expected 3", n)
+	}
+}
+
+func TestRetryOnlyIdempotentPaths(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{})
+	calls := registerFlakyHandler(t, server, "/write", 1, func(*Channel) error { return ErrRateLimited })
+	client := newTestClient(t, addr, ClientConfig{Retry: &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, IdempotentPaths: []string{"/read*"}}})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channel.DoRequest("/write", []byte("x"), time.Second*5); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected rate limited error, got %v", err)
+	}
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Fatalf("non-idempotent path attempted %d times", n)
+	}
+}
+
+//超时的尝试之后换用池中的私有channel重试，调用者的channel不被替换或关闭，迟到的响应不会被之后的请求收到
+func TestRetryAfterTimeoutKeepsCallerChannel(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{})
+	release := make(chan struct{})
+	var slowChannel atomic.Value
+	calls := registerFlakyHandler(t, server, "/retry/slow", 1, func(c *Channel) error {
+		slowChannel.Store(c.Id)
+		<-release
+		return nil
+	})
+	client := newTestClient(t, addr, ClientConfig{Retry: &RetryPolicy{MaxAttempts: 2, PerTryTimeout: time.Millisecond * 100,
+		InitialBackoff: time.Millisecond, IdempotentPaths: []string{"/retry/*"}}})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	internal := channel.internalChannel
+	ret, err := channel.DoRequestContext(context.Background(), "/retry/slow", []byte("first"))
+	if err != nil || string(ret) != "first" {
+		t.Fatalf("request: %q, %v", ret, err)
+	}
+	if n := atomic.LoadInt32(calls); n != 2 {
+		t.Fatalf("%d attempts, expected 2", n)
+	}
+	if channel.internalChannel != internal {
+		t.Fatal("caller's channel replaced")
+	}
+	if id, _ := slowChannel.Load().(uint32); id != internal.Id {
+		t.Fatalf("first attempt on channel %d, caller's channel is %d", id, internal.Id)
+	}
+	//成功的私有channel放回池中
+	if n := len(client.pool.idle); n != 1 {
+		t.Fatalf("%d idle pool channels after retry", n)
+	}
+	//首次尝试迟到的响应被丢弃，调用者的channel之后的请求收到自己的响应
+	close(release)
+	waitFor(t, "late response", func() bool {
+		internal.pending.Lock()
+		defer internal.pending.Unlock()
+		return len(internal.pending.queue) == 0
+	})
+	if ret, err := channel.DoRequest("/retry/slow", []byte("second"), time.Second*5); err != nil || string(ret) != "second" {
+		t.Fatalf("request after retry: %q, %v", ret, err)
+	}
+}
+
+//并发的请求在同一client上重试，不会相互替换channel(以-race运行)
+func TestRetryConcurrentChannels(t *testing.T) {
+	server, addr := newTestServer(t, ServerConfig{})
+	registerFlakyHandler(t, server, "/retry/limited", 8, func(*Channel) error { return ErrRateLimited })
+	client := newTestClient(t, addr, ClientConfig{Retry: &RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Millisecond, IdempotentPaths: []string{"/retry/*"}}})
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		go func() {
+			_, err := client.Do("/retry/limited", []byte("x"))
+			errs <- err
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
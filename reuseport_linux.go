@@ -0,0 +1,25 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package iip
+
+import (
+	"syscall"
+)
+
+//syscall包未定义SO_REUSEPORT，mips以外的linux平台取值均为15
+const soReusePort = 0xf
+
+//监听socket在bind之前设置SO_REUSEPORT
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,263 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//延时响应调度器：handler可以预约在将来某一时刻向channel所在连接的对端推送数据，
+//适用于直接基于iip构建的提醒、通知类服务。推送经调度器在该连接上打开的推送channel发送(见push.go)，
+//client以RegisterPushHandler注册的handler处理，不会被当作channel上请求的响应；发起预约的channel关闭不影响推送，连接关闭时任务被丢弃
+package iip
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//预约的推送任务
+type ScheduledTask struct {
+	Id         string    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	ChannelId  uint32    `json:"channel_id"`
+	Path       string    `json:"path"`
+	Data       []byte    `json:"data"`
+	At         time.Time `json:"at"`
+	channel    *Channel
+	timer      *time.Timer
+}
+
+//预约任务的持久化接口，可选
+type ScheduleStore interface {
+	Save(task *ScheduledTask) error
+	Delete(id string) error
+	Load() ([]*ScheduledTask, error)
+}
+
+type Scheduler struct {
+	store ScheduleStore
+	tasks map[string]*ScheduledTask
+	push  map[*Connection]*Channel //各连接上发送推送的推送channel，首次推送时打开
+	seq   uint64
+	lock  sync.Mutex
+}
+
+//创建调度器，store为nil表示不持久化
+func NewScheduler(store ScheduleStore) *Scheduler {
+	return &Scheduler{store: store, tasks: make(map[string]*ScheduledTask), push: make(map[*Connection]*Channel)}
+}
+
+//预约在at时刻向channel c所在连接的对端推送path/data，data被拷贝，调用之后可以复用，返回任务id
+func (m *Scheduler) Schedule(c *Channel, path string, data []byte, at time.Time) (string, error) {
+	if c == nil || c.conn == nil {
+		return "", fmt.Errorf("invalid channel")
+	}
+	if c.conn.Role != RoleServer {
+		return "", fmt.Errorf("scheduled push can only be sent by server")
+	}
+	if err := c.errClosed(); err != nil {
+		return "", err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.seq++
+	task := &ScheduledTask{
+		Id:         strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(m.seq, 36),
+		RemoteAddr: c.conn.tcpConn.RemoteAddr().String(),
+		ChannelId:  c.Id,
+		Path:       path,
+		Data:       append([]byte(nil), data...), //data可能是handler收到的请求数据，其缓冲区在handler返回后可能被复用
+		At:         at,
+		channel:    c,
+	}
+	if m.store != nil {
+		if err := m.store.Save(task); err != nil {
+			return "", err
+		}
+	}
+	m.tasks[task.Id] = task
+	task.timer = time.AfterFunc(time.Until(at), func() { m.fire(task) })
+	return task.Id, nil
+}
+
+//预约在delay之后推送
+func (m *Scheduler) ScheduleAfter(c *Channel, path string, data []byte, delay time.Duration) (string, error) {
+	return m.Schedule(c, path, data, time.Now().Add(delay))
+}
+
+//取消预约，任务不存在或已经执行返回false
+func (m *Scheduler) Cancel(id string) bool {
+	m.lock.Lock()
+	task, ok := m.tasks[id]
+	if ok {
+		delete(m.tasks, id)
+	}
+	m.lock.Unlock()
+	if !ok {
+		return false
+	}
+	task.timer.Stop()
+	m.deleteStored(id)
+	return true
+}
+
+//停止调度器，未执行的任务仍保留在store中，可以在下次启动时通过Recover取回
+func (m *Scheduler) Stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, task := range m.tasks {
+		task.timer.Stop()
+		delete(m.tasks, id)
+	}
+	for conn, c := range m.push {
+		c.Close(fmt.Errorf("scheduler stopped"))
+		delete(m.push, conn)
+	}
+}
+
+//取回上一个进程持久化的、尚未执行的任务并将其从store中删除。
+//原来的连接已经不存在，由应用决定如何重新投递
+func (m *Scheduler) Recover() ([]*ScheduledTask, error) {
+	if m.store == nil {
+		return nil, nil
+	}
+	tasks, err := m.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range tasks {
+		m.deleteStored(v.Id)
+	}
+	return tasks, nil
+}
+
+//当前等待执行的任务数
+func (m *Scheduler) Pending() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.tasks)
+}
+
+func (m *Scheduler) fire(task *ScheduledTask) {
+	m.lock.Lock()
+	_, ok := m.tasks[task.Id]
+	delete(m.tasks, task.Id)
+	m.lock.Unlock()
+	if !ok {
+		return
+	}
+	m.deleteStored(task.Id)
+	push, err := m.pushChannel(task.channel.conn)
+	if err != nil {
+		log.Errorf("scheduled task %s dropped, connection of channel %d is invalid, %s", task.Id, task.ChannelId, err.Error())
+		return
+	}
+	if err := push.Push(task.Path, task.Data); err != nil {
+		log.Errorf("scheduled task %s send fail, %s", task.Id, err.Error())
+	}
+}
+
+//连接上发送推送的推送channel，没有或者已关闭时新开一个，channel关闭(包括连接关闭)时从m.push中移除
+func (m *Scheduler) pushChannel(conn *Connection) (*Channel, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if c, ok := m.push[conn]; ok && !c.isClosed() {
+		return c, nil
+	}
+	c, err := conn.NewPushChannel()
+	if err != nil {
+		return nil, err
+	}
+	m.push[conn] = c
+	go func() {
+		<-c.Context().Done()
+		m.lock.Lock()
+		if m.push[conn] == c {
+			delete(m.push, conn)
+		}
+		m.lock.Unlock()
+	}()
+	return c, nil
+}
+
+func (m *Scheduler) deleteStored(id string) {
+	if m.store == nil {
+		return
+	}
+	if err := m.store.Delete(id); err != nil {
+		log.Errorf("delete scheduled task %s from store fail, %s", id, err.Error())
+	}
+}
+
+//基于json文件的ScheduleStore实现，每次变更重写整个文件，适用于任务量不大的场景
+type FileScheduleStore struct {
+	fileName string
+	tasks    map[string]*ScheduledTask
+	lock     sync.Mutex
+}
+
+func NewFileScheduleStore(fileName string) (*FileScheduleStore, error) {
+	ret := &FileScheduleStore{fileName: fileName, tasks: make(map[string]*ScheduledTask)}
+	bts, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, err
+	}
+	var tasks []*ScheduledTask
+	if len(bts) > 0 {
+		if err := json.Unmarshal(bts, &tasks); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range tasks {
+		ret.tasks[v.Id] = v
+	}
+	return ret, nil
+}
+
+func (m *FileScheduleStore) Save(task *ScheduledTask) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.tasks[task.Id] = task
+	return m.flush()
+}
+
+func (m *FileScheduleStore) Delete(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.tasks[id]; !ok {
+		return nil
+	}
+	delete(m.tasks, id)
+	return m.flush()
+}
+
+func (m *FileScheduleStore) Load() ([]*ScheduledTask, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make([]*ScheduledTask, 0, len(m.tasks))
+	for _, v := range m.tasks {
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+func (m *FileScheduleStore) flush() error {
+	tasks := make([]*ScheduledTask, 0, len(m.tasks))
+	for _, v := range m.tasks {
+		tasks = append(tasks, v)
+	}
+	bts, err := json.Marshal(tasks)
+	if err != nil {
+		return err
+	}
+	tmp := m.fileName + ".tmp"
+	if err := ioutil.WriteFile(tmp, bts, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.fileName)
+}
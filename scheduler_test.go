@@ -0,0 +1,118 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"testing"
+	"time"
+)
+
+//client端记录收到的推送
+type pushRecorder chan string
+
+func (m pushRecorder) Handle(c *Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	if dataCompleted {
+		m <- string(data)
+	}
+	return nil, nil
+}
+
+//注册/test/schedule：预约在delay之后以/test/remind推送请求数据
+func newSchedulerTestServer(t *testing.T, delay time.Duration) (*Server, *Scheduler, string) {
+	t.Helper()
+	server, addr := newTestServer(t, ServerConfig{})
+	scheduler := NewScheduler(nil)
+	t.Cleanup(scheduler.Stop)
+	err := server.RegisterHandler("/test/schedule", NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		if _, err := scheduler.ScheduleAfter(c, "/test/remind", request, delay); err != nil {
+			return err
+		}
+		_, err := w.Write([]byte("scheduled"))
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.RegisterHandler("/test/slow", NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		time.Sleep(delay * 4)
+		_, err := w.Write(request)
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, scheduler, addr
+}
+
+//预约的推送在请求等待响应期间到达，交给推送handler，不会被当作请求的响应
+func TestScheduledPushDoesNotHijackRequest(t *testing.T) {
+	_, scheduler, addr := newSchedulerTestServer(t, time.Millisecond*50)
+	client := newTestClient(t, addr, ClientConfig{})
+	pushes := make(pushRecorder, 4)
+	if err := client.RegisterPushHandler("/test/remind", pushes); err != nil {
+		t.Fatal(err)
+	}
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret, err := channel.DoRequest("/test/schedule", []byte("remind me"), time.Second*5); err != nil || string(ret) != "scheduled" {
+		t.Fatalf("schedule: %q, %v", ret, err)
+	}
+	//推送在/test/slow处理期间到达
+	if ret, err := channel.DoRequest("/test/slow", []byte("slow"), time.Second*5); err != nil || string(ret) != "slow" {
+		t.Fatalf("request while push fired: %q, %v", ret, err)
+	}
+	select {
+	case s := <-pushes:
+		if s != "remind me" {
+			t.Fatalf("push: %q", s)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("scheduled push not received")
+	}
+	if n := scheduler.Pending(); n != 0 {
+		t.Fatalf("%d pending tasks", n)
+	}
+}
+
+//同一连接上的推送共用一个推送channel，发起预约的channel关闭不影响推送，连接关闭时推送channel被移除
+func TestScheduledPushChannelPerConnection(t *testing.T) {
+	server, scheduler, addr := newSchedulerTestServer(t, time.Millisecond*20)
+	client := newTestClient(t, addr, ClientConfig{})
+	pushes := make(pushRecorder, 4)
+	if err := client.RegisterPushHandler("/test/remind", pushes); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a", "b"} {
+		channel, err := client.NewChannel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := channel.DoRequest("/test/schedule", []byte(s), time.Second*5); err != nil {
+			t.Fatal(err)
+		}
+		channel.Close(nil)
+		select {
+		case got := <-pushes:
+			if got != s {
+				t.Fatalf("push: %q, expected %q", got, s)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("push %q not received", s)
+		}
+	}
+	//只剩推送channel
+	waitFor(t, "request channels closed", func() bool {
+		stats := server.ConnectionsSnapshot()
+		return len(stats) == 1 && stats[0].Channels == 1
+	})
+	client.Close()
+	waitFor(t, "push channel removed", func() bool {
+		scheduler.lock.Lock()
+		defer scheduler.lock.Unlock()
+		return len(scheduler.push) == 0
+	})
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//帧序号：client配置SequenceCheck后在握手时协商FeatureSequence，此后每一帧在channel id之后携带4字节帧序号，
+//由写循环按channel id从0开始递增，接收方的读循环逐帧校验，发现乱序、重复或者丢帧时立即记录日志并关闭连接，
+//用于尽早发现中间代理或者新的传输层引入的顺序问题。
+//序号按channel id而不是按channel对象计数，在连接的整个生命周期中延续：channel关闭后id被复用时，
+//旧channel尚未写出的帧与新channel的帧在同一个id的写队列中先后写出，序号仍然连续，不会误报。
+//帧序号在校验和及PSK加密的认证范围之内
+package iip
+
+import "sync/atomic"
+
+//client握手时提议的特性，配置SequenceCheck时才提议帧序号
+func (m *Client) handshakeFeatures() uint32 {
+	if m.config.SequenceCheck {
+		return handshakeFeatures
+	}
+	return handshakeFeatures &^ FeatureSequence
+}
+
+//在写循环中为写出的帧分配序号
+func (m *Connection) nextSequence(pkt *Packet) {
+	if m.writeSeq == nil {
+		m.writeSeq = make(map[uint32]uint32)
+	}
+	pkt.Seq = m.writeSeq[pkt.ChannelId]
+	m.writeSeq[pkt.ChannelId] = pkt.Seq + 1
+}
+
+//在读循环中校验读入帧的序号，包括随后被丢弃的帧
+func (m *Connection) checkSequence(pkt *Packet) error {
+	if m.readSeq == nil {
+		m.readSeq = make(map[uint32]uint32)
+	}
+	expected := m.readSeq[pkt.ChannelId]
+	if pkt.Seq == expected {
+		m.readSeq[pkt.ChannelId] = expected + 1
+		return nil
+	}
+	if svr := m.server; svr != nil {
+		atomic.AddInt64(&svr.seqErrors, 1)
+	} else if client := m.client; client != nil {
+		atomic.AddInt64(&client.seqErrors, 1)
+	}
+	err := protocolError("frame sequence mismatch, channel id: %d, path: %s, expected: %d, got: %d", pkt.ChannelId, pkt.Path, expected, pkt.Seq)
+	log.Errorf("connection %s %s", m.key, err.Error())
+	return err
+}
+
+//帧序号校验失败而关闭的连接数
+func (m *Server) SequenceErrors() int64 {
+	return atomic.LoadInt64(&m.seqErrors)
+}
+
+//帧序号校验失败而关闭的连接数
+func (m *Client) SequenceErrors() int64 {
+	return atomic.LoadInt64(&m.seqErrors)
+}
@@ -6,48 +6,169 @@
 package iip
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ServerConfig struct {
-	MaxConnections        int
-	MaxChannelsPerConn    int
+	MaxConnections        int //最大并发连接数，达到上限后暂停accept直至有连接关闭，0表示不限制
+	MaxChannelsPerConn    int //每个连接最大channel数(不含0号系统channel)，超出时拒绝新建channel，0表示不限制
 	ChannelPacketQueueLen uint32
 	TcpWriteQueueLen      uint32
-	TcpReadBufferSize     int
-	TcpWriteBufferSize    int
+	TcpReadBufferSize     int                //accept的TCP连接的内核socket读缓冲区大小，0表示使用系统默认值
+	TcpWriteBufferSize    int                //accept的TCP连接的内核socket写缓冲区大小，0表示使用系统默认值
+	TcpKeepAlive          time.Duration      //accept的TCP连接的keepalive间隔，0表示使用系统默认值(15秒)，负数表示关闭
+	TcpDelay              bool               //开启Nagle算法(关闭TCP_NODELAY)，小帧合并发送以提高吞吐，默认关闭即小帧立即发送
+	TcpLinger             time.Duration      //关闭连接时的SO_LINGER，0表示使用系统默认值(在后台发送剩余数据)，负数表示丢弃未发送的数据并发送RST
+	MaxPacketSize         uint32             //packet最大字节数，0表示使用默认值MaxPacketSize，握手时与client协商取较小值
+	MaxPathLen            uint32             //path最大字节数，0表示使用默认值MaxPathLen，握手时与client协商取较小值
+	FrameSize             uint32             //发送时每帧数据的最大字节数，0表示与MaxPacketSize相同，握手时与client协商取较小值
+	Checksum              byte               //帧校验算法，client在握手时未要求校验的情况下使用该算法
+	Codec                 Codec              //RegisterTyped注册的处理函数使用的编解码器，默认JSONCodec
+	ConnRequestRate       float64            //每个连接每秒请求数上限，0表示不限制
+	ConnByteRate          float64            //每个连接每秒读入字节数上限，超出时暂停读取该连接，0表示不限制
+	PathRequestRate       map[string]float64 //按path的每秒请求数上限，server范围
+	RateLimitBackpressure bool               //连接请求数超限时暂停读取该连接，而不是返回ErrRateLimited
+	Authenticator         Authenticator      //连接认证器，配置后client须在握手中通过认证，租户在认证之后绑定
+	TLSConfig             *tls.Config        //非nil时连接使用TLS，要求并验证client证书即为双向认证，在监听时确定，见tls.go
+	CertAuthorizer        CertAuthorizer     //按验证通过的client证书授权并确定连接的身份，配置后client须提供证书
+	PSK                   []byte             //预共享密钥，配置后只接受持有相同PSK的client，连接以PSKCipher加密，见psk.go
+	PSKCipher             PSKCipher          //PSK加密的算法，nil为AES-256-GCM，client须使用相同的算法
+	ChannelIdleTimeout    time.Duration      //channel空闲超时，超时的channel被关闭并回收，0表示不检查
+	ChannelCloseLinger    time.Duration      //channel关闭后的逗留期，期间该channel的帧被静默丢弃，也是等待对端关闭确认的上限，0为5秒，负数表示不逗留，见closeack.go
+	IdleTimeout           time.Duration      //连接空闲超时，超时没有收发任何帧的连接被关闭，0表示不检查
+	FrameReadTimeout      time.Duration      //读取一帧的时限，从收到帧的首字节开始计时，超时未读完整帧时关闭连接，0表示不限制，见readtimeout.go
+	FirstFrameTimeout     time.Duration      //连接建立后读完首帧(握手)的时限，TLS握手也计在内，超时关闭连接，0表示不限制
+	MinReadBytes          int                //读取帧的过程中每MinReadInterval至少读入的字节数，不足时关闭连接，用于防止慢速攻击，0表示不检查
+	MinReadInterval       time.Duration      //MinReadBytes的统计间隔，默认1秒
+	MaxConnectionAge      time.Duration      //连接最大存活时间，超过后连接被排空并关闭，0表示不限制
+	MaxConnectionAgeGrace time.Duration      //连接排空的宽限期，超过后强制关闭，默认30秒
+	SysEndpoints          bool               //开启/sys/stats、/sys/channels管理路径，默认关闭
+	HealthCheck           func() error       //应答/sys/health时调用，返回错误时报告not_serving，nil表示总是serving
+	AccessLog             AccessLogger       //请求处理完成后调用，nil表示不记录，见accesslog.go
+	SlowRequestThreshold  time.Duration      //耗时超过该值的请求以Warn级别记录日志，0表示不记录，见pathstats.go
+	Workers               int                //处理请求的worker数，0表示在各channel的处理goroutine中处理，见workerpool.go
+	WorkerQueueLen        int                //worker队列长度，默认等于Workers
+	ChannelOrdered        bool               //开启worker时，同一channel上的请求逐个处理，响应与请求的顺序一致
+	EventLoops            int                //事件循环模式的共享处理goroutine数，大于0时channel不再各自占用处理goroutine，见eventloop.go
+	RecycleRequests       bool               //handler返回后回收请求的数据缓冲区，handler不能在返回后继续使用请求数据，默认关闭，见pool.go
+	MaxRequestSize        uint32             //多帧请求合并后的最大字节数，超过时以ErrRequestTooLarge响应并关闭channel，0表示不限制
+	RejectWhenQueueFull   bool               //channel的接收队列(ChannelPacketQueueLen)满时以ErrOverloaded响应并关闭channel，而不是暂停读取整个连接
+	ConnMemoryLimit       int64              //每个连接排队中的数据(写队列、接收队列及合并中的请求)字节数上限，超过时暂停接收新请求，0表示不限制，见membudget.go
+	MemoryLimit           int64              //server全部连接排队中的数据字节数上限，0表示不限制
+	ShedOnMemoryLimit     bool               //超过内存上限时直接以ErrOverloaded拒绝新请求，而不是先暂停读取连接
+	SysAuthorizer         SysAuthorizer      //管理路径的访问控制，nil表示不限制(配置了Authenticator时只有认证通过的连接可以访问)
+	ReusePort             bool               //监听socket设置SO_REUSEPORT(仅linux)，多个进程可以监听同一端口，用于不停机替换server程序
+	Listeners             int                //ReusePort时打开的监听socket数，每个socket一个accept循环，由内核在其间分配新连接，默认1
+	AcceptRate            float64            //每秒accept的连接数上限，超过时暂停accept，0表示不限制，见connfilter.go
+	AcceptBurst           int                //AcceptRate的突发上限，小于AcceptRate时取AcceptRate
+	AllowCIDRs            []string           //只接受这些网段(CIDR或者单个ip)的连接，空表示不限制
+	DenyCIDRs             []string           //拒绝这些网段的连接，优先于AllowCIDRs
+	ConnFilter            ConnFilter         //accept之后、创建连接之前调用，返回false时关闭连接，nil表示不过滤
+	MaxConnectionsPerIP   int                //每个对端ip的最大并发连接数，超出时以ErrTooManyConnections拒绝，0表示不限制，见ipcap.go
+	AssembleRequests      bool               //合并多帧请求，handler只以完整的请求调用一次，大小受MaxRequestSize(为0时为max packet size)限制，见assemble.go
+	PathRules             *PathRules         //path的校验规则，发送及接收请求时检查，nil表示只拒绝含有\0的path，见pathrules.go
+	OnNewChannelRequest   NewChannelPolicy   //client请求新建channel时调用，返回错误时拒绝，nil表示不限制，见channelpolicy.go
+	StreamFrameThreshold  uint32             //注册了FrameConsumer的path，数据不小于该值的帧不分配缓冲区而流式交给consumer，0为64KB，见framestream.go
+	MaxConsecutiveFrames  int                //开启公平分派，各channel之间轮询投递收到的帧，每一轮从一个channel最多投递该帧数，0表示不开启，见readsched.go
+	DispatchQueueLen      int                //公平分派暂存的帧数上限，满时暂停读取连接，默认1024
 }
 
 type Server struct {
+	//以原子操作访问的64位字段放在最前，保证在32位平台上按8字节对齐，见sizes.go
+	pendingBytes         int64 //全部连接排队中的数据字节数的缓存，见PendingBytes
+	pendingBytesTime     int64
+	seqErrors            int64 //帧序号校验失败而关闭的连接数
+	unknownChannelFrames int64 //收到的不存在的channel的帧数，见reset.go
+	rejectedConns        int64 //accept之后被拒绝的连接数，见connfilter.go、ipcap.go
+	oneWay               oneWayCounters
+
 	DefaultErrorHolder
 	DefaultContext
-	config      ServerConfig
+	config      atomic.Value //*ServerConfig，见UpdateConfig
 	listenAddr  string
-	tcpListener net.Listener
+	listeners   []net.Listener
+	listenLock  sync.Mutex
+	stopped     int32
+	draining    int32
 	connections map[string]*Connection //key: remote addr for client
 	connLock    sync.Mutex
+	connCount   int32         //当前连接数，含尚未完成启动的连接
+	connFreed   chan struct{} //连接关闭时通知等待中的accept
 	closeNotify chan int
+	tenants     tenantManager
+	workers     chan func() //worker队列，未开启worker时为nil
+	eventLoop   *eventLoop  //事件循环模式的就绪队列，未开启时为nil
+
+	pendingRejects int32
+	ipConns        map[string]int //按ip的连接数，由connLock保护
+	taps           tapList        //全部连接上的tap，见tap.go
+
+	handler     *serverHandler
+	middlewares []Middleware
+	chain       Handler //handler经过middlewares包装后的结果
+	chainLock   sync.RWMutex
 
-	handler *serverHandler
+	panicHandler   PanicHandler
+	streamHandlers map[string]StreamHandler
+	streamLock     sync.RWMutex
+	frameConsumers map[string]FrameConsumer //见framestream.go
+	consumerLock   sync.RWMutex
+	pathLimiters   atomic.Value //map[string]*tokenBucket，按path的请求速率限制，替换而不修改
+	ipFilter       atomic.Value //*ipFilter，按CIDR的允许、拒绝列表
+	acceptLimiter  *tokenBucket
+	startTime      time.Time
 }
 
-func NewServer(config ServerConfig, listenAddr string) (*Server, error) {
+//handler发生panic时调用，返回的error作为错误响应发给对端
+type PanicHandler func(c *Channel, request *Packet, recovered interface{}) error
+
+//创建server，opts按顺序修改config，见options.go
+func NewServer(config ServerConfig, listenAddr string, opts ...ServerOption) (*Server, error) {
+	for _, opt := range opts {
+		opt.applyServer(&config)
+	}
 	ret := &Server{
-		config:      config,
 		listenAddr:  listenAddr,
 		connections: make(map[string]*Connection),
+		connFreed:   make(chan struct{}, 1),
+		closeNotify: make(chan int),
 		handler:     &serverHandler{pathHandlerManager: &PathHandlerManager{}},
+		startTime:   time.Now(),
+	}
+	ret.handler.sys = newServerSysMux(ret.handler)
+	if err := ret.initConnFilter(&config); err != nil {
+		return nil, err
+	}
+	ret.config.Store(&config)
+	ret.initPathRateLimit()
+	if config.Workers > 0 {
+		ret.startWorkers(config.Workers, config.WorkerQueueLen)
+	}
+	if config.EventLoops > 0 {
+		ret.startEventLoops(config.EventLoops)
 	}
 	return ret, nil
 }
 
-func (m *Server) acceptConn() (*Connection, error) {
+func (m *Server) acceptConn(lsn net.Listener) (*Connection, error) {
 	for {
-		netConn, err := m.tcpListener.Accept()
+		if !m.acquireConnSlot() {
+			return nil, fmt.Errorf("server stopped")
+		}
+		if !m.throttleAccept() {
+			m.releaseConnSlot()
+			return nil, fmt.Errorf("server stopped")
+		}
+		netConn, err := lsn.Accept()
 		if err != nil {
+			m.releaseConnSlot()
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 				time.Sleep(time.Second)
 				continue
@@ -55,73 +176,304 @@ func (m *Server) acceptConn() (*Connection, error) {
 				return nil, err
 			}
 		}
-		tcpConn := netConn.(*net.TCPConn)
-		if conn, err := NewConnection(tcpConn, RoleServer, int(m.config.TcpWriteQueueLen)); err == nil {
-			m.connLock.Lock()
-			m.connections[tcpConn.RemoteAddr().String()] = conn
-			m.connLock.Unlock()
-			conn.SetCtxData(CtxServer, m)
+		if !m.admitConn(netConn) {
+			m.releaseConnSlot()
+			netConn.Close()
+			continue
+		}
+		config := m.getConfig()
+		setTcpOptions(netConn, tcpOptions{
+			keepAlive:   config.TcpKeepAlive,
+			delay:       config.TcpDelay,
+			readBuffer:  config.TcpReadBufferSize,
+			writeBuffer: config.TcpWriteBufferSize,
+			linger:      config.TcpLinger,
+		})
+		if conn, err := m.serveConn(netConn, netConn.RemoteAddr().String()); err == nil {
 			return conn, nil
-		} else {
-			return nil, err
 		}
 	}
 }
 
+//为已建立的网络连接创建server端的connection并启动，调用者须已占用连接数配额
+func (m *Server) serveConn(netConn net.Conn, key string) (*Connection, error) {
+	config := m.getConfig()
+	ip, ok := m.acquireIPSlot(netConn.RemoteAddr())
+	if !ok {
+		m.releaseConnSlot()
+		m.rejectTooManyConns(netConn, ip)
+		return nil, ErrTooManyConnections
+	}
+	conn, err := createConnection(netConn, RoleServer, int(config.TcpWriteQueueLen))
+	if err != nil {
+		m.releaseConnSlot()
+		m.releaseIPSlot(ip)
+		netConn.Close()
+		return nil, err
+	}
+	conn.key, conn.ipSlot = key, ip
+	conn.server = m
+	conn.SetCtxData(CtxServer, m)
+	conn.ownerTaps = &m.taps
+	conn.setLimits(config.MaxPacketSize, config.MaxPathLen)
+	conn.setFrameSize(config.FrameSize)
+	m.initConnRateLimit(conn)
+	conn.setChannelIdleTimeout(config.ChannelIdleTimeout)
+	conn.setCloseLinger(config.ChannelCloseLinger)
+	conn.setFrameReadTimeout(config.FrameReadTimeout)
+	conn.setSlowReadLimits(config.FirstFrameTimeout, config.MinReadBytes, config.MinReadInterval)
+	conn.setLifetime(config.IdleTimeout, config.MaxConnectionAge, config.MaxConnectionAgeGrace)
+	conn.setDispatch(config.MaxConsecutiveFrames, config.DispatchQueueLen)
+	m.connLock.Lock()
+	m.connections[key] = conn
+	m.connLock.Unlock()
+	conn.start()
+	if config.authRequired() {
+		return conn, nil
+	}
+	if err := m.bindTenant(conn); err != nil {
+		log.Errorf("bind tenant fail, %s", err.Error())
+		conn.Close(err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+//并发连接数达到上限时阻塞，不再accept新连接，未处理的连接请求留在内核的backlog中
+func (m *Server) acquireConnSlot() bool {
+	warned := false
+	for !m.tryAcquireConnSlot() {
+		if !warned {
+			log.Warnf("max connections %d reached, pause accepting", m.getConfig().MaxConnections)
+			warned = true
+		}
+		//上限可能被UpdateConfig调高，定期重新检查
+		select {
+		case <-m.connFreed:
+		case <-time.After(time.Second):
+		case <-m.closeNotify:
+			return false
+		}
+	}
+	return true
+}
+
+//不等待地占用一个连接数，达到上限时返回false
+func (m *Server) tryAcquireConnSlot() bool {
+	for {
+		n := atomic.LoadInt32(&m.connCount)
+		if max := m.getConfig().MaxConnections; max > 0 && int(n) >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&m.connCount, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (m *Server) releaseConnSlot() {
+	atomic.AddInt32(&m.connCount, -1)
+	select {
+	case m.connFreed <- struct{}{}:
+	default:
+	}
+}
+
 func (m *Server) removeConn(addr string) {
 	log.Logf("connection: %s disconnected.", addr)
 	m.connLock.Lock()
 	defer m.connLock.Unlock()
+	if conn, ok := m.connections[addr]; ok {
+		m.unbindTenant(conn)
+		m.releaseConnSlot()
+		m.releaseIPSlotLocked(conn.ipSlot)
+	}
 	delete(m.connections, addr)
 }
 
 //listen socket and start server process
 func (m *Server) StartListen() error {
-	lsn, err := net.Listen("tcp4", m.listenAddr)
+	listeners, err := m.listen()
 	if err != nil {
 		return err
 	}
-	m.tcpListener = lsn
-	m.closeNotify = make(chan int)
+	for _, lsn := range listeners {
+		m.Serve(lsn)
+	}
+	return nil
+}
 
-	go func() {
-		for {
-			select {
-			case <-m.closeNotify:
-				return
-			default:
-				if conn, err := m.acceptConn(); err != nil {
-					m.Stop(fmt.Errorf("accept connection fail, %s", err.Error()))
+//在已打开的监听socket上accept，如从父进程继承的socket。server停止时lsn被关闭，配置了TLSConfig时以TLS包装
+func (m *Server) Serve(lsn net.Listener) {
+	lsn = m.tlsListener(lsn)
+	m.listenLock.Lock()
+	m.listeners = append(m.listeners, lsn)
+	m.listenLock.Unlock()
+	go m.acceptLoop(lsn)
+}
+
+func (m *Server) getListeners() []net.Listener {
+	m.listenLock.Lock()
+	defer m.listenLock.Unlock()
+	return append([]net.Listener(nil), m.listeners...)
+}
+
+//当前全部连接
+func (m *Server) connectionList() []*Connection {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	ret := make([]*Connection, 0, len(m.connections))
+	for _, conn := range m.connections {
+		ret = append(ret, conn)
+	}
+	return ret
+}
+
+//打开监听socket，配置了ReusePort时按Listeners打开多个
+func (m *Server) listen() ([]net.Listener, error) {
+	config := m.getConfig()
+	transport, addr, err := lookupTransport(m.listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	if transport != nil {
+		//ReusePort只适用于TCP
+		lsn, err := transport.Listen(addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lsn}, nil
+	}
+	if !config.ReusePort {
+		lsn, err := net.Listen("tcp4", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{lsn}, nil
+	}
+	n := config.Listeners
+	if n <= 0 {
+		n = 1
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	ret := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		lsn, err := lc.Listen(context.Background(), "tcp4", addr)
+		if err != nil {
+			for _, v := range ret {
+				v.Close()
+			}
+			return nil, err
+		}
+		ret = append(ret, lsn)
+	}
+	return ret, nil
+}
+
+func (m *Server) acceptLoop(lsn net.Listener) {
+	for {
+		select {
+		case <-m.closeNotify:
+			return
+		default:
+			if conn, err := m.acceptConn(lsn); err != nil {
+				//Drain关闭了监听socket
+				if atomic.LoadInt32(&m.draining) == 1 {
 					return
-				} else {
-					log.Logf("accepted new connection: %s", conn.tcpConn.RemoteAddr().String())
 				}
+				m.Stop(fmt.Errorf("accept connection fail, %s", err.Error()))
+				return
+			} else {
+				log.Logf("accepted new connection: %s", conn.tcpConn.RemoteAddr().String())
 			}
 		}
-	}()
-
-	return nil
+	}
 }
 
-//stop server
+//stop server，重复调用无效果
 func (m *Server) Stop(err error) {
+	if !atomic.CompareAndSwapInt32(&m.stopped, 0, 1) {
+		return
+	}
 	log.Errorf("server stopped, %s", err.Error())
 	m.SetError(err)
-	m.tcpListener.Close()
+	for _, lsn := range m.getListeners() {
+		lsn.Close()
+	}
 
 	m.connLock.Lock()
 	defer m.connLock.Unlock()
+	//协商了FeatureCloseReason的连接先收到ErrShutdown，见closereason.go
+	reason := kindError(ErrShutdown, err, "server shutting down, %s", err.Error())
+	var wg sync.WaitGroup
 	for _, conn := range m.connections {
-		conn.SetCtxData(CtxServer, nil)
 		if conn.tcpConn != nil {
-			conn.tcpConn.CloseWrite()
-			conn.tcpConn.CloseRead()
-			conn.tcpConn.Close()
+			wg.Add(1)
+			go func(conn *Connection) {
+				defer wg.Done()
+				conn.sendCloseFrame(reason)
+				closeNetConn(conn.tcpConn)
+			}(conn)
 		}
 	}
+	wg.Wait()
 	m.connections = make(map[string]*Connection)
 
 	close(m.closeNotify)
+	if m.eventLoop != nil {
+		m.eventLoop.close()
+	}
+}
+
+//添加中间件，先添加的中间件位于外层，先于后添加的中间件执行
+func (m *Server) Use(mw Middleware) {
+	if mw == nil {
+		return
+	}
+	m.chainLock.Lock()
+	defer m.chainLock.Unlock()
+	m.middlewares = append(m.middlewares, mw)
+	var h Handler = m.handler
+	for i := len(m.middlewares) - 1; i >= 0; i-- {
+		h = m.middlewares[i](h)
+	}
+	m.chain = h
+}
+
+//处理请求的Handler，已经过middlewares包装
+func (m *Server) requestHandler() Handler {
+	m.chainLock.RLock()
+	defer m.chainLock.RUnlock()
+	if m.chain != nil {
+		return m.chain
+	}
+	return m.handler
+}
+
+//设置handler的panic处理函数，不设置时响应ErrHandlerPanic
+func (m *Server) SetPanicHandler(h PanicHandler) {
+	m.chainLock.Lock()
+	defer m.chainLock.Unlock()
+	m.panicHandler = h
+}
+
+//执行handler，将panic转换为错误响应，保证channel的处理循环不会因此退出
+func (m *Server) safeHandle(c *Channel, request *Packet, dataCompleted bool) (ret []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("handle pkt %s panic: %v\n%s", request.Path, r, debug.Stack())
+			m.chainLock.RLock()
+			h := m.panicHandler
+			m.chainLock.RUnlock()
+			ret, err = nil, ErrHandlerPanic
+			if h != nil {
+				if e := h(c, request, r); e != nil {
+					err = e
+				}
+			}
+		}
+	}()
+	return m.requestHandler().Handle(c, request, dataCompleted)
 }
 
 func (m *Server) RegisterHandler(path string, handler PathHandler) error {
@@ -0,0 +1,151 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//连接的会话：handler按对端(连接)保存的状态，如认证之后加载的用户信息、请求计数，可被同一连接上的多个channel并发访问。
+//会话随连接创建，连接关闭时按注册的相反顺序调用OnClose注册的清理函数，之后会话中的数据被清空。
+//与连接的Context(GetCtxData/SetCtxData)不同，会话只保存应用的数据，不与框架内部的key混用
+package iip
+
+import (
+	"sort"
+	"sync"
+)
+
+type Session struct {
+	conn    *Connection
+	lock    sync.RWMutex
+	values  map[string]interface{}
+	onClose []func(s *Session)
+	closed  bool
+}
+
+func newSession(conn *Connection) *Session {
+	return &Session{conn: conn, values: make(map[string]interface{})}
+}
+
+//会话所属的连接
+func (m *Session) Connection() *Connection {
+	return m.conn
+}
+
+func (m *Session) Get(key string) (interface{}, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ret, ok := m.values[key]
+	return ret, ok
+}
+
+//连接关闭之后的设置被忽略
+func (m *Session) Set(key string, value interface{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.closed {
+		m.values[key] = value
+	}
+}
+
+func (m *Session) Delete(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.values, key)
+}
+
+//key已存在时返回已有的值及true，否则保存value并返回value及false，用于并发的handler之间只初始化一次
+func (m *Session) LoadOrStore(key string, value interface{}) (interface{}, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if ret, ok := m.values[key]; ok {
+		return ret, true
+	}
+	if !m.closed {
+		m.values[key] = value
+	}
+	return value, false
+}
+
+//计数器：key的值加上delta并返回新值，key不存在时从0开始；key的值不是int64时被覆盖
+func (m *Session) Add(key string, delta int64) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n, _ := m.values[key].(int64)
+	n += delta
+	if !m.closed {
+		m.values[key] = n
+	}
+	return n
+}
+
+//全部key，按字典序
+func (m *Session) Keys() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ret := make([]string, 0, len(m.values))
+	for k := range m.values {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+//连接是否已关闭
+func (m *Session) Closed() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.closed
+}
+
+//注册连接关闭时的清理函数，如释放按连接分配的资源；连接已关闭时立即调用
+func (m *Session) OnClose(fn func(s *Session)) {
+	m.lock.Lock()
+	if !m.closed {
+		m.onClose = append(m.onClose, fn)
+		m.lock.Unlock()
+		return
+	}
+	m.lock.Unlock()
+	m.callOnClose(fn)
+}
+
+//连接关闭时调用，重复调用无效果。清理函数在数据被清空之前调用，可以读取会话中的数据
+func (m *Session) close() {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return
+	}
+	m.closed = true
+	hooks := m.onClose
+	m.onClose = nil
+	m.lock.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		m.callOnClose(hooks[i])
+	}
+	m.lock.Lock()
+	m.values = make(map[string]interface{})
+	m.lock.Unlock()
+}
+
+func (m *Session) callOnClose(fn func(s *Session)) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("session close hook of %s panic: %v", m.conn.key, r)
+		}
+	}()
+	fn(m)
+}
+
+//连接的会话
+func (m *Connection) Session() *Session {
+	return m.session
+}
+
+//channel所在连接的会话
+func (m *Channel) Session() *Session {
+	return m.conn.session
+}
+
+//channel所在连接的会话
+func (m *ClientChannel) Session() *Session {
+	return m.internalChannel.conn.session
+}
@@ -0,0 +1,25 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//长度与计数在各平台上的保证，32位平台(386、arm，如ARM网关)上协议的行为与64位平台相同：
+//	帧头中的数据长度为uint32，读入时先与max packet size比较再转换为int，max packet size的上限MaxPacketSize(16MB)在任何平台上都在int的范围内；
+//	合并到一个[]byte中的数据(合并模式的请求、client的完整响应、流的一条消息)不超过MaxBufferedSize，超过时以ErrRequestTooLarge/ErrResponseTooLarge关闭channel，
+//	而不是在32位平台上因slice长度越界而panic；
+//	请求已接收的字节数(见limits.go)及全部字节数、帧数的统计均为int64，在一个channel、连接上累计超过2GB时不会回绕，见bench.Cumulative；
+//	以原子操作访问的64位字段放在结构体的最前(或者所在结构体单独分配)，在32位平台上保证8字节对齐，新增此类字段时须遵守
+//以上保证由GOARCH=386 go test检查，见sizes_test.go
+package iip
+
+import "math"
+
+//合并到一个[]byte中的数据的最大字节数，在各平台上相同
+const MaxBufferedSize int64 = math.MaxInt32
+
+//MaxPacketSize加上加密的认证标签不超过MaxBufferedSize，保证帧的数据长度在32位平台上可以转换为int
+const _ uint = uint(MaxBufferedSize) - uint(MaxPacketSize) - pskOverhead
+
+//已缓冲的n字节再追加add字节后是否超过MaxBufferedSize
+func exceedsBuffered(n, add int) bool {
+	return int64(n)+int64(add) > MaxBufferedSize
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"bytes"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//以下测试应同时以GOARCH=386运行：go test -run 'Buffered|Past2GB' .
+//32位平台上int为32位，64位字段未按8字节对齐时原子操作直接panic
+
+func TestExceedsBuffered(t *testing.T) {
+	tests := []struct {
+		n, add  int
+		exceeds bool
+	}{
+		{0, 1024, false},
+		{math.MaxInt32 - 1024, 1024, false},
+		{math.MaxInt32 - 1024, 1025, true},
+		{math.MaxInt32, 1, true},
+		{math.MaxInt32, math.MaxInt32, true},
+	}
+	for _, v := range tests {
+		if exceedsBuffered(v.n, v.add) != v.exceeds {
+			t.Errorf("exceedsBuffered(%d, %d) != %v", v.n, v.add, v.exceeds)
+		}
+	}
+}
+
+//计数器从接近2^31开始累加，跨过2GB之后不回绕
+func TestCountersPast2GB(t *testing.T) {
+	_, addr := newTestServer(t, ServerConfig{})
+	client := newTestClient(t, addr, ClientConfig{})
+	channel, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := channel.internalChannel
+	conn := c.conn
+	const seed = math.MaxInt32 - 10
+	for _, v := range []*int64{&c.ReadBytes, &c.WriteBytes, &c.ReadPacketCount, &c.WritePacketCount, &conn.stats.readBytes, &conn.stats.writeBytes} {
+		atomic.StoreInt64(v, seed)
+	}
+	data := bytes.Repeat([]byte("x"), 1024)
+	ret, err := channel.DoRequest(testEchoPath, data, time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ret, data) {
+		t.Fatalf("echo returned %d bytes", len(ret))
+	}
+
+	stats := c.Stats()
+	if stats.ReadBytes <= math.MaxInt32 || stats.WriteBytes <= math.MaxInt32 {
+		t.Fatalf("channel bytes wrapped: read %d, write %d", stats.ReadBytes, stats.WriteBytes)
+	}
+	if stats.ReadPackets <= seed || stats.WritePackets <= seed {
+		t.Fatalf("channel packets not counted: read %d, write %d", stats.ReadPackets, stats.WritePackets)
+	}
+	connStats := conn.Stats()
+	if connStats.ReadBytes <= math.MaxInt32 || connStats.WriteBytes <= math.MaxInt32 {
+		t.Fatalf("connection bytes wrapped: read %d, write %d", connStats.ReadBytes, connStats.WriteBytes)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//连接、channel统计：连接级别的收发计数在读写循环中以原子操作累加，Stats返回某一时刻的快照，供监控、运维面板使用。
+//写队列及channel接收队列除当前长度外还记录最高水位(自连接、channel创建以来的最大长度)，
+//最高水位接近容量(TcpWriteQueueLen、ChannelPacketQueueLen)说明反压正在形成，发送方或读循环即将阻塞
+package iip
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+//连接统计数据的快照
+type ConnectionStats struct {
+	RemoteAddr           string        `json:"remote_addr"` //对端地址，内存连接为memory-N
+	Role                 byte          `json:"role"`
+	Channels             int           `json:"channels"` //打开的channel数，不含0号系统channel
+	ReadBytes            int64         `json:"read_bytes"`
+	ReadPackets          int64         `json:"read_packets"`
+	WriteBytes           int64         `json:"write_bytes"`
+	WritePackets         int64         `json:"write_packets"`
+	WriteQueueLen        int           `json:"write_queue_len"` //写队列中待写出的帧数
+	PendingWriteBytes    int64         `json:"pending_write_bytes"`
+	PendingReadBytes     int64         `json:"pending_read_bytes"` //server端已读入、尚未处理完成的请求数据字节数
+	CreateTime           time.Time     `json:"create_time"`
+	Uptime               time.Duration `json:"uptime"`
+	LastActive           time.Time     `json:"last_active"` //最近一次收发帧的时间
+	Draining             bool          `json:"draining"`
+	Healthy              bool          `json:"healthy"`                //client端连接的健康检查结果，见health.go
+	UnknownChannelFrames int64         `json:"unknown_channel_frames"` //收到的不存在的channel的帧数，见reset.go
+	WriteQueueCap        int           `json:"write_queue_cap"`        //写队列的容量(帧数)
+	WriteQueueHigh       int           `json:"write_queue_high"`       //写队列长度的最高水位
+	ReceivedQueueLen     int           `json:"received_queue_len"`     //全部channel的接收队列中待处理的帧数
+	ReceivedQueueHigh    int           `json:"received_queue_high"`    //连接上channel接收队列长度的最高水位，含已关闭的channel
+	MaxConsecutiveFrames int           `json:"max_consecutive_frames"` //读循环连续收到同一channel的最长帧数，见readsched.go
+	DispatchQueueLen     int           `json:"dispatch_queue_len"`     //开启公平分派时分派器中暂存的帧数
+	DispatchYields       int64         `json:"dispatch_yields"`        //开启公平分派时channel还有待投递的帧而轮到下一个channel的次数
+}
+
+//channel统计数据的快照
+type ChannelStats struct {
+	Id             uint32        `json:"id"`
+	NewTime        time.Time     `json:"new_time"`
+	ReadPackets    int64         `json:"read_packets"`
+	ReadBytes      int64         `json:"read_bytes"`
+	WritePackets   int64         `json:"write_packets"`
+	WriteBytes     int64         `json:"write_bytes"`
+	ReceivedQueue  int           `json:"received_queue"` //待处理的帧数
+	LastActive     time.Time     `json:"last_active"`
+	Busy           bool          `json:"busy"`
+	Push           bool          `json:"push"`
+	SendClosed     bool          `json:"send_closed"`
+	PeerSendClosed bool          `json:"peer_send_closed"`
+	Generation     uint32        `json:"generation"`      //本端分配的id被复用的代数
+	ReceivedCap    int           `json:"received_cap"`    //接收队列的容量(帧数)
+	ReceivedHigh   int           `json:"received_high"`   //接收队列长度的最高水位
+	QueueWaitMax   time.Duration `json:"queue_wait_max"`  //帧在接收队列中等待处理的最长时间
+	QueueWaitMean  time.Duration `json:"queue_wait_mean"` //帧在接收队列中等待处理的平均时间
+}
+
+//连接级别的收发计数
+type connStats struct {
+	readBytes            int64
+	readPackets          int64
+	writeBytes           int64
+	writePackets         int64
+	unknownChannelFrames int64
+	writeQueueHigh       int64 //写队列长度的最高水位
+	receivedQueueHigh    int64 //channel接收队列长度的最高水位
+	maxRun               int64 //读循环连续收到同一channel的最长帧数
+}
+
+func (m *Connection) Stats() ConnectionStats {
+	m.ChannelsLock.RLock()
+	channels := len(m.Channels)
+	if _, ok := m.Channels[0]; ok {
+		channels--
+	}
+	received := 0
+	for _, c := range m.Channels {
+		received += len(c.receivedQueue)
+	}
+	m.ChannelsLock.RUnlock()
+	var dispatchLen int
+	var dispatchYields int64
+	if m.dispatcher != nil {
+		dispatchLen, dispatchYields = m.dispatcher.stats()
+	}
+	return ConnectionStats{
+		RemoteAddr:           m.key,
+		Role:                 m.Role,
+		Channels:             channels,
+		ReadBytes:            atomic.LoadInt64(&m.stats.readBytes),
+		ReadPackets:          atomic.LoadInt64(&m.stats.readPackets),
+		WriteBytes:           atomic.LoadInt64(&m.stats.writeBytes),
+		WritePackets:         atomic.LoadInt64(&m.stats.writePackets),
+		WriteQueueLen:        len(m.writeSched.slots),
+		PendingWriteBytes:    m.PendingWriteBytes(),
+		PendingReadBytes:     m.PendingReadBytes(),
+		CreateTime:           m.createTime,
+		Uptime:               time.Since(m.createTime),
+		LastActive:           time.Unix(0, atomic.LoadInt64(&m.lastActive)),
+		Draining:             m.Draining(),
+		Healthy:              m.Healthy(),
+		UnknownChannelFrames: atomic.LoadInt64(&m.stats.unknownChannelFrames),
+		WriteQueueCap:        cap(m.writeSched.slots),
+		WriteQueueHigh:       int(atomic.LoadInt64(&m.stats.writeQueueHigh)),
+		ReceivedQueueLen:     received,
+		ReceivedQueueHigh:    int(atomic.LoadInt64(&m.stats.receivedQueueHigh)),
+		MaxConsecutiveFrames: int(atomic.LoadInt64(&m.stats.maxRun)),
+		DispatchQueueLen:     dispatchLen,
+		DispatchYields:       dispatchYields,
+	}
+}
+
+func (m *connStats) addRead(frameLen int) {
+	atomic.AddInt64(&m.readBytes, int64(frameLen))
+	atomic.AddInt64(&m.readPackets, 1)
+}
+
+func (m *connStats) addWrite(frameLen int) {
+	atomic.AddInt64(&m.writeBytes, int64(frameLen))
+	atomic.AddInt64(&m.writePackets, 1)
+}
+
+func (m *Channel) addRead(frameLen int) {
+	atomic.AddInt64(&m.ReadBytes, int64(frameLen))
+	atomic.AddInt64(&m.ReadPacketCount, 1)
+}
+
+//以当前值v更新最高水位
+func raiseHighWater(high *int64, v int64) {
+	for {
+		old := atomic.LoadInt64(high)
+		if v <= old || atomic.CompareAndSwapInt64(high, old, v) {
+			return
+		}
+	}
+}
+
+//帧投递到接收队列之后更新channel及连接的最高水位
+func (m *Channel) observeReceived() {
+	n := int64(len(m.receivedQueue))
+	raiseHighWater(&m.receivedHigh, n)
+	raiseHighWater(&m.conn.stats.receivedQueueHigh, n)
+}
+
+//server全部连接的统计快照，按对端地址排序
+func (m *Server) ConnectionsSnapshot() []ConnectionStats {
+	return connectionsStats(m.connectionList())
+}
+
+//client全部连接的统计快照，按对端地址排序
+func (m *Client) ConnectionsSnapshot() []ConnectionStats {
+	m.connLock.Lock()
+	conns := append([]*Connection(nil), m.connections...)
+	m.connLock.Unlock()
+	return connectionsStats(conns)
+}
+
+//client全部连接及其channel的统计快照，按对端地址排序
+func (m *Client) ChannelsSnapshot() []ConnectionChannels {
+	m.connLock.Lock()
+	conns := append([]*Connection(nil), m.connections...)
+	m.connLock.Unlock()
+	return connectionChannels(conns)
+}
+
+func connectionsStats(conns []*Connection) []ConnectionStats {
+	ret := make([]ConnectionStats, 0, len(conns))
+	for _, conn := range conns {
+		ret = append(ret, conn.Stats())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].RemoteAddr < ret[j].RemoteAddr
+	})
+	return ret
+}
+
+func (m *Channel) Stats() ChannelStats {
+	var waitMean time.Duration
+	if n := atomic.LoadInt64(&m.waitCount); n > 0 {
+		waitMean = time.Duration(atomic.LoadInt64(&m.waitTotal) / n)
+	}
+	return ChannelStats{
+		Id:             m.Id,
+		NewTime:        m.NewTime,
+		ReadPackets:    atomic.LoadInt64(&m.ReadPacketCount),
+		ReadBytes:      atomic.LoadInt64(&m.ReadBytes),
+		WritePackets:   atomic.LoadInt64(&m.WritePacketCount),
+		WriteBytes:     atomic.LoadInt64(&m.WriteBytes),
+		ReceivedQueue:  len(m.receivedQueue),
+		LastActive:     time.Unix(0, atomic.LoadInt64(&m.lastActive)),
+		Busy:           atomic.LoadInt32(&m.busy) != 0,
+		Push:           m.push,
+		SendClosed:     m.SendClosed(),
+		PeerSendClosed: m.PeerSendClosed(),
+		Generation:     m.generation,
+		ReceivedCap:    cap(m.receivedQueue),
+		ReceivedHigh:   int(atomic.LoadInt64(&m.receivedHigh)),
+		QueueWaitMax:   time.Duration(atomic.LoadInt64(&m.waitMax)),
+		QueueWaitMean:  waitMean,
+	}
+}
+
+//连接上全部channel的统计数据，按id排序，不含0号系统channel
+func (m *Connection) ChannelsStats() []ChannelStats {
+	m.ChannelsLock.RLock()
+	channels := make([]*Channel, 0, len(m.Channels))
+	for id, c := range m.Channels {
+		if id != 0 {
+			channels = append(channels, c)
+		}
+	}
+	m.ChannelsLock.RUnlock()
+	ret := make([]ChannelStats, 0, len(channels))
+	for _, c := range channels {
+		ret = append(ret, c.Stats())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Id < ret[j].Id
+	})
+	return ret
+}
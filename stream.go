@@ -0,0 +1,216 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//双向流：建立在channel之上，client和server双方都可以随时Send、Recv，不受请求->响应的顺序约束，
+//适用于聊天、日志跟踪(tail -f)等场景。每次Send发送一条完整的消息(超过帧大小时自动分片)，Recv返回一条完整的消息；
+//CloseSend半关闭本端的发送方向，对端的Recv随后返回io.EOF。
+//client通过Client.NewStream打开流，首条消息的path命中server通过RegisterStreamHandler注册的handler时，
+//server为该channel启动流处理，handler返回后server端的发送方向被半关闭
+package iip
+
+import (
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+//server端的流处理函数，返回nil时半关闭server的发送方向；返回*Error时以错误帧发给client(其Recv返回该错误)
+//之后半关闭，返回其他error时关闭channel
+type StreamHandler func(s *Stream) error
+
+type Stream struct {
+	channel *Channel
+	path    string
+	recv    chan *Packet //handle循环交付的帧，对端半关闭后被关闭
+	done    chan int     //channel的closeNotify
+	pending *Packet      //尚未接收完整的消息
+}
+
+func newStream(c *Channel, path string) *Stream {
+	ret := &Stream{channel: c, path: path, recv: make(chan *Packet, cap(c.receivedQueue)+1), done: c.closeNotify}
+	//流的生命周期由双方控制，不做空闲检查
+	atomic.StoreInt32(&c.busy, 1)
+	c.stream.Store(ret)
+	return ret
+}
+
+func (m *Channel) getStream() *Stream {
+	if s, ok := m.stream.Load().(*Stream); ok {
+		return s
+	}
+	return nil
+}
+
+//handle循环将帧交给流，半关闭帧使流的Recv返回io.EOF。channel已关闭或被重置时返回false
+func (m *Stream) deliver(pkt *Packet) bool {
+	if pkt.Status == StatusR12 {
+		//对端重置，Recv返回重置的错误
+		err := decodeErrorFrame(pkt.Data)
+		pkt.Release()
+		m.channel.close(err, false)
+		return false
+	}
+	if isHalfCloseStatus(pkt.Status) {
+		pkt.Release()
+		close(m.recv)
+		m.channel.peerEOF()
+		return true
+	}
+	select {
+	case m.recv <- pkt:
+		return true
+	case <-m.done:
+		pkt.Release()
+		return false
+	}
+}
+
+func (m *Stream) Channel() *Channel {
+	return m.channel
+}
+
+func (m *Stream) Path() string {
+	return m.path
+}
+
+//发送一条完整的消息
+func (m *Stream) Send(data []byte) error {
+	pktType := PacketTypeRequest
+	if m.channel.conn.Role == RoleServer {
+		pktType = PacketTypeResponse
+	}
+	return m.channel.SendPacket(&Packet{Type: pktType, Path: m.path, ChannelId: m.channel.Id, Data: data, channel: m.channel})
+}
+
+//接收一条完整的消息，对端半关闭且数据全部接收之后返回io.EOF
+func (m *Stream) Recv() ([]byte, error) {
+	for {
+		var pkt *Packet
+		var ok bool
+		select {
+		case pkt, ok = <-m.recv:
+		case <-m.done:
+			//channel关闭之前交付的帧仍然可以接收
+			select {
+			case pkt, ok = <-m.recv:
+			default:
+				return nil, m.channel.errClosed()
+			}
+		}
+		if !ok {
+			if m.pending != nil {
+				m.pending.Release()
+				m.pending = nil
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, io.EOF
+		}
+		completed := isClientStatusCompleted(pkt.Status) || isServerStatusCompleted(pkt.Status)
+		if m.pending == nil {
+			m.pending = pkt
+		} else if exceedsBuffered(len(m.pending.Data), len(pkt.Data)) {
+			m.pending.Release()
+			m.pending = nil
+			pkt.Release()
+			err := ErrResponseTooLarge
+			if m.channel.conn.Role == RoleServer {
+				err = ErrRequestTooLarge
+			}
+			m.channel.Close(err)
+			return nil, err
+		} else {
+			m.pending.Data = append(m.pending.Data, pkt.Data...)
+			pkt.Release()
+		}
+		if completed && m.pending.Status == StatusS11 {
+			err := decodeErrorFrame(m.pending.Data)
+			m.pending.Release()
+			m.pending = nil
+			return nil, err
+		}
+		if completed {
+			//缓冲区不再回收，交给调用者
+			ret := m.pending.Data
+			m.pending.buf = nil
+			m.pending.Release()
+			m.pending = nil
+			return ret, nil
+		}
+	}
+}
+
+//半关闭本端的发送方向，仍可以继续Recv
+func (m *Stream) CloseSend() error {
+	return m.channel.CloseSend()
+}
+
+//关闭流及其channel
+func (m *Stream) Close(err error) {
+	m.channel.Close(err)
+}
+
+//打开一个到path的双向流
+func (m *Client) NewStream(path string) (*Stream, error) {
+	c, err := m.NewChannelFor(path)
+	if err != nil {
+		return nil, err
+	}
+	if !c.internalChannel.conn.HasFeature(FeatureHalfClose) {
+		c.Close(fmt.Errorf("peer does not support stream"))
+		return nil, fmt.Errorf("peer does not support stream")
+	}
+	return newStream(c.internalChannel, path), nil
+}
+
+//注册path的流处理函数，优先于RegisterHandler注册的同path的handler
+func (m *Server) RegisterStreamHandler(path string, handler StreamHandler) error {
+	if handler == nil {
+		return fmt.Errorf("hander is nil")
+	}
+	if len(path) > int(MaxPathLen) {
+		return fmt.Errorf("path is too large, must <= %d", MaxPathLen)
+	}
+	if isSysPath(path) {
+		return errReservedPath(path)
+	}
+	m.streamLock.Lock()
+	defer m.streamLock.Unlock()
+	if m.streamHandlers == nil {
+		m.streamHandlers = make(map[string]StreamHandler)
+	}
+	m.streamHandlers[path] = handler
+	return nil
+}
+
+func (m *Server) UnRegisterStreamHandler(path string) {
+	m.streamLock.Lock()
+	defer m.streamLock.Unlock()
+	delete(m.streamHandlers, path)
+}
+
+func (m *Server) getStreamHandler(path string) StreamHandler {
+	m.streamLock.RLock()
+	defer m.streamLock.RUnlock()
+	return m.streamHandlers[path]
+}
+
+func (m *Server) serveStream(s *Stream, handler StreamHandler) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("stream %s panic: %v\n%s", s.path, r, debug.Stack())
+			s.Close(ErrHandlerPanic)
+		}
+	}()
+	if err := handler(s); err != nil {
+		log.Errorf("stream %s fail, %s", s.path, err.Error())
+		if e, ok := err.(*Error); ok && s.channel.conn.HasFeature(FeatureErrorFrame) && s.channel.sendError(s.path, e) == nil {
+			s.CloseSend()
+			return
+		}
+		s.Close(err)
+		return
+	}
+	s.CloseSend()
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//帧状态机：channel上每个方向的帧(请求方向C0~C3、C9，响应方向S4~S7、S10、S11)按确定的规则转换，
+//状态只由该方向上收到的最近一帧决定：
+//	空闲(尚未收到帧，或上一个请求/响应已完成)：接受首帧(C0/C1、S4/S5/S11)及半关闭帧(C9/S10)；
+//	进行中(未完成的首帧或后续帧之后)：只接受后续帧(C2/C3、S6/S7)；
+//	半关闭之后：不再接受任何数据帧。
+//关闭连接(Status8)在任何状态下都有效且不改变状态；重置(R12)、单向消息(O13)不经过状态机，由读循环单独处理。
+//CheckClientPacketStatus、CheckServerPacketStatus以同一状态机校验一对相邻的状态，逐项的转换见conformance.Transitions
+package iip
+
+//方向上的阶段
+type streamPhase byte
+
+const (
+	phaseInvalid streamPhase = iota //最近一帧不属于该方向，不接受任何帧
+	phaseIdle
+	phaseActive
+	phaseHalfClosed
+)
+
+//一个状态的转换：from为允许的前一阶段，to为收到该状态之后的阶段
+type statusTransition struct {
+	valid bool
+	from  streamPhase
+	to    streamPhase
+}
+
+//一个方向上全部状态的转换规则，下标为状态
+type streamRules [StatusO13 + 1]statusTransition
+
+var (
+	//请求方向，由server校验client发来的帧
+	requestRules = streamRules{
+		StatusC0: {true, phaseIdle, phaseActive},
+		StatusC1: {true, phaseIdle, phaseIdle},
+		StatusC2: {true, phaseActive, phaseActive},
+		StatusC3: {true, phaseActive, phaseIdle},
+		StatusC9: {true, phaseIdle, phaseHalfClosed},
+	}
+	//响应方向，由client校验server发来的帧
+	responseRules = streamRules{
+		StatusS4:  {true, phaseIdle, phaseActive},
+		StatusS5:  {true, phaseIdle, phaseIdle},
+		StatusS6:  {true, phaseActive, phaseActive},
+		StatusS7:  {true, phaseActive, phaseIdle},
+		StatusS10: {true, phaseIdle, phaseHalfClosed},
+		StatusS11: {true, phaseIdle, phaseIdle},
+	}
+)
+
+//状态之后所处的阶段，statusNone表示尚未收到帧
+func (m *streamRules) phaseOf(status byte) streamPhase {
+	if status == statusNone {
+		return phaseIdle
+	}
+	if int(status) >= len(m) || !m[status].valid {
+		return phaseInvalid
+	}
+	return m[status].to
+}
+
+//由prev转换到current是否合法
+func (m *streamRules) check(prev, current byte) error {
+	if current == Status8 {
+		return nil
+	}
+	if int(current) >= len(m) || !m[current].valid {
+		return protocolError("invalid status value: %d", current)
+	}
+	if m.phaseOf(prev) != m[current].from {
+		return protocolError("invalid protocol, prev status: %d, current %d", prev, current)
+	}
+	return nil
+}
+
+//尚未收到帧时的状态
+const statusNone byte = 255
+
+//channel上一个方向的帧状态，只由读循环访问
+type streamState struct {
+	rules *streamRules
+	last  byte //最近一帧的状态，statusNone表示尚未收到
+}
+
+//校验对端发来的帧的状态机：server校验请求方向，client校验响应方向
+func newStreamState(role byte) streamState {
+	if role == RoleServer {
+		return streamState{rules: &requestRules, last: statusNone}
+	}
+	return streamState{rules: &responseRules, last: statusNone}
+}
+
+//校验并推进到status，不合法时状态不变
+func (m *streamState) advance(status byte) error {
+	if err := m.rules.check(m.last, status); err != nil {
+		return err
+	}
+	if status != Status8 {
+		m.last = status
+	}
+	return nil
+}
+
+//校验client发来的相邻两帧的状态，prev为255表示current是channel上的第一帧
+func CheckClientPacketStatus(prev, current byte) error {
+	return requestRules.check(prev, current)
+}
+
+//校验server发来的相邻两帧的状态，prev为255表示current是channel上的第一帧
+func CheckServerPacketStatus(prev, current byte) error {
+	return responseRules.check(prev, current)
+}
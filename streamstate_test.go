@@ -0,0 +1,89 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import "testing"
+
+func TestStreamStateTransitions(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     byte
+		statuses []byte
+		fail     int //第一个不合法的帧的下标，-1表示全部合法
+	}{
+		{"single frame requests", RoleServer, []byte{StatusC1, StatusC1, StatusC1}, -1},
+		{"multi frame request", RoleServer, []byte{StatusC0, StatusC2, StatusC2, StatusC3, StatusC1}, -1},
+		{"half close after request", RoleServer, []byte{StatusC1, StatusC9}, -1},
+		{"close in the middle", RoleServer, []byte{StatusC0, Status8, StatusC3}, -1},
+		{"close after half close", RoleServer, []byte{StatusC9, Status8}, -1},
+		{"next frame before first", RoleServer, []byte{StatusC2}, 0},
+		{"last frame before first", RoleServer, []byte{StatusC3}, 0},
+		{"first frame while active", RoleServer, []byte{StatusC0, StatusC1}, 1},
+		{"half close while active", RoleServer, []byte{StatusC0, StatusC9}, 1},
+		{"data after half close", RoleServer, []byte{StatusC9, StatusC1}, 1},
+		{"half close twice", RoleServer, []byte{StatusC9, StatusC9}, 1},
+		{"response status in request", RoleServer, []byte{StatusS5}, 0},
+		{"reset is not a stream status", RoleServer, []byte{StatusR12}, 0},
+		{"unknown status", RoleServer, []byte{StatusO13 + 1}, 0},
+
+		{"single frame responses", RoleClient, []byte{StatusS5, StatusS11, StatusS5}, -1},
+		{"multi frame response", RoleClient, []byte{StatusS4, StatusS6, StatusS7, StatusS5}, -1},
+		{"half close after response", RoleClient, []byte{StatusS5, StatusS10}, -1},
+		{"error response while active", RoleClient, []byte{StatusS4, StatusS11}, 1},
+		{"next frame before first response", RoleClient, []byte{StatusS6}, 0},
+		{"first response while active", RoleClient, []byte{StatusS4, StatusS4}, 1},
+		{"data after response half close", RoleClient, []byte{StatusS10, StatusS5}, 1},
+		{"request status in response", RoleClient, []byte{StatusC1}, 0},
+	}
+	for _, v := range tests {
+		t.Run(v.name, func(t *testing.T) {
+			state := newStreamState(v.role)
+			for i, status := range v.statuses {
+				last := state.last
+				err := state.advance(status)
+				if i == v.fail {
+					if err == nil {
+						t.Fatalf("status %d at %d accepted", status, i)
+					}
+					if state.last != last {
+						t.Fatalf("state changed by illegal status %d: %d -> %d", status, last, state.last)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("status %d at %d rejected: %v", status, i, err)
+				}
+			}
+			if v.fail >= 0 {
+				t.Fatalf("expected status at %d to be rejected", v.fail)
+			}
+		})
+	}
+}
+
+//导出的校验函数校验一对相邻的状态，prev为255表示第一帧
+func TestCheckPacketStatus(t *testing.T) {
+	tests := []struct {
+		check         func(prev, current byte) error
+		prev, current byte
+		ok            bool
+	}{
+		{CheckClientPacketStatus, statusNone, StatusC1, true},
+		{CheckClientPacketStatus, statusNone, StatusC2, false},
+		{CheckClientPacketStatus, StatusC0, StatusC2, true},
+		{CheckClientPacketStatus, StatusC1, StatusC3, false},
+		{CheckClientPacketStatus, StatusC0, Status8, true},
+		{CheckClientPacketStatus, StatusC9, StatusC0, false},
+		{CheckServerPacketStatus, statusNone, StatusS11, true},
+		{CheckServerPacketStatus, StatusS4, StatusS7, true},
+		{CheckServerPacketStatus, StatusS4, StatusS11, false},
+		{CheckServerPacketStatus, StatusS5, StatusC1, false},
+	}
+	for _, v := range tests {
+		if err := v.check(v.prev, v.current); (err == nil) != v.ok {
+			t.Errorf("prev: %d, current: %d, expected ok: %v, got: %v", v.prev, v.current, v.ok, err)
+		}
+	}
+}
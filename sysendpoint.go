@@ -0,0 +1,170 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//管理路径：ServerConfig.SysEndpoints开启后，任何iip client都可以通过/sys/stats、/sys/channels
+//以json查询server的统计数据，访问受Authenticator(CertAuthorizer)及SysAuthorizer的控制。/sys/health见health.go
+package iip
+
+import (
+	"encoding/json"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+//管理路径的访问控制，返回错误时拒绝访问，错误作为响应返回给client
+type SysAuthorizer func(c *Channel, path string) error
+
+//按path的请求计数及耗时分布，只统计注册了handler的path，见pathstats.go
+type PathCounters struct {
+	Requests int64         `json:"requests"`
+	Errors   int64         `json:"errors"`
+	Mean     time.Duration `json:"mean"` //从收到请求首帧到响应入队的平均耗时
+	P50      time.Duration `json:"p50"`
+	P90      time.Duration `json:"p90"`
+	P99      time.Duration `json:"p99"`
+	Max      time.Duration `json:"max"`
+}
+
+//server统计数据的快照
+type ServerStats struct {
+	StartTime            time.Time               `json:"start_time"`
+	Uptime               time.Duration           `json:"uptime"`
+	Connections          int                     `json:"connections"`
+	Channels             int                     `json:"channels"`
+	ReadBytes            int64                   `json:"read_bytes"`
+	WriteBytes           int64                   `json:"write_bytes"`
+	PendingBytes         int64                   `json:"pending_bytes"` //全部连接排队中的数据字节数，见membudget.go
+	Paths                map[string]PathCounters `json:"paths"`
+	OneWay               OneWayStats             `json:"one_way"`                //单向消息的计数，见oneway.go
+	SeqErrors            int64                   `json:"sequence_errors"`        //帧序号校验失败而关闭的连接数，见sequence.go
+	UnknownChannelFrames int64                   `json:"unknown_channel_frames"` //收到的不存在的channel的帧数，见reset.go
+	RejectedConnections  int64                   `json:"rejected_connections"`   //accept之后被ip列表、ConnFilter或按ip的连接数上限拒绝的连接数，见connfilter.go、ipcap.go
+	Tenants              map[string]TenantStats  `json:"tenants,omitempty"`
+	WriteQueueLen        int                     `json:"write_queue_len"`     //全部连接写队列中待写出的帧数
+	WriteQueueHigh       int                     `json:"write_queue_high"`    //各连接写队列最高水位中的最大值
+	ReceivedQueueLen     int                     `json:"received_queue_len"`  //全部channel的接收队列中待处理的帧数
+	ReceivedQueueHigh    int                     `json:"received_queue_high"` //各连接channel接收队列最高水位中的最大值
+}
+
+type ResponseSysStats struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	ServerStats
+}
+
+//连接及其channel的统计快照
+type ConnectionChannels struct {
+	Connection ConnectionStats `json:"connection"`
+	Channels   []ChannelStats  `json:"channels"`
+}
+
+type ResponseSysChannels struct {
+	Code        int                  `json:"code"`
+	Message     string               `json:"message,omitempty"`
+	Connections []ConnectionChannels `json:"connections"`
+}
+
+type ResponseSysHealth struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+	Status  string `json:"status"` //HealthServing、HealthDraining或HealthNotServing
+}
+
+func (m *serverHandler) countPath(path string, err error) {
+	v, ok := m.pathCounters.Load(path)
+	if !ok {
+		v, _ = m.pathCounters.LoadOrStore(path, &pathMetrics{})
+	}
+	metrics := v.(*pathMetrics)
+	atomic.AddInt64(&metrics.requests, 1)
+	if err != nil {
+		atomic.AddInt64(&metrics.errors, 1)
+	}
+}
+
+func (m *serverHandler) pathStats() map[string]PathCounters {
+	ret := make(map[string]PathCounters)
+	m.pathCounters.Range(func(k, v interface{}) bool {
+		ret[k.(string)] = v.(*pathMetrics).snapshot()
+		return true
+	})
+	return ret
+}
+
+//处理管理路径，未开启时与没有注册handler的path一样
+func (m *serverHandler) handleSys(request *Packet) ([]byte, error) {
+	svr := request.channel.conn.server
+	if svr == nil {
+		return nil, ErrNoHandler
+	}
+	if request.Path == PathSysHealth {
+		status, message := svr.healthStatus(request.channel.conn)
+		return json.Marshal(&ResponseSysHealth{Status: status, Message: message})
+	}
+	if !svr.getConfig().SysEndpoints {
+		return nil, ErrNoHandler
+	}
+	if authorizer := svr.getConfig().SysAuthorizer; authorizer != nil {
+		if err := authorizer(request.channel, request.Path); err != nil {
+			log.Warnf("access %s denied, %s", request.Path, err.Error())
+			if e, ok := err.(*Error); ok {
+				return nil, e
+			}
+			return nil, &Error{Code: ErrAccessDenied.(*Error).Code, Message: ErrAccessDenied.Error() + ", " + err.Error()}
+		}
+	}
+	var resp interface{}
+	switch request.Path {
+	case PathSysStats:
+		resp = &ResponseSysStats{ServerStats: svr.Stats()}
+	case PathSysChannels:
+		resp = &ResponseSysChannels{Connections: svr.ChannelsSnapshot()}
+	}
+	return json.Marshal(resp)
+}
+
+func (m *Server) Stats() ServerStats {
+	ret := ServerStats{StartTime: m.startTime, Uptime: time.Since(m.startTime), Paths: m.handler.pathStats(), OneWay: m.OneWayStats(), SeqErrors: m.SequenceErrors(), UnknownChannelFrames: m.UnknownChannelFrames(), RejectedConnections: m.RejectedConnections()}
+	for _, v := range m.ConnectionsSnapshot() {
+		ret.Connections++
+		ret.Channels += v.Channels
+		ret.ReadBytes += v.ReadBytes
+		ret.WriteBytes += v.WriteBytes
+		ret.PendingBytes += v.PendingReadBytes + v.PendingWriteBytes
+		ret.WriteQueueLen += v.WriteQueueLen
+		ret.ReceivedQueueLen += v.ReceivedQueueLen
+		if v.WriteQueueHigh > ret.WriteQueueHigh {
+			ret.WriteQueueHigh = v.WriteQueueHigh
+		}
+		if v.ReceivedQueueHigh > ret.ReceivedQueueHigh {
+			ret.ReceivedQueueHigh = v.ReceivedQueueHigh
+		}
+	}
+	m.tenants.RLock()
+	if len(m.tenants.tenants) > 0 {
+		ret.Tenants = make(map[string]TenantStats, len(m.tenants.tenants))
+		for name, tenant := range m.tenants.tenants {
+			ret.Tenants[name] = tenant.Stats()
+		}
+	}
+	m.tenants.RUnlock()
+	return ret
+}
+
+//server全部连接及其channel的统计快照，按对端地址排序
+func (m *Server) ChannelsSnapshot() []ConnectionChannels {
+	return connectionChannels(m.connectionList())
+}
+
+func connectionChannels(conns []*Connection) []ConnectionChannels {
+	ret := make([]ConnectionChannels, 0, len(conns))
+	for _, conn := range conns {
+		ret = append(ret, ConnectionChannels{Connection: conn.Stats(), Channels: conn.ChannelsStats()})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Connection.RemoteAddr < ret[j].Connection.RemoteAddr
+	})
+	return ret
+}
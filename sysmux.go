@@ -0,0 +1,188 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//系统path的命名空间：/sys/下的path保留给框架，RegisterHandler、RegisterStreamHandler、Tenant.RegisterHandler及client的RegisterHandler、
+//RegisterPushHandler注册/sys/下的path时返回错误。server端/sys/下的请求一律经内部的sysMux分派，不会落到应用或租户的handler，未注册的响应ErrNoHandler。
+//框架内置的系统操作(新建、删除channel，probe，stats等)在创建server时注册；扩展包(如pubsub)以Server.RegisterSysHandler、
+//Client.RegisterSysPushHandler加入新的系统操作，与已有的系统path重复时返回错误，不会与应用的path冲突
+package iip
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const sysPathPrefix = "/sys/"
+
+//是否为保留给框架的系统path
+func isSysPath(path string) bool {
+	return strings.HasPrefix(path, sysPathPrefix)
+}
+
+func errReservedPath(path string) error {
+	return fmt.Errorf("path %s is reserved for system use, paths under %s can not be registered", path, sysPathPrefix)
+}
+
+//系统path的分派
+type sysMux struct {
+	lock     sync.RWMutex
+	handlers map[string]Handler
+}
+
+func (m *sysMux) register(path string, handler Handler) error {
+	if !isSysPath(path) {
+		return fmt.Errorf("system path must start with %s, got %s", sysPathPrefix, path)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.handlers == nil {
+		m.handlers = make(map[string]Handler)
+	}
+	if _, ok := m.handlers[path]; ok {
+		return fmt.Errorf("system path %s already registered", path)
+	}
+	m.handlers[path] = handler
+	return nil
+}
+
+func (m *sysMux) handle(c *Channel, request *Packet, dataCompleted bool) ([]byte, error) {
+	m.lock.RLock()
+	handler := m.handlers[request.Path]
+	m.lock.RUnlock()
+	if handler == nil {
+		return nil, ErrNoHandler
+	}
+	ret, err := handler.Handle(c, request, dataCompleted)
+	if err != nil && err != ErrPacketContinue && err != ErrResponseSent {
+		if _, ok := err.(*Error); !ok {
+			return nil, &Error{Code: -1, Message: "handler fail:" + err.Error(), cause: err}
+		}
+	}
+	return ret, err
+}
+
+//创建server端的系统path分派，注册内置的系统操作
+func newServerSysMux(m *serverHandler) *sysMux {
+	ret := &sysMux{}
+	ret.register(PathNewChannel, HandlerFunc(m.newChannel))
+	ret.register(PathDeleteChannel, HandlerFunc(m.deleteChannel))
+	ret.register(PathProbe, HandlerFunc(m.probe))
+	for _, v := range []string{PathSysStats, PathSysChannels, PathSysHealth} {
+		ret.register(v, HandlerFunc(func(c *Channel, request *Packet, dataCompleted bool) ([]byte, error) {
+			return m.handleSys(request)
+		}))
+	}
+	return ret
+}
+
+//注册系统操作，供框架的扩展包(如pubsub)使用，path须在/sys/之下且未被注册
+func (m *Server) RegisterSysHandler(path string, handler PathHandler) error {
+	if handler == nil {
+		return fmt.Errorf("hander is nil")
+	}
+	return m.handler.sys.register(path, HandlerFunc(func(c *Channel, request *Packet, dataCompleted bool) ([]byte, error) {
+		return handler.Handle(c, request.Path, request.Data, dataCompleted)
+	}))
+}
+
+//注册/sys/下的推送处理函数，供框架的扩展包使用
+func (m *Client) RegisterSysPushHandler(path string, handler PathHandler) error {
+	if handler == nil {
+		return fmt.Errorf("hander is nil")
+	}
+	if !isSysPath(path) {
+		return fmt.Errorf("system path must start with %s, got %s", sysPathPrefix, path)
+	}
+	m.pushHandler.pathHandlerManager.register(path, handler)
+	return nil
+}
+
+func (m *serverHandler) newChannel(c *Channel, request *Packet, dataCompleted bool) ([]byte, error) {
+	if request.channel.conn.Draining() {
+		bts, _ := json.Marshal(&ResponseNewChannel{Code: ErrConnDraining.(*Error).Code, Message: ErrConnDraining.Error()})
+		return bts, nil
+	}
+	if svr := request.channel.conn.server; svr != nil && svr.getConfig().MaxChannelsPerConn > 0 {
+		request.channel.conn.ChannelsLock.RLock()
+		n := len(request.channel.conn.Channels) - 1
+		request.channel.conn.ChannelsLock.RUnlock()
+		if n >= svr.getConfig().MaxChannelsPerConn {
+			bts, _ := json.Marshal(&ResponseNewChannel{Code: ErrTooManyChannels.(*Error).Code, Message: ErrTooManyChannels.Error()})
+			return bts, nil
+		}
+	}
+	if svr := request.channel.conn.server; svr != nil {
+		if resp := svr.admitNewChannel(request.channel.conn); resp != nil {
+			bts, _ := json.Marshal(resp)
+			return bts, nil
+		}
+	}
+	tenant := request.channel.conn.tenant()
+	if tenant != nil {
+		if err := tenant.acquireChannel(); err != nil {
+			bts, _ := json.Marshal(&ResponseNewChannel{Code: -1, Message: err.Error()})
+			return bts, nil
+		}
+	}
+	conn := request.channel.conn
+	//channel_id缺省时为旧版client，由server分配id，见newLegacyChannel
+	var req struct {
+		ChannelId *uint32 `json:"channel_id"`
+	}
+	if err := json.Unmarshal(request.Data, &req); err != nil || (req.ChannelId != nil && (*req.ChannelId == 0 || conn.ownsChannelId(*req.ChannelId))) {
+		if tenant != nil {
+			tenant.releaseChannel()
+		}
+		bts, _ := json.Marshal(&ResponseNewChannel{Code: -1, Message: "invalid channel id"})
+		return bts, nil
+	}
+	queueLen := uint32(100)
+	if svr := conn.server; svr != nil && svr.getConfig().ChannelPacketQueueLen > 0 {
+		queueLen = svr.getConfig().ChannelPacketQueueLen
+	}
+	var ret *Channel
+	var err error
+	if req.ChannelId == nil {
+		ret, err = conn.newLegacyChannel(queueLen, tenant)
+	} else {
+		ret, err = conn.newChannelWithId(*req.ChannelId, queueLen, false, tenant)
+	}
+	if err != nil {
+		if tenant != nil {
+			tenant.releaseChannel()
+		}
+		bts, _ := json.Marshal(&ResponseNewChannel{Code: -1, Message: err.Error()})
+		return bts, nil
+	}
+	bts, _ := json.Marshal(&ResponseNewChannel{Code: 0, ChannelId: ret.Id})
+	return bts, nil
+}
+
+func (m *serverHandler) deleteChannel(c *Channel, request *Packet, dataCompleted bool) ([]byte, error) {
+	request.channel.Close(fmt.Errorf("close by peer command"))
+	bts, _ := json.Marshal(&ResponseDeleteChannel{Code: 0})
+	return bts, nil
+}
+
+func (m *serverHandler) probe(c *Channel, request *Packet, dataCompleted bool) ([]byte, error) {
+	resp := &ResponseProbe{
+		Version:       ProtocolVersion,
+		Features:      FeatureTenant | FeatureScheduler | FeatureMiddleware | FeaturePanicRecover | FeatureChecksum | FeatureServerPush | FeatureMetadata | FeatureHalfClose | FeatureErrorFrame | FeatureGoAway | FeatureTrailer | FeatureReset | FeatureEncryption | FeatureOneWay | FeatureSequence | FeatureCloseAck | FeatureEmptyData | FeatureCloseReason,
+		PathCount:     m.pathHandlerManager.count(),
+		MaxPathLen:    MaxPathLen,
+		MaxPacketSize: MaxPacketSize,
+	}
+	if svr := request.channel.conn.server; svr != nil {
+		config := svr.getConfig()
+		resp.MaxConnections = config.MaxConnections
+		resp.MaxChannelsPerConn = config.MaxChannelsPerConn
+		resp.MaxPathLen = normalizeLimit(config.MaxPathLen, MaxPathLen)
+		resp.MaxPacketSize = normalizeLimit(config.MaxPacketSize, MaxPacketSize)
+		resp.FrameSize = config.FrameSize
+	}
+	bts, _ := json.Marshal(resp)
+	return bts, nil
+}
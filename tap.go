@@ -0,0 +1,206 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//帧监听(tap)：在Connection(或者Server、Client的全部连接)上注册PacketTap后，读循环读入、写循环写出的每一帧
+//都以TapEvent的形式(数据为拷贝)交给tap，用于调试时观察协议交互。
+//Recorder是内置的tap，将帧逐行以json写入记录文件，记录文件可以由Replayer驱动client重放，见replay.go
+package iip
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//帧的方向
+const (
+	TapInbound  byte = 0 //读入
+	TapOutbound byte = 1 //写出
+)
+
+//一帧的记录，加密的连接为解密后的数据
+type TapEvent struct {
+	Conn      string            `json:"conn"` //连接的key，tcp连接为对端地址
+	Role      byte              `json:"role"` //连接的角色，RoleClient或RoleServer
+	Direction byte              `json:"direction"`
+	Time      time.Time         `json:"time"`
+	Status    byte              `json:"status"`
+	Path      string            `json:"path,omitempty"`
+	ChannelId uint32            `json:"channel_id"`
+	Size      int               `json:"size"` //帧的字节数
+	Meta      map[string]string `json:"meta,omitempty"`
+	Data      []byte            `json:"data,omitempty"`
+}
+
+//帧监听函数，在读循环或写循环中同步调用，不应阻塞；同一个event会交给注册的全部tap，不应修改
+type PacketTap func(conn *Connection, event *TapEvent)
+
+//写时复制的tap列表，读写循环中无锁读取
+type tapList struct {
+	taps atomic.Value //[]PacketTap
+	lock sync.Mutex
+}
+
+func (m *tapList) add(tap PacketTap) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	old := m.load()
+	taps := make([]PacketTap, len(old), len(old)+1)
+	copy(taps, old)
+	m.taps.Store(append(taps, tap))
+}
+
+func (m *tapList) load() []PacketTap {
+	ret, _ := m.taps.Load().([]PacketTap)
+	return ret
+}
+
+//在连接上注册tap
+func (m *Connection) AddTap(tap PacketTap) {
+	if tap != nil {
+		m.taps.add(tap)
+	}
+}
+
+//在server的全部连接(包括此后建立的连接)上注册tap
+func (m *Server) AddTap(tap PacketTap) {
+	if tap != nil {
+		m.taps.add(tap)
+	}
+}
+
+//在client的全部连接(包括此后建立的连接)上注册tap
+func (m *Client) AddTap(tap PacketTap) {
+	if tap != nil {
+		m.taps.add(tap)
+	}
+}
+
+//将一帧交给连接及其所属server、client上注册的tap，没有tap时不做拷贝
+func (m *Connection) tap(direction byte, pkt *Packet, size int) {
+	taps := m.taps.load()
+	var ownerTaps []PacketTap
+	if m.ownerTaps != nil {
+		ownerTaps = m.ownerTaps.load()
+	}
+	if len(taps) == 0 && len(ownerTaps) == 0 {
+		return
+	}
+	event := &TapEvent{
+		Conn:      m.key,
+		Role:      m.Role,
+		Direction: direction,
+		Time:      time.Now(),
+		Status:    pkt.Status,
+		Path:      pkt.Path,
+		ChannelId: pkt.ChannelId,
+		Size:      size,
+	}
+	if len(pkt.Meta) > 0 {
+		event.Meta = make(map[string]string, len(pkt.Meta))
+		for k, v := range pkt.Meta {
+			event.Meta[k] = v
+		}
+	}
+	if len(pkt.Data) > 0 {
+		event.Data = append([]byte(nil), pkt.Data...)
+	}
+	for _, v := range taps {
+		v(m, event)
+	}
+	for _, v := range ownerTaps {
+		v(m, event)
+	}
+}
+
+//将帧记录到文件(或任意io.Writer)的tap，每帧为一行json(TapEvent)，以Tap方法注册：
+//	rec, _ := iip.CreateRecorder("capture.jsonl")
+//	server.AddTap(rec.Tap)
+//写入经过缓冲，Close(或Flush)之后记录才完整
+type Recorder struct {
+	writer *bufio.Writer
+	closer io.Closer
+	count  int64
+	err    error
+	closed bool
+	lock   sync.Mutex
+}
+
+//创建写入w的Recorder
+func NewRecorder(w io.Writer) *Recorder {
+	ret := &Recorder{writer: bufio.NewWriterSize(w, 64*1024)}
+	if closer, ok := w.(io.Closer); ok {
+		ret.closer = closer
+	}
+	return ret
+}
+
+//创建(或截断)记录文件并返回写入该文件的Recorder
+func CreateRecorder(fileName string) (*Recorder, error) {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(f), nil
+}
+
+//PacketTap，Close之后或者写入出错之后不再记录
+func (m *Recorder) Tap(conn *Connection, event *TapEvent) {
+	bts, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	bts = append(bts, '\n')
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed || m.err != nil {
+		return
+	}
+	if _, m.err = m.writer.Write(bts); m.err != nil {
+		log.Errorf("record frame fail, %s", m.err.Error())
+		return
+	}
+	m.count++
+}
+
+//已记录的帧数
+func (m *Recorder) Count() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.count
+}
+
+//将缓冲的记录写入底层的writer
+func (m *Recorder) Flush() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	return m.writer.Flush()
+}
+
+//停止记录，写入缓冲的记录并关闭底层的writer(实现了io.Closer时)
+func (m *Recorder) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	err := m.err
+	if err == nil {
+		err = m.writer.Flush()
+	}
+	if m.closer != nil {
+		if cerr := m.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
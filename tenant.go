@@ -0,0 +1,216 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//多租户隔离：每个租户拥有独立的path命名空间、配额、速率限制、统计及连接数限制
+package iip
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+type TenantConfig struct {
+	Name                string
+	MaxConnections      int     //租户最大连接数，0不限制
+	MaxChannels         int     //租户最大channel数(不含0号系统channel)，0不限制
+	RequestsPerSecond   float64 //租户请求速率限制，0不限制
+	RequestQuota        int64   //租户累计请求数配额，0不限制
+	ShareServerHandlers bool    //租户命名空间中找不到handler时，是否使用server注册的公共handler
+}
+
+//租户统计数据
+type TenantStats struct {
+	Connections int64 `json:"connections"`
+	Channels    int64 `json:"channels"`
+	Requests    int64 `json:"requests"`
+	Rejected    int64 `json:"rejected"`
+	ReadBytes   int64 `json:"read_bytes"`
+	WriteBytes  int64 `json:"write_bytes"`
+}
+
+type Tenant struct {
+	stats              TenantStats //以原子操作访问，放在最前以保证在32位平台上按8字节对齐
+	config             TenantConfig
+	pathHandlerManager *PathHandlerManager
+	limiter            *tokenBucket
+}
+
+//根据连接确定其所属租户名，返回空字符串表示连接不属于任何租户
+type TenantResolver func(conn *Connection) string
+
+func newTenant(config TenantConfig) *Tenant {
+	ret := &Tenant{config: config, pathHandlerManager: &PathHandlerManager{}}
+	if config.RequestsPerSecond > 0 {
+		ret.limiter = newTokenBucket(config.RequestsPerSecond, config.RequestsPerSecond)
+	}
+	return ret
+}
+
+func (m *Tenant) Name() string {
+	return m.config.Name
+}
+
+//注册租户命名空间下的Path-Handler
+func (m *Tenant) RegisterHandler(path string, handler PathHandler) error {
+	return m.pathHandlerManager.registerHandler(path, handler)
+}
+
+func (m *Tenant) UnRegisterHandler(path string) {
+	m.pathHandlerManager.unRegisterHandler(path)
+}
+
+func (m *Tenant) Stats() TenantStats {
+	return TenantStats{
+		Connections: atomic.LoadInt64(&m.stats.Connections),
+		Channels:    atomic.LoadInt64(&m.stats.Channels),
+		Requests:    atomic.LoadInt64(&m.stats.Requests),
+		Rejected:    atomic.LoadInt64(&m.stats.Rejected),
+		ReadBytes:   atomic.LoadInt64(&m.stats.ReadBytes),
+		WriteBytes:  atomic.LoadInt64(&m.stats.WriteBytes),
+	}
+}
+
+func (m *Tenant) acquireConnection() error {
+	if n := atomic.AddInt64(&m.stats.Connections, 1); m.config.MaxConnections > 0 && n > int64(m.config.MaxConnections) {
+		atomic.AddInt64(&m.stats.Connections, -1)
+		return fmt.Errorf("tenant %s: too many connections", m.config.Name)
+	}
+	return nil
+}
+
+func (m *Tenant) releaseConnection() {
+	atomic.AddInt64(&m.stats.Connections, -1)
+}
+
+func (m *Tenant) acquireChannel() error {
+	if n := atomic.AddInt64(&m.stats.Channels, 1); m.config.MaxChannels > 0 && n > int64(m.config.MaxChannels) {
+		atomic.AddInt64(&m.stats.Channels, -1)
+		return fmt.Errorf("tenant %s: too many channels", m.config.Name)
+	}
+	return nil
+}
+
+func (m *Tenant) releaseChannel() {
+	atomic.AddInt64(&m.stats.Channels, -1)
+}
+
+//请求准入检查：配额与速率限制，只在请求首帧上检查
+func (m *Tenant) admitRequest(request *Packet) error {
+	atomic.AddInt64(&m.stats.ReadBytes, int64(len(request.Data)))
+	if request.Status != StatusC0 && request.Status != StatusC1 {
+		return nil
+	}
+	if m.config.RequestQuota > 0 && atomic.LoadInt64(&m.stats.Requests) >= m.config.RequestQuota {
+		atomic.AddInt64(&m.stats.Rejected, 1)
+		return fmt.Errorf("tenant %s: request quota exceeded", m.config.Name)
+	}
+	if m.limiter != nil && !m.limiter.allow(1) {
+		atomic.AddInt64(&m.stats.Rejected, 1)
+		return fmt.Errorf("tenant %s: rate limited", m.config.Name)
+	}
+	atomic.AddInt64(&m.stats.Requests, 1)
+	return nil
+}
+
+func (m *Tenant) getHandler(path string, server *Server) PathHandler {
+	if ret := m.pathHandlerManager.getHandler(path); ret != nil {
+		return ret
+	}
+	if m.config.ShareServerHandlers && server != nil {
+		return server.handler.pathHandlerManager.getHandler(path)
+	}
+	return nil
+}
+
+//server的租户管理
+type tenantManager struct {
+	tenants  map[string]*Tenant
+	resolver TenantResolver
+	sync.RWMutex
+}
+
+//添加一个租户
+func (m *Server) AddTenant(config TenantConfig) (*Tenant, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("tenant name is empty")
+	}
+	m.tenants.Lock()
+	defer m.tenants.Unlock()
+	if m.tenants.tenants == nil {
+		m.tenants.tenants = make(map[string]*Tenant)
+	}
+	if _, ok := m.tenants.tenants[config.Name]; ok {
+		return nil, fmt.Errorf("tenant %s already exists", config.Name)
+	}
+	ret := newTenant(config)
+	m.tenants.tenants[config.Name] = ret
+	return ret, nil
+}
+
+//删除租户，已经绑定到该租户的连接不受影响
+func (m *Server) RemoveTenant(name string) {
+	m.tenants.Lock()
+	defer m.tenants.Unlock()
+	delete(m.tenants.tenants, name)
+}
+
+func (m *Server) GetTenant(name string) *Tenant {
+	m.tenants.RLock()
+	defer m.tenants.RUnlock()
+	if ret, ok := m.tenants.tenants[name]; ok {
+		return ret
+	}
+	return nil
+}
+
+//设置租户识别函数，新接入的连接据此绑定到租户
+func (m *Server) SetTenantResolver(resolver TenantResolver) {
+	m.tenants.Lock()
+	defer m.tenants.Unlock()
+	m.tenants.resolver = resolver
+}
+
+//将连接绑定到所属租户，超出租户连接数限制返回错误。连接已绑定租户时不再重复计数
+func (m *Server) bindTenant(conn *Connection) error {
+	if conn.tenant() != nil {
+		return nil
+	}
+	m.tenants.RLock()
+	resolver := m.tenants.resolver
+	m.tenants.RUnlock()
+	name := ""
+	if resolver != nil {
+		name = resolver(conn)
+	} else if identity := conn.Identity(); identity != nil {
+		name = identity.Tenant
+	}
+	if name == "" {
+		return nil
+	}
+	tenant := m.GetTenant(name)
+	if tenant == nil {
+		return fmt.Errorf("unknown tenant: %s", name)
+	}
+	if err := tenant.acquireConnection(); err != nil {
+		return err
+	}
+	conn.SetCtxData(CtxTenant, tenant)
+	return nil
+}
+
+func (m *Server) unbindTenant(conn *Connection) {
+	if tenant := conn.tenant(); tenant != nil {
+		conn.RemoveCtxData(CtxTenant)
+		tenant.releaseConnection()
+	}
+}
+
+//连接所属租户，不属于任何租户时返回nil
+func (m *Connection) tenant() *Tenant {
+	if t := m.GetCtxData(CtxTenant); t != nil {
+		return t.(*Tenant)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"testing"
+	"time"
+)
+
+//以resolver把全部连接绑定到租户a的server
+func newTenantTestServer(t *testing.T, config TenantConfig) (*Server, *Tenant, string) {
+	t.Helper()
+	config.ShareServerHandlers = true
+	server, addr := newTestServer(t, ServerConfig{})
+	tenant, err := server.AddTenant(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetTenantResolver(func(conn *Connection) string { return config.Name })
+	return server, tenant, addr
+}
+
+//等待租户的连接数、channel数回到指定值
+func waitTenantStats(t *testing.T, tenant *Tenant, connections, channels int64) {
+	t.Helper()
+	waitFor(t, "tenant stats", func() bool {
+		stats := tenant.Stats()
+		return stats.Connections == connections && stats.Channels == channels
+	})
+}
+
+//连接断开时仍打开的channel释放其计入的租户channel数，租户不会因泄漏而被永久拒绝
+func TestTenantChannelsReleasedOnDisconnect(t *testing.T) {
+	_, tenant, addr := newTenantTestServer(t, TenantConfig{Name: "a", MaxChannels: 2})
+	for i := 0; i < 3; i++ {
+		client := newTestClient(t, addr, ClientConfig{})
+		channel, err := client.NewChannel()
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		if _, err := channel.DoRequest(testEchoPath, []byte("hi"), time.Second*5); err != nil {
+			t.Fatal(err)
+		}
+		waitTenantStats(t, tenant, 1, 1)
+		client.Close()
+		waitTenantStats(t, tenant, 0, 0)
+	}
+}
+
+//channel关闭时释放，超过MaxChannels时拒绝；推送channel不计入
+func TestTenantChannelLimit(t *testing.T) {
+	server, tenant, addr := newTenantTestServer(t, TenantConfig{Name: "a", MaxChannels: 2})
+	client := newTestClient(t, addr, ClientConfig{})
+	first, err := client.NewChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NewChannel(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NewChannel(); err == nil {
+		t.Fatal("third channel exceeds the tenant limit")
+	}
+	waitTenantStats(t, tenant, 1, 2)
+
+	var conn *Connection
+	server.connLock.Lock()
+	for _, v := range server.connections {
+		conn = v
+	}
+	server.connLock.Unlock()
+	if _, err := conn.NewPushChannel(); err != nil {
+		t.Fatal(err)
+	}
+	waitTenantStats(t, tenant, 1, 2)
+
+	first.Close(nil)
+	waitTenantStats(t, tenant, 1, 1)
+	if _, err := client.NewChannel(); err != nil {
+		t.Fatalf("channel released by close not reusable: %v", err)
+	}
+	waitTenantStats(t, tenant, 1, 2)
+}
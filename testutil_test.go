@@ -0,0 +1,84 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+//测试server的echo路径，原样返回完整的请求数据
+const testEchoPath = "/test/echo"
+
+//在随机端口上启动server并注册testEchoPath，测试结束时停止。config中为0的队列长度取测试的默认值
+func newTestServer(t testing.TB, config ServerConfig, opts ...ServerOption) (*Server, string) {
+	t.Helper()
+	if config.MaxConnections == 0 {
+		config.MaxConnections = 100
+	}
+	if config.MaxChannelsPerConn == 0 {
+		config.MaxChannelsPerConn = 100
+	}
+	if config.ChannelPacketQueueLen == 0 {
+		config.ChannelPacketQueueLen = 100
+	}
+	if config.TcpWriteQueueLen == 0 {
+		config.TcpWriteQueueLen = 100
+	}
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(config, lsn.Addr().String(), opts...)
+	if err != nil {
+		lsn.Close()
+		t.Fatal(err)
+	}
+	err = server.RegisterHandler(testEchoPath, NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		_, err := w.Write(request)
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Serve(lsn)
+	t.Cleanup(func() { server.Stop(fmt.Errorf("test finished")) })
+	return server, lsn.Addr().String()
+}
+
+//连接addr的client，测试结束时关闭。config中为0的队列长度、缓冲区大小取测试的默认值
+func newTestClient(t testing.TB, addr string, config ClientConfig) *Client {
+	t.Helper()
+	if config.MaxConnections == 0 {
+		config.MaxConnections = 1
+	}
+	if config.MaxChannelsPerConn == 0 {
+		config.MaxChannelsPerConn = 100
+	}
+	if config.ChannelPacketQueueLen == 0 {
+		config.ChannelPacketQueueLen = 100
+	}
+	if config.TcpWriteQueueLen == 0 {
+		config.TcpWriteQueueLen = 100
+	}
+	if config.TcpConnectTimeout == 0 {
+		config.TcpConnectTimeout = time.Second * 3
+	}
+	//为0时socket缓冲区被设为系统的最小值
+	if config.TcpReadBufferSize == 0 {
+		config.TcpReadBufferSize = 1 << 20
+	}
+	if config.TcpWriteBufferSize == 0 {
+		config.TcpWriteBufferSize = 1 << 20
+	}
+	client, err := NewClient(config, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//handler超时：超过时限的handler调用被放弃，client收到ErrHandlerTimeout，channel的处理循环继续处理后续请求。
+//handler在独立的goroutine中执行，超时后仍会继续运行直至返回，其结果被丢弃；
+//handler应通过Channel.HandlerContext(类型化处理函数的ctx)感知超时并尽早返回。不适用于流式响应(NewWriterHandler)
+package iip
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+)
+
+//当前handler调用的context，在handler超时(见NewTimeoutHandler)或者channel关闭时被取消，可以通过ChannelFromContext取得channel。
+//没有设置超时时即为Channel.Context()
+func (m *Channel) HandlerContext() context.Context {
+	//atomic.Value要求每次保存的值类型相同，context以handlerContext包装
+	if v, ok := m.handlerCtx.Load().(handlerContext); ok && v.ctx != nil {
+		return v.ctx
+	}
+	return m.Context()
+}
+
+type handlerContext struct {
+	ctx context.Context
+}
+
+type timeoutHandler struct {
+	handler PathHandler
+	timeout time.Duration
+}
+
+//为handler的每次调用设置时限
+func NewTimeoutHandler(handler PathHandler, timeout time.Duration) PathHandler {
+	return &timeoutHandler{handler: handler, timeout: timeout}
+}
+
+//注册path的handler，每次调用的时限为timeout，见NewTimeoutHandler
+func (m *Server) HandleWithTimeout(path string, handler PathHandler, timeout time.Duration) error {
+	if timeout <= 0 {
+		return m.RegisterHandler(path, handler)
+	}
+	return m.RegisterHandler(path, NewTimeoutHandler(handler, timeout))
+}
+
+type handlerResult struct {
+	ret []byte
+	err error
+}
+
+func (m *timeoutHandler) Handle(c *Channel, path string, data []byte, dataCompleted bool) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(c.Context(), m.timeout)
+	defer cancel()
+	//超时返回后handler可能仍在使用data，而开启RecycleRequests时data的缓冲区在返回后被回收，须拷贝
+	data = append([]byte(nil), data...)
+	result := make(chan handlerResult, 1)
+	prev, _ := c.handlerCtx.Load().(handlerContext)
+	c.handlerCtx.Store(handlerContext{ctx: ctx})
+	defer c.handlerCtx.Store(prev)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("handle pkt %s panic: %v\n%s", path, r, debug.Stack())
+				result <- handlerResult{err: ErrHandlerPanic}
+			}
+		}()
+		ret, err := m.handler.Handle(c, path, data, dataCompleted)
+		result <- handlerResult{ret: ret, err: err}
+	}()
+	select {
+	case r := <-result:
+		return r.ret, r.err
+	case <-ctx.Done():
+		log.Warnf("handle pkt %s timeout after %s, channel %d", path, m.timeout, c.Id)
+		return nil, ErrHandlerTimeout
+	}
+}
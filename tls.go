@@ -0,0 +1,146 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//TLS及双向认证：ServerConfig/ClientConfig配置TLSConfig后连接使用TLS。server的TLSConfig要求并验证client证书
+//(ClientAuth为tls.RequireAndVerifyClientCert并配置ClientCAs)时，握手中以验证通过的client证书确定连接的身份：
+//配置了CertAuthorizer时由其按证书授权，否则身份的Name为证书的CommonName。同时配置了Authenticator时，
+//client还须在握手中提交凭证，连接的身份以Authenticator的结果为准，证书仍可通过PeerCertificate获取
+package iip
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+//按client证书授权，返回错误时拒绝连接
+type CertAuthorizer func(conn *Connection, cert *x509.Certificate) (*Identity, error)
+
+//连接的TLS状态，非TLS连接返回nil
+func (m *Connection) TLSState() *tls.ConnectionState {
+	if tlsConn, ok := m.tcpConn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+//对端经过验证的证书，非TLS连接或者对端未提供证书(或未经验证)时返回nil
+func (m *Connection) PeerCertificate() *x509.Certificate {
+	state := m.TLSState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+//channel所在连接的对端证书，见Connection.PeerCertificate
+func (m *Channel) PeerCertificate() *x509.Certificate {
+	return m.conn.PeerCertificate()
+}
+
+//以证书生成身份：Name为CommonName，Attributes包括subject、issuer、serial，以及dns、uri(如SPIFFE ID)等SAN
+func CertIdentity(cert *x509.Certificate) *Identity {
+	ret := &Identity{
+		Name: cert.Subject.CommonName,
+		Attributes: map[string]string{
+			"subject": cert.Subject.String(),
+			"issuer":  cert.Issuer.String(),
+			"serial":  cert.SerialNumber.String(),
+		},
+	}
+	if len(cert.DNSNames) > 0 {
+		ret.Attributes["dns"] = strings.Join(cert.DNSNames, ",")
+	}
+	if len(cert.URIs) > 0 {
+		uris := make([]string, 0, len(cert.URIs))
+		for _, v := range cert.URIs {
+			uris = append(uris, v.String())
+		}
+		ret.Attributes["uri"] = strings.Join(uris, ",")
+	}
+	return ret
+}
+
+//连接是否须在握手中认证，包括PSK的验证
+func (m *ServerConfig) authRequired() bool {
+	return m.Authenticator != nil || m.CertAuthorizer != nil || len(m.PSK) > 0
+}
+
+//以client证书确定的身份，没有证书且未配置CertAuthorizer时返回nil
+func (m *Server) certIdentity(conn *Connection, config *ServerConfig) (*Identity, error) {
+	cert := conn.PeerCertificate()
+	if config.CertAuthorizer == nil {
+		if cert == nil {
+			return nil, nil
+		}
+		return CertIdentity(cert), nil
+	}
+	if cert == nil {
+		return nil, fmt.Errorf("client certificate required")
+	}
+	identity, err := config.CertAuthorizer(conn, cert)
+	if err == nil && identity == nil {
+		err = fmt.Errorf("no identity")
+	}
+	return identity, err
+}
+
+//server的监听socket，配置了TLSConfig时以TLS包装
+func (m *Server) tlsListener(lsn net.Listener) net.Listener {
+	if config := m.getConfig().TLSConfig; config != nil {
+		return tls.NewListener(lsn, config)
+	}
+	return lsn
+}
+
+//client端在建立的连接上完成TLS握手。addr为解析之后的地址，未设置ServerName时取serverAddr中的主机名，
+//serverAddr含多个不同的主机名(或使用Resolver)时应设置ServerName，否则以addr中的IP验证服务端证书
+func (m *Client) tlsClient(conn net.Conn, addr string) (net.Conn, error) {
+	config := m.config.TLSConfig
+	if config == nil {
+		return conn, nil
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		if config.ServerName = m.tlsServerName(); config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(stripScheme(addr))
+		}
+	}
+	timeout := m.config.TcpConnectTimeout
+	if timeout <= 0 {
+		timeout = time.Second * 3
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake fail, %s", err.Error())
+	}
+	return tlsConn, nil
+}
+
+//serverAddr中唯一的主机名，没有或者有多个不同的主机名时返回空串
+func (m *Client) tlsServerName() string {
+	if m.config.Resolver != nil {
+		return ""
+	}
+	ret := ""
+	for _, v := range strings.Split(m.serverAddr, ",") {
+		host, _, err := net.SplitHostPort(stripScheme(strings.TrimSpace(v)))
+		if err != nil || host == "" || net.ParseIP(host) != nil {
+			continue
+		}
+		if ret != "" && ret != host {
+			return ""
+		}
+		ret = host
+	}
+	return ret
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//传输层：iip的帧可以承载在任何可靠、有序的字节流(net.Conn)之上。client的服务端地址及server的监听地址以"scheme://"开头时，
+//使用以该scheme注册的Transport建立连接，如iipkcp注册的kcp://；没有scheme或者为tcp://时使用TCP。
+//帧格式、握手及之上的全部功能与传输层无关
+package iip
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//传输层实现，addr为去掉scheme之后的host:port
+type Transport interface {
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+var transports = struct {
+	sync.RWMutex
+	m map[string]Transport
+}{m: make(map[string]Transport)}
+
+//注册scheme对应的传输层，通常在实现包的init中调用
+func RegisterTransport(scheme string, transport Transport) {
+	if scheme == "" || scheme == "tcp" || transport == nil {
+		panic(fmt.Sprintf("iip: invalid transport scheme: %q", scheme))
+	}
+	transports.Lock()
+	defer transports.Unlock()
+	transports.m[scheme] = transport
+}
+
+//拆分地址中的scheme，没有scheme时返回空串
+func splitScheme(addr string) (scheme, hostport string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+3:]
+	}
+	return "", addr
+}
+
+//地址对应的传输层，TCP返回nil
+func lookupTransport(addr string) (Transport, string, error) {
+	scheme, hostport := splitScheme(addr)
+	if scheme == "" || scheme == "tcp" {
+		return nil, hostport, nil
+	}
+	transports.RLock()
+	defer transports.RUnlock()
+	if ret, ok := transports.m[scheme]; ok {
+		return ret, hostport, nil
+	}
+	return nil, "", fmt.Errorf("unsupported transport: %s", scheme)
+}
+
+//以addr的scheme对应的传输层建立连接
+func dialTransport(addr string, timeout time.Duration) (net.Conn, error) {
+	transport, hostport, err := lookupTransport(addr)
+	if err != nil {
+		return nil, err
+	}
+	if transport == nil {
+		return net.DialTimeout("tcp4", hostport, timeout)
+	}
+	return transport.Dial(hostport, timeout)
+}
+
+//TCP socket选项，在连接accept或dial之后设置
+type tcpOptions struct {
+	keepAlive   time.Duration //keepalive间隔，0表示不做修改，负数表示关闭
+	delay       bool          //开启Nagle算法，即关闭TCP_NODELAY
+	readBuffer  int           //内核socket读缓冲区大小，0表示使用系统默认值
+	writeBuffer int           //内核socket写缓冲区大小，0表示使用系统默认值
+	linger      time.Duration //SO_LINGER，0表示使用系统默认值(关闭后在后台发送剩余数据)，负数表示关闭时丢弃未发送的数据并发送RST
+}
+
+//设置TCP连接的socket选项，TLS连接设置其底层的连接，其他传输层忽略
+func setTcpOptions(conn net.Conn, o tcpOptions) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if o.keepAlive < 0 {
+		tcpConn.SetKeepAlive(false)
+	} else if o.keepAlive > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(o.keepAlive)
+	}
+	if o.delay {
+		tcpConn.SetNoDelay(false)
+	}
+	if o.readBuffer > 0 {
+		tcpConn.SetReadBuffer(o.readBuffer)
+	}
+	if o.writeBuffer > 0 {
+		tcpConn.SetWriteBuffer(o.writeBuffer)
+	}
+	if o.linger < 0 {
+		tcpConn.SetLinger(0)
+	} else if o.linger > 0 {
+		sec := int((o.linger + time.Second - 1) / time.Second)
+		tcpConn.SetLinger(sec)
+	}
+}
@@ -13,7 +13,10 @@ import (
 type Error struct {
 	Code    int
 	Message string
+	Details string //可选的错误详情，随错误帧传给对端
 	Tm      time.Time
+	remote  bool
+	cause   error //Unwrap返回的原因，见errors.go
 }
 
 func (m *Error) Error() string {
@@ -43,6 +46,7 @@ type Context interface {
 	RemoveCtxData(key string)
 }
 
+//Context的默认实现，可被读循环、处理循环及应用的goroutine并发访问
 type DefaultContext struct {
 	ctx     map[string]interface{}
 	ctxLock sync.RWMutex
@@ -54,9 +58,7 @@ func (m *DefaultContext) GetCtxData(key string) interface{} {
 	}
 	m.ctxLock.RLock()
 	defer m.ctxLock.RUnlock()
-	if m.ctx == nil {
-		m.ctx = make(map[string]interface{})
-	}
+	//只读，nil map可直接读取；不能在读锁下创建map
 	if ret, ok := m.ctx[key]; ok {
 		return ret
 	}
@@ -81,8 +83,86 @@ func (m *DefaultContext) RemoveCtxData(key string) {
 	}
 	m.ctxLock.Lock()
 	defer m.ctxLock.Unlock()
-	if m.ctx == nil {
-		m.ctx = make(map[string]interface{})
-	}
 	delete(m.ctx, key)
 }
+
+//令牌桶，用于各类速率限制
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64 //每秒产生的令牌数
+	burst  float64 //桶容量
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	if burst < rate {
+		burst = rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+//修改速率，rate<=0表示不再限制
+func (m *tokenBucket) setRate(rate float64, burst float64) {
+	m.Lock()
+	defer m.Unlock()
+	if burst < rate {
+		burst = rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	m.rate, m.burst = rate, burst
+	if m.tokens > burst {
+		m.tokens = burst
+	}
+}
+
+func (m *tokenBucket) getRate() float64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.rate
+}
+
+//尝试取走n个令牌，令牌不足返回false
+func (m *tokenBucket) allow(n float64) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	m.tokens += now.Sub(m.last).Seconds() * m.rate
+	if m.tokens > m.burst {
+		m.tokens = m.burst
+	}
+	m.last = now
+	if m.tokens < n {
+		return false
+	}
+	m.tokens -= n
+	return true
+}
+
+//取走n个令牌，令牌不足时透支，返回透支部分恢复所需的时间，用于背压
+func (m *tokenBucket) reserve(n float64) time.Duration {
+	m.Lock()
+	defer m.Unlock()
+	if m.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	m.tokens += now.Sub(m.last).Seconds() * m.rate
+	if m.tokens > m.burst {
+		m.tokens = m.burst
+	}
+	m.last = now
+	m.tokens -= n
+	if m.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-m.tokens / m.rate * float64(time.Second))
+}
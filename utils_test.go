@@ -0,0 +1,128 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package iip
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//以-race运行：并发读写同一个DefaultContext，每一轮使用新的context，覆盖map尚未创建时的并发读
+func TestDefaultContextConcurrent(t *testing.T) {
+	for round := 0; round < 100; round++ {
+		var ctx DefaultContext
+		var wg, read sync.WaitGroup
+		read.Add(4)
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				//全部goroutine都读过之后才开始写，各自的首次读取之间没有先后关系
+				ctx.GetCtxData("k")
+				read.Done()
+				read.Wait()
+				for j := 0; j < 100; j++ {
+					key := fmt.Sprint(j % 16)
+					switch (i + j) % 3 {
+					case 1:
+						ctx.GetCtxData(key)
+					case 0:
+						ctx.SetCtxData(key, j)
+					default:
+						ctx.RemoveCtxData(key)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		ctx.SetCtxData("k", round)
+		if ctx.GetCtxData("k") != round {
+			t.Fatal("context data lost")
+		}
+	}
+}
+
+//以-race运行：多个goroutine并发创建、使用、关闭channel，同时在连接的channel map中查找channel及统计；
+//channel的context同时被handler与应用的goroutine访问
+func TestChannelMapConcurrent(t *testing.T) {
+	const path = "/test/ctx"
+	server, addr := newTestServer(t, ServerConfig{})
+	err := server.RegisterHandler(path, NewWriterHandler(func(c *Channel, path string, request []byte, w ResponseWriter) error {
+		c.SetCtxData("request", string(request))
+		c.conn.SetCtxData("last", c.Id)
+		_, err := fmt.Fprint(w, c.GetCtxData("request"))
+		return err
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, addr, ClientConfig{MaxConnections: 2})
+
+	var stop int32
+	var lookups sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		lookups.Add(1)
+		go func() {
+			defer lookups.Done()
+			for id := uint32(0); atomic.LoadInt32(&stop) == 0; id++ {
+				for _, conn := range client.connectionList() {
+					if c := conn.getChannel(id % 64); c != nil {
+						c.GetCtxData("owner")
+						c.Stats()
+					}
+					conn.ChannelsStats()
+					conn.Stats()
+				}
+				server.Stats()
+				//单核机器上不让出时，其他goroutine要等到抢占才能运行
+				time.Sleep(time.Microsecond * 100)
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				channel, err := client.NewChannel()
+				if err != nil {
+					errs <- err
+					return
+				}
+				channel.internalChannel.SetCtxData("owner", i)
+				request := fmt.Sprintf("%d-%d", i, j)
+				ret, err := channel.DoRequest(path, []byte(request), time.Second*5)
+				channel.Close(nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if string(ret) != request {
+					errs <- fmt.Errorf("response %q, request %q", ret, request)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	atomic.StoreInt32(&stop, 1)
+	lookups.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	//关闭的channel全部移出client的channel map，只剩0号系统channel
+	for _, conn := range client.connectionList() {
+		if n := len(conn.ChannelsStats()); n != 0 {
+			t.Fatalf("%d channels left on connection %s", n, conn.key)
+		}
+	}
+}
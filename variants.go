@@ -8,9 +8,41 @@ package iip
 var (
 	DefaultResponseData = []byte(`{"code": -1, "message": "unknown"}`)
 
-	ErrPacketContinue   error = &Error{Code: 100, Message: "packet uncompleted"}
-	ErrHandleNoResponse error = &Error{Code: 101, Message: "handle no response"}
-	ErrHandleError      error = &Error{Code: 102, Message: "handle error"}
-	ErrRequestTimeout   error = &Error{Code: 103, Message: "request timtout"}
-	ErrUnknown          error = &Error{Code: 104, Message: "unknown"}
+	ErrPacketContinue     error = &Error{Code: 100, Message: "packet uncompleted"}
+	ErrHandleNoResponse   error = &Error{Code: 101, Message: "handle no response"}
+	ErrHandleError        error = &Error{Code: 102, Message: "handle error"}
+	ErrRequestTimeout     error = &Error{Code: 103, Message: "request timtout"}
+	ErrUnknown            error = &Error{Code: 104, Message: "unknown"}
+	ErrHandlerPanic       error = &Error{Code: 105, Message: "handler panic"}
+	ErrRateLimited        error = &Error{Code: 106, Message: "rate limited"}
+	ErrAuthFailed         error = &Error{Code: 107, Message: "authentication failed"}
+	ErrChannelIdle        error = &Error{Code: 108, Message: "channel idle timeout"}
+	ErrChannelDeadline    error = &Error{Code: 109, Message: "channel deadline exceeded"}
+	ErrConnectionIdle     error = &Error{Code: 110, Message: "connection idle timeout"}
+	ErrConnectionMaxAge   error = &Error{Code: 111, Message: "connection max age reached"}
+	ErrConnDraining       error = &Error{Code: 112, Message: "connection is draining"}
+	ErrTooManyChannels    error = &Error{Code: 113, Message: "too many channels, refused"}
+	ErrSendClosed         error = &Error{Code: 114, Message: "channel send side is closed"}
+	ErrWriteQueueFull     error = &Error{Code: 115, Message: "write queue is full"}
+	ErrNoHandler          error = &Error{Code: 116, Message: "no handler"}
+	ErrAccessDenied       error = &Error{Code: 117, Message: "access denied"}
+	ErrResponseSent       error = &Error{Code: 118, Message: "response already sent"} //handler已自行发送了完整的响应，见response.go
+	ErrHandlerTimeout     error = &Error{Code: 119, Message: "handler deadline exceeded"}
+	ErrRequestTooLarge    error = &Error{Code: 120, Message: "request too large"}
+	ErrOverloaded         error = &Error{Code: 121, Message: "channel overloaded"}
+	ErrChannelReset       error = &Error{Code: 122, Message: "channel reset"}
+	ErrChannelIdExhausted error = &Error{Code: 123, Message: "channel id exhausted"}
+	ErrUnknownChannel     error = &Error{Code: 124, Message: "unknown channel"}
+	ErrTooManyConnections error = &Error{Code: 125, Message: "too many connections from this ip"}
+	ErrClosed             error = &Error{Code: 126, Message: "closed"} //channel或连接已关闭，见lifecycle.go
+	ErrChannelBusy        error = &Error{Code: 127, Message: "channel has a request in progress"}
+	ErrInvalidPath        error = &Error{Code: 128, Message: "invalid path"}       //见pathrules.go
+	ErrResponseTooLarge   error = &Error{Code: 129, Message: "response too large"} //超过MaxBufferedSize，见sizes.go
+
+	//错误的类别，见errors.go
+	ErrTimeout  error = &Error{Code: 130, Message: "timeout"}
+	ErrTooLarge error = &Error{Code: 131, Message: "too large"}
+	ErrProtocol error = &Error{Code: 132, Message: "protocol error"}
+
+	ErrShutdown error = &Error{Code: 133, Message: "server shutting down"} //server停止时随关闭连接的帧发给client，见closereason.go
 )
@@ -0,0 +1,69 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//handler的worker池：ServerConfig.Workers大于0时，请求交给server范围的固定数量的worker处理，而不是在channel的处理goroutine中处理，
+//限制同时执行的handler数，并使同一channel上先后完成接收的请求可以并发处理(响应的顺序可能与请求不同)。
+//同一请求的各帧总是按序交给handler；ChannelOrdered为true时同一channel上的请求逐个处理。0号系统channel上的请求不经过worker
+package iip
+
+//启动worker，在NewServer中调用
+func (m *Server) startWorkers(workers, queueLen int) {
+	if queueLen <= 0 {
+		queueLen = workers
+	}
+	m.workers = make(chan func(), queueLen)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-m.closeNotify:
+					return
+				case task := <-m.workers:
+					task()
+				}
+			}
+		}()
+	}
+}
+
+//处理请求的一帧，未开启worker时直接处理。worker队列满时等待，对读取形成反压；
+//请求的中间帧及ChannelOrdered时等待处理完成。channel或server关闭时返回false
+func (m *Server) dispatch(c *Channel, pkt *Packet, req *requestState, limited bool) bool {
+	if m.workers == nil || c.Id == 0 {
+		c.serveRequest(m, pkt, req, limited)
+		return true
+	}
+	var done chan struct{}
+	if !isClientStatusCompleted(pkt.Status) || m.getConfig().ChannelOrdered {
+		done = make(chan struct{})
+	}
+	task := func() {
+		c.serveRequest(m, pkt, req, limited)
+		if done != nil {
+			close(done)
+		}
+	}
+	select {
+	case m.workers <- task:
+	case <-c.closeNotify:
+		pkt.Release()
+		return false
+	case <-m.closeNotify:
+		pkt.Release()
+		return false
+	}
+	if done != nil {
+		select {
+		case <-done:
+		case <-m.closeNotify:
+			return false
+		}
+	}
+	return true
+}
+
+//worker队列中等待处理的请求帧数
+func (m *Server) WorkerQueueLen() int {
+	return len(m.workers)
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//连接的写调度：每个channel一个FIFO队列，各channel之间按权重做差额轮询(deficit round robin)，
+//使同一连接上大数据量的channel不会饿死对延迟敏感的小请求。0号系统channel优先于其他channel。
+//写队列的总长度(帧数)受TcpWriteQueueLen限制，队列满时发送方等待，以此对慢速的对端形成反压
+package iip
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+//每一轮按权重获得的可写字节数为 weight*writeQuantum
+const writeQuantum = 1024
+
+type writeQueue struct {
+	channelId uint32
+	weight    int
+	deficit   int
+	inTurn    bool
+	packets   []*Packet
+	drained   func() //队列写空时调用，见whenDrained
+}
+
+type writeScheduler struct {
+	lock   sync.Mutex
+	queues map[uint32]*writeQueue //有待写帧的channel
+	active []*writeQueue          //轮询顺序，不含0号channel
+	slots  chan struct{}          //写队列的容量
+	notify chan struct{}
+}
+
+func newWriteScheduler(queueLen int) *writeScheduler {
+	if queueLen <= 0 {
+		queueLen = 1
+	}
+	return &writeScheduler{
+		queues: make(map[uint32]*writeQueue),
+		slots:  make(chan struct{}, queueLen),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func (m *writeScheduler) push(pkt *Packet) {
+	m.lock.Lock()
+	q, ok := m.queues[pkt.ChannelId]
+	if !ok {
+		q = &writeQueue{channelId: pkt.ChannelId, weight: DefaultChannelWeight}
+		if pkt.channel != nil {
+			q.weight = pkt.channel.Weight()
+		}
+		m.queues[pkt.ChannelId] = q
+		if pkt.ChannelId != 0 {
+			m.active = append(m.active, q)
+		}
+	}
+	q.packets = append(q.packets, pkt)
+	m.lock.Unlock()
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+//取出下一个要写的帧，没有时返回nil
+func (m *writeScheduler) pop() *Packet {
+	m.lock.Lock()
+	var drained func()
+	defer func() {
+		m.lock.Unlock()
+		if drained != nil {
+			drained()
+		}
+	}()
+	if q, ok := m.queues[0]; ok {
+		pkt := q.packets[0]
+		drained = m.shift(q)
+		if len(q.packets) == 0 {
+			delete(m.queues, 0)
+		}
+		return pkt
+	}
+	for len(m.active) > 0 {
+		q := m.active[0]
+		if !q.inTurn {
+			q.deficit += q.weight * writeQuantum
+			q.inTurn = true
+		}
+		pkt := q.packets[0]
+		size := len(pkt.Data) + len(pkt.Path) + 10
+		//只有一个channel有待写帧时无需轮询
+		if size <= q.deficit || len(m.active) == 1 {
+			q.deficit -= size
+			drained = m.shift(q)
+			if len(q.packets) == 0 {
+				delete(m.queues, q.channelId)
+				m.active = m.active[1:]
+			}
+			return pkt
+		}
+		q.inTurn = false
+		m.active = append(m.active[1:], q)
+	}
+	return nil
+}
+
+//移除队首的帧，队列写空时返回其drained回调
+func (m *writeScheduler) shift(q *writeQueue) func() {
+	q.packets[0] = nil
+	q.packets = q.packets[1:]
+	if len(q.packets) > 0 {
+		return nil
+	}
+	q.deficit, q.inTurn = 0, false
+	ret := q.drained
+	q.drained = nil
+	return ret
+}
+
+//channel的帧全部取出写出时调用fn，没有待写的帧时返回true且不调用fn。
+//本端分配的channel id在其关闭通知写出之后才能复用，否则0号channel上新建channel的请求可能先于关闭通知到达对端
+func (m *writeScheduler) whenDrained(channelId uint32, fn func()) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	q, ok := m.queues[channelId]
+	if !ok {
+		return true
+	}
+	q.drained = fn
+	return false
+}
+
+//设置channel的写调度权重，取值范围[1, MaxChannelWeight]，默认DefaultChannelWeight。
+//权重在channel的待写帧被写空之后的下一次发送生效
+func (m *Channel) SetWeight(weight int) error {
+	if weight < 1 || weight > MaxChannelWeight {
+		return fmt.Errorf("invalid channel weight %d, must be in [1, %d]", weight, MaxChannelWeight)
+	}
+	atomic.StoreInt32(&m.weight, int32(weight))
+	return nil
+}
+
+func (m *Channel) Weight() int {
+	if ret := atomic.LoadInt32(&m.weight); ret > 0 {
+		return int(ret)
+	}
+	return DefaultChannelWeight
+}
+
+//设置channel的写调度权重，见Channel.SetWeight
+func (m *ClientChannel) SetWeight(weight int) error {
+	return m.internalChannel.SetWeight(weight)
+}
@@ -0,0 +1,10 @@
+module github.com/truexf/iip/wstransport
+
+go 1.18
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/truexf/iip v0.0.0
+)
+
+replace github.com/truexf/iip => ../
@@ -0,0 +1,267 @@
+// Copyright 2021 fangyousong(方友松). All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//WebSocket传输：以WebSocket的二进制消息承载iip的字节流，使浏览器，或者只开放了80/443端口的环境可以访问iip server。
+//导入本包之后，client的服务端地址及server的监听地址可以使用ws://host:port(client还可以使用wss://)，路径为DefaultPath；
+//Listener可以挂载到已有的http server上，Bridge将websocket连接转接到只监听TCP的iip server。
+//消息边界没有意义，接收方将二进制消息依次拼接为字节流后按iip的帧格式解析，浏览器端的实现见SPEC.md。独立模块，避免iip依赖websocket
+package wstransport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/truexf/iip"
+)
+
+const (
+	DefaultPath = "/iip" //websocket的http路径
+	Subprotocol = "iip"  //websocket子协议
+)
+
+type Options struct {
+	Path        string                     //websocket的http路径，默认DefaultPath
+	CheckOrigin func(r *http.Request) bool //检查浏览器请求的Origin，nil表示只允许同源的请求
+	Dialer      *websocket.Dialer          //client使用的Dialer(如设置TLS、代理)，nil表示websocket.DefaultDialer
+}
+
+func (m Options) path() string {
+	if m.Path == "" {
+		return DefaultPath
+	}
+	return m.Path
+}
+
+func (m Options) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{Subprotocols: []string{Subprotocol}, CheckOrigin: m.CheckOrigin}
+}
+
+func init() {
+	iip.RegisterTransport("ws", NewTransport(false, Options{}))
+	iip.RegisterTransport("wss", NewTransport(true, Options{}))
+}
+
+type transport struct {
+	secure  bool
+	options Options
+}
+
+//创建WebSocket传输层，secure为true时使用wss，可以以其他scheme注册不同的配置
+func NewTransport(secure bool, options Options) iip.Transport {
+	return &transport{secure: secure, options: options}
+}
+
+func (m *transport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := websocket.DefaultDialer
+	if m.options.Dialer != nil {
+		dialer = m.options.Dialer
+	}
+	d := *dialer
+	d.HandshakeTimeout = timeout
+	d.Subprotocols = []string{Subprotocol}
+	scheme := "ws"
+	if m.secure {
+		scheme = "wss"
+	}
+	ws, _, err := d.Dial(scheme+"://"+addr+m.options.path(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(ws), nil
+}
+
+//在addr上启动http server接收websocket连接。wss须自行以http.Server.ListenAndServeTLS挂载Listener
+func (m *transport) Listen(addr string) (net.Listener, error) {
+	if m.secure {
+		return nil, fmt.Errorf("wss listener is not supported, serve wstransport.Listener with a tls http server")
+	}
+	lsn, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	ret := NewListener(m.options)
+	ret.addr = lsn.Addr()
+	mux := http.NewServeMux()
+	mux.Handle(m.options.path(), ret)
+	ret.httpServer = &http.Server{Handler: mux}
+	go ret.httpServer.Serve(lsn)
+	return ret, nil
+}
+
+//websocket连接适配为net.Conn
+type conn struct {
+	ws        *websocket.Conn
+	reader    io.Reader
+	writeLock sync.Mutex
+}
+
+func NewConn(ws *websocket.Conn) net.Conn {
+	return &conn{ws: ws}
+}
+
+func (m *conn) Read(p []byte) (int, error) {
+	for {
+		if m.reader == nil {
+			typ, r, err := m.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if typ != websocket.BinaryMessage {
+				return 0, fmt.Errorf("unexpected websocket message type: %d", typ)
+			}
+			m.reader = r
+		}
+		n, err := m.reader.Read(p)
+		if err == io.EOF {
+			m.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (m *conn) Write(p []byte) (int, error) {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	if err := m.ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (m *conn) Close() error {
+	return m.ws.Close()
+}
+
+func (m *conn) LocalAddr() net.Addr {
+	return m.ws.LocalAddr()
+}
+
+func (m *conn) RemoteAddr() net.Addr {
+	return m.ws.RemoteAddr()
+}
+
+func (m *conn) SetDeadline(t time.Time) error {
+	if err := m.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return m.ws.SetWriteDeadline(t)
+}
+
+func (m *conn) SetReadDeadline(t time.Time) error {
+	return m.ws.SetReadDeadline(t)
+}
+
+func (m *conn) SetWriteDeadline(t time.Time) error {
+	return m.ws.SetWriteDeadline(t)
+}
+
+//接收websocket连接的net.Listener，同时是http.Handler，挂载到http server之后以iip.Server.Serve接收连接：
+//	lsn := wstransport.NewListener(wstransport.Options{})
+//	http.Handle(wstransport.DefaultPath, lsn)
+//	server.Serve(lsn)
+type Listener struct {
+	options    Options
+	upgrader   *websocket.Upgrader
+	conns      chan net.Conn
+	closed     chan struct{}
+	closeOnce  sync.Once
+	addr       net.Addr
+	httpServer *http.Server //由Listen创建的http server，随Listener关闭
+}
+
+func NewListener(options Options) *Listener {
+	return &Listener{
+		options:  options,
+		upgrader: options.upgrader(),
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+		addr:     addr(options.path()),
+	}
+}
+
+func (m *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := m.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	select {
+	case m.conns <- NewConn(ws):
+	case <-m.closed:
+		ws.Close()
+	}
+}
+
+func (m *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-m.conns:
+		return c, nil
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *Listener) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		if m.httpServer != nil {
+			m.httpServer.Close()
+		}
+	})
+	return nil
+}
+
+func (m *Listener) Addr() net.Addr {
+	return m.addr
+}
+
+//挂载在http server上的Listener的地址
+type addr string
+
+func (m addr) Network() string {
+	return "websocket"
+}
+
+func (m addr) String() string {
+	return string(m)
+}
+
+//将websocket连接转接到target(host:port)上只监听TCP的iip server，浏览器经此访问已有的server
+type Bridge struct {
+	target   string
+	timeout  time.Duration
+	upgrader *websocket.Upgrader
+}
+
+func NewBridge(target string, options Options) *Bridge {
+	return &Bridge{target: target, timeout: time.Second * 5, upgrader: options.upgrader()}
+}
+
+func (m *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tcpConn, err := net.DialTimeout("tcp4", m.target, m.timeout)
+	if err != nil {
+		http.Error(w, "iip server unavailable", http.StatusBadGateway)
+		return
+	}
+	ws, err := m.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		tcpConn.Close()
+		return
+	}
+	wsConn := NewConn(ws)
+	go func() {
+		io.Copy(tcpConn, wsConn)
+		tcpConn.Close()
+	}()
+	io.Copy(wsConn, tcpConn)
+	wsConn.Close()
+}